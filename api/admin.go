@@ -0,0 +1,186 @@
+package api
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// AdminResource defines the endpoints managing the kontinuous install, only the
+// users listed in ADMIN_USERS can use them
+type AdminResource struct {
+	kv.KVClient
+	mc.ObjectStore
+}
+
+// MigrationStatus is the stored schema version and the migrations not run yet
+type MigrationStatus struct {
+	SchemaVersion int             `json:"schema_version"`
+	LatestVersion int             `json:"latest_version"`
+	Pending       []*ps.Migration `json:"pending"`
+}
+
+// BackupRequest is the passphrase encrypting the secrets of a backup and whether the
+// logs and artifacts are included
+type BackupRequest struct {
+	Passphrase string `json:"passphrase"`
+	Objects    bool   `json:"objects"`
+}
+
+const (
+	mimeGzip = "application/gzip"
+
+	// backupPassphraseHeader carries the passphrase of a restore, the body is the backup
+	backupPassphraseHeader = "X-Backup-Passphrase"
+)
+
+var errMissingPassphrase = errors.New("A passphrase is required to encrypt the secrets of a backup")
+
+// Register registers the endpoints to the container
+func (a *AdminResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.
+		Path("/api/v1/admin").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Doc("Manage the kontinuous install").
+		Filter(ncsaCommonLogFormatLogger).
+		Filter(authenticate).
+		Filter(requireAdmin)
+
+	ws.Route(ws.GET("/migrations").To(a.migrations).
+		Doc("Get the schema version of the store and the pending migrations").
+		Operation("migrations").
+		Writes(MigrationStatus{}))
+
+	ws.Route(ws.POST("/migrations").To(a.migrate).
+		Doc("Back up the store and run the pending migrations").
+		Operation("migrate").
+		Param(ws.QueryParameter("dry_run", "run the migrations on a copy of the store, nothing is changed").DataType("boolean")).
+		Writes(ps.MigrationReport{}))
+
+	ws.Route(ws.POST("/prune").To(a.prune).
+		Doc("Delete the builds outside the retention policy of their pipeline, with their logs, artifacts and images").
+		Operation("prune").
+		Param(ws.QueryParameter("dry_run", "only report the builds that would be deleted").DataType("boolean")).
+		Writes(ps.PruneReport{}))
+
+	ws.Route(ws.POST("/backup").To(a.backup).
+		Doc("Back up the pipelines, builds, stages and users, and optionally the logs and artifacts, as a gzipped tarball").
+		Operation("backup").
+		Produces(mimeGzip).
+		Reads(BackupRequest{}))
+
+	ws.Route(ws.POST("/restore").To(a.restore).
+		Doc("Restore a backup, keys that already have the backed up value are left as they are").
+		Operation("restore").
+		Consumes(mimeGzip).
+		Param(ws.HeaderParameter(backupPassphraseHeader, "the passphrase of the backup").DataType("string")).
+		Writes(ps.RestoreReport{}))
+
+	ws.Route(ws.GET("/vars").To(a.vars).
+		Doc("Get the metrics of the server, including the GitHub rate limits and cache hits").
+		Operation("vars"))
+
+	container.Add(ws)
+}
+
+// vars serves the published expvars
+func (a *AdminResource) vars(req *restful.Request, res *restful.Response) {
+	expvar.Handler().ServeHTTP(res.ResponseWriter, req.Request)
+}
+
+func (a *AdminResource) migrations(req *restful.Request, res *restful.Response) {
+	version, err := ps.SchemaVersion(a.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to read the schema version")
+		return
+	}
+
+	pending, err := ps.PendingMigrations(a.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to list the pending migrations")
+		return
+	}
+
+	res.WriteEntity(&MigrationStatus{
+		SchemaVersion: version,
+		LatestVersion: ps.LatestSchemaVersion(),
+		Pending:       pending,
+	})
+}
+
+func (a *AdminResource) migrate(req *restful.Request, res *restful.Response) {
+	dryRun, _ := strconv.ParseBool(req.QueryParameter("dry_run"))
+
+	report, err := ps.Migrate(a.KVClient, a.ObjectStore, dryRun)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to migrate the store")
+		return
+	}
+
+	res.WriteEntity(report)
+}
+
+func (a *AdminResource) prune(req *restful.Request, res *restful.Response) {
+	dryRun, _ := strconv.ParseBool(req.QueryParameter("dry_run"))
+
+	report, err := ps.Prune(a.KVClient, a.ObjectStore, dryRun)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to prune builds")
+		return
+	}
+
+	res.WriteEntity(report)
+}
+
+func (a *AdminResource) backup(req *restful.Request, res *restful.Response) {
+	backupReq := new(BackupRequest)
+	if err := req.ReadEntity(backupReq); err != nil {
+		jsonError(res, http.StatusBadRequest, err, "Unable to read request payload")
+		return
+	}
+	if backupReq.Passphrase == "" {
+		jsonError(res, http.StatusBadRequest, errMissingPassphrase, "Unable to back up the store")
+		return
+	}
+
+	res.AddHeader("Content-Type", mimeGzip)
+	res.AddHeader("Content-Disposition", "attachment; filename=kontinuous-backup.tar.gz")
+	manifest, err := ps.WriteBackup(res, backupReq.Passphrase, backupReq.Objects, a.KVClient, a.ObjectStore)
+	if err != nil {
+		// the archive has started, the client sees a truncated backup
+		logrus.WithError(err).Error("Unable to back up the store")
+		return
+	}
+	logrus.Infof("Backed up %d keys and %d objects at schema version %d", manifest.Keys, manifest.Objects, manifest.SchemaVersion)
+}
+
+func (a *AdminResource) restore(req *restful.Request, res *restful.Response) {
+	passphrase := req.HeaderParameter(backupPassphraseHeader)
+	if passphrase == "" {
+		jsonError(res, http.StatusBadRequest, errMissingPassphrase, "Unable to restore the backup")
+		return
+	}
+
+	report, err := ps.RestoreBackup(req.Request.Body, passphrase, a.KVClient, a.ObjectStore)
+	switch err {
+	case nil:
+		res.WriteEntity(report)
+	case ps.ErrBackupPassphrase, ps.ErrBackupFormat:
+		jsonError(res, http.StatusBadRequest, err, "Unable to restore the backup")
+	case ps.ErrSchemaTooNew:
+		jsonError(res, http.StatusConflict, err, "Unable to restore the backup")
+	default:
+		jsonError(res, http.StatusInternalServerError, err, "Unable to restore the backup")
+	}
+}
@@ -0,0 +1,712 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/emicklei/go-restful"
+
+	"github.com/AcalephStorage/kontinuous/kube"
+	fakekube "github.com/AcalephStorage/kontinuous/kube/fake"
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/scm"
+	fakescm "github.com/AcalephStorage/kontinuous/scm/fake"
+	fakekv "github.com/AcalephStorage/kontinuous/store/kv/fake"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+const (
+	testAuthSecret = "c2VjcmV0"
+	testOwner      = "acaleph"
+	testRepo       = "kontinuous"
+	testLogin      = "kontinuous-bot"
+)
+
+var testSpec = `
+apiVersion: v1alpha1
+kind: Pipeline
+metadata:
+  name: kontinuous
+  namespace: acaleph
+spec:
+  selector:
+    matchLabels:
+      app: kontinuous
+  template:
+    metadata:
+      name: kontinuous
+      labels:
+        app: kontinuous
+    stages:
+    - name: Test
+      type: command
+      params:
+        command: ["make", "test"]
+    - name: Package
+      type: command
+      params:
+        command: ["make", "package"]
+`
+
+// testServer runs the pipeline API against a fake remote, store and cluster
+type testServer struct {
+	*httptest.Server
+	scm  *fakescm.Client
+	kv   *fakekv.Client
+	kube *fakekube.Client
+	jwt  string
+
+	objects string
+
+	restore func()
+}
+
+// newTestServer starts the API with a pipeline created for the fake repository
+func newTestServer(t *testing.T) *testServer {
+	os.Setenv("AUTH_SECRET", testAuthSecret)
+	os.Setenv("KONTINUOUS_URL", "http://kontinuous.test")
+
+	s := &testServer{
+		scm:  fakescm.NewClient(scm.RepoGithub),
+		kv:   fakekv.NewClient(),
+		kube: fakekube.NewClient(),
+	}
+	s.scm.AddRepository(testOwner, testRepo, "admin", "push")
+	s.scm.SetFile(testOwner, testRepo, ps.PipelineYAML, []byte(testSpec))
+
+	defaultSCMClient, defaultKubeClient := scmClientFor, ps.NewKubeClient
+	scmClientFor = func(source string) scm.Client {
+		return s.scm
+	}
+	ps.NewKubeClient = func() (kube.KubeClient, error) {
+		return s.kube, nil
+	}
+	s.restore = func() {
+		scmClientFor, ps.NewKubeClient = defaultSCMClient, defaultKubeClient
+	}
+
+	objects, err := ioutil.TempDir("", "kontinuous-objects")
+	if err != nil {
+		t.Fatalf("Unable to create object store: %s", err)
+	}
+	s.objects = objects
+	objectStore, err := mc.NewLocalStore(objects)
+	if err != nil {
+		t.Fatalf("Unable to create object store: %s", err)
+	}
+
+	jwt, err := signJWT("github|1", scm.RepoGithub, "user-token", testAuthSecret)
+	if err != nil {
+		t.Fatalf("Unable to sign JWT: %s", err)
+	}
+	s.jwt = jwt
+
+	container := restful.NewContainer()
+	pipelines := &PipelineResource{KVClient: s.kv, KubeClient: s.kube, ObjectStore: objectStore}
+	pipelines.Register(container)
+	admin := &AdminResource{KVClient: s.kv}
+	admin.Register(container)
+	s.Server = httptest.NewServer(container)
+
+	pipeline := fmt.Sprintf(`{"owner":"%s","repo":"%s","login":"%s","events":["push","pull_request"]}`, testOwner, testRepo, testLogin)
+	if status, body := s.authRequest(t, "POST", "/api/v1/pipelines", []byte(pipeline)); status != http.StatusCreated {
+		s.Close()
+		t.Fatalf("Expected pipeline to be created, got %d: %s", status, body)
+	}
+
+	return s
+}
+
+func (s *testServer) Close() {
+	s.Server.Close()
+	s.restore()
+	os.RemoveAll(s.objects)
+}
+
+func (s *testServer) request(t *testing.T, method, path string, body []byte, header http.Header) (int, []byte) {
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	req.Header.Set("Accept", restful.MIME_JSON)
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	defer res.Body.Close()
+
+	content, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, content
+}
+
+func (s *testServer) authRequest(t *testing.T, method, path string, body []byte) (int, []byte) {
+	return s.request(t, method, path, body, http.Header{"Authorization": {"Bearer " + s.jwt}})
+}
+
+// sendHook delivers a webhook signed with the secret of the pipeline's hook
+func (s *testServer) sendHook(t *testing.T, event, deliveryID string, payload []byte) (int, []byte) {
+	hooks := s.scm.Hooks(testOwner, testRepo)
+	if len(hooks) != 1 {
+		t.Fatalf("Expected 1 webhook, got %d", len(hooks))
+	}
+
+	mac := hmac.New(sha256.New, []byte(hooks[0].Secret))
+	mac.Write(payload)
+	header := http.Header{
+		"X-Github-Event":      {event},
+		"X-Github-Delivery":   {deliveryID},
+		"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+
+	return s.request(t, "POST", fmt.Sprintf("/api/v1/pipelines/%s/%s/builds", testOwner, testRepo), payload, header)
+}
+
+// updateStage sends a stage status like the job's agent does
+func (s *testServer) updateStage(t *testing.T, build, stage int, status string) {
+	update, _ := json.Marshal(&ps.StatusUpdate{
+		Status:    status,
+		Timestamp: time.Now().UnixNano(),
+	})
+	path := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d/stages/%d", testOwner, testRepo, build, stage)
+	if code, body := s.request(t, "POST", path, update, nil); code != http.StatusOK {
+		t.Fatalf("Expected stage %d update to %s to succeed, got %d: %s", stage, status, code, body)
+	}
+}
+
+// runStages reports all the stages of a build as successful
+func (s *testServer) runStages(t *testing.T, build int) {
+	for stage := 1; stage <= 2; stage++ {
+		s.updateStage(t, build, stage, ps.BuildRunning)
+		s.updateStage(t, build, stage, ps.BuildSuccess)
+	}
+}
+
+func (s *testServer) getBuild(t *testing.T, number int) *ps.Build {
+	code, body := s.authRequest(t, "GET", fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d", testOwner, testRepo, number), nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected build %d, got %d: %s", number, code, body)
+	}
+	return decodeBuild(t, body)
+}
+
+func decodeBuild(t *testing.T, body []byte) *ps.Build {
+	build := new(ps.Build)
+	if err := json.Unmarshal(body, build); err != nil {
+		t.Fatalf("Unable to parse build: %s", err)
+	}
+	return build
+}
+
+func TestCreatePipeline(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	hooks := s.scm.Hooks(testOwner, testRepo)
+	if len(hooks) != 1 || hooks[0].Secret == "" {
+		t.Fatalf("Expected a signed webhook, got %+v", hooks)
+	}
+	if !strings.HasSuffix(hooks[0].Callback, fmt.Sprintf("/api/v1/pipelines/%s/%s/builds", testOwner, testRepo)) {
+		t.Errorf("Expected webhook to call the builds endpoint, got %s", hooks[0].Callback)
+	}
+	if keys := s.scm.Keys(testOwner, testRepo); len(keys) != 1 {
+		t.Errorf("Expected 1 deploy key, got %d", len(keys))
+	}
+}
+
+func TestPushBuild(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Add feature")
+	code, body := s.sendHook(t, scm.EventPush, "delivery-1", payload)
+	if code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+	if build := decodeBuild(t, body); build.Number != 1 || build.Commit != "0a1b2c3" {
+		t.Fatalf("Expected build 1 of 0a1b2c3, got %d of %s", build.Number, build.Commit)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 1 {
+		t.Fatalf("Expected the job of the first stage, got %d jobs", len(jobs))
+	}
+
+	s.updateStage(t, 1, 1, ps.BuildRunning)
+	s.updateStage(t, 1, 1, ps.BuildSuccess)
+	if jobs := s.kube.Jobs(); len(jobs) != 2 {
+		t.Fatalf("Expected the job of the second stage, got %d jobs", len(jobs))
+	}
+	s.updateStage(t, 1, 2, ps.BuildRunning)
+	s.updateStage(t, 1, 2, ps.BuildSuccess)
+
+	if build := s.getBuild(t, 1); build.Status != ps.BuildSuccess {
+		t.Errorf("Expected build to succeed, got %s", build.Status)
+	}
+
+	statuses := s.scm.Statuses(testOwner, testRepo, "0a1b2c3")
+	if len(statuses) == 0 {
+		t.Fatal("Expected commit statuses to be reported")
+	}
+	if last := statuses[len(statuses)-1]; last.StageID != 2 || last.State != scm.StateSuccess {
+		t.Errorf("Expected stage 2 to succeed, got stage %d %s", last.StageID, last.State)
+	}
+
+	// remotes retry deliveries with the same ID
+	if code, _ := s.sendHook(t, scm.EventPush, "delivery-1", payload); code != http.StatusConflict {
+		t.Errorf("Expected duplicate delivery to be rejected, got %d", code)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 2 {
+		t.Errorf("Expected duplicate delivery not to run, got %d jobs", len(jobs))
+	}
+}
+
+func TestPullRequestBuildComment(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PullRequestHook(testOwner, testRepo, 7, testOwner+"/"+testRepo, "feature", "master", "4d5e6f7")
+	if code, body := s.sendHook(t, scm.EventPullRequest, "delivery-pr", payload); code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+	s.runStages(t, 1)
+
+	comments := s.scm.Comments(testOwner, testRepo, 7)
+	if len(comments) != 1 {
+		t.Fatalf("Expected a comment on the pull request, got %d", len(comments))
+	}
+	for _, stage := range []string{"Test", "Package"} {
+		if !strings.Contains(comments[0].Body, stage) {
+			t.Errorf("Expected comment to list stage %s, got %s", stage, comments[0].Body)
+		}
+	}
+
+	// later builds edit the same comment
+	payload = s.scm.PullRequestHook(testOwner, testRepo, 7, testOwner+"/"+testRepo, "feature", "master", "8a9b0c1")
+	if code, body := s.sendHook(t, scm.EventPullRequest, "delivery-pr-2", payload); code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+	s.runStages(t, 2)
+
+	if comments := s.scm.Comments(testOwner, testRepo, 7); len(comments) != 1 || !strings.Contains(comments[0].Body, "#2") {
+		t.Errorf("Expected the comment to be updated by build 2, got %+v", comments)
+	}
+}
+
+func TestApproveWithoutJob(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	p, _ := ps.FindPipeline(testOwner, testRepo, s.kv)
+	p.ForkPolicy = ps.ForkPolicyApproval
+	p.Save(s.kv)
+
+	payload := s.scm.PullRequestHook(testOwner, testRepo, 3, "someone/"+testRepo, "feature", "master", "4d5e6f7")
+	if code, body := s.sendHook(t, scm.EventPullRequest, "delivery-fork", payload); code != http.StatusOK {
+		t.Fatalf("Expected fork build to be created, got %d: %s", code, body)
+	}
+	if build := s.getBuild(t, 1); build.Status != ps.BuildPendingApproval {
+		t.Fatalf("Expected build pending approval, got %s", build.Status)
+	}
+
+	// the definition can't be read so the first stage can't be started
+	s.scm.SetFile(testOwner, testRepo, ps.PipelineYAML, []byte("stages: ["))
+	approve := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/1/approve", testOwner, testRepo)
+	if code, _ := s.authRequest(t, "POST", approve, nil); code != http.StatusInternalServerError {
+		t.Errorf("Expected the approval to fail, got %d", code)
+	}
+	if build := s.getBuild(t, 1); build.Status != ps.BuildPendingApproval || !build.Untrusted {
+		t.Errorf("Expected the build to wait for approval again, got %s", build.Status)
+	}
+
+	s.scm.SetFile(testOwner, testRepo, ps.PipelineYAML, []byte(testSpec))
+	if code, body := s.authRequest(t, "POST", approve, nil); code != http.StatusOK {
+		t.Fatalf("Expected the approval to start the build, got %d: %s", code, body)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 1 {
+		t.Errorf("Expected 1 job, got %d", len(jobs))
+	}
+}
+
+func TestUnsignedHook(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Add feature")
+	header := http.Header{"X-Github-Event": {scm.EventPush}}
+	code, _ := s.request(t, "POST", fmt.Sprintf("/api/v1/pipelines/%s/%s/builds", testOwner, testRepo), payload, header)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected unsigned hook to be rejected, got %d", code)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 0 {
+		t.Errorf("Expected no jobs, got %d", len(jobs))
+	}
+}
+
+func TestCustomEventRequiresToken(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	path := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds", testOwner, testRepo)
+	payload := []byte(`{"author":"testuser"}`)
+	if code, _ := s.request(t, "POST", path, payload, http.Header{"X-Custom-Event": {scm.EventCLI}}); code != http.StatusUnauthorized {
+		t.Errorf("Expected custom event without a token to be rejected, got %d", code)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 0 {
+		t.Fatalf("Expected no jobs, got %d", len(jobs))
+	}
+
+	header := http.Header{
+		"X-Custom-Event": {scm.EventCLI},
+		"Authorization":  {"Bearer " + s.jwt},
+	}
+	if code, body := s.request(t, "POST", path, payload, header); code != http.StatusOK {
+		t.Fatalf("Expected custom event to start a build, got %d: %s", code, body)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 1 {
+		t.Errorf("Expected 1 job, got %d", len(jobs))
+	}
+}
+
+func TestSkippedAndIgnoredHooks(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	skipped := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Fix typo [skip ci]")
+	if code, body := s.sendHook(t, scm.EventPush, "delivery-skip", skipped); code != http.StatusNoContent {
+		t.Errorf("Expected skipped commit not to build, got %d: %s", code, body)
+	}
+	if code, body := s.sendHook(t, "issues", "delivery-issue", []byte(`{}`)); code != http.StatusNoContent {
+		t.Errorf("Expected issue event not to build, got %d: %s", code, body)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 0 {
+		t.Errorf("Expected no jobs, got %d", len(jobs))
+	}
+
+	os.Setenv("ADMIN_USERS", "")
+	if code, _ := s.authRequest(t, "GET", fmt.Sprintf("/api/v1/pipelines/%s/%s/hooks", testOwner, testRepo), nil); code != http.StatusForbidden {
+		t.Errorf("Expected hook deliveries to require an admin, got %d", code)
+	}
+
+	os.Setenv("ADMIN_USERS", "github|1")
+	defer os.Unsetenv("ADMIN_USERS")
+
+	code, body := s.authRequest(t, "GET", fmt.Sprintf("/api/v1/pipelines/%s/%s/hooks", testOwner, testRepo), nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected hook deliveries, got %d: %s", code, body)
+	}
+	deliveries := []*ps.Delivery{}
+	json.Unmarshal(body, &deliveries)
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d", len(deliveries))
+	}
+	for _, d := range deliveries {
+		if d.Result != ps.DeliveryIgnored {
+			t.Errorf("Expected delivery %s to be ignored, got %s", d.ID, d.Result)
+		}
+	}
+}
+
+func TestReplayDelivery(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Add feature")
+	if code, body := s.sendHook(t, scm.EventPush, "delivery-1", payload); code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+
+	code, body := s.authRequest(t, "POST", fmt.Sprintf("/api/v1/pipelines/%s/%s/hooks/delivery-1/replay", testOwner, testRepo), nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected replay to start a build, got %d: %s", code, body)
+	}
+	if build := decodeBuild(t, body); build.Number != 2 || build.Commit != "0a1b2c3" {
+		t.Errorf("Expected build 2 of 0a1b2c3, got %d of %s", build.Number, build.Commit)
+	}
+	if jobs := s.kube.Jobs(); len(jobs) != 2 {
+		t.Errorf("Expected a job for each build, got %d", len(jobs))
+	}
+}
+
+func TestWatchBuild(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Add feature")
+	if code, body := s.sendHook(t, scm.EventPush, "delivery-1", payload); code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+
+	req, _ := http.NewRequest("GET", s.URL+fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/1/events", testOwner, testRepo), nil)
+	req.Header.Set("Authorization", "Bearer "+s.jwt)
+	req.Header.Set("Accept", mimeEventStream)
+	// the stream only ends with the timeout
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to watch build: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the build's events, got %d", res.StatusCode)
+	}
+
+	events := bufio.NewScanner(res.Body)
+	nextBuild := func() *ps.Build {
+		for events.Scan() {
+			if line := events.Text(); strings.HasPrefix(line, "data: ") {
+				return decodeBuild(t, []byte(strings.TrimPrefix(line, "data: ")))
+			}
+		}
+		t.Fatalf("Expected a build event, the stream ended: %v", events.Err())
+		return nil
+	}
+
+	if build := nextBuild(); build.Number != 1 || len(build.Stages) != 2 {
+		t.Errorf("Expected build 1 with its stages first, got %d with %d stages", build.Number, len(build.Stages))
+	}
+
+	s.updateStage(t, 1, 1, ps.BuildRunning)
+	for build := nextBuild(); build.Stages[0].Status != ps.BuildRunning; build = nextBuild() {
+	}
+}
+
+func TestStreamEndsWithReconnect(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	builds := make(chan *ps.Build)
+	// the watch ended, eg. it fell behind
+	close(builds)
+
+	streamBuilds(restful.NewResponse(recorder), builds, &ps.Build{Number: 1})
+
+	body := recorder.Body.String()
+	if !strings.HasPrefix(body, fmt.Sprintf("retry: %d\n\n", streamRetry)) {
+		t.Errorf("Expected the stream to set the reconnect delay, got %q", body)
+	}
+	if !strings.Contains(body, "event: build\n") || !strings.HasSuffix(body, "event: end\ndata: reconnect to continue watching\n\n") {
+		t.Errorf("Expected the build and an end event, got %q", body)
+	}
+}
+
+func TestBuildObjectsToken(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	payload := s.scm.PushHook(testOwner, testRepo, "master", "0a1b2c3", "Add feature")
+	if code, body := s.sendHook(t, scm.EventPush, "delivery-1", payload); code != http.StatusOK {
+		t.Fatalf("Expected build to start, got %d: %s", code, body)
+	}
+	s.updateStage(t, 1, 1, ps.BuildRunning)
+
+	token := ""
+	for _, env := range s.kube.Jobs()[0].Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "KONTINUOUS_BUILD_TOKEN" {
+			token = env.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("Expected the build token in the env of the agent")
+	}
+
+	objects := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/1/objects", testOwner, testRepo)
+	for _, header := range []http.Header{{"Accept": {mimeTar}}, {"Accept": {mimeTar}, buildTokenHeader: {"not-the-token"}}} {
+		if code, _ := s.request(t, "GET", objects, nil, header); code != http.StatusUnauthorized {
+			t.Errorf("Expected objects to be refused without the build token, got %d", code)
+		}
+	}
+	if code, body := s.request(t, "GET", objects, nil, http.Header{"Accept": {mimeTar}, buildTokenHeader: {token}}); code != http.StatusOK {
+		t.Errorf("Expected the objects of the build, got %d: %s", code, body)
+	}
+}
+
+func TestDryRunMigrations(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	os.Setenv("ADMIN_USERS", "")
+	if code, _ := s.authRequest(t, "GET", "/api/v1/admin/migrations", nil); code != http.StatusForbidden {
+		t.Errorf("Expected migrations to require an admin, got %d", code)
+	}
+
+	os.Setenv("ADMIN_USERS", "gitlab|1, github|1")
+	defer os.Unsetenv("ADMIN_USERS")
+
+	code, body := s.authRequest(t, "GET", "/api/v1/admin/migrations", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected the migration status, got %d: %s", code, body)
+	}
+	status := &MigrationStatus{}
+	json.Unmarshal(body, status)
+	if status.SchemaVersion != 0 || len(status.Pending) != ps.LatestSchemaVersion() {
+		t.Errorf("Expected every migration to be pending, got %+v", status)
+	}
+
+	code, body = s.authRequest(t, "POST", "/api/v1/admin/migrations?dry_run=true", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected the dry run report, got %d: %s", code, body)
+	}
+	report := &ps.MigrationReport{}
+	json.Unmarshal(body, report)
+	if !report.DryRun || report.To != ps.LatestSchemaVersion() || report.Backup != "" {
+		t.Errorf("Expected a dry run to the latest version, got %+v", report)
+	}
+	if version, _ := ps.SchemaVersion(s.kv); version != 0 {
+		t.Errorf("Expected the dry run to keep the schema version, got %d", version)
+	}
+}
+
+func TestAdminVars(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	os.Setenv("ADMIN_USERS", "")
+	if code, _ := s.authRequest(t, "GET", "/api/v1/admin/vars", nil); code != http.StatusForbidden {
+		t.Errorf("Expected the metrics to require an admin, got %d", code)
+	}
+	if code, _ := s.request(t, "GET", "/debug/vars", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected no unauthenticated metrics, got %d", code)
+	}
+
+	os.Setenv("ADMIN_USERS", "github|1")
+	defer os.Unsetenv("ADMIN_USERS")
+
+	code, body := s.authRequest(t, "GET", "/api/v1/admin/vars", nil)
+	vars := map[string]interface{}{}
+	if code != http.StatusOK || json.Unmarshal(body, &vars) != nil || vars["memstats"] == nil {
+		t.Errorf("Expected the expvars, got %d: %s", code, body)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	os.Setenv("ADMIN_USERS", "github|1")
+	defer os.Unsetenv("ADMIN_USERS")
+
+	if code, _ := s.authRequest(t, "POST", "/api/v1/admin/backup", []byte(`{}`)); code != http.StatusBadRequest {
+		t.Errorf("Expected a backup to require a passphrase, got %d", code)
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + s.jwt}, "Accept": {mimeGzip}}
+	code, backup := s.request(t, "POST", "/api/v1/admin/backup", []byte(`{"passphrase":"passphrase"}`), header)
+	if code != http.StatusOK || !bytes.HasPrefix(backup, []byte{0x1f, 0x8b}) {
+		t.Fatalf("Expected a gzipped backup, got %d", code)
+	}
+
+	header = http.Header{
+		"Authorization":        {"Bearer " + s.jwt},
+		"Content-Type":         {mimeGzip},
+		backupPassphraseHeader: {"wrong"},
+	}
+	if code, body := s.request(t, "POST", "/api/v1/admin/restore", backup, header); code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong passphrase to be rejected, got %d: %s", code, body)
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	for n := 1; n <= 3; n++ {
+		payload := s.scm.PushHook(testOwner, testRepo, "master", fmt.Sprintf("0a1b2c%d", n), "Add feature")
+		if code, body := s.sendHook(t, scm.EventPush, fmt.Sprintf("delivery-%d", n), payload); code != http.StatusOK {
+			t.Fatalf("Expected build %d to start, got %d: %s", n, code, body)
+		}
+		s.runStages(t, n)
+	}
+
+	retention := fmt.Sprintf("/api/v1/pipelines/%s/%s/retention", testOwner, testRepo)
+	if code, _ := s.authRequest(t, "PUT", retention, []byte(`{"keep_last":-1}`)); code != 422 {
+		t.Errorf("Expected an invalid policy to be rejected, got %d", code)
+	}
+	if code, body := s.authRequest(t, "PUT", retention, []byte(`{"keep_last":1}`)); code != http.StatusOK {
+		t.Fatalf("Expected the policy to be set, got %d: %s", code, body)
+	}
+
+	os.Setenv("ADMIN_USERS", "github|1")
+	defer os.Unsetenv("ADMIN_USERS")
+
+	code, body := s.authRequest(t, "POST", "/api/v1/admin/prune?dry_run=true", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected the dry run report, got %d: %s", code, body)
+	}
+	report := &ps.PruneReport{}
+	json.Unmarshal(body, report)
+	if !report.DryRun || report.Deleted != 2 || len(report.Pipelines) != 1 {
+		t.Errorf("Expected builds 2 and 1 to be reported, got %+v", report)
+	}
+	if build := s.getBuild(t, 1); build.Status != ps.BuildSuccess {
+		t.Errorf("Expected the dry run to keep build 1, got %s", build.Status)
+	}
+}
+
+// listBuilds gets a page of builds and the cursor of the next page
+func (s *testServer) listBuilds(t *testing.T, query string) ([]*ps.BuildSummary, string) {
+	path := fmt.Sprintf("%s/api/v1/pipelines/%s/%s/builds?%s", s.URL, testOwner, testRepo, query)
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+s.jwt)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to send request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected builds for %s, got %d", query, res.StatusCode)
+	}
+
+	builds := []*ps.BuildSummary{}
+	json.NewDecoder(res.Body).Decode(&builds)
+	return builds, res.Header.Get(nextCursorHeader)
+}
+
+func TestListBuilds(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	for n, branch := range []string{"master", "develop", "master"} {
+		payload := s.scm.PushHook(testOwner, testRepo, branch, fmt.Sprintf("0a1b2c%d", n), "Add feature")
+		if code, body := s.sendHook(t, scm.EventPush, fmt.Sprintf("delivery-%d", n), payload); code != http.StatusOK {
+			t.Fatalf("Expected build %d to start, got %d: %s", n+1, code, body)
+		}
+	}
+	s.runStages(t, 1)
+
+	builds, cursor := s.listBuilds(t, "limit=2")
+	if len(builds) != 2 || builds[0].Number != 3 || cursor != "2" {
+		t.Fatalf("Expected builds 3 and 2 with cursor 2, got %d builds with cursor %q", len(builds), cursor)
+	}
+	builds, cursor = s.listBuilds(t, "limit=2&cursor="+cursor)
+	if len(builds) != 1 || builds[0].Number != 1 || cursor != "" {
+		t.Errorf("Expected build 1 on the last page, got %d builds with cursor %q", len(builds), cursor)
+	}
+
+	if builds, _ := s.listBuilds(t, "branch=master&status=SUCCESS"); len(builds) != 1 || builds[0].Number != 1 {
+		t.Errorf("Expected the successful master build, got %d builds", len(builds))
+	}
+	if builds, _ := s.listBuilds(t, "sort=created&since=2000-01-01"); len(builds) != 3 || builds[0].Number != 1 {
+		t.Errorf("Expected the oldest build first, got %d builds", len(builds))
+	}
+
+	for _, query := range []string{"limit=0", "cursor=next", "since=yesterday", "sort=status"} {
+		path := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds?%s", testOwner, testRepo, query)
+		if code, _ := s.authRequest(t, "GET", path, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", query, code)
+		}
+	}
+}
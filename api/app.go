@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/scm/github"
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// AppResource defines the endpoints of the GitHub App
+type AppResource struct {
+	kv.KVClient
+}
+
+// Register registers the endpoints to the container
+func (a *AppResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.
+		Path("/api/v1/apps/github").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Doc("GitHub App integration").
+		Filter(ncsaCommonLogFormatLogger)
+
+	ws.Route(ws.POST("/hooks").To(a.hook).
+		Doc("Receive installation webhooks of the GitHub App").
+		Operation("hook").
+		Param(ws.HeaderParameter("X-Github-Event", "installation or installation_repositories").DataType("string")))
+
+	ws.Route(ws.GET("/installations").To(a.installations).
+		Doc("Get the repositories where the GitHub App is installed").
+		Operation("installations").
+		Writes([]ps.Installation{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	container.Add(ws)
+}
+
+func (a *AppResource) hook(req *restful.Request, res *restful.Response) {
+	body, _ := ioutil.ReadAll(req.Request.Body)
+
+	if err := verifyAppHook(req, body); err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Unable to verify hook")
+		return
+	}
+
+	event := req.HeaderParameter("X-Github-Event")
+	if event != "installation" && event != "installation_repositories" {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	payload := new(github.InstallationHook)
+	if err := json.Unmarshal(body, payload); err != nil {
+		jsonError(res, http.StatusBadRequest, err, "Unable to parse hook")
+		return
+	}
+
+	added, removed := payload.RepositoriesAdded, payload.RepositoriesRemoved
+	switch payload.Action {
+	case "created":
+		added = payload.Repositories
+	case "deleted":
+		removed = payload.Repositories
+	}
+
+	id := payload.Installation.ID
+	for _, repo := range added {
+		if err := toInstallation(id, repo).Save(a.KVClient); err != nil {
+			jsonError(res, http.StatusInternalServerError, err, "Unable to save installation of "+repo.FullName)
+			return
+		}
+	}
+	for _, repo := range removed {
+		if err := toInstallation(id, repo).Delete(a.KVClient); err != nil {
+			jsonError(res, http.StatusInternalServerError, err, "Unable to remove installation of "+repo.FullName)
+			return
+		}
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AppResource) installations(req *restful.Request, res *restful.Response) {
+	installations, err := ps.FindAllInstallations(a.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to list installations")
+		return
+	}
+
+	res.WriteEntity(installations)
+}
+
+func toInstallation(id int, repo github.InstallationRepository) *ps.Installation {
+	names := strings.SplitN(repo.FullName, "/", 2)
+	installation := &ps.Installation{ID: id, Owner: names[0], Repo: repo.Name}
+	if len(names) == 2 {
+		installation.Repo = names[1]
+	}
+	return installation
+}
+
+// verifyAppHook checks the signature of app webhooks with the app's webhook secret
+func verifyAppHook(req *restful.Request, body []byte) error {
+	secret := os.Getenv("GITHUB_APP_WEBHOOK_SECRET")
+	if secret == "" {
+		return errors.New("GitHub App webhook secret is not configured")
+	}
+
+	if signature := req.HeaderParameter("X-Hub-Signature-256"); signature != "" {
+		return verifySignature(signature, "sha256=", sha256.New, []byte(secret), body)
+	}
+	if signature := req.HeaderParameter("X-Hub-Signature"); signature != "" {
+		return verifySignature(signature, "sha1=", sha1.New, []byte(secret), body)
+	}
+	return errMissingSignature
+}
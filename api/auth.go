@@ -16,6 +16,8 @@ import (
 	"github.com/emicklei/go-restful"
 
 	"github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/scm/gitlab"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 )
 
@@ -23,9 +25,15 @@ type GithubAuthResponse struct {
 	AccessToken string `json:"access_token"`
 }
 
+type GitlabAuthResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
 // JWTClaims contains the claims from the jwt
 type JWTClaims struct {
 	GithubAccessToken string
+	RemoteSource      string
+	UserID            string
 }
 
 type AuthResource struct {
@@ -38,45 +46,98 @@ type AuthResponse struct {
 	UserID string `json:"user_id"`
 }
 
+// claimsAttribute is the request attribute keeping the claims of the request's jwt
+const claimsAttribute = "claims"
+
+// requestClaims returns the claims set by authenticate, empty without them
+func requestClaims(req *restful.Request) *JWTClaims {
+	if claims, ok := req.Attribute(claimsAttribute).(*JWTClaims); ok {
+		return claims
+	}
+	return &JWTClaims{}
+}
+
 var (
-	claims JWTClaims
+	errMissingToken = errors.New("Missing Access Token!")
+	errUnauthorized = errors.New("Unauthorized!")
+)
 
-	authenticate restful.FilterFunction = func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-		authToken := parseToken(req)
+// parseClaims validates the jwt of the request and returns its claims
+func parseClaims(req *restful.Request) (*JWTClaims, error) {
+	authToken := parseToken(req)
+	if authToken == "" {
+		return nil, errMissingToken
+	}
 
-		if authToken == "" {
-			resp.WriteServiceError(http.StatusUnauthorized, restful.ServiceError{Message: "Missing Access Token!"})
-			return
+	dsecret, _ := base64.URLEncoding.DecodeString(os.Getenv("AUTH_SECRET"))
+	token, err := jwt.Parse(
+		authToken,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(dsecret), nil
+		})
+	if err != nil || !token.Valid {
+		return nil, errUnauthorized
+	}
+
+	claims := &JWTClaims{}
+	claims.UserID, _ = token.Claims["user_id"].(string)
+
+	if token.Claims["identities"] != nil {
+		identity := token.Claims["identities"].([]interface{})[0].(map[string]interface{})
+		claims.GithubAccessToken = identity["access_token"].(string)
+		if provider, ok := identity["provider"].(string); ok {
+			claims.RemoteSource = provider
 		}
+	}
+	return claims, nil
+}
 
-		dsecret, _ := base64.URLEncoding.DecodeString(os.Getenv("AUTH_SECRET"))
-		token, err := jwt.Parse(
-			authToken,
-			func(token *jwt.Token) (interface{}, error) {
-				return []byte(dsecret), nil
-			})
+// useAccessToken makes the remote access token of the claims the request's credentials
+func useAccessToken(req *restful.Request, claims *JWTClaims) error {
+	if len(claims.GithubAccessToken) == 0 {
+		return errMissingToken
+	}
 
-		if err == nil && token.Valid {
-			claims.GithubAccessToken = ""
+	req.Request.Header.Set("Authorization", claims.GithubAccessToken)
+	if len(claims.RemoteSource) != 0 && len(req.HeaderParameter("X-Remote-Client")) == 0 {
+		req.Request.Header.Set("X-Remote-Client", claims.RemoteSource)
+	}
+	return nil
+}
 
-			if token.Claims["identities"] != nil {
-				claims.GithubAccessToken = token.Claims["identities"].([]interface{})[0].(map[string]interface{})["access_token"].(string)
-			}
+var (
+	authenticate restful.FilterFunction = func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		claims, err := parseClaims(req)
+		switch err {
+		case nil:
+			req.SetAttribute(claimsAttribute, claims)
 			chain.ProcessFilter(req, resp)
-		} else {
-			jsonError(resp, http.StatusUnauthorized, errors.New("Unauthorized!"), "Unauthorized request")
+		case errMissingToken:
+			resp.WriteServiceError(http.StatusUnauthorized, restful.ServiceError{Message: err.Error()})
+		default:
+			jsonError(resp, http.StatusUnauthorized, err, "Unauthorized request")
 		}
 	}
 
 	requireAccessToken restful.FilterFunction = func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-		if len(claims.GithubAccessToken) == 0 {
-			jsonError(resp, http.StatusBadRequest, errors.New("Missing Access Token!"), "Unable to find access token")
+		if err := useAccessToken(req, requestClaims(req)); err != nil {
+			jsonError(resp, http.StatusBadRequest, err, "Unable to find access token")
 			return
 		}
-
-		req.Request.Header.Set("Authorization", claims.GithubAccessToken)
 		chain.ProcessFilter(req, resp)
 	}
+
+	// requireAdmin allows the users listed in ADMIN_USERS, by the user id returned on login
+	requireAdmin restful.FilterFunction = func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		claims := requestClaims(req)
+		for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+			if admin = strings.TrimSpace(admin); admin != "" && admin == claims.UserID {
+				chain.ProcessFilter(req, resp)
+				return
+			}
+		}
+		jsonError(resp, http.StatusForbidden, errors.New("Admin rights required"), "Unauthorized admin request")
+	}
 )
 
 func (a *AuthResource) Register(container *restful.Container) {
@@ -93,6 +154,11 @@ func (a *AuthResource) Register(container *restful.Container) {
 		Doc("Generate JWT for API authentication").
 		Operation("authorize"))
 
+	ws.Route(ws.POST("gitlab").To(a.gitlabLogin).
+		Writes(AuthResponse{}).
+		Doc("Generate JWT for API authentication using GitLab").
+		Operation("authorizeGitlab"))
+
 	container.Add(ws)
 }
 
@@ -182,6 +248,94 @@ func (a *AuthResource) githubLogin(req *restful.Request, res *restful.Response)
 	res.WriteEntity(entity)
 }
 
+func (a *AuthResource) gitlabLogin(req *restful.Request, res *restful.Response) {
+
+	dsecret := os.Getenv("AUTH_SECRET")
+
+	authCode := req.QueryParameter("code")
+	redirectURI := req.QueryParameter("redirect_uri")
+	if len(redirectURI) == 0 {
+		redirectURI = os.Getenv("GITLAB_REDIRECT_URI")
+	}
+
+	if len(authCode) == 0 {
+		jsonError(res, http.StatusUnauthorized, errors.New("Missing Authorization Code"), "No authorization code provided")
+		return
+	}
+
+	host := os.Getenv("GITLAB_URL")
+	if len(host) == 0 {
+		host = gitlab.DefaultURL
+	}
+
+	// gitlab requires the same redirect uri used for the authorization request
+	form := url.Values{}
+	form.Set("client_id", os.Getenv("GITLAB_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("GITLAB_CLIENT_SECRET"))
+	form.Set("code", authCode)
+	form.Set("grant_type", "authorization_code")
+	form.Set("redirect_uri", redirectURI)
+
+	r, err := http.NewRequest("POST", strings.TrimSuffix(host, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Error creating auth request")
+		return
+	}
+	r.Header.Add("Accept", "application/json")
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	authRes, err := http.DefaultClient.Do(r)
+	if err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Error requesting authorization token")
+		return
+	}
+	defer authRes.Body.Close()
+
+	body, err := ioutil.ReadAll(authRes.Body)
+	if err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Error reading response body")
+		return
+	}
+
+	var glRes GitlabAuthResponse
+	if err := json.Unmarshal(body, &glRes); err != nil || len(glRes.AccessToken) == 0 {
+		jsonError(res, http.StatusUnauthorized, errors.New(authRes.Status), "Error reading json body")
+		return
+	}
+
+	accessToken := glRes.AccessToken
+
+	glUser, err := GetGitlabUser(accessToken)
+	if err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Unable to get gitlab user")
+		return
+	}
+
+	userID := fmt.Sprintf("gitlab|%v", glUser.ID)
+	jwtToken, err := signJWT(userID, scm.RepoGitlab, accessToken, string(dsecret))
+	if err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Unable to create jwt for user")
+		return
+	}
+
+	user := &pipeline.User{
+		Name:     glUser.Username,
+		RemoteID: userID,
+		Token:    accessToken,
+	}
+	if err := user.Save(a.KVClient); err != nil {
+		jsonError(res, http.StatusUnauthorized, err, "Unable to register user")
+		return
+	}
+
+	entity := &AuthResponse{
+		JWT:    jwtToken,
+		UserID: userID,
+	}
+
+	res.WriteEntity(entity)
+}
+
 func parseToken(req *restful.Request) string {
 	// apply the same checking as jwt.ParseFromRequest
 	if ah := req.HeaderParameter("Authorization"); ah != "" {
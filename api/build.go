@@ -3,6 +3,7 @@ package api
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"encoding/json"
@@ -20,7 +21,7 @@ import (
 // BuildResource defines the endpoints for builds
 type BuildResource struct {
 	kv.KVClient
-	*mc.MinioClient
+	mc.ObjectStore
 }
 
 // DashboardPayload contains the data expected from a build hook coming from the dashboard
@@ -31,11 +32,21 @@ type DashboardPayload struct {
 func (b *BuildResource) extend(ws *restful.WebService) {
 
 	ws.Route(ws.GET("/{owner}/{repo}/builds").To(b.list).
-		Doc("Get pipelines for repo").
+		Doc("Get a page of the builds of the pipeline, the cursor of the next page is in the X-Next-Cursor header").
 		Operation("list").
 		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
-		Writes([]ps.Build{}).
+		Param(ws.QueryParameter("limit", "number of builds in the page, 50 by default and 500 at most").DataType("int")).
+		Param(ws.QueryParameter("cursor", "the X-Next-Cursor of the previous page").DataType("int")).
+		Param(ws.QueryParameter("status", "only builds with the status, eg. SUCCESS").DataType("string")).
+		Param(ws.QueryParameter("branch", "only builds of the branch").DataType("string")).
+		Param(ws.QueryParameter("author", "only builds of the author").DataType("string")).
+		Param(ws.QueryParameter("event", "only builds triggered by the event, eg. push").DataType("string")).
+		Param(ws.QueryParameter("since", "only builds created at or after the time, RFC3339 or a date").DataType("string")).
+		Param(ws.QueryParameter("until", "only builds created before the time, RFC3339 or a date").DataType("string")).
+		Param(ws.QueryParameter("sort", "created for the oldest builds first, -created (default) for the newest").DataType("string")).
+		Writes([]ps.BuildSummary{}).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
 	ws.Route(ws.POST("/{owner}/{repo}/builds").To(b.create).
@@ -45,8 +56,7 @@ func (b *BuildResource) extend(ws *restful.WebService) {
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Param(ws.HeaderParameter("X-Custom-Event", "specifies a custom event, supports: dashboard, cli").DataType("string")).
 		Reads(DashboardPayload{}).
-		Writes(ps.Build{}).
-		Filter(requireAccessToken))
+		Writes(ps.Build{}))
 
 	ws.Route(ws.GET("/{owner}/{repo}/builds/{buildNumber}").To(b.show).
 		Doc("Show build details").
@@ -55,6 +65,26 @@ func (b *BuildResource) extend(ws *restful.WebService) {
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
 		Writes(ps.Build{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.GET("/{owner}/{repo}/builds/events").To(b.watchBuilds).
+		Doc("Stream the builds of the pipeline as server-sent events every time one is created or saved").
+		Operation("watchBuilds").
+		Produces(mimeEventStream).
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.GET("/{owner}/{repo}/builds/{buildNumber}/events").To(b.watchBuild).
+		Doc("Stream the build as server-sent events every time it is saved, starting with the build as it is").
+		Operation("watchBuild").
+		Produces(mimeEventStream).
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
 	ws.Route(ws.DELETE("/{owner}/{repo}/builds/{buildNumber}").To(b.delete).
@@ -64,8 +94,59 @@ func (b *BuildResource) extend(ws *restful.WebService) {
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
 		Writes(ps.Build{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.POST("/{owner}/{repo}/builds/{buildNumber}/approve").To(b.approve).
+		Doc("Approve a pull request build from a fork").
+		Operation("approve").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
+		Writes(ps.Build{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.GET("/{owner}/{repo}/hooks").To(b.deliveries).
+		Doc("Get the webhook deliveries received by the pipeline").
+		Operation("deliveries").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Writes([]ps.Delivery{}).
+		Filter(authenticate).
+		Filter(requireAdmin).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.POST("/{owner}/{repo}/hooks/{deliveryID}/replay").To(b.replay).
+		Doc("Build a received webhook delivery again").
+		Operation("replay").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.PathParameter("deliveryID", "webhook delivery ID").DataType("string")).
+		Writes(ps.Build{}).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
+	ws.Route(ws.PUT("/{owner}/{repo}/builds/{buildNumber}/objects").To(b.uploadObjects).
+		Doc("Store the logs and artifacts of a running build from a tar archive, used by the agent without S3").
+		Operation("uploadObjects").
+		Consumes(mimeTar).
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
+		Param(ws.HeaderParameter(buildTokenHeader, "token of the build, from the agent's env").DataType("string")).
+		Writes([]string{}))
+
+	ws.Route(ws.GET("/{owner}/{repo}/builds/{buildNumber}/objects").To(b.downloadObjects).
+		Doc("Get the stored objects of a running build as a tar archive, used by the agent without S3").
+		Operation("downloadObjects").
+		Produces(mimeTar).
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.PathParameter("buildNumber", "build number").DataType("int")).
+		Param(ws.HeaderParameter(buildTokenHeader, "token of the build, from the agent's env").DataType("string")).
+		Param(ws.QueryParameter("prefix", "only objects starting with prefix, eg. artifacts").DataType("string")))
+
 }
 
 func (b *BuildResource) create(req *restful.Request, res *restful.Response) {
@@ -83,21 +164,43 @@ func (b *BuildResource) create(req *restful.Request, res *restful.Response) {
 	}
 
 	// parse hook details
-	client := newSCMClient(req)
 	body, _ := ioutil.ReadAll(req.Request.Body)
 	hook := new(scm.Hook)
+	var client scm.Client
 
 	switch {
 	case b.isRemoteEvent(&req.Request.Header):
-		client, err := getScopedClient(pipeline.Login, b.KVClient, req)
+		if err := verifyHook(req, pipeline, body); err != nil {
+			jsonError(res, http.StatusUnauthorized, err, "Unable to verify hook")
+			return
+		}
+
+		// remotes retry deliveries with the same ID, these must not build twice
+		delivery := ps.NewDelivery(b.remoteEvent(&req.Request.Header), req.Request.Header, body)
+		claimed, err := pipeline.ClaimDelivery(delivery, b.KVClient)
 		if err != nil {
-			jsonError(res, http.StatusBadRequest, err, "Unable to retrieve remote user")
+			jsonError(res, http.StatusInternalServerError, err, "Unable to save hook delivery")
+			return
+		}
+		if !claimed {
+			jsonError(res, http.StatusConflict, fmt.Errorf("Delivery %s was already received", delivery.ID), "Duplicate hook delivery")
 			return
 		}
 
-		hook, err = client.ParseHook(body, req.HeaderParameter("X-Github-Event"))
+		b.writeDelivery(res, b.deliver(pipeline, delivery))
+		return
 	case b.isCustomEvent(&req.Request.Header):
-		client.SetAccessToken(req.HeaderParameter("Authorization"))
+		// remote events are verified by their signature, custom ones are sent by users
+		claims, authErr := parseClaims(req)
+		if authErr != nil {
+			jsonError(res, http.StatusUnauthorized, authErr, "Unauthorized request")
+			return
+		}
+		if err := useAccessToken(req, claims); err != nil {
+			jsonError(res, http.StatusBadRequest, err, "Unable to find access token")
+			return
+		}
+		client = pipelineClient(req, pipeline, b.KVClient)
 		hook, err = b.parseCustomHook(owner, repo, body, req.HeaderParameter("X-Custom-Event"), client)
 	default:
 		jsonError(res, http.StatusUnauthorized, errors.New("Unknown event trigger"), "Hook source unknown")
@@ -109,43 +212,165 @@ func (b *BuildResource) create(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	//check if .pipeline exist in branch
-	if _, err := pipeline.Definition(hook.Commit, client); err != nil {
-		jsonError(res, http.StatusInternalServerError, err, "Unable to create build. pipeline")
+	build, buildErr := b.startBuild(pipeline, hook, client)
+	if buildErr != nil {
+		jsonError(res, buildErr.status, buildErr.err, buildErr.msg)
 		return
 	}
 
-	// persist build
-	build := &ps.Build{
-		Author:   hook.Author,
-		Branch:   hook.Branch,
-		CloneURL: hook.CloneURL,
-		Commit:   hook.Commit,
-		Event:    hook.Event,
+	res.WriteEntity(build)
+}
+
+// deliveryResult holds the outcome of a webhook delivery
+type deliveryResult struct {
+	build *ps.Build
+	err   *buildError
+}
+
+// deliver builds a webhook delivery and records its result
+func (b *BuildResource) deliver(pipeline *ps.Pipeline, delivery *ps.Delivery) *deliveryResult {
+	// the delivery is saved before the build so it is listed even when the build fails
+	if err := pipeline.SaveDelivery(delivery, b.KVClient); err != nil {
+		return &deliveryResult{err: &buildError{http.StatusInternalServerError, err, "Unable to save hook delivery"}}
 	}
 
-	if err = pipeline.CreateBuild(build, []*ps.Stage{}, b.KVClient, client); err != nil {
-		jsonError(res, http.StatusInternalServerError, err, "Unable to create build")
-		return
+	result := b.buildDelivery(pipeline, delivery)
+	switch {
+	case result.err != nil:
+		delivery.Result = ps.DeliveryFailed
+		delivery.Message = fmt.Sprintf("%s: %s", result.err.msg, result.err.err)
+	case result.build == nil:
+		delivery.Result = ps.DeliveryIgnored
+	default:
+		delivery.Result = ps.DeliveryBuilt
+		delivery.Message = ""
+		delivery.BuildNumber = result.build.Number
 	}
 
-	info := &ps.NextJobInfo{hook.Commit, build.Number, 1}
-	definition, jobInfo, err := pipeline.PrepareBuildStage(info, client)
+	if err := pipeline.SaveDelivery(delivery, b.KVClient); err != nil {
+		apiLogger.InFunc("deliver").WithError(err).Errorf("Unable to save result of delivery %s", delivery.ID)
+	}
+	return result
+}
+
+func (b *BuildResource) buildDelivery(pipeline *ps.Pipeline, delivery *ps.Delivery) *deliveryResult {
+	client, err := getScopedClient(pipeline, b.KVClient)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to get stage details %s/%s/builds/%s/stages/%d", owner, repo, build.Number, 1)
-		jsonError(res, http.StatusInternalServerError, err, msg)
-		return
+		return &deliveryResult{err: &buildError{http.StatusBadRequest, err, "Unable to retrieve remote user"}}
+	}
+
+	hook, err := client.ParseHook([]byte(delivery.Body), delivery.Event)
+
+	// webhooks can carry events the pipeline doesn't build, like tags not matching the filters
+	if err == nil && !pipeline.Triggers(hook) {
+		err = scm.ErrIgnoredEvent
+	}
+
+	// events like closed pull requests are acknowledged without a build
+	if err == scm.ErrIgnoredEvent {
+		return &deliveryResult{}
+	}
+
+	if err != nil {
+		return &deliveryResult{err: &buildError{http.StatusNotFound, err, "Unable to parse hook"}}
+	}
+
+	build, buildErr := b.startBuild(pipeline, hook, client)
+	return &deliveryResult{build, buildErr}
+}
+
+func (b *BuildResource) writeDelivery(res *restful.Response, result *deliveryResult) {
+	switch {
+	case result.err != nil:
+		jsonError(res, result.err.status, result.err.err, result.err.msg)
+	case result.build == nil:
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		res.WriteEntity(result.build)
+	}
+}
+
+// buildError holds the response details of a failed build start
+type buildError struct {
+	status int
+	err    error
+	msg    string
+}
+
+// startBuild persists a build for the hook and creates the job of its first stage
+func (b *BuildResource) startBuild(pipeline *ps.Pipeline, hook *scm.Hook, client scm.Client) (*ps.Build, *buildError) {
+	owner := pipeline.Owner
+	repo := pipeline.Repo
+
+	//check if .pipeline exist in branch
+	definition, err := pipeline.Definition(hook.Commit, client)
+	if err != nil {
+		return nil, &buildError{http.StatusInternalServerError, err, "Unable to create build. pipeline"}
+	}
+
+	// deployment events only run the deploy stages of the environment
+	if hook.DeploymentID != 0 {
+		definition.DeployStages(hook.Environment)
+		if len(definition.GetStages()) == 0 {
+			err := fmt.Errorf("%s has no deploy stages for %s", ps.PipelineYAML, hook.Environment)
+			return nil, &buildError{http.StatusBadRequest, err, "Unable to create deployment build"}
+		}
+	}
+
+	// persist build
+	build := &ps.Build{
+		Author:       hook.Author,
+		Branch:       hook.Branch,
+		CloneURL:     hook.CloneURL,
+		Commit:       hook.Commit,
+		Event:        hook.Event,
+		PullRequest:  hook.PullRequest,
+		BaseBranch:   hook.BaseBranch,
+		HeadRepo:     hook.HeadRepo,
+		Ref:          hook.Ref,
+		Tag:          hook.Tag,
+		Message:      hook.Message,
+		Environment:  hook.Environment,
+		DeploymentID: hook.DeploymentID,
+	}
+
+	if err := pipeline.CreateBuild(build, []*ps.Stage{}, b.KVClient, client); err != nil {
+		return nil, &buildError{http.StatusInternalServerError, err, "Unable to create build"}
 	}
 
-	//update details in pipeline
-	pipeline.UpdatePipeline(definition, b.KVClient)
+	//update details in pipeline, forks can't change the pipeline's notifiers, secrets and vars
+	if !build.IsFork(pipeline) {
+		pipeline.UpdatePipeline(definition, b.KVClient)
+	}
 
 	// save stage details
 	build.Stages = definition.GetStages()
 	if err := build.CreateStages(b.KVClient); err != nil {
-		msg := fmt.Sprintf("Unable to save stage details %s/%s/builds/%s", owner, repo, build.Number)
-		jsonError(res, http.StatusInternalServerError, err, msg)
-		return
+		msg := fmt.Sprintf("Unable to save stage details %s/%s/builds/%d", owner, repo, build.Number)
+		return nil, &buildError{http.StatusInternalServerError, err, msg}
+	}
+
+	// builds pending approval start once a maintainer approves them
+	if build.Status == ps.BuildPendingApproval {
+		return build, nil
+	}
+
+	if buildErr := b.runFirstStage(pipeline, build, client); buildErr != nil {
+		return nil, buildErr
+	}
+
+	return build, nil
+}
+
+func (b *BuildResource) runFirstStage(pipeline *ps.Pipeline, build *ps.Build, client scm.Client) *buildError {
+	owner := pipeline.Owner
+	repo := pipeline.Repo
+
+	info := build.NextJobInfo(1)
+	definition, jobInfo, err := pipeline.PrepareBuildStage(info, client)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to get stage details %s/%s/builds/%d/stages/%d", owner, repo, build.Number, 1)
+		return &buildError{http.StatusInternalServerError, err, msg}
 	}
 
 	stageStatus := &ps.StatusUpdate{
@@ -154,20 +379,109 @@ func (b *BuildResource) create(req *restful.Request, res *restful.Response) {
 	}
 	stage, err := findStage("1", build, b.KVClient)
 	if err != nil {
-		jsonError(res, http.StatusInternalServerError, err, "Stage not found")
-		return
+		return &buildError{http.StatusInternalServerError, err, "Stage not found"}
 	}
 
 	if _, err := ps.CreateJob(definition, jobInfo, client); err != nil {
 		stage.UpdateStatus(stageStatus, pipeline, build, b.KVClient, client)
-		msg := fmt.Sprintf("Unable to create job for %s/%s/builds/%s/stages/%d", owner, repo, build.Number, 1)
-		jsonError(res, http.StatusInternalServerError, err, msg)
+		msg := fmt.Sprintf("Unable to create job for %s/%s/builds/%d/stages/%d", owner, repo, build.Number, 1)
+		return &buildError{http.StatusInternalServerError, err, msg}
+	}
+
+	return nil
+}
+
+func (b *BuildResource) approve(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	buildNumber := req.PathParameter("buildNumber")
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	build, err := findBuild(buildNumber, pipeline, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find build %s for %s/%s", buildNumber, owner, repo))
+		return
+	}
+
+	// only maintainers who can push to the repository can approve builds
+	if !isMaintainer(req, pipeline) {
+		jsonError(res, http.StatusForbidden, errors.New("Not a maintainer"), fmt.Sprintf("Unable to approve build %s for %s/%s", buildNumber, owner, repo))
+		return
+	}
+
+	client, err := getScopedClient(pipeline, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusBadRequest, err, "Unable to retrieve remote user")
+		return
+	}
+
+	if err := build.Approve(b.KVClient); err != nil {
+		jsonError(res, http.StatusBadRequest, err, fmt.Sprintf("Unable to approve build %s for %s/%s", buildNumber, owner, repo))
+		return
+	}
+
+	if buildErr := b.runFirstStage(pipeline, build, client); buildErr != nil {
+		// without a job the build waits for approval again, failed jobs fail the build
+		if current, exists := pipeline.GetBuild(build.Number, b.KVClient); exists && current.Status == ps.BuildPending {
+			if err := current.RevokeApproval(b.KVClient); err != nil {
+				apiLogger.InFunc("approve").WithError(err).Errorf("Unable to revoke the approval of build %d", build.Number)
+			}
+		}
+		jsonError(res, buildErr.status, buildErr.err, buildErr.msg)
 		return
 	}
 
 	res.WriteEntity(build)
 }
 
+func (b *BuildResource) deliveries(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	deliveries, err := pipeline.GetDeliveries(b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to list hook deliveries for %s/%s", owner, repo))
+		return
+	}
+
+	res.WriteEntity(deliveries)
+}
+
+func (b *BuildResource) replay(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	deliveryID := req.PathParameter("deliveryID")
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	delivery, exists := pipeline.FindDelivery(deliveryID, b.KVClient)
+	if !exists {
+		jsonError(res, http.StatusNotFound, errors.New("Delivery not found"), fmt.Sprintf("Unable to find hook delivery %s for %s/%s", deliveryID, owner, repo))
+		return
+	}
+
+	// replays bypass the webhook signature, only maintainers can start them
+	if !isMaintainer(req, pipeline) {
+		jsonError(res, http.StatusForbidden, errors.New("Not a maintainer"), fmt.Sprintf("Unable to replay hook delivery %s for %s/%s", deliveryID, owner, repo))
+		return
+	}
+
+	delivery.Message = ""
+	b.writeDelivery(res, b.deliver(pipeline, delivery))
+}
+
 func (b *BuildResource) delete(req *restful.Request, res *restful.Response) {
 
 	owner := req.PathParameter("owner")
@@ -186,7 +500,9 @@ func (b *BuildResource) delete(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	build.Delete(pipeline.ID, b.KVClient, b.MinioClient)
+	if err := build.Delete(pipeline.ID, b.KVClient, b.ObjectStore); err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to delete build %s of %s/%s", buildNumber, owner, repo))
+	}
 }
 
 func (b *BuildResource) list(req *restful.Request, res *restful.Response) {
@@ -198,13 +514,22 @@ func (b *BuildResource) list(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	builds, err := pipeline.GetAllBuildsSummary(b.KVClient)
+	query, err := buildQuery(req)
+	if err != nil {
+		jsonError(res, http.StatusBadRequest, err, "Invalid build query")
+		return
+	}
+
+	page, err := pipeline.ListBuilds(query, b.KVClient)
 	if err != nil {
 		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to list builds for %s/%s", owner, repo))
 		return
 	}
 
-	res.WriteEntity(builds)
+	if page.Next != 0 {
+		res.AddHeader(nextCursorHeader, strconv.Itoa(page.Next))
+	}
+	res.WriteEntity(page.Builds)
 }
 
 func (b *BuildResource) show(req *restful.Request, res *restful.Response) {
@@ -228,15 +553,25 @@ func (b *BuildResource) show(req *restful.Request, res *restful.Response) {
 
 func (b *BuildResource) isPing(req *http.Request) bool {
 	// add other ping checks here
-	return req.Header.Get("X-Github-Event") == scm.EventPing
+	return req.Header.Get("X-Github-Event") == scm.EventPing ||
+		req.Header.Get("X-Event-Key") == "diagnostics:ping"
 }
 
 func (b *BuildResource) isRemoteEvent(h *http.Header) bool {
+	return b.remoteEvent(h) != ""
+}
+
+// remoteEvent returns the event name sent by the remote source
+func (b *BuildResource) remoteEvent(h *http.Header) string {
 	switch {
 	case h.Get("X-Github-Event") != "":
-		return true
+		return h.Get("X-Github-Event")
+	case h.Get("X-Gitlab-Event") != "":
+		return h.Get("X-Gitlab-Event")
+	case h.Get("X-Event-Key") != "":
+		return h.Get("X-Event-Key")
 	default:
-		return false
+		return ""
 	}
 }
 
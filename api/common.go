@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -19,7 +20,10 @@ import (
 
 	ps "github.com/AcalephStorage/kontinuous/pipeline"
 	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/scm/bitbucket"
+	"github.com/AcalephStorage/kontinuous/scm/git"
 	"github.com/AcalephStorage/kontinuous/scm/github"
+	"github.com/AcalephStorage/kontinuous/scm/gitlab"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 	"github.com/AcalephStorage/kontinuous/util"
 	"github.com/dgrijalva/jwt-go"
@@ -64,25 +68,48 @@ type (
 
 // utils
 func jsonError(res *restful.Response, statusCode int, err error, msg string) {
+	// the client can read the resource again and retry
+	if err == ps.ErrConflict {
+		statusCode = http.StatusConflict
+	}
 	logrus.WithError(err).Error(msg)
 	res.WriteServiceError(statusCode, restful.NewError(statusCode, err.Error()))
 }
 
 func newSCMClient(req *restful.Request) scm.Client {
 	// set github as default SCM provider
-	client := new(github.Client)
+	source := scm.RepoGithub
 	token := req.HeaderParameter("Authorization")
 	accessToken := strings.Replace(token, "Bearer ", "", -1)
 
 	switch {
-	case req.HeaderParameter("X-Remote-Client") == "github", req.HeaderParameter("X-Github-Event") != "":
-		client = new(github.Client)
+	case req.HeaderParameter("X-Remote-Client") == scm.RepoGitlab, req.HeaderParameter("X-Gitlab-Event") != "":
+		source = scm.RepoGitlab
+	case req.HeaderParameter("X-Remote-Client") == scm.RepoBitbucket, req.HeaderParameter("X-Event-Key") != "":
+		source = scm.RepoBitbucket
+	case req.HeaderParameter("X-Remote-Client") == scm.RepoGithub, req.HeaderParameter("X-Github-Event") != "":
+		source = scm.RepoGithub
 	}
+
+	client := scmClientFor(source)
 	client.SetAccessToken(accessToken)
 
 	return client
 }
 
+// scmClientFor returns the SCM client implementation for a pipeline source,
+// tests replace it with a fake remote
+var scmClientFor = func(source string) scm.Client {
+	switch source {
+	case scm.RepoGitlab:
+		return gitlab.NewClient(os.Getenv("GITLAB_URL"))
+	case scm.RepoBitbucket:
+		return bitbucket.NewClient(os.Getenv("BITBUCKET_URL"))
+	default:
+		return new(github.Client)
+	}
+}
+
 // finders
 func findPipeline(owner, repo string, kvClient kv.KVClient) (*ps.Pipeline, error) {
 	pipeline, exists := ps.FindPipeline(owner, repo, kvClient)
@@ -124,12 +151,25 @@ func findStage(stageIndex string, build *ps.Build, kvClient kv.KVClient) (*ps.St
 	return stage, nil
 }
 
-func getScopedClient(userID string, kvClient kv.KVClient, req *restful.Request) (scm.Client, error) {
-	client := newSCMClient(req)
+// getScopedClient returns a client for the pipeline's remote source acting as the pipeline's user
+func getScopedClient(pipeline *ps.Pipeline, kvClient kv.KVClient) (scm.Client, error) {
+	// plain git remotes are accessed with the pipeline's deploy key
+	if pipeline.Source == scm.RepoGit {
+		return git.NewClient(pipeline.Remote, pipeline.Keys.Private, pipeline.KnownHosts), nil
+	}
+
+	// github pipelines act as the GitHub App when it is installed on the repository
+	if pipeline.Source == scm.RepoGithub || pipeline.Source == "" {
+		if client, ok := installationClient(pipeline, kvClient); ok {
+			return client, nil
+		}
+	}
+
+	client := scmClientFor(pipeline.Source)
 
-	user, exists := ps.FindUser(userID, kvClient)
+	user, exists := ps.FindUser(pipeline.Login, kvClient)
 	if !exists {
-		err := fmt.Errorf("User %s not found, cannot access remote source.", userID)
+		err := fmt.Errorf("User %s not found, cannot access remote source.", pipeline.Login)
 		return nil, err
 	}
 
@@ -138,6 +178,64 @@ func getScopedClient(userID string, kvClient kv.KVClient, req *restful.Request)
 	return client, nil
 }
 
+// installationClient returns a client of the GitHub App installation on the pipeline's repository.
+// Installations are discovered from the app's webhooks or when the pipeline is created.
+func installationClient(pipeline *ps.Pipeline, kvClient kv.KVClient) (scm.Client, bool) {
+	app, err := github.AppFromEnv()
+	if err != nil {
+		return nil, false
+	}
+
+	id, exists := ps.FindInstallation(pipeline.Owner, pipeline.Repo, kvClient)
+	if !exists {
+		return nil, false
+	}
+
+	return github.NewInstallationClient(app, id), true
+}
+
+// discoverInstallation looks up the GitHub App installation of a repository
+// installed before its installation webhooks could be received
+func discoverInstallation(owner, repo string, kvClient kv.KVClient) {
+	app, err := github.AppFromEnv()
+	if err != nil {
+		return
+	}
+
+	if _, exists := ps.FindInstallation(owner, repo, kvClient); exists {
+		return
+	}
+
+	id, err := app.FindInstallation(owner, repo)
+	if err != nil {
+		return
+	}
+
+	installation := &ps.Installation{ID: id, Owner: owner, Repo: repo}
+	if err := installation.Save(kvClient); err != nil {
+		apiLogger.InFunc("discoverInstallation").WithError(err).Warnf("Unable to save installation of %s/%s", owner, repo)
+	}
+}
+
+// pipelineClient returns the request's client, or the deploy key client for plain git pipelines
+func pipelineClient(req *restful.Request, pipeline *ps.Pipeline, kvClient kv.KVClient) scm.Client {
+	if pipeline.Source == scm.RepoGit {
+		client, _ := getScopedClient(pipeline, kvClient)
+		return client
+	}
+	return newSCMClient(req)
+}
+
+// isMaintainer checks if the request's user can push to the pipeline's repository.
+// Plain git remotes have no permission model so any authenticated user is allowed.
+func isMaintainer(req *restful.Request, pipeline *ps.Pipeline) bool {
+	if pipeline.Source == scm.RepoGit {
+		return true
+	}
+	source, exists := newSCMClient(req).GetRepository(pipeline.Owner, pipeline.Repo)
+	return exists && source.Permissions["push"]
+}
+
 func CreateJWT(accessToken string, secret string) (string, error) {
 	if accessToken == "" {
 		return "", errors.New("Access Token is empty")
@@ -150,10 +248,16 @@ func CreateJWT(accessToken string, secret string) (string, error) {
 		return "", err
 	}
 
+	userID := "github|" + strconv.Itoa(ghUser.ID)
+	return signJWT(userID, scm.RepoGithub, accessToken, secret)
+}
+
+// signJWT creates the API token of a user authenticated against a remote source
+func signJWT(userID, source, accessToken, secret string) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims["user_id"] = "github|" + strconv.Itoa(ghUser.ID)
+	token.Claims["user_id"] = userID
 	token.Claims["identities"] = []map[string]string{
-		{"access_token": accessToken},
+		{"access_token": accessToken, "provider": source},
 	}
 
 	s, _ := base64.URLEncoding.DecodeString(secret)
@@ -206,3 +310,9 @@ func GetGithubUser(token string) (*GithubUser, error) {
 	}
 	return user, nil
 }
+
+func GetGitlabUser(token string) (*gitlab.User, error) {
+	client := gitlab.NewClient(os.Getenv("GITLAB_URL"))
+	client.SetAccessToken(token)
+	return client.User()
+}
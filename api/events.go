@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"encoding/json"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+)
+
+const mimeEventStream = "text/event-stream"
+
+const (
+	// streamHeartbeat is how often an idle stream is written to, so proxies don't close it
+	streamHeartbeat = 30 * time.Second
+	// streamRetry is how long clients wait to reconnect once a stream ended, in milliseconds
+	streamRetry = 2000
+)
+
+func (b *BuildResource) watchBuilds(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	builds, err := pipeline.WatchBuilds(b.KVClient, stop)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to watch the builds of %s/%s", owner, repo))
+		return
+	}
+	streamBuilds(res, builds)
+}
+
+func (b *BuildResource) watchBuild(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	buildNumber := req.PathParameter("buildNumber")
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	build, err := findBuild(buildNumber, pipeline, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find build %s for %s/%s", buildNumber, owner, repo))
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	builds, err := build.Watch(b.KVClient, stop)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to watch build %s for %s/%s", buildNumber, owner, repo))
+		return
+	}
+
+	// the build is read again once watched so no change is missed
+	if current, exists := pipeline.GetBuild(build.Number, b.KVClient); exists {
+		build = current
+	}
+	streamBuilds(res, builds, build)
+}
+
+// streamBuilds writes the initial builds and the watched builds as server-sent events
+// until the watch ends or the client goes away. A watch ends when the build is deleted
+// or when it fell behind, the stream then ends with an end event and clients connect
+// again to catch up.
+func streamBuilds(res *restful.Response, builds <-chan *ps.Build, initial ...*ps.Build) {
+	flusher, ok := res.ResponseWriter.(http.Flusher)
+	if !ok {
+		jsonError(res, http.StatusInternalServerError, errors.New("Streaming is not supported"), "Unable to stream builds")
+		return
+	}
+	var gone <-chan bool
+	if notifier, ok := res.ResponseWriter.(http.CloseNotifier); ok {
+		gone = notifier.CloseNotify()
+	}
+
+	res.AddHeader("Content-Type", mimeEventStream)
+	res.AddHeader("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(res, "retry: %d\n\n", streamRetry); err != nil {
+		return
+	}
+	for _, build := range initial {
+		if err := writeBuildEvent(res, build); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case build, open := <-builds:
+			if !open {
+				fmt.Fprint(res, "event: end\ndata: reconnect to continue watching\n\n")
+				flusher.Flush()
+				return
+			}
+			if err := writeBuildEvent(res, build); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeBuildEvent(res *restful.Response, build *ps.Build) error {
+	data, err := json.Marshal(build)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "event: build\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"hash"
+	"os"
+	"strings"
+
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+)
+
+var (
+	errMissingSignature = errors.New("Webhook is not signed")
+	errInvalidSignature = errors.New("Webhook signature does not match")
+)
+
+// verifyHook checks that a webhook was sent by the pipeline's remote.
+// GitHub and Bitbucket sign the payload with the hook secret, GitLab sends the secret as a token.
+// Pipelines created before hook secrets still authenticate with the JWT in the callback url
+// unless REQUIRE_HOOK_SIGNATURE is set.
+func verifyHook(req *restful.Request, pipeline *ps.Pipeline, body []byte) error {
+	if pipeline.HookSecret == "" {
+		if os.Getenv("REQUIRE_HOOK_SIGNATURE") == "true" {
+			return errMissingSignature
+		}
+
+		token := req.QueryParameter("id_token")
+		if token == "" || !pipeline.ValidLegacyHookToken(token, os.Getenv("AUTH_SECRET")) {
+			return errInvalidSignature
+		}
+		apiLogger.InFunc("verifyHook").Warnf("Pipeline %s/%s uses a legacy webhook, migrate it with POST /api/v1/pipelines/%s/%s/hook",
+			pipeline.Owner, pipeline.Repo, pipeline.Owner, pipeline.Repo)
+		return nil
+	}
+
+	secret := []byte(pipeline.HookSecret)
+	switch {
+	case req.HeaderParameter("X-Hub-Signature-256") != "":
+		return verifySignature(req.HeaderParameter("X-Hub-Signature-256"), "sha256=", sha256.New, secret, body)
+	case req.HeaderParameter("X-Hub-Signature") != "":
+		signature := req.HeaderParameter("X-Hub-Signature")
+		// bitbucket sends sha256 signatures on the older header
+		if strings.HasPrefix(signature, "sha256=") {
+			return verifySignature(signature, "sha256=", sha256.New, secret, body)
+		}
+		return verifySignature(signature, "sha1=", sha1.New, secret, body)
+	case req.HeaderParameter("X-Gitlab-Token") != "":
+		if subtle.ConstantTimeCompare([]byte(req.HeaderParameter("X-Gitlab-Token")), secret) != 1 {
+			return errInvalidSignature
+		}
+		return nil
+	}
+
+	return errMissingSignature
+}
+
+func verifySignature(signature, prefix string, h func() hash.Hash, secret, body []byte) error {
+	if !strings.HasPrefix(signature, prefix) {
+		return errInvalidSignature
+	}
+
+	actual, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	mac := hmac.New(h, secret)
+	mac.Write(body)
+	if !hmac.Equal(actual, mac.Sum(nil)) {
+		return errInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// Janitor deletes the builds outside the retention policy of their pipeline, with
+// their logs, artifacts and images, and the expired webhook deliveries on every interval.
+// Only the instance holding the janitor's lease prunes.
+type Janitor struct {
+	kv.KVClient
+	mc.ObjectStore
+	Interval time.Duration
+
+	holder string
+}
+
+// Start prunes the builds in the background until the stop channel is closed
+func (j *Janitor) Start(stop <-chan struct{}) {
+	host, _ := os.Hostname()
+	j.holder = fmt.Sprintf("%s-%d", host, time.Now().UnixNano())
+
+	ticker := time.NewTicker(j.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.prune()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (j *Janitor) prune() {
+	log := apiLogger.InFunc("prune")
+
+	// the lease outlasts the next interval, the holder renews it before expiring
+	claimed, err := ps.ClaimJanitor(j.holder, 2*j.Interval, j.KVClient)
+	if err != nil {
+		log.WithError(err).Error("Unable to claim the janitor")
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	report, err := ps.Prune(j.KVClient, j.ObjectStore, false)
+	if err != nil {
+		log.WithError(err).Error("Unable to prune builds")
+		return
+	}
+
+	for _, pruned := range report.Pipelines {
+		if pruned.Error != "" {
+			log.Errorf("Unable to prune builds of %s: %s", pruned.Pipeline, pruned.Error)
+		}
+		if len(pruned.Deleted) > 0 {
+			log.Infof("Deleted %d builds of %s: %v", len(pruned.Deleted), pruned.Pipeline, pruned.Deleted)
+		}
+		if pruned.DeletedDeliveries > 0 {
+			log.Infof("Deleted %d hook deliveries of %s", pruned.DeletedDeliveries, pruned.Pipeline)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+)
+
+// Lists are paged with limit and cursor, the cursor of the next page is sent in the
+// X-Next-Cursor header and is missing on the last page.
+
+const (
+	nextCursorHeader = "X-Next-Cursor"
+
+	// defaultBuildsLimit is the page size of the build lists without a limit
+	defaultBuildsLimit = 50
+
+	// maxListLimit is the largest page of any list
+	maxListLimit = 500
+)
+
+// listLimit reads the limit of a page, fallback is used when it isn't set
+func listLimit(req *restful.Request, fallback int) (int, error) {
+	value := req.QueryParameter("limit")
+	if value == "" {
+		return fallback, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+	return limit, nil
+}
+
+// listTime reads a time in RFC3339 or as a date, zero when it isn't set
+func listTime(req *restful.Request, name string) (int64, error) {
+	value := req.QueryParameter(name)
+	if value == "" {
+		return 0, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a RFC3339 time or a date, eg. 2016-05-01", name)
+}
+
+// buildQuery reads the filters and the page of a build list
+func buildQuery(req *restful.Request) (*ps.BuildQuery, error) {
+	q := &ps.BuildQuery{
+		Status: req.QueryParameter("status"),
+		Branch: req.QueryParameter("branch"),
+		Author: req.QueryParameter("author"),
+		Event:  req.QueryParameter("event"),
+	}
+
+	var err error
+	if q.Limit, err = listLimit(req, defaultBuildsLimit); err != nil {
+		return nil, err
+	}
+	if q.Since, err = listTime(req, "since"); err != nil {
+		return nil, err
+	}
+	if q.Until, err = listTime(req, "until"); err != nil {
+		return nil, err
+	}
+
+	if cursor := req.QueryParameter("cursor"); cursor != "" {
+		if q.Cursor, err = strconv.Atoi(cursor); err != nil || q.Cursor < 1 {
+			return nil, fmt.Errorf("Invalid cursor %s", cursor)
+		}
+	}
+
+	// the newest builds are listed first unless sorted by created
+	sort := req.QueryParameter("sort")
+	if sort != "" && sort != "created" && sort != "-created" {
+		return nil, fmt.Errorf("Unable to sort builds by %s", sort)
+	}
+	q.Ascending = sort == "created"
+	return q, nil
+}
+
+// pipelineQuery reads the filters and the page of a pipeline list, every pipeline is
+// listed without a limit
+func pipelineQuery(req *restful.Request) (*ps.PipelineQuery, error) {
+	q := &ps.PipelineQuery{
+		Owner:  req.QueryParameter("owner"),
+		Cursor: req.QueryParameter("cursor"),
+	}
+
+	var err error
+	if q.Limit, err = listLimit(req, 0); err != nil {
+		return nil, err
+	}
+
+	sort := req.QueryParameter("sort")
+	if sort != "" && sort != "name" && sort != "-name" {
+		return nil, fmt.Errorf("Unable to sort pipelines by %s", sort)
+	}
+	q.Descending = sort == "-name"
+	return q, nil
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"archive/tar"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+)
+
+const (
+	mimeTar      = "application/x-tar"
+	objectBucket = "kontinuous"
+
+	// buildTokenHeader carries the token the agent gets with its job
+	buildTokenHeader = "X-Build-Token"
+)
+
+// objectsPrefix is where the logs and artifacts of a build are stored
+func objectsPrefix(pipeline *ps.Pipeline, build *ps.Build) string {
+	return fmt.Sprintf("pipelines/%s/builds/%d/", pipeline.ID, build.Number)
+}
+
+// objectName keeps the names from the archive under the build's prefix
+func objectName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// runningBuild finds the build of the request. The objects are only accepted with
+// the build's token and while the build is running.
+func (b *BuildResource) runningBuild(req *restful.Request, res *restful.Response) (*ps.Pipeline, *ps.Build, bool) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	buildNumber := req.PathParameter("buildNumber")
+
+	pipeline, err := findPipeline(owner, repo, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return nil, nil, false
+	}
+
+	build, err := findBuild(buildNumber, pipeline, b.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find build %s for %s/%s", buildNumber, owner, repo))
+		return nil, nil, false
+	}
+
+	token := req.HeaderParameter(buildTokenHeader)
+	if build.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(build.Token)) != 1 {
+		jsonError(res, http.StatusUnauthorized, fmt.Errorf("Invalid %s header", buildTokenHeader), fmt.Sprintf("Unable to authenticate the agent of build %s", buildNumber))
+		return nil, nil, false
+	}
+
+	if build.Status != ps.BuildRunning {
+		jsonError(res, http.StatusConflict, fmt.Errorf("Build %s is %s", buildNumber, build.Status), "Objects can only be stored by running builds")
+		return nil, nil, false
+	}
+	return pipeline, build, true
+}
+
+func (b *BuildResource) uploadObjects(req *restful.Request, res *restful.Response) {
+	pipeline, build, ok := b.runningBuild(req, res)
+	if !ok {
+		return
+	}
+
+	prefix := objectsPrefix(pipeline, build)
+	stored := []string{}
+	archive := tar.NewReader(req.Request.Body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			jsonError(res, http.StatusBadRequest, err, "Unable to read tar archive")
+			return
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := prefix + objectName(header.Name)
+		if err := b.ObjectStore.PutObject(objectBucket, name, archive); err != nil {
+			jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to store %s", header.Name))
+			return
+		}
+		stored = append(stored, name)
+	}
+
+	res.WriteEntity(stored)
+}
+
+func (b *BuildResource) downloadObjects(req *restful.Request, res *restful.Response) {
+	pipeline, build, ok := b.runningBuild(req, res)
+	if !ok {
+		return
+	}
+
+	prefix := objectsPrefix(pipeline, build)
+	objects, err := b.ObjectStore.ListObjects(objectBucket, prefix+objectName(req.QueryParameter("prefix")))
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err, "Unable to list objects")
+		return
+	}
+
+	res.AddHeader("Content-Type", mimeTar)
+	archive := tar.NewWriter(res)
+	defer archive.Close()
+
+	for _, object := range objects {
+		if err := b.writeObject(archive, object, strings.TrimPrefix(object, prefix)); err != nil {
+			// the archive has started, the agent sees a truncated tar
+			logrus.WithError(err).Errorf("Unable to send %s", object)
+			return
+		}
+	}
+}
+
+// writeObject adds an object to the archive, objects are copied to a file first to know their size
+func (b *BuildResource) writeObject(archive *tar.Writer, object, name string) error {
+	tmpfile, err := ioutil.TempFile("", "object-")
+	if err != nil {
+		return err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	if err := b.ObjectStore.CopyLocally(objectBucket, object, tmpfile.Name()); err != nil {
+		return err
+	}
+
+	file, err := os.Open(tmpfile.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
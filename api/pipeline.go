@@ -1,7 +1,9 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 
 	"encoding/json"
 	"io/ioutil"
@@ -9,15 +11,22 @@ import (
 
 	"github.com/AcalephStorage/kontinuous/kube"
 	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/scm/git"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 	"github.com/AcalephStorage/kontinuous/store/mc"
 	"github.com/emicklei/go-restful"
 )
 
+// PublicKey contains the public deploy key of a pipeline
+type PublicKey struct {
+	Key string `json:"key"`
+}
+
 // PipelineResource defines the endpoints of a Pipeline
 type PipelineResource struct {
 	kv.KVClient
-	*mc.MinioClient
+	mc.ObjectStore
 	kube.KubeClient
 }
 
@@ -34,8 +43,12 @@ func (p *PipelineResource) Register(container *restful.Container) {
 		Filter(ncsaCommonLogFormatLogger)
 
 	ws.Route(ws.GET("").To(p.list).
-		Doc("Get all pipelines").
+		Doc("Get the pipelines, paged when a limit is set with the cursor of the next page in the X-Next-Cursor header").
 		Operation("list").
+		Param(ws.QueryParameter("limit", "number of pipelines in the page, 500 at most").DataType("int")).
+		Param(ws.QueryParameter("cursor", "the X-Next-Cursor of the previous page").DataType("string")).
+		Param(ws.QueryParameter("owner", "only pipelines of the owner").DataType("string")).
+		Param(ws.QueryParameter("sort", "name (default) or -name for the reverse order").DataType("string")).
 		Writes([]ps.Pipeline{}).
 		Filter(authenticate).
 		Filter(requireAccessToken))
@@ -66,20 +79,39 @@ func (p *PipelineResource) Register(container *restful.Container) {
 		Filter(requireAccessToken))
 
 	ws.Route(ws.DELETE("/{owner}/{repo}").To(p.delete).
-		Doc("Delete pipeline").
+		Doc("Delete pipeline, its webhook and deploy key are removed from the remote").
 		Operation("delete").
 		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Param(ws.QueryParameter("keep_hooks", "keep the webhook and deploy key in the remote").DataType("boolean")).
 		Writes(ps.Pipeline{}).
 		Filter(authenticate).
 		Filter(requireAccessToken))
 
+	ws.Route(ws.GET("/{owner}/{repo}/keys/public").To(p.publicKey).
+		Doc("Get the public deploy key of the pipeline, needed for remotes without an API").
+		Operation("publicKey").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Writes(PublicKey{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.POST("/{owner}/{repo}/hook").To(p.rotateHook).
+		Doc("Recreate the webhook of the pipeline with a new signing secret, migrates hooks authenticating with a token in the url").
+		Operation("rotateHook").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
 	ws.Route(ws.GET("/{owner}/{repo}/definition").To(p.definition).
 		Doc("Get pipeline details of the repository").
 		Operation("definition").
 		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Writes(ps.DefinitionFile{}).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
 	ws.Route(ws.GET("/{owner}/{repo}/definition/{ref}").To(p.definition).
@@ -89,6 +121,7 @@ func (p *PipelineResource) Register(container *restful.Container) {
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Param(ws.PathParameter("ref", "commit or branch").DataType("string")).
 		Writes(ps.DefinitionFile{}).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
 	ws.Route(ws.POST("/{owner}/{repo}/definition").To(p.updateDefinition).
@@ -97,15 +130,35 @@ func (p *PipelineResource) Register(container *restful.Container) {
 		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
 		Param(ws.PathParameter("repo", "repository name").DataType("string")).
 		Writes(ps.DefinitionFile{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.PUT("/{owner}/{repo}/retention").To(p.updateRetention).
+		Doc("Set the retention policy of the pipeline's builds, replaces the global policy").
+		Operation("updateRetention").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Reads(ps.RetentionPolicy{}).
+		Writes(ps.Pipeline{}).
+		Filter(authenticate).
+		Filter(requireAccessToken))
+
+	ws.Route(ws.DELETE("/{owner}/{repo}/retention").To(p.updateRetention).
+		Doc("Remove the retention policy of the pipeline, its builds follow the global policy").
+		Operation("deleteRetention").
+		Param(ws.PathParameter("owner", "repository owner name").DataType("string")).
+		Param(ws.PathParameter("repo", "repository name").DataType("string")).
+		Writes(ps.Pipeline{}).
+		Filter(authenticate).
 		Filter(requireAccessToken))
 
 	buildResource := &BuildResource{
 		KVClient:    p.KVClient,
-		MinioClient: p.MinioClient,
+		ObjectStore: p.ObjectStore,
 	}
 	stageResource := &StageResource{
 		KVClient:    p.KVClient,
-		MinioClient: p.MinioClient,
+		ObjectStore: p.ObjectStore,
 		KubeClient:  p.KubeClient,
 	}
 
@@ -123,6 +176,11 @@ func (p *PipelineResource) create(req *restful.Request, res *restful.Response) {
 		return
 	}
 
+	// plain git pipelines have no remote API, the deploy key is added to the remote manually
+	if pipeline.Source == scm.RepoGit {
+		client = git.NewClient(pipeline.Remote, "", pipeline.KnownHosts)
+	}
+
 	// save user token if not saved already (for remote access)
 	if _, exists := ps.FindUser(pipeline.Login, p.KVClient); !exists {
 		u := &ps.User{
@@ -142,6 +200,10 @@ func (p *PipelineResource) create(req *restful.Request, res *restful.Response) {
 		return
 	}
 
+	if pipeline.Source == scm.RepoGithub || pipeline.Source == "" {
+		discoverInstallation(pipeline.Owner, pipeline.Repo, p.KVClient)
+	}
+
 	res.WriteHeaderAndEntity(http.StatusCreated, pipeline)
 }
 
@@ -154,7 +216,23 @@ func (p *PipelineResource) delete(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	if err := pipeline.DeletePipeline(p.KVClient, p.MinioClient); err != nil {
+	keepHooks, _ := strconv.ParseBool(req.QueryParameter("keep_hooks"))
+	if !keepHooks && pipeline.Source != scm.RepoGit {
+		// hooks and keys are managed by repository admins, same as when creating the pipeline
+		client := newSCMClient(req)
+		source, exists := client.GetRepository(owner, repo)
+		if !exists || !source.IsAdmin() {
+			jsonError(res, http.StatusForbidden, errors.New("Admin rights required to remove the webhook and deploy key"), fmt.Sprintf("Unable to delete pipeline %s/%s", owner, repo))
+			return
+		}
+
+		if err := pipeline.DeleteHookAndKey(client); err != nil {
+			jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to remove webhook and deploy key of %s/%s", owner, repo))
+			return
+		}
+	}
+
+	if err := pipeline.DeletePipeline(p.KVClient, p.ObjectStore); err != nil {
 		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to delete pipeline %s/%s", owner, repo))
 		return
 	}
@@ -164,12 +242,21 @@ func (p *PipelineResource) delete(req *restful.Request, res *restful.Response) {
 }
 
 func (p *PipelineResource) list(req *restful.Request, res *restful.Response) {
-	pipelines, err := ps.FindAllPipelines(p.KVClient)
+	query, err := pipelineQuery(req)
+	if err != nil {
+		jsonError(res, http.StatusBadRequest, err, "Invalid pipeline query")
+		return
+	}
+
+	pipelines, next, err := ps.ListPipelines(query, p.KVClient)
 	if err != nil {
 		jsonError(res, http.StatusInternalServerError, err, "Unable to list pipelines")
 		return
 	}
 
+	if next != "" {
+		res.AddHeader(nextCursorHeader, next)
+	}
 	res.WriteEntity(pipelines)
 }
 
@@ -185,6 +272,88 @@ func (p *PipelineResource) show(req *restful.Request, res *restful.Response) {
 	res.WriteEntity(pipeline)
 }
 
+func (p *PipelineResource) publicKey(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	pipeline, err := findPipeline(owner, repo, p.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	res.WriteEntity(&PublicKey{Key: pipeline.Keys.Public})
+}
+
+func (p *PipelineResource) rotateHook(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	pipeline, err := findPipeline(owner, repo, p.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	if pipeline.Source == scm.RepoGit {
+		jsonError(res, http.StatusBadRequest, errors.New("Plain git remotes have no webhooks"), fmt.Sprintf("Unable to update hook of %s/%s", owner, repo))
+		return
+	}
+
+	// hooks are managed by repository admins, same as when creating the pipeline
+	client := newSCMClient(req)
+	source, exists := client.GetRepository(owner, repo)
+	if !exists || !source.IsAdmin() {
+		jsonError(res, http.StatusForbidden, errors.New("Admin rights required"), fmt.Sprintf("Unable to update hook of %s/%s", owner, repo))
+		return
+	}
+
+	if err := pipeline.RotateHookSecret(client, p.KVClient); err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to update hook of %s/%s", owner, repo))
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (p *PipelineResource) updateRetention(req *restful.Request, res *restful.Response) {
+	owner := req.PathParameter("owner")
+	repo := req.PathParameter("repo")
+	pipeline, err := findPipeline(owner, repo, p.KVClient)
+	if err != nil {
+		jsonError(res, http.StatusNotFound, err, fmt.Sprintf("Unable to find pipeline %s/%s", owner, repo))
+		return
+	}
+
+	// the policy deletes builds, it is managed by repository admins like the pipeline
+	if pipeline.Source != scm.RepoGit {
+		source, exists := newSCMClient(req).GetRepository(owner, repo)
+		if !exists || !source.IsAdmin() {
+			jsonError(res, http.StatusForbidden, errors.New("Admin rights required"), fmt.Sprintf("Unable to update retention of %s/%s", owner, repo))
+			return
+		}
+	}
+
+	var policy *ps.RetentionPolicy
+	if req.Request.Method == "PUT" {
+		policy = new(ps.RetentionPolicy)
+		if err := req.ReadEntity(policy); err != nil {
+			jsonError(res, http.StatusBadRequest, err, "Unable to read request payload")
+			return
+		}
+		if err := policy.Validate(); err != nil {
+			jsonError(res, 422, err, fmt.Sprintf("Unable to update retention of %s/%s", owner, repo))
+			return
+		}
+	}
+
+	pipeline.Retention = policy
+	if err := pipeline.Save(p.KVClient); err != nil {
+		jsonError(res, http.StatusInternalServerError, err, fmt.Sprintf("Unable to update retention of %s/%s", owner, repo))
+		return
+	}
+
+	res.WriteEntity(pipeline)
+}
+
 func (p *PipelineResource) login(req *restful.Request, res *restful.Response) {
 	user := new(ps.User)
 	if err := req.ReadEntity(user); err != nil {
@@ -201,7 +370,6 @@ func (p *PipelineResource) login(req *restful.Request, res *restful.Response) {
 }
 
 func (p *PipelineResource) definition(req *restful.Request, res *restful.Response) {
-	client := newSCMClient(req)
 	owner := req.PathParameter("owner")
 	repo := req.PathParameter("repo")
 	ref := req.PathParameter("ref")
@@ -212,6 +380,7 @@ func (p *PipelineResource) definition(req *restful.Request, res *restful.Respons
 		return
 	}
 
+	client := pipelineClient(req, pipeline, p.KVClient)
 	file, exists := pipeline.GetDefinitionFile(client, ref)
 	if !exists {
 		err = fmt.Errorf("Definition file for %s/%s not found.", owner, repo)
@@ -232,7 +401,7 @@ func (p *PipelineResource) updateDefinition(req *restful.Request, res *restful.R
 		return
 	}
 
-	client := newSCMClient(req)
+	client := pipelineClient(req, pipeline, p.KVClient)
 	body, _ := ioutil.ReadAll(req.Request.Body)
 	payload := new(struct {
 		Definition *ps.DefinitionFile `json:"definition"`
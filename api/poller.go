@@ -0,0 +1,105 @@
+package api
+
+import (
+	"time"
+
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
+	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/scm/git"
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// Poller creates builds for pipelines of plain git remotes, which can't send webhooks,
+// by checking the heads of the pipeline branches on every interval
+type Poller struct {
+	kv.KVClient
+	mc.ObjectStore
+	Interval time.Duration
+}
+
+// Start polls the remotes in the background until the stop channel is closed
+func (p *Poller) Start(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.poll()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Poller) poll() {
+	log := apiLogger.InFunc("poll")
+
+	pipelines, err := ps.FindAllPipelines(p.KVClient)
+	if err != nil {
+		log.WithError(err).Error("Unable to list pipelines")
+		return
+	}
+
+	for _, pipeline := range pipelines {
+		if pipeline.Source != scm.RepoGit {
+			continue
+		}
+		p.pollPipeline(pipeline)
+	}
+}
+
+func (p *Poller) pollPipeline(pipeline *ps.Pipeline) {
+	log := apiLogger.InFunc("pollPipeline")
+	client := git.NewClient(pipeline.Remote, pipeline.Keys.Private, pipeline.KnownHosts)
+
+	branches := pipeline.Branches
+	if len(branches) == 0 {
+		branch, err := client.DefaultBranch()
+		if err != nil {
+			log.WithError(err).Errorf("Unable to get default branch of %s", pipeline.Remote)
+			return
+		}
+		branches = []string{branch}
+	}
+
+	heads, err := client.LsRemote(branches...)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to poll %s", pipeline.Remote)
+		return
+	}
+
+	builds := &BuildResource{
+		KVClient:    p.KVClient,
+		ObjectStore: p.ObjectStore,
+	}
+
+	for _, branch := range branches {
+		commit, ok := heads[branch]
+		if !ok || commit == pipeline.GetPolledHead(branch, p.KVClient) {
+			continue
+		}
+
+		// the head is saved before building so a failing commit is not retried on every poll
+		if err := pipeline.SavePolledHead(branch, commit, p.KVClient); err != nil {
+			log.WithError(err).Errorf("Unable to save head of %s/%s", pipeline.Name, branch)
+			continue
+		}
+
+		hook := &scm.Hook{
+			Author:   pipeline.Login,
+			Branch:   branch,
+			CloneURL: pipeline.Remote,
+			Commit:   commit,
+			Event:    scm.EventPush,
+		}
+
+		if _, buildErr := builds.startBuild(pipeline, hook, client); buildErr != nil {
+			log.WithError(buildErr.err).Error(buildErr.msg)
+			continue
+		}
+		log.Infof("Started build of %s on %s for new head %s", pipeline.Name, branch, commit)
+	}
+}
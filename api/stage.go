@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -19,7 +20,7 @@ import (
 // StageResource defines the endpoints for build stages
 type StageResource struct {
 	kv.KVClient
-	*mc.MinioClient
+	mc.ObjectStore
 	kube.KubeClient
 }
 
@@ -84,7 +85,13 @@ func (s *StageResource) run(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	client, err := getScopedClient(pipeline.Login, s.KVClient, req)
+	if build.Status == ps.BuildPendingApproval {
+		msg := fmt.Sprintf("Build %s of %s/%s needs to be approved first", buildNumber, owner, repo)
+		jsonError(res, http.StatusForbidden, errors.New("Build pending approval"), msg)
+		return
+	}
+
+	client, err := getScopedClient(pipeline, s.KVClient)
 	if err != nil {
 		jsonError(res, http.StatusBadRequest, err, "Unable to retrieve remote user")
 		return
@@ -113,7 +120,7 @@ func (s *StageResource) logs(req *restful.Request, res *restful.Response) {
 	if stage.Status == ps.BuildRunning {
 		// where to get ref?
 		ref := build.Commit
-		client, err := getScopedClient(pipeline.Login, s.KVClient, req)
+		client, err := getScopedClient(pipeline, s.KVClient)
 		if err != nil {
 			jsonError(res, http.StatusInternalServerError, err, "unable to create scm client")
 			return
@@ -128,7 +135,7 @@ func (s *StageResource) logs(req *restful.Request, res *restful.Response) {
 		}
 		logs, err = buildlog.FetchRunningLogs(s.KubeClient, namespace, pipeline.ID, buildNumber, stageIndex)
 	} else {
-		logs, err = buildlog.FetchLogs(s.MinioClient, pipeline.ID, buildNumber, stageIndex)
+		logs, err = buildlog.FetchLogs(s.ObjectStore, pipeline.ID, buildNumber, stageIndex)
 	}
 
 	if err != nil {
@@ -200,7 +207,7 @@ func (s *StageResource) update(req *restful.Request, res *restful.Response) {
 		return
 	}
 
-	client, err := getScopedClient(pipeline.Login, s.KVClient, req)
+	client, err := getScopedClient(pipeline, s.KVClient)
 	if err != nil {
 		jsonError(res, http.StatusBadRequest, err, "Unable to retrieve remote user")
 		return
@@ -271,7 +278,7 @@ func (s *StageResource) fetchResources(owner, repo, buildNumber, stageIndex stri
 }
 
 func (s *StageResource) runStage(pipeline *ps.Pipeline, build *ps.Build, stage *ps.Stage, scmClient scm.Client) (error, string) {
-	info := &ps.NextJobInfo{build.Commit, build.Number, stage.Index}
+	info := build.NextJobInfo(stage.Index)
 	definition, jobInfo, err := pipeline.PrepareBuildStage(info, scmClient)
 	if err != nil {
 		msg := fmt.Sprintf("Unable to get stage details %s/%s/builds/%d/stages/%d", pipeline.Owner, pipeline.Repo, build.Number, stage.Index)
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"net/http"
+	"net/url"
 
 	apiReq "github.com/AcalephStorage/kontinuous/cli/request"
 	"github.com/codegangsta/cli"
@@ -49,10 +51,48 @@ func main() {
 				},
 				{
 					Name:      "builds",
-					Usage:     "get all builds of pipeline",
+					Usage:     "get the builds of pipeline, newest first",
 					ArgsUsage: "<pipeline-name>",
 					Before:    requireNameArg,
-					Action:    getBuilds,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "limit",
+							Usage: "number of builds per page (default: the server's page size)",
+						},
+						cli.StringFlag{
+							Name:  "cursor",
+							Usage: "start after the page the cursor was printed for",
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "get every page of builds",
+						},
+						cli.StringFlag{
+							Name:  "status",
+							Usage: "only builds with the status, eg. SUCCESS or FAIL",
+						},
+						cli.StringFlag{
+							Name:  "branch",
+							Usage: "only builds of the branch",
+						},
+						cli.StringFlag{
+							Name:  "author",
+							Usage: "only builds of the author",
+						},
+						cli.StringFlag{
+							Name:  "event",
+							Usage: "only builds triggered by the event, eg. push or pull_request",
+						},
+						cli.StringFlag{
+							Name:  "since",
+							Usage: "only builds created at or after the time, RFC3339 or a date like 2016-05-01",
+						},
+						cli.StringFlag{
+							Name:  "until",
+							Usage: "only builds created before the time, RFC3339 or a date like 2016-05-01",
+						},
+					},
+					Action: getBuilds,
 				},
 				{
 					Name:      "stages",
@@ -82,6 +122,31 @@ func main() {
 							Name:  "events",
 							Value: "push",
 						},
+						cli.StringFlag{
+							Name:  "fork-policy",
+							Value: "never",
+							Usage: "builds of pull requests from forks: never (no secrets or deploys), approval, allow",
+						},
+						cli.StringFlag{
+							Name:  "tags",
+							Usage: "comma separated tag patterns to build on tag and release events, eg. v*",
+						},
+						cli.BoolFlag{
+							Name:  "checks",
+							Usage: "report stages as GitHub check runs with annotations instead of commit statuses",
+						},
+						cli.IntFlag{
+							Name:  "keep-last",
+							Usage: "keep the last N builds, older finished builds are deleted (default: the server's policy)",
+						},
+						cli.IntFlag{
+							Name:  "keep-days",
+							Usage: "keep the builds of the last N days (default: the server's policy)",
+						},
+						cli.StringFlag{
+							Name:  "protected-branches",
+							Usage: "comma separated branch patterns whose successful builds are always kept, eg. master,release-*",
+						},
 					},
 					Action: createPipeline,
 				},
@@ -92,6 +157,13 @@ func main() {
 					Before:    requireNameArg,
 					Action:    createBuild,
 				},
+				{
+					Name:      "hook",
+					Usage:     "recreate pipeline webhook with a new signing secret",
+					ArgsUsage: "<pipeline-name>",
+					Before:    requireNameArg,
+					Action:    createHook,
+				},
 			},
 		},
 		{
@@ -101,8 +173,14 @@ func main() {
 					Name:      "pipeline",
 					Usage:     "delete pipeline",
 					ArgsUsage: "<pipeline-name>",
-					Before:    requireNameArg,
-					Action:    deletePipeline,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "keep-hooks",
+							Usage: "keep the webhook and deploy key in the remote repository",
+						},
+					},
+					Before: requireNameArg,
+					Action: deletePipeline,
 				},
 				{
 					Name:      "build",
@@ -209,6 +287,75 @@ func main() {
 			},
 			Action: resumeBuild,
 		},
+		{
+			Name:      "approve",
+			Usage:     "approve pipeline builds of pull requests from forks",
+			ArgsUsage: "<pipeline-name>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "build, b",
+					Usage: "Required, Pipeline build number you want to approve",
+				},
+			},
+			Before: requireNameArg,
+			Action: approveBuild,
+		},
+		{
+			Name:  "migrate",
+			Usage: "back up the store and migrate it to the schema of the server, requires admin rights",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "report the changes of the pending migrations without making them",
+				},
+			},
+			Action: migrate,
+		},
+		{
+			Name:  "prune",
+			Usage: "delete the builds outside the retention policies, with their logs, artifacts and images, requires admin rights",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "report the builds that would be deleted without deleting them",
+				},
+			},
+			Action: prune,
+		},
+		{
+			Name:  "backup",
+			Usage: "back up the pipelines, builds and users, and optionally the logs and artifacts, requires admin rights",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "kontinuous-backup.tar.gz",
+					Usage: "file to write the backup to",
+				},
+				cli.BoolFlag{
+					Name:  "objects",
+					Usage: "include the logs and artifacts of the builds",
+				},
+				cli.StringFlag{
+					Name:   "passphrase",
+					Usage:  "Required, passphrase encrypting the deploy keys and access tokens in the backup",
+					EnvVar: "KONTINUOUS_BACKUP_PASSPHRASE",
+				},
+			},
+			Action: backup,
+		},
+		{
+			Name:      "restore",
+			Usage:     "restore a backup, restoring it again changes nothing, requires admin rights",
+			ArgsUsage: "<backup-file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "passphrase",
+					Usage:  "Required, passphrase the backup was made with",
+					EnvVar: "KONTINUOUS_BACKUP_PASSPHRASE",
+				},
+			},
+			Action: restore,
+		},
 	}
 	app.Run(os.Args)
 }
@@ -289,15 +436,35 @@ func getBuilds(c *cli.Context) {
 		os.Exit(1)
 	}
 
+	query := url.Values{}
+	if c.IsSet("limit") {
+		query.Set("limit", strconv.Itoa(c.Int("limit")))
+	}
+	for _, filter := range []string{"cursor", "status", "branch", "author", "event", "since", "until"} {
+		if value := c.String(filter); value != "" {
+			query.Set(filter, value)
+		}
+	}
+
 	owner, repo, _ := parseNameArg(c.Args().First())
-	builds, err := config.GetBuilds(http.DefaultClient, owner, repo)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	builds := []*apiReq.BuildData{}
+	cursor := ""
+	for {
+		page, next, err := config.GetBuilds(http.DefaultClient, owner, repo, query)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		builds = append(builds, page...)
+		cursor = next
+		if !c.Bool("all") || cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
 	}
 
 	table := uitable.New()
-	table.AddRow("BUILD", "STATUS", "CREATED", "FINISHED", "EVENT", "AUTHOR", "COMMIT")
+	table.AddRow("BUILD", "STATUS", "CREATED", "FINISHED", "EVENT", "AUTHOR", "COMMIT", "MESSAGE")
 	for _, b := range builds {
 		created := "-"
 		if b.Created != 0 {
@@ -307,9 +474,18 @@ func getBuilds(c *cli.Context) {
 		if b.Finished != 0 {
 			finished = time.Unix(0, b.Finished).Format(time.RFC3339)
 		}
-		table.AddRow(b.Number, b.Status, created, finished, b.Event, b.Author, b.Commit)
+		// only the subject of the commit message fits the table
+		message := strings.SplitN(b.Message, "\n", 2)[0]
+		if len(message) > 50 {
+			message = message[:47] + "..."
+		}
+		table.AddRow(b.Number, b.Status, created, finished, b.Event, b.Author, b.Commit, message)
 	}
 	fmt.Println(table)
+
+	if cursor != "" {
+		fmt.Printf("\nMore builds: --cursor %s, or --all for every page\n", cursor)
+	}
 }
 
 func getLatestBuild(c *cli.Context) {
@@ -394,9 +570,21 @@ func createPipeline(c *cli.Context) {
 	}
 
 	pipeline := &apiReq.PipelineData{
-		Owner:  owner,
-		Repo:   repo,
-		Events: events,
+		Owner:      owner,
+		Repo:       repo,
+		Events:     events,
+		ForkPolicy: c.String("fork-policy"),
+		Checks:     c.Bool("checks"),
+		Tags:       splitList(c.String("tags")),
+	}
+
+	// without retention flags the pipeline follows the server's policy
+	if c.IsSet("keep-last") || c.IsSet("keep-days") || c.IsSet("protected-branches") {
+		pipeline.Retention = &apiReq.RetentionData{
+			KeepLast:          c.Int("keep-last"),
+			KeepDays:          c.Int("keep-days"),
+			ProtectedBranches: splitList(c.String("protected-branches")),
+		}
 	}
 
 	err = config.CreatePipeline(http.DefaultClient, pipeline)
@@ -407,6 +595,31 @@ func createPipeline(c *cli.Context) {
 	}
 }
 
+// splitList splits a comma separated flag, without empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func createHook(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+	owner, repo, _ := parseNameArg(c.Args().First())
+	err = config.RotateHook(http.DefaultClient, owner, repo)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("webhook of pipeline `%s/%s` updated", owner, repo)
+	}
+}
+
 func createBuild(c *cli.Context) {
 	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
 	if err != nil {
@@ -426,7 +639,7 @@ func deletePipeline(c *cli.Context) {
 		os.Exit(1)
 	}
 	pipelineName := c.Args().First()
-	err = config.DeletePipeline(http.DefaultClient, pipelineName)
+	err = config.DeletePipeline(http.DefaultClient, pipelineName, c.Bool("keep-hooks"))
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -532,3 +745,150 @@ func resumeBuild(c *cli.Context) {
 		os.Exit(1)
 	}
 }
+
+func approveBuild(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+	owner, repo, _ := parseNameArg(c.Args().First())
+	buildNo := c.Int("build")
+
+	if buildNo == 0 {
+		fmt.Println("Missing fields.")
+		os.Exit(1)
+	}
+
+	if err = config.ApproveBuild(http.DefaultClient, owner, repo, buildNo); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func migrate(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+
+	report, err := config.Migrate(http.DefaultClient, c.Bool("dry-run"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(report.Migrations) == 0 {
+		fmt.Printf("Schema version %d is up to date.\n", report.From)
+		return
+	}
+
+	table := uitable.New()
+	table.AddRow("VERSION", "MIGRATION", "CHANGED")
+	for _, m := range report.Migrations {
+		table.AddRow(m.Version, m.Name, m.Changed)
+	}
+	fmt.Println(table)
+
+	if report.DryRun {
+		fmt.Printf("Dry run, the schema is still at version %d.\n", report.From)
+		return
+	}
+	fmt.Printf("Migrated from schema version %d to %d, backup: %s\n", report.From, report.To, report.Backup)
+}
+
+func prune(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+
+	report, err := config.Prune(http.DefaultClient, c.Bool("dry-run"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(report.Pipelines) == 0 {
+		fmt.Println("No builds to delete.")
+		return
+	}
+
+	table := uitable.New()
+	table.Wrap = true
+	table.AddRow("PIPELINE", "KEPT", "DELETED", "ERROR")
+	for _, p := range report.Pipelines {
+		deleted := make([]string, len(p.Deleted))
+		for i, number := range p.Deleted {
+			deleted[i] = strconv.Itoa(number)
+		}
+		table.AddRow(p.Pipeline, p.Kept, strings.Join(deleted, ", "), p.Error)
+	}
+	fmt.Println(table)
+
+	if report.DryRun {
+		fmt.Printf("Dry run, %d builds would be deleted.\n", report.Deleted)
+		return
+	}
+	fmt.Printf("Deleted %d builds.\n", report.Deleted)
+}
+
+func backup(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+
+	passphrase := c.String("passphrase")
+	if passphrase == "" {
+		fmt.Println("Missing passphrase.")
+		os.Exit(1)
+	}
+
+	output := c.String("output")
+	file, err := os.Create(output)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	if err := config.Backup(http.DefaultClient, passphrase, c.Bool("objects"), file); err != nil {
+		fmt.Println(err)
+		file.Close()
+		os.Remove(output)
+		os.Exit(1)
+	}
+	fmt.Printf("Backup written to %s.\n", output)
+}
+
+func restore(c *cli.Context) {
+	config, err := apiReq.GetConfigFromFile(c.GlobalString("conf"))
+	if err != nil {
+		os.Exit(1)
+	}
+
+	passphrase := c.String("passphrase")
+	input := strings.TrimSpace(c.Args().First())
+	if passphrase == "" || input == "" {
+		fmt.Println("Missing fields.")
+		os.Exit(1)
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	report, err := config.Restore(http.DefaultClient, passphrase, file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored %d keys (%d unchanged) and %d objects at schema version %d.\n", report.Keys, report.Unchanged, report.Objects, report.SchemaVersion)
+	if report.Migration != nil && len(report.Migration.Migrations) > 0 {
+		fmt.Printf("Migrated from schema version %d to %d.\n", report.Migration.From, report.Migration.To)
+	}
+}
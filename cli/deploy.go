@@ -231,6 +231,9 @@ spec:
       containers:
         - name: registry
           image: registry:2
+          env:
+            - name: REGISTRY_STORAGE_DELETE_ENABLED
+              value: "true"
           ports:
             - name: service
               containerPort: 5000
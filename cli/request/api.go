@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/AcalephStorage/kontinuous/api"
 	scm "github.com/AcalephStorage/kontinuous/scm"
@@ -33,12 +35,22 @@ type (
 	}
 
 	PipelineData struct {
-		ID          string     `json:"id"`
-		Owner       string     `json:"owner"`
-		Repo        string     `json:"repo"`
-		Events      []string   `json:"events"`
-		Login       string     `json:"login"`
-		LatestBuild *BuildData `json:"latest_build"`
+		ID          string         `json:"id"`
+		Owner       string         `json:"owner"`
+		Repo        string         `json:"repo"`
+		Events      []string       `json:"events"`
+		Login       string         `json:"login"`
+		ForkPolicy  string         `json:"fork_policy,omitempty"`
+		Checks      bool           `json:"checks,omitempty"`
+		Tags        []string       `json:"tags,omitempty"`
+		Retention   *RetentionData `json:"retention,omitempty"`
+		LatestBuild *BuildData     `json:"latest_build"`
+	}
+
+	RetentionData struct {
+		KeepLast          int      `json:"keep_last,omitempty"`
+		KeepDays          int      `json:"keep_days,omitempty"`
+		ProtectedBranches []string `json:"protected_branches,omitempty"`
 	}
 
 	RepoData struct {
@@ -54,6 +66,7 @@ type (
 		Event        string       `json:"event"`
 		Author       string       `json:"author"`
 		Commit       string       `json:"commit"`
+		Message      string       `json:"message"`
 		CurrentStage int          `json:"current_stage"`
 		Stages       []*StageData `json:"stages"`
 	}
@@ -69,8 +82,50 @@ type (
 		Namespace string `json:"namespace"`
 		PodName   string `json:"pod_name"`
 	}
+
+	MigrationData struct {
+		Version int    `json:"version"`
+		Name    string `json:"name"`
+		Changed int    `json:"changed"`
+	}
+
+	MigrationReportData struct {
+		From       int              `json:"from"`
+		To         int              `json:"to"`
+		DryRun     bool             `json:"dry_run"`
+		Backup     string           `json:"backup"`
+		Migrations []*MigrationData `json:"migrations"`
+	}
+
+	PrunedPipelineData struct {
+		Pipeline string `json:"pipeline"`
+		Kept     int    `json:"kept"`
+		Deleted  []int  `json:"deleted"`
+		Error    string `json:"error"`
+	}
+
+	PruneReportData struct {
+		DryRun    bool                  `json:"dry_run"`
+		Deleted   int                   `json:"deleted"`
+		Pipelines []*PrunedPipelineData `json:"pipelines"`
+	}
+
+	BackupRequestData struct {
+		Passphrase string `json:"passphrase"`
+		Objects    bool   `json:"objects"`
+	}
+
+	RestoreReportData struct {
+		SchemaVersion int                  `json:"schema_version"`
+		Keys          int                  `json:"keys"`
+		Unchanged     int                  `json:"unchanged"`
+		Objects       int                  `json:"objects"`
+		Migration     *MigrationReportData `json:"migration"`
+	}
 )
 
+const mimeGzip = "application/gzip"
+
 func GetConfigFromFile(file string) (*Config, error) {
 	_, err := os.Stat(file)
 	if err != nil {
@@ -149,18 +204,23 @@ func (c *Config) GetRepos(client *http.Client) ([]*RepoData, error) {
 	return list, nil
 }
 
-func (c *Config) GetBuilds(client *http.Client, owner, repo string) ([]*BuildData, error) {
+// GetBuilds gets a page of the builds matching the query, eg. limit, cursor or status,
+// and the cursor of the next page which is empty on the last page
+func (c *Config) GetBuilds(client *http.Client, owner, repo string, query url.Values) ([]*BuildData, string, error) {
 	endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds", owner, repo)
-	body, err := c.sendAPIRequest(client, "GET", endpoint, nil)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	body, header, err := c.sendRequest(client, "GET", endpoint, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	list := []*BuildData{}
 	err = json.Unmarshal(body, &list)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return list, nil
+	return list, header.Get("X-Next-Cursor"), nil
 }
 
 func (c *Config) GetBuild(client *http.Client, owner, repo string, buildNumber int) (*BuildData, error) {
@@ -257,77 +317,154 @@ func (c *Config) CreateBuild(client *http.Client, owner, repo string) error {
 	return nil
 }
 
+// monitorBuildStatus reports the status of the build as it changes until it is
+// finished or waits for approval, the stages waiting for input ask to continue
 func (c *Config) monitorBuildStatus(client *http.Client, buildNumber int, owner, repo string, started bool) error {
+	stop := make(chan struct{})
+	defer close(stop)
 
-	build, err := c.GetBuild(client, owner, repo, buildNumber)
-	stages, err := c.GetStages(client, owner, repo, buildNumber)
-	currentStage := build.CurrentStage
+	builds, errs, err := c.watchBuild(client, owner, repo, buildNumber, stop)
 	if err != nil {
 		return err
 	}
 
-	buildStatus := build.Status
+	prompted := 0
+	for build := range builds {
+		stages := build.Stages
+		currentStage := build.CurrentStage
 
-	switch buildStatus {
+		switch build.Status {
 
-	case "FAIL":
-		fmt.Println("\nBuild failed.")
-		return err
-	case "SUCCESS":
-
-		stage := stages[currentStage-1]
-		if currentStage == len(stages) && stage.Status == "SUCCESS" {
-			fmt.Println("\nBuild successful.")
+		case "FAIL":
+			fmt.Println("\nBuild failed.")
 			return nil
-		}
+		case "SUCCESS":
+			if currentStage < 1 || currentStage > len(stages) {
+				break
+			}
 
-		if stage.Status != "WAITING" {
-			break
-		}
+			stage := stages[currentStage-1]
+			if currentStage == len(stages) && stage.Status == "SUCCESS" {
+				fmt.Println("\nBuild successful.")
+				return nil
+			}
 
-		message := "\nDo you want to continue? (Y/N) "
-		reader := bufio.NewReader(os.Stdin)
-
-		fmt.Printf("%s", message)
-		text, _ := reader.ReadString('\n')
-		text = strings.ToLower(strings.TrimSpace(text))
-
-		switch text {
-		case "y":
-			fallthrough
-		case "yes":
-			data := fmt.Sprintf(`{"status":"%s","timestamp": %v }`, buildStatus, time.Now().UnixNano())
-			endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d/stages/%d?continue=yes", owner, repo, buildNumber, currentStage)
-			_, err := c.sendAPIRequest(client, "POST", endpoint, []byte(data))
-			if err != nil {
-				return err
+			// the build is saved again before the stage is resumed
+			if stage.Status != "WAITING" || prompted == currentStage {
+				break
+			}
+			prompted = currentStage
+
+			message := "\nDo you want to continue? (Y/N) "
+			reader := bufio.NewReader(os.Stdin)
+
+			fmt.Printf("%s", message)
+			text, _ := reader.ReadString('\n')
+			text = strings.ToLower(strings.TrimSpace(text))
+
+			switch text {
+			case "y":
+				fallthrough
+			case "yes":
+				data := fmt.Sprintf(`{"status":"%s","timestamp": %v }`, build.Status, time.Now().UnixNano())
+				endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d/stages/%d?continue=yes", owner, repo, buildNumber, currentStage)
+				_, err := c.sendAPIRequest(client, "POST", endpoint, []byte(data))
+				if err != nil {
+					return err
+				}
+				fmt.Print("Resuming build.")
+			case "n":
+				fallthrough
+			case "no":
+				fmt.Println("Build stopped.")
+				return nil
+			default:
+				fmt.Println("Invalid input.")
+				prompted = 0
 			}
-			fmt.Print("Resuming build.")
-			time.Sleep(2 * time.Second)
-		case "n":
-			fallthrough
-		case "no":
-			fmt.Println("Build stopped.")
-			return nil
-		default:
-			fmt.Println("Invalid input.")
-		}
 
-	case "RUNNING":
-		if !started {
-			fmt.Print("\nBuild running.")
-			started = true
-		} else {
-			fmt.Print(".")
-			time.Sleep(2 * time.Second)
+		case "PENDING_APPROVAL":
+			fmt.Printf("\nBuild is from a fork and needs to be approved by a maintainer: kontinuous-cli approve %s/%s --build %d\n", owner, repo, buildNumber)
+			return nil
+		case "RUNNING":
+			if !started {
+				fmt.Print("\nBuild running.")
+				started = true
+			} else {
+				fmt.Print(".")
+			}
 		}
 	}
 
+	// the stream ends when the server goes away, watch again from the build as it is
+	if err := <-errs; err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Second)
 	return c.monitorBuildStatus(client, buildNumber, owner, repo, started)
 }
 
-func (c *Config) DeletePipeline(client *http.Client, pipelineName string) error {
+// watchBuild streams the build every time it is saved, starting with the build as it
+// is, until stop is closed. The channel is closed when the stream ends, with its error
+// if it failed.
+func (c *Config) watchBuild(client *http.Client, owner, repo string, buildNumber int, stop <-chan struct{}) (<-chan *BuildData, <-chan error, error) {
+	endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d/events", owner, repo, buildNumber)
+	stream, err := c.openStream(client, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		<-stop
+		stream.Close()
+	}()
+
+	builds := make(chan *BuildData)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(builds)
+
+		// server-sent events, the data of an event is on its own line after its name
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+				continue
+			}
+			if !strings.HasPrefix(line, "data: ") || event != "build" {
+				continue
+			}
+			build := new(BuildData)
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), build); err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case builds <- build:
+			case <-stop:
+				return
+			}
+		}
+		errs <- scanner.Err()
+	}()
+	return builds, errs, nil
+}
+
+func (c *Config) RotateHook(client *http.Client, owner, repo string) error {
+	endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/hook", owner, repo)
+	_, err := c.sendAPIRequest(client, "POST", endpoint, nil)
+	return err
+}
+
+func (c *Config) DeletePipeline(client *http.Client, pipelineName string, keepHooks bool) error {
 	endpoint := fmt.Sprintf("/api/v1/pipelines/%s", pipelineName)
+	if keepHooks {
+		endpoint += "?keep_hooks=true"
+	}
 	_, err := c.sendAPIRequest(client, "DELETE", endpoint, nil)
 	if err != nil {
 		return err
@@ -372,6 +509,97 @@ func (c *Config) ResumeBuild(client *http.Client, owner, repo string, buildNumbe
 	return nil
 }
 
+func (c *Config) ApproveBuild(client *http.Client, owner, repo string, buildNumber int) error {
+	endpoint := fmt.Sprintf("/api/v1/pipelines/%s/%s/builds/%d/approve", owner, repo, buildNumber)
+	_, err := c.sendAPIRequest(client, "POST", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print("Build approved.")
+	return c.monitorBuildStatus(client, buildNumber, owner, repo, false)
+}
+
+// Migrate runs the pending migrations of the store, a dry run reports the changes without making them
+func (c *Config) Migrate(client *http.Client, dryRun bool) (*MigrationReportData, error) {
+	endpoint := "/api/v1/admin/migrations"
+	if dryRun {
+		endpoint += "?dry_run=true"
+	}
+	body, err := c.sendAPIRequest(client, "POST", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := new(MigrationReportData)
+	if err := json.Unmarshal(body, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Prune deletes the builds outside the retention policies, a dry run only reports them
+func (c *Config) Prune(client *http.Client, dryRun bool) (*PruneReportData, error) {
+	endpoint := "/api/v1/admin/prune"
+	if dryRun {
+		endpoint += "?dry_run=true"
+	}
+	body, err := c.sendAPIRequest(client, "POST", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := new(PruneReportData)
+	if err := json.Unmarshal(body, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Backup writes a backup of the store to w, with the logs and artifacts when withObjects
+// is set. The secrets in the backup are encrypted with the passphrase.
+func (c *Config) Backup(client *http.Client, passphrase string, withObjects bool, w io.Writer) error {
+	data, _ := json.Marshal(&BackupRequestData{
+		Passphrase: passphrase,
+		Objects:    withObjects,
+	})
+	req, err := http.NewRequest("POST", c.Host+"/api/v1/admin/backup", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", mimeGzip)
+	req.Header.Add("Content-Type", "application/json")
+
+	body, err := c.sendStreamRequest(client, req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// Restore restores a backup read from r, keys that already have the backed up value are not changed
+func (c *Config) Restore(client *http.Client, passphrase string, r io.Reader) (*RestoreReportData, error) {
+	req, err := http.NewRequest("POST", c.Host+"/api/v1/admin/restore", r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", mimeGzip)
+	req.Header.Add("X-Backup-Passphrase", passphrase)
+
+	body, err := c.sendStreamRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	report := new(RestoreReportData)
+	if err := json.NewDecoder(body).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
 func (c *Config) validate() error {
 	missing := []string{}
 	if len(c.Host) == 0 {
@@ -389,17 +617,59 @@ func (c *Config) validate() error {
 	return nil
 }
 
-func (c *Config) sendAPIRequest(client *http.Client, method, endpoint string, data []byte) ([]byte, error) {
-	url := c.Host + endpoint
-	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+// openStream starts a stream of server-sent events, the caller closes it
+func (c *Config) openStream(client *http.Client, endpoint string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.Host+endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Add("Accept", "text/event-stream")
+	return c.sendStreamRequest(client, req)
+}
 
+// sendStreamRequest sends an authenticated request and returns the body of the
+// response without reading it, the caller closes it
+func (c *Config) sendStreamRequest(client *http.Client, req *http.Request) (io.ReadCloser, error) {
 	jwtToken, err := api.CreateJWT(c.Token, c.Secret)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Add("Authorization", "Bearer "+jwtToken)
+	req.Header.Add("X-Custom-Event", scm.EventCLI)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		apiError := &Error{}
+		if err := json.Unmarshal(body, apiError); err != nil {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errors.New(apiError.Message)
+	}
+	return resp.Body, nil
+}
+
+func (c *Config) sendAPIRequest(client *http.Client, method, endpoint string, data []byte) ([]byte, error) {
+	body, _, err := c.sendRequest(client, method, endpoint, data)
+	return body, err
+}
+
+// sendRequest sends an API request and returns the body and the headers of the response
+func (c *Config) sendRequest(client *http.Client, method, endpoint string, data []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, c.Host+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jwtToken, err := api.CreateJWT(c.Token, c.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
 	auth := "Bearer " + jwtToken
 	req.Header.Add("Authorization", auth)
 	req.Header.Add("Accept", "application/json")
@@ -408,7 +678,7 @@ func (c *Config) sendAPIRequest(client *http.Client, method, endpoint string, da
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -418,10 +688,10 @@ func (c *Config) sendAPIRequest(client *http.Client, method, endpoint string, da
 		apiError := &Error{}
 		err = json.Unmarshal(body, apiError)
 		if err != nil {
-			return nil, errors.New(resp.Status)
+			return nil, nil, errors.New(resp.Status)
 		}
-		return nil, errors.New(apiError.Message)
+		return nil, nil, errors.New(apiError.Message)
 	}
 
-	return body, nil
+	return body, resp.Header, nil
 }
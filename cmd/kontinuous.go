@@ -3,6 +3,8 @@ package main
 import (
 	"net"
 	"os"
+	"path/filepath"
+	"time"
 
 	"encoding/json"
 	"io/ioutil"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/AcalephStorage/kontinuous/api"
 	"github.com/AcalephStorage/kontinuous/kube"
+	ps "github.com/AcalephStorage/kontinuous/pipeline"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 	"github.com/AcalephStorage/kontinuous/store/mc"
 	"github.com/AcalephStorage/kontinuous/util"
@@ -31,6 +34,13 @@ type Secrets struct {
 	S3AccessKey        string
 	GithubClientID     string
 	GithubClientSecret string
+	GitlabURL          string
+	GitlabClientID     string
+	GitlabClientSecret string
+	BitbucketURL       string
+	GithubAppID        string
+	GithubAppKey       string
+	GithubAppSecret    string
 }
 
 var (
@@ -41,6 +51,7 @@ var (
 		"Content-Type",
 		"Origin",
 		"X-Custom-Event",
+		"X-Remote-Client",
 	}
 )
 
@@ -64,7 +75,44 @@ func main() {
 
 	container := createRestfulContainer()
 
-	kvClient := createKVClient(kvAddress)
+	kvAPI := getEnv("KV_API", "2")
+
+	// copy the v2 keyspace to v3 and exit, before switching KV_API to 3
+	if len(os.Args) > 1 && os.Args[1] == "migrate-v3" {
+		migrateToV3(kvAddress, getEnv("KV_V3_ADDRESS", kvAddress))
+		return
+	}
+
+	var kvClient kv.KVClient
+	var objectStore mc.ObjectStore
+
+	// embedded storage keeps everything under DATA_DIR, for installs without etcd and minio
+	switch storage := getEnv("STORAGE", "etcd"); storage {
+	case "etcd":
+		kvClient = createKVClient(kvAPI, kvAddress)
+		objectStore = createMinioClient(s3Url, s3Access, s3Secret)
+	case "embedded":
+		dataDir := getEnv("DATA_DIR", "/var/lib/kontinuous")
+		kvClient, objectStore = createEmbeddedStores(dataDir)
+
+		// the agents upload logs and artifacts to kontinuous when S3_URL is not set
+		if s3Url != "" {
+			log.Warn("S3_URL is ignored with embedded storage")
+			os.Unsetenv("S3_URL")
+		}
+	default:
+		log.Fatalf("unknown storage %s", storage)
+	}
+
+	// move pipelines and builds stored with a key per field to documents and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate-documents" {
+		migrateDocuments(kvClient)
+		return
+	}
+
+	// bring the store to the layout of this version before serving, or leave it to `kontinuous-cli migrate`
+	migrateSchema(kvClient, objectStore, getEnv("AUTO_MIGRATE", "true") == "true")
+
 	kubeClient, err := kube.NewClient("https://kubernetes.default")
 	if err != nil {
 		log.WithError(err).Fatal("unable to create kubernetes client")
@@ -73,14 +121,47 @@ func main() {
 	auth := &api.AuthResource{KVClient: kvClient}
 	pipeline := &api.PipelineResource{
 		KVClient:    kvClient,
-		MinioClient: createMinioClient(s3Url, s3Access, s3Secret),
+		ObjectStore: objectStore,
 		KubeClient:  kubeClient,
 	}
 	repos := &api.RepositoryResource{}
+	app := &api.AppResource{KVClient: kvClient}
+	admin := &api.AdminResource{
+		KVClient:    kvClient,
+		ObjectStore: objectStore,
+	}
 
 	auth.Register(container)
 	pipeline.Register(container)
 	repos.Register(container)
+	app.Register(container)
+	admin.Register(container)
+
+	// plain git remotes have no webhooks, poll them for new commits instead
+	pollInterval, err := time.ParseDuration(getEnv("POLL_INTERVAL", "1m"))
+	if err != nil {
+		log.WithError(err).Fatal("invalid poll interval")
+	}
+	poller := &api.Poller{
+		KVClient:    kvClient,
+		ObjectStore: objectStore,
+		Interval:    pollInterval,
+	}
+	poller.Start(make(chan struct{}))
+
+	// delete the builds outside the retention policies, 0 leaves them to `kontinuous-cli prune`
+	retentionInterval, err := time.ParseDuration(getEnv("RETENTION_INTERVAL", "1h"))
+	if err != nil {
+		log.WithError(err).Fatal("invalid retention interval")
+	}
+	if retentionInterval > 0 {
+		janitor := &api.Janitor{
+			KVClient:    kvClient,
+			ObjectStore: objectStore,
+			Interval:    retentionInterval,
+		}
+		janitor.Start(make(chan struct{}))
+	}
 
 	swaggerUIPath := getEnv("SWAGGER_UI", "")
 	swaggerConfig := swagger.Config{
@@ -139,8 +220,13 @@ func createRestfulContainer() *restful.Container {
 	return container
 }
 
-func createKVClient(address string) kv.KVClient {
-	kvClient, err := kv.NewEtcdClient("", "", "", address)
+func createKVClient(api, address string) kv.KVClient {
+	newClient := kv.NewEtcdClient
+	if api == "3" {
+		newClient = kv.NewEtcdV3Client
+	}
+
+	kvClient, err := newClient("", "", "", address)
 	if err != nil {
 		mainLog.InFunc("createKvClient").
 			WithError(err).
@@ -150,6 +236,52 @@ func createKVClient(address string) kv.KVClient {
 	return kvClient
 }
 
+func migrateToV3(v2Address, v3Address string) {
+	log := mainLog.InFunc("migrateToV3")
+
+	count, err := kv.MigrateToV3(createKVClient("2", v2Address), createKVClient("3", v3Address), "/kontinuous")
+	if err != nil {
+		log.WithError(err).Fatalf("migration failed after %d keys", count)
+	}
+	log.Infof("Migrated %d keys to etcd v3", count)
+}
+
+func migrateDocuments(kvClient kv.KVClient) {
+	log := mainLog.InFunc("migrateDocuments")
+
+	count, err := ps.MigrateDocuments(kvClient)
+	if err != nil {
+		log.WithError(err).Fatalf("migration failed after %d documents", count)
+	}
+	log.Infof("Migrated %d pipelines and builds to documents", count)
+}
+
+// migrateSchema runs the pending migrations, the keys are backed up to the object store first
+func migrateSchema(kvClient kv.KVClient, objectStore mc.ObjectStore, auto bool) {
+	log := mainLog.InFunc("migrateSchema")
+
+	pending, err := ps.PendingMigrations(kvClient)
+	if err != nil {
+		log.WithError(err).Fatal("unable to check the schema version")
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if !auto {
+		log.Warnf("%d migrations are pending, run them with kontinuous-cli migrate", len(pending))
+		return
+	}
+
+	report, err := ps.Migrate(kvClient, objectStore, false)
+	if err != nil {
+		log.WithError(err).Fatal("migration failed")
+	}
+	for _, m := range report.Migrations {
+		log.Infof("Migrated to schema version %d (%s), %d records changed", m.Version, m.Name, m.Changed)
+	}
+	log.Infof("The store was backed up to %s before migrating", report.Backup)
+}
+
 func createMinioClient(url, access, secret string) *mc.MinioClient {
 	minioClient, err := mc.NewMinioClient(url, access, secret)
 	if err != nil {
@@ -161,6 +293,25 @@ func createMinioClient(url, access, secret string) *mc.MinioClient {
 	return minioClient
 }
 
+func createEmbeddedStores(dataDir string) (kv.KVClient, mc.ObjectStore) {
+	log := mainLog.InFunc("createEmbeddedStores")
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		log.WithError(err).Fatalf("unable to create %s", dataDir)
+	}
+
+	kvClient, err := kv.NewBoltClient(filepath.Join(dataDir, "kontinuous.db"))
+	if err != nil {
+		log.WithError(err).Fatal("unable to create kv client")
+	}
+
+	objectStore, err := mc.NewLocalStore(filepath.Join(dataDir, "objects"))
+	if err != nil {
+		log.WithError(err).Fatal("unable to create object store")
+	}
+	return kvClient, objectStore
+}
+
 func getSecrets() *Secrets {
 	content, err := ioutil.ReadFile(SecretFile)
 	if err != nil {
@@ -188,5 +339,18 @@ func setEnv() {
 		os.Setenv("S3_SECRET_KEY", secrets.S3SecretKey)
 		os.Setenv("GITHUB_CLIENT_ID", secrets.GithubClientID)
 		os.Setenv("GITHUB_CLIENT_SECRET", secrets.GithubClientSecret)
+		os.Setenv("GITLAB_CLIENT_ID", secrets.GitlabClientID)
+		os.Setenv("GITLAB_CLIENT_SECRET", secrets.GitlabClientSecret)
+		if secrets.GitlabURL != "" {
+			os.Setenv("GITLAB_URL", secrets.GitlabURL)
+		}
+		if secrets.BitbucketURL != "" {
+			os.Setenv("BITBUCKET_URL", secrets.BitbucketURL)
+		}
+		if secrets.GithubAppID != "" {
+			os.Setenv("GITHUB_APP_ID", secrets.GithubAppID)
+			os.Setenv("GITHUB_APP_KEY", secrets.GithubAppKey)
+			os.Setenv("GITHUB_APP_WEBHOOK_SECRET", secrets.GithubAppSecret)
+		}
 	}
 }
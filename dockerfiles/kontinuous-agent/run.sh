@@ -9,12 +9,52 @@ prepare_kube_config() {
 	sed -i "s/{{token}}/$(cat /var/run/secrets/kubernetes.io/serviceaccount/token)/g" /root/.kube/config
 }
 
+# clone_url is the remote of the pipeline, the user's token is the credentials of https remotes
+clone_url() {
+	if [[ -z "${GIT_CLONE_URL}" ]]; then
+		echo "https://${GIT_USER}@github.com/${GIT_OWNER}/${GIT_REPO}.git"
+		return
+	fi
+	if [[ -n "${GIT_USER}" && "${GIT_CLONE_URL}" == https://* ]]; then
+		local credentials="${GIT_USER}"
+		if [[ -n "${GIT_CLONE_USER}" ]]; then
+			credentials="${GIT_CLONE_USER}:${GIT_USER}"
+		fi
+		echo "https://${credentials}@${GIT_CLONE_URL#https://}"
+		return
+	fi
+	echo "${GIT_CLONE_URL}"
+}
+
+# plain git remotes are cloned with the deploy key and the host keys pinned for the
+# pipeline, both are mounted from the pipeline's secret
+prepare_ssh() {
+	if [[ ! -f /kontinuous/ssh/ssh-privatekey ]]; then
+		return 0
+	fi
+	mkdir -p /root/.ssh
+	install -m 600 /kontinuous/ssh/ssh-privatekey /root/.ssh/id_rsa
+	install -m 600 /kontinuous/ssh/known_hosts /root/.ssh/known_hosts
+	cat > /root/.ssh/config <<-EOF
+		Host *
+		    IdentityFile /root/.ssh/id_rsa
+		    IdentitiesOnly yes
+		    StrictHostKeyChecking yes
+		    UserKnownHostsFile /root/.ssh/known_hosts
+	EOF
+}
+
 clone_source() {
 	# clone source code if needed
 	if [[ "${REQUIRE_SOURCE_CODE}" == "TRUE" ]]; then
 		echo "Retrieving source code..."
-		git clone -- https://${GIT_USER}@github.com/${GIT_OWNER}/${GIT_REPO}.git /kontinuous/src/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}
+		prepare_ssh
+		git clone -- "$(clone_url)" /kontinuous/src/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID} || return 1
 		cd /kontinuous/src/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}
+		# pull request commits, possibly from forks, are only reachable from their ref, eg. refs/pull/1/head
+		if [[ -n "${GIT_REF}" ]]; then
+			git fetch origin "${GIT_REF}" || return 1
+		fi
 		git checkout ${GIT_COMMIT}
 	fi
 }
@@ -161,10 +201,22 @@ wait_for_success() {
 	done
 }
 
+objects_url() {
+	echo "${KONTINUOUS_URL}/api/v1/pipelines/${GIT_OWNER}/${GIT_REPO}/builds/${KONTINUOUS_BUILD_ID}/objects"
+}
+
+# without S3 the objects are stored by kontinuous, the mc dir is uploaded as a tar archive
+upload_objects() {
+	local mc_dir=$1
+	tar -C ${mc_dir}/pipelines/${KONTINUOUS_PIPELINE_ID}/builds/${KONTINUOUS_BUILD_ID} -cf - . | curl -k -X PUT -H "X-Build-Token: ${KONTINUOUS_BUILD_TOKEN}" -H 'Content-Type: application/x-tar' --data-binary @- "$(objects_url)"
+}
+
 prepare_mc() {
 	echo "Setting up logs and artifact storage..."
-	mc config host add internal-storage "${S3_URL}" "${S3_ACCESS_KEY}" "${S3_SECRET_KEY}" S3v4
-	mc mb internal-storage/kontinuous || true
+	if [[ -n "${S3_URL}" ]]; then
+		mc config host add internal-storage "${S3_URL}" "${S3_ACCESS_KEY}" "${S3_SECRET_KEY}" S3v4
+		mc mb internal-storage/kontinuous || true
+	fi
 	mkdir -pv /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}/mc/pipelines/${KONTINUOUS_PIPELINE_ID}/builds/${KONTINUOUS_BUILD_ID}/stages/${KONTINUOUS_STAGE_ID}/logs
 	mkdir -pv /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/mc/pipelines/${KONTINUOUS_PIPELINE_ID}/builds/${KONTINUOUS_BUILD_ID}/artifacts
 }
@@ -180,6 +232,10 @@ store_logs() {
 		local container_name=$(kubectl get pods ${pod_name} --namespace=${KONTINUOUS_NAMESPACE} -o template --template="{{(index .spec.containers ${i}).name}}")
 		kubectl logs ${pod_name} ${container_name} --namespace=${KONTINUOUS_NAMESPACE} > /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}/mc/pipelines/${KONTINUOUS_PIPELINE_ID}/builds/${KONTINUOUS_BUILD_ID}/stages/${KONTINUOUS_STAGE_ID}/logs/${container_name}.log
 	done
+	if [[ -z "${S3_URL}" ]]; then
+		upload_objects /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}/mc
+		return
+	fi
 	mc mirror --quiet --force /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/${KONTINUOUS_STAGE_ID}/mc/ internal-storage/kontinuous
 }
 
@@ -202,6 +258,10 @@ store_artifacts() {
 			done
 		done
 	fi
+	if [[ -z "${S3_URL}" ]]; then
+		upload_objects /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/mc
+		return
+	fi
 	echo "storing to mc..."
 	mc mirror --quiet --force /kontinuous/status/${KONTINUOUS_PIPELINE_ID}/${KONTINUOUS_BUILD_ID}/mc/ internal-storage/kontinuous
 }
@@ -227,6 +287,11 @@ fail() {
 
 load_artifacts() {
 	echo 'Loading previous artifacts...'
+	if [[ -z "${S3_URL}" ]]; then
+		mkdir -p /kontinuous/src
+		curl -k -f -H "X-Build-Token: ${KONTINUOUS_BUILD_TOKEN}" "$(objects_url)?prefix=artifacts" | tar -C /kontinuous/src -xf -
+		return
+	fi
 	mc cp -r --quiet internal-storage/kontinuous/pipelines/${KONTINUOUS_PIPELINE_ID}/builds/${KONTINUOUS_BUILD_ID}/artifacts/ /kontinuous/src/artifacts/
 }
 
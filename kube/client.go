@@ -20,6 +20,7 @@ import (
 type KubeClient interface {
 	CreateJob(job *Job) error
 	GetSecret(namespace string, secretName string) (map[string]string, error)
+	CreateSecret(namespace, secretName string, data map[string]string) error
 	GetLog(namespace, pod, container string) (string, error)
 	GetPodNameBySelector(namespace string, selector map[string]string) (string, error)
 	GetPodContainers(namespace, podName string) ([]string, error)
@@ -94,6 +95,31 @@ func (r *realKubeClient) GetSecret(namespace string, secretName string) (map[str
 	return secrets, nil
 }
 
+// CreateSecret creates the secret with the given values, replacing it when it exists
+func (r *realKubeClient) CreateSecret(namespace, secretName string, data map[string]string) error {
+	secret := &Secret{
+		Kind:       "Secret",
+		ApiVersion: "v1",
+		Metadata:   map[string]interface{}{"name": secretName, "namespace": namespace},
+		Data:       make(map[string]string),
+		Type:       "Opaque",
+	}
+	for key, value := range data {
+		secret.Data[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	uri := "/api/v1/namespaces/" + namespace + "/secrets"
+	err = r.doPost(uri, bytes.NewReader(body))
+	if err == nil || !strings.HasPrefix(err.Error(), "409:") {
+		return err
+	}
+	return r.doPut(uri+"/"+secretName, bytes.NewReader(body))
+}
+
 func (r *realKubeClient) doGet(uri string, response interface{}) error {
 	req, err := r.createRequest("GET", uri, nil)
 	if err != nil {
@@ -169,6 +195,26 @@ func (r *realKubeClient) doPost(uri string, data io.Reader) error {
 	return fmt.Errorf("%d: %s", res.StatusCode, string(body))
 }
 
+func (r *realKubeClient) doPut(uri string, data io.Reader) error {
+	req, err := r.createRequest("PUT", uri, data)
+	if err != nil {
+		return err
+	}
+	res, err := r.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%d: %s", res.StatusCode, string(body))
+}
+
 func (r *realKubeClient) createRequest(method, uri string, data io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, r.address+uri, data)
 	if err != nil {
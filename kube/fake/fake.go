@@ -0,0 +1,149 @@
+// Package fake is an in-memory kube.KubeClient for tests. It records the jobs
+// created through it and serves the secrets, pods and logs added to it.
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AcalephStorage/kontinuous/kube"
+)
+
+type pod struct {
+	namespace  string
+	name       string
+	labels     map[string]string
+	containers []string
+}
+
+// Client is an in-memory cluster
+type Client struct {
+	mu      sync.Mutex
+	jobs    []*kube.Job
+	secrets map[string]map[string]string
+	pods    []*pod
+	logs    map[string]string
+}
+
+// NewClient returns an empty fake cluster
+func NewClient() *Client {
+	return &Client{
+		secrets: make(map[string]map[string]string),
+		logs:    make(map[string]string),
+	}
+}
+
+// SetSecret adds or replaces a secret, values are not encoded
+func (c *Client) SetSecret(namespace, name string, data map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secrets[namespace+"/"+name] = data
+}
+
+// AddPod adds a pod with the given labels and containers
+func (c *Client) AddPod(namespace, name string, labels map[string]string, containers ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pods = append(c.pods, &pod{namespace, name, labels, containers})
+}
+
+// SetLog sets the log of a pod's container
+func (c *Client) SetLog(namespace, podName, container, log string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs[namespace+"/"+podName+"/"+container] = log
+}
+
+// Jobs returns the jobs created in the cluster, oldest first
+func (c *Client) Jobs() []*kube.Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jobs := make([]*kube.Job, len(c.jobs))
+	copy(jobs, c.jobs)
+	return jobs
+}
+
+// CreateJob records the job, jobs with the same name and namespace are rejected like in kubernetes
+func (c *Client) CreateJob(job *kube.Job) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, j := range c.jobs {
+		if j.Metadata["name"] == job.Metadata["name"] && j.Metadata["namespace"] == job.Metadata["namespace"] {
+			return fmt.Errorf("409: job %v already exists", job.Metadata["name"])
+		}
+	}
+	c.jobs = append(c.jobs, job)
+	return nil
+}
+
+// GetSecret returns the data of a secret
+func (c *Client) GetSecret(namespace string, secretName string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, exists := c.secrets[namespace+"/"+secretName]
+	if !exists {
+		return nil, fmt.Errorf("404: secret %s not found", secretName)
+	}
+
+	secrets := make(map[string]string, len(data))
+	for key, value := range data {
+		secrets[key] = value
+	}
+	return secrets, nil
+}
+
+// CreateSecret adds or replaces a secret like SetSecret
+func (c *Client) CreateSecret(namespace, secretName string, data map[string]string) error {
+	c.SetSecret(namespace, secretName, data)
+	return nil
+}
+
+// GetLog returns the log of a pod's container
+func (c *Client) GetLog(namespace, podName, container string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log, exists := c.logs[namespace+"/"+podName+"/"+container]
+	if !exists {
+		return "", fmt.Errorf("404: container %s of pod %s not found", container, podName)
+	}
+	return log, nil
+}
+
+// GetPodNameBySelector returns the first pod matching all the labels of the selector, empty when none match
+func (c *Client) GetPodNameBySelector(namespace string, selector map[string]string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.pods {
+		if p.namespace == namespace && matches(p.labels, selector) {
+			return p.name, nil
+		}
+	}
+	return "", nil
+}
+
+// GetPodContainers returns the container names of a pod
+func (c *Client) GetPodContainers(namespace, podName string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.pods {
+		if p.namespace == namespace && p.name == podName {
+			return p.containers, nil
+		}
+	}
+	return nil, fmt.Errorf("404: pod %s not found", podName)
+}
+
+func matches(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
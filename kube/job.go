@@ -108,6 +108,16 @@ func (j *Job) AddPodVolume(name, path string) *Volume {
 	return vol
 }
 
+// AddSecretVolume adds a volume holding the keys of a secret as files. Reference to the created volume is returned
+func (j *Job) AddSecretVolume(name, secretName string) *Volume {
+	vol := &Volume{
+		Name:   name,
+		Secret: &SecretVolume{secretName},
+	}
+	j.Spec.Template.Spec.Volumes = append(j.Spec.Template.Spec.Volumes, vol)
+	return vol
+}
+
 // AddPodContainer adds a new container to the pod. Reference to the created pod is returned
 func (j *Job) AddPodContainer(name, image string) *Container {
 	container := &Container{
@@ -148,6 +158,7 @@ type Volume struct {
 	Name     string          `json:"name,omitempty"`
 	HostPath *HostPathVolume `json:"hostPath,omitempty"`
 	EmptyDir *EmptyDirVolume `json:"emptyDir,omitempty"`
+	Secret   *SecretVolume   `json:"secret,omitempty"`
 	// add more volumes?
 }
 
@@ -161,6 +172,11 @@ type EmptyDirVolume struct {
 	Medium string `json:"medium,omitempty"`
 }
 
+// SecretVolume is a volume with a file for each key of a secret
+type SecretVolume struct {
+	SecretName string `json:"secretName,omitempty"`
+}
+
 // Container defines a container in a kubernetes pod
 type Container struct {
 	Name            string           `json:"name,omitempty"`
@@ -1,9 +1,9 @@
 package kube
 
 type Secret struct {
-	Kind       string                 `json:"apiVersion",omitempty"`
+	Kind       string                 `json:"kind,omitempty"`
 	ApiVersion string                 `json:"apiVersion,omitempty"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 	Data       map[string]string      `json:"data,omitempty"`
-	Type       string                 `json:"type, omitempty"`
+	Type       string                 `json:"type,omitempty"`
 }
@@ -0,0 +1,528 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// A backup is a gzipped tarball with a manifest, the keys of the store and optionally
+// the logs and artifacts. The private deploy keys, the webhook secrets, the headers of
+// the webhook deliveries and the users' access tokens are encrypted with a key derived
+// from a passphrase, the rest of the archive is not.
+
+const (
+	// backupFormat is the version of the archive's layout, backups of format 1 only
+	// have the deploy keys and the access tokens encrypted
+	backupFormat = 2
+
+	backupManifestFile = "manifest.json"
+	backupKeysFile     = "keys.json"
+	backupObjectsDir   = "objects/"
+
+	// encryptedPrefix marks the encrypted values in the archive
+	encryptedPrefix = "encrypted:"
+
+	// backupCheck is encrypted in the manifest to verify the passphrase
+	backupCheck = "kontinuous"
+
+	keyIterations = 100000
+	keyLength     = 32
+)
+
+var (
+	// ErrBackupPassphrase is returned when the encrypted values of a backup can't be decrypted
+	ErrBackupPassphrase = errors.New("unable to decrypt the backup, wrong passphrase")
+
+	// ErrBackupFormat is returned when reading an archive that is not a backup or is of a newer format
+	ErrBackupFormat = errors.New("not a kontinuous backup or of a newer format")
+)
+
+type (
+	// BackupManifest describes the content of a backup
+	BackupManifest struct {
+		Format        int    `json:"format"`
+		SchemaVersion int    `json:"schema_version"`
+		Created       int64  `json:"created"`
+		Keys          int    `json:"keys"`
+		Objects       int    `json:"objects"`
+		Salt          string `json:"salt"`
+
+		// Check is backupCheck encrypted with the passphrase, a wrong passphrase is
+		// detected before anything is restored even when the backup has no secrets
+		Check string `json:"check"`
+	}
+
+	// RestoreReport describes a restored backup
+	RestoreReport struct {
+		SchemaVersion int              `json:"schema_version"`
+		Keys          int              `json:"keys"`
+		Unchanged     int              `json:"unchanged"`
+		Objects       int              `json:"objects"`
+		Migration     *MigrationReport `json:"migration,omitempty"`
+	}
+
+	// backupCipher encrypts the secrets of a backup
+	backupCipher struct {
+		aead cipher.AEAD
+	}
+)
+
+func newBackupCipher(passphrase string, salt []byte) (*backupCipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is required to encrypt the backup's secrets")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, keyIterations, keyLength, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &backupCipher{aead}, nil
+}
+
+func (c *backupCipher) encrypt(value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *backupCipher) decrypt(value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrBackupPassphrase
+	}
+
+	size := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", ErrBackupPassphrase
+	}
+	return string(plain), nil
+}
+
+// decryptEncrypted decrypts the values that were encrypted, the secrets a backup of
+// format 1 has in plain text are kept
+func (c *backupCipher) decryptEncrypted(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	return c.decrypt(value)
+}
+
+// isSecretKey checks if the key holds a secret by itself, the deploy key or the hook
+// secret of a pipeline stored with a key per field, the headers of a webhook delivery
+// stored with a key per field or the access token of a user
+func isSecretKey(key string) bool {
+	if strings.HasPrefix(key, pipelineNamespace) {
+		return strings.HasSuffix(key, "/keys/private") ||
+			strings.HasSuffix(key, "/hook-secret") ||
+			(strings.Contains(key, "/hooks/") && strings.HasSuffix(key, "/headers"))
+	}
+	return strings.HasPrefix(key, userNamespace) && strings.HasSuffix(key, "/token")
+}
+
+// isPipelineDocument checks if the key is the document of a pipeline, its deploy key
+// and hook secret are secrets
+func isPipelineDocument(key string) bool {
+	return strings.HasPrefix(key, pipelineNamespace) &&
+		strings.HasSuffix(key, documentKey) &&
+		!strings.Contains(strings.TrimPrefix(key, pipelineNamespace), "/builds/") &&
+		!isDeliveryDocument(key)
+}
+
+// isDeliveryDocument checks if the key is the document of a webhook delivery, its
+// headers are a secret
+func isDeliveryDocument(key string) bool {
+	return strings.HasPrefix(key, pipelineNamespace) &&
+		strings.HasSuffix(key, documentKey) &&
+		strings.Contains(strings.TrimPrefix(key, pipelineNamespace), "/hooks/")
+}
+
+// transformSecrets replaces the secrets of an entry with the result of transform
+func transformSecrets(entry *kv.Entry, transform func(string) (string, error)) error {
+	if entry.Dir || entry.Value == "" {
+		return nil
+	}
+
+	if isSecretKey(entry.Key) {
+		value, err := transform(entry.Value)
+		if err != nil {
+			return err
+		}
+		entry.Value = value
+		return nil
+	}
+
+	if isDeliveryDocument(entry.Key) {
+		return transformHeaders(entry, transform)
+	}
+	if !isPipelineDocument(entry.Key) {
+		return nil
+	}
+
+	// only the deploy key and the hook secret are changed, the other fields are kept as they are
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(entry.Value), &doc); err != nil {
+		return err
+	}
+	changed := false
+
+	keys := Key{}
+	if raw, exists := doc["keys"]; exists && json.Unmarshal(raw, &keys) == nil && keys.Private != "" {
+		private, err := transform(keys.Private)
+		if err != nil {
+			return err
+		}
+		keys.Private = private
+		if doc["keys"], err = json.Marshal(keys); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	hookSecret := ""
+	if raw, exists := doc["hook_secret"]; exists && json.Unmarshal(raw, &hookSecret) == nil && hookSecret != "" {
+		secret, err := transform(hookSecret)
+		if err != nil {
+			return err
+		}
+		if doc["hook_secret"], err = json.Marshal(secret); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	entry.Value = string(value)
+	return nil
+}
+
+// transformHeaders replaces the headers of a delivery document with the result of
+// transform, the headers are a string once encrypted and an object once decrypted
+func transformHeaders(entry *kv.Entry, transform func(string) (string, error)) error {
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(entry.Value), &doc); err != nil {
+		return err
+	}
+	raw, exists := doc["headers"]
+	if !exists || string(raw) == "null" {
+		return nil
+	}
+
+	encrypted := ""
+	if json.Unmarshal(raw, &encrypted) == nil {
+		headers, err := transform(encrypted)
+		if err != nil {
+			return err
+		}
+		doc["headers"] = json.RawMessage(headers)
+	} else {
+		headers, err := transform(string(raw))
+		if err != nil || headers == string(raw) {
+			return err
+		}
+		if doc["headers"], err = json.Marshal(headers); err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	entry.Value = string(value)
+	return nil
+}
+
+// WriteBackup writes a backup of the store, with the logs and artifacts when withObjects
+// is set. The secrets are encrypted with the passphrase.
+func WriteBackup(w io.Writer, passphrase string, withObjects bool, kvClient kv.KVClient, objectStore mc.ObjectStore) (*BackupManifest, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	c, err := newBackupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := SchemaVersion(kvClient)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := kv.Dump(kvClient, appNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := transformSecrets(entry, c.encrypt); err != nil {
+			return nil, fmt.Errorf("unable to encrypt %s: %s", entry.Key, err)
+		}
+	}
+
+	objects := []string{}
+	if withObjects {
+		all, err := objectStore.ListObjects("kontinuous", "")
+		if err != nil {
+			return nil, err
+		}
+		// backups taken before migrating are not restored
+		for _, object := range all {
+			if !strings.HasPrefix(object, backupPrefix) {
+				objects = append(objects, object)
+			}
+		}
+	}
+
+	check, err := c.encrypt(backupCheck)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{
+		Format:        backupFormat,
+		SchemaVersion: version,
+		Created:       time.Now().UnixNano(),
+		Keys:          len(entries),
+		Objects:       len(objects),
+		Salt:          base64.StdEncoding.EncodeToString(salt),
+		Check:         check,
+	}
+
+	zw := gzip.NewWriter(w)
+	archive := tar.NewWriter(zw)
+
+	if err := writeJSONFile(archive, backupManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(archive, backupKeysFile, entries); err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if err := writeBackupObject(archive, object, objectStore); err != nil {
+			return nil, fmt.Errorf("unable to back up %s: %s", object, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, zw.Close()
+}
+
+func writeJSONFile(archive *tar.Writer, name string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = archive.Write(content)
+	return err
+}
+
+// writeBackupObject adds an object to the archive, it is copied to a file first to know its size
+func writeBackupObject(archive *tar.Writer, object string, objectStore mc.ObjectStore) error {
+	tmpfile, err := ioutil.TempFile("", "backup-")
+	if err != nil {
+		return err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	if err := objectStore.CopyLocally("kontinuous", object, tmpfile.Name()); err != nil {
+		return err
+	}
+
+	file, err := os.Open(tmpfile.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    backupObjectsDir + object,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// RestoreBackup restores a backup written by WriteBackup and runs the migrations of
+// the restored keys when the backup is from an older version. Keys that already have
+// the value of the backup are not written again, restoring twice is the same as once.
+func RestoreBackup(r io.Reader, passphrase string, kvClient kv.KVClient, objectStore mc.ObjectStore) (*RestoreReport, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrBackupFormat
+	}
+	archive := tar.NewReader(zr)
+
+	// the manifest and the keys come first, the keys are only written once all of
+	// them are decrypted
+	manifest := new(BackupManifest)
+	if err := readJSONFile(archive, backupManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format < 1 || manifest.Format > backupFormat {
+		return nil, ErrBackupFormat
+	}
+	if manifest.SchemaVersion > LatestSchemaVersion() {
+		return nil, ErrSchemaTooNew
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(manifest.Salt)
+	if err != nil {
+		return nil, ErrBackupFormat
+	}
+	c, err := newBackupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := c.decrypt(manifest.Check); err != nil || check != backupCheck {
+		return nil, ErrBackupPassphrase
+	}
+
+	entries := []*kv.Entry{}
+	if err := readJSONFile(archive, backupKeysFile, &entries); err != nil {
+		return nil, err
+	}
+	decrypt := c.decrypt
+	if manifest.Format < 2 {
+		decrypt = c.decryptEncrypted
+	}
+	for _, entry := range entries {
+		if err := transformSecrets(entry, decrypt); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &RestoreReport{SchemaVersion: manifest.SchemaVersion}
+	changed := []*kv.Entry{}
+	for _, entry := range entries {
+		if restored(entry, kvClient) {
+			report.Unchanged++
+			continue
+		}
+		changed = append(changed, entry)
+	}
+	if err := kv.Restore(kvClient, changed); err != nil {
+		return report, err
+	}
+	report.Keys = len(changed)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if !strings.HasPrefix(header.Name, backupObjectsDir) {
+			continue
+		}
+
+		object := backupObjectName(strings.TrimPrefix(header.Name, backupObjectsDir))
+		if err := objectStore.PutObject("kontinuous", object, archive); err != nil {
+			return report, fmt.Errorf("unable to restore %s: %s", object, err)
+		}
+		report.Objects++
+	}
+
+	// the keys are at the backup's schema whatever version the store was at
+	if err := restoreSchemaVersion(manifest.SchemaVersion, kvClient); err != nil {
+		return report, err
+	}
+	pending, err := PendingMigrations(kvClient)
+	if err != nil {
+		return report, err
+	}
+	if len(pending) > 0 {
+		if report.Migration, err = Migrate(kvClient, objectStore, false); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// restored checks if the entry already has its value in the store
+func restored(entry *kv.Entry, kvClient kv.KVClient) bool {
+	if entry.Dir {
+		_, err := kvClient.GetDir(entry.Key)
+		return err == nil
+	}
+	value, err := kvClient.Get(entry.Key)
+	return err == nil && value == entry.Value
+}
+
+func readJSONFile(archive *tar.Reader, name string, v interface{}) error {
+	header, err := archive.Next()
+	if err != nil || header.Name != name {
+		return ErrBackupFormat
+	}
+
+	var content bytes.Buffer
+	if _, err := io.Copy(&content, archive); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content.Bytes(), v); err != nil {
+		return ErrBackupFormat
+	}
+	return nil
+}
+
+// backupObjectName keeps the restored objects in the bucket
+func backupObjectName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -9,13 +9,13 @@ import (
 	"strings"
 	"text/template"
 
-	etcd "github.com/coreos/etcd/client"
-
-	"github.com/AcalephStorage/kontinuous/kube"
 	"github.com/AcalephStorage/kontinuous/notif"
+	"github.com/AcalephStorage/kontinuous/registry"
+	"github.com/AcalephStorage/kontinuous/scm"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 	"github.com/AcalephStorage/kontinuous/store/mc"
 	"github.com/Masterminds/sprig"
+	"github.com/Sirupsen/logrus"
 )
 
 // Build contains the details needed to run a build
@@ -32,8 +32,26 @@ type Build struct {
 	Author       string   `json:"author"`
 	Event        string   `json:"event"`
 	CloneURL     string   `json:"clone_url"`
+	PullRequest  int      `json:"pull_request,omitempty"`
+	BaseBranch   string   `json:"base_branch,omitempty"`
+	HeadRepo     string   `json:"head_repo,omitempty"`
+	Ref          string   `json:"ref,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	Untrusted    bool     `json:"untrusted,omitempty"`
+	Message      string   `json:"message,omitempty"`
+	Environment  string   `json:"environment,omitempty"`
+	DeploymentID int      `json:"deployment_id,omitempty"`
 	Pipeline     string   `json:"-"`
 	Stages       []*Stage `json:"stages,omitempty"`
+
+	// Token authenticates the agent when it stores and reads the build's objects
+	Token string `json:"-"`
+
+	// Params are set by `[kontinuous key=value]` directives in the commit message
+	Params map[string]interface{} `json:"params,omitempty"`
+
+	// ResourceVersion is incremented when the build is saved, its stages have their own
+	ResourceVersion int `json:"resource_version"`
 }
 
 // BuildSummary contains the summarized details of a build
@@ -47,147 +65,212 @@ type BuildSummary struct {
 	Branch   string `json:"branch"`
 	Commit   string `json:"commit"`
 	Author   string `json:"author"`
+	Event    string `json:"event,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Message  string `json:"message,omitempty"`
 }
 
-func getBuild(path string, kvClient kv.KVClient) *Build {
-	b := new(Build)
-	b.ID, _ = kvClient.Get(path + "/uuid")
-	b.Status, _ = kvClient.Get(path + "/status")
-	b.Branch, _ = kvClient.Get(path + "/branch")
-	b.Commit, _ = kvClient.Get(path + "/commit")
-	b.Author, _ = kvClient.Get(path + "/author")
-	b.Event, _ = kvClient.Get(path + "/event")
-	b.CloneURL, _ = kvClient.Get(path + "/clone-url")
-	b.Pipeline, _ = kvClient.Get(path + "/pipeline")
-	b.Number, _ = kvClient.GetInt(path + "/number")
-	b.CurrentStage, _ = kvClient.GetInt(path + "/current-stage")
-	created, _ := kvClient.Get(path + "/created")
-	started, _ := kvClient.Get(path + "/started")
-	finished, _ := kvClient.Get(path + "/finished")
-	b.Created, _ = strconv.ParseInt(created, 10, 64)
-	b.Started, _ = strconv.ParseInt(started, 10, 64)
-	b.Finished, _ = strconv.ParseInt(finished, 10, 64)
-	b.GetStages(kvClient)
-
-	return b
+// getBuild reads a build, builds stored with a key per field are read from their fields
+func getBuild(path string, kvClient kv.KVClient) (*Build, bool) {
+	b, _, err := readBuild(path, kvClient)
+	if err != nil {
+		return nil, false
+	}
+	if b != nil {
+		return b, true
+	}
+
+	if _, err := kvClient.GetDir(path); err == nil {
+		return getLegacyBuild(path, kvClient), true
+	}
+
+	// the keys of a build are removed while it is migrated, its document is in the lock
+	m, _, err := readBuildMigration(path, kvClient)
+	if err != nil || m == nil || m.Document == "" {
+		return nil, false
+	}
+	b, err = decodeBuild([]byte(m.Document))
+	return b, err == nil
 }
 
-func getBuildSummary(path string, kvClient kv.KVClient) *BuildSummary {
-	b := new(BuildSummary)
-	b.ID, _ = kvClient.Get(path + "/uuid")
-	b.Status, _ = kvClient.Get(path + "/status")
-	b.Branch, _ = kvClient.Get(path + "/branch")
-	b.Commit, _ = kvClient.Get(path + "/commit")
-	b.Author, _ = kvClient.Get(path + "/author")
-	b.Number, _ = kvClient.GetInt(path + "/number")
-	created, _ := kvClient.Get(path + "/created")
-	started, _ := kvClient.Get(path + "/started")
-	finished, _ := kvClient.Get(path + "/finished")
-	b.Created, _ = strconv.ParseInt(created, 10, 64)
-	b.Started, _ = strconv.ParseInt(started, 10, 64)
-	b.Finished, _ = strconv.ParseInt(finished, 10, 64)
-
-	return b
+func getBuildSummary(path string, kvClient kv.KVClient) (*BuildSummary, bool) {
+	value, err := readDocument(path, kvClient)
+	if err != nil {
+		return nil, false
+	}
+	if value != "" {
+		b := new(BuildSummary)
+		if err := json.Unmarshal([]byte(value), b); err != nil {
+			return nil, false
+		}
+		return b, true
+	}
+
+	if _, err := kvClient.GetDir(path); err != nil {
+		return nil, false
+	}
+	return getLegacyBuildSummary(path, kvClient), true
 }
 
-func (b *Build) Delete(pipelinesID string, kvClient kv.KVClient, mcClient *mc.MinioClient) (err error) {
-	path := fmt.Sprintf("%s%s/builds/%d", pipelineNamespace, b.Pipeline, b.Number)
-	buildsPrefix := fmt.Sprintf("pipelines/%s/builds/%d", pipelinesID, b.Number)
-	bucket := "kontinuous"
+// listedBuild decodes a build listed from the builds directory. Builds stored with a
+// key per field are listed as directories without a value and are read from their fields.
+func listedBuild(pair *kv.KVPair, kvClient kv.KVClient) *Build {
+	if len(pair.Value) != 0 {
+		if b, err := decodeBuild(pair.Value); err == nil {
+			return b
+		}
+	}
+	return getLegacyBuild(pair.Key, kvClient)
+}
 
-	//remove build info from etcd
-	if err := kvClient.DeleteTree(path); err != nil {
-		return err
+func listedBuildSummary(pair *kv.KVPair, kvClient kv.KVClient) *BuildSummary {
+	if len(pair.Value) != 0 {
+		b := new(BuildSummary)
+		if err := json.Unmarshal(pair.Value, b); err == nil {
+			return b
+		}
 	}
+	return getLegacyBuildSummary(pair.Key, kvClient)
+}
+
+// Delete removes the build with its logs, artifacts and the image it pushed to the
+// internal registry. The build is removed from the store last, a failed delete can be
+// done again and the janitor deletes the builds outside the retention policy again
+// until their image is deleted.
+func (b *Build) Delete(pipelinesID string, kvClient kv.KVClient, mcClient mc.ObjectStore) (err error) {
+	buildsPrefix := fmt.Sprintf("pipelines/%s/builds/%d/", pipelinesID, b.Number)
+	bucket := "kontinuous"
 
 	//remove build {num} artifacts and logs from minio storage
 	if err := mcClient.DeleteTree(bucket, buildsPrefix); err != nil {
 		return err
 	}
-	return nil
-}
 
-// Save persists the build details to `etcd`
-func (b *Build) Save(kvClient kv.KVClient) (err error) {
-	buildsPrefix := fmt.Sprintf("%s%s/builds", pipelineNamespace, b.Pipeline)
-	path := fmt.Sprintf("%s/%d", buildsPrefix, b.Number)
-	isNew := false
-
-	_, err = kvClient.GetDir(path)
-	if err != nil || etcd.IsKeyNotFound(err) {
-		isNew = true
+	// images are left in registries that don't allow deletes
+	if registryClient, err := NewRegistryClient(); err == nil {
+		image := buildImage(pipelinesID, strconv.Itoa(b.Number))
+		if err := registryClient.DeleteImage(image, b.Commit); err != nil {
+			if err != registry.ErrDeleteDisabled {
+				return fmt.Errorf("unable to delete image %s:%s: %s", image, b.Commit, err)
+			}
+			logrus.WithError(err).Warnf("Keeping image %s:%s", image, b.Commit)
+		}
 	}
 
-	// strings
-	if err := kvClient.Put(path+"/uuid", b.ID); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/status", b.Status); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/branch", b.Branch); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/commit", b.Commit); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/author", b.Author); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/event", b.Event); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/clone-url", b.CloneURL); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/pipeline", b.Pipeline); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	//remove build info from etcd, the index entries of the build as it is stored now
+	path := b.path()
+	if stored, _, err := readBuild(path, kvClient); err == nil && stored != nil {
+		b = stored
 	}
-	// int as string
-	if err := kvClient.Put(path+"/created", strconv.FormatInt(b.Created, 10)); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err := kvClient.Put(path+"/started", strconv.FormatInt(b.Started, 10)); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	if err := kvClient.DeleteTree(path); err != nil {
+		return err
 	}
-	if err := kvClient.Put(path+"/finished", strconv.FormatInt(b.Finished, 10)); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	return unindexBuild(path, b, kvClient)
+}
+
+// Save persists the build details to `etcd`, stages of new builds are saved with the
+// build and later with Stage.Save. Returns ErrConflict when the build was saved by
+// someone else since it was read.
+func (b *Build) Save(kvClient kv.KVClient) error {
+	saved, err := updateBuild(b.path(), kvClient, func(stored *Build) (*Build, error) {
+		next := *b
+		if stored == nil {
+			b.prepareStages(kvClient)
+		} else {
+			if stored.ResourceVersion != b.ResourceVersion {
+				return nil, ErrConflict
+			}
+			next.Stages = stored.Stages
+			next.Token = stored.Token
+		}
+
+		next.ResourceVersion++
+		return &next, nil
+	})
+	if saved != nil {
+		b.ResourceVersion = saved.ResourceVersion
+		b.Stages = saved.Stages
 	}
-	// integers
-	if err := kvClient.PutInt(path+"/number", b.Number); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	return err
+}
+
+func (b *Build) path() string {
+	return fmt.Sprintf("%s%s/builds/%d", pipelineNamespace, b.Pipeline, b.Number)
+}
+
+// NextJobInfo returns the details needed to create the job of a build stage
+func (b *Build) NextJobInfo(stageIndex int) *NextJobInfo {
+	return &NextJobInfo{
+		Commit:       b.Commit,
+		BuildNumber:  b.Number,
+		StageIndex:   stageIndex,
+		Branch:       b.Branch,
+		Ref:          b.Ref,
+		PullRequest:  b.PullRequest,
+		BaseBranch:   b.BaseBranch,
+		Tag:          b.Tag,
+		Untrusted:    b.Untrusted,
+		Params:       b.Params,
+		Environment:  b.Environment,
+		DeploymentID: b.DeploymentID,
+		Token:        b.Token,
 	}
-	if err := kvClient.PutInt(path+"/current-stage", b.CurrentStage); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+}
+
+// IsFork checks if the build is for a pull request coming from another repository
+func (b *Build) IsFork(p *Pipeline) bool {
+	return p.isFork(b.PullRequest, b.HeadRepo)
+}
+
+// Approve lets a build held for approval continue with the pipeline's secrets
+func (b *Build) Approve(kvClient kv.KVClient) error {
+	if b.Status != BuildPendingApproval {
+		return fmt.Errorf("Build %d is not pending approval.", b.Number)
 	}
-	// save stages
-	if isNew {
-		if err := b.CreateStages(kvClient); err != nil {
-			return handleSaveError(path, isNew, err, kvClient)
-		}
+
+	b.Untrusted = false
+	b.Status = BuildPending
+	return b.Save(kvClient)
+}
+
+// RevokeApproval makes an approved build wait for approval again, for builds whose
+// first stage could not be started
+func (b *Build) RevokeApproval(kvClient kv.KVClient) error {
+	if b.Status != BuildPending {
+		return fmt.Errorf("Build %d is not pending.", b.Number)
 	}
 
-	return nil
+	b.Untrusted = true
+	b.Status = BuildPendingApproval
+	return b.Save(kvClient)
 }
 
 // CreateStages perists the build's stage details
-func (b *Build) CreateStages(kvClient kv.KVClient) (err error) {
-	buildsPrefix := fmt.Sprintf("%s%s/builds", pipelineNamespace, b.Pipeline)
-	stagesPrefix := fmt.Sprintf("%s/%d/stages", buildsPrefix, b.Number)
+func (b *Build) CreateStages(kvClient kv.KVClient) error {
+	b.prepareStages(kvClient)
+
+	_, err := updateBuild(b.path(), kvClient, func(stored *Build) (*Build, error) {
+		if stored == nil {
+			return nil, fmt.Errorf("Build %d not found.", b.Number)
+		}
+		stored.Stages = b.Stages
+		return stored, nil
+	})
+	return err
+}
+
+// prepareStages sets up the stages of a new build with the pipeline's vars
+func (b *Build) prepareStages(kvClient kv.KVClient) {
 	p := getPipeline(fmt.Sprintf("%s%s", pipelineNamespace, b.Pipeline), kvClient)
 
 	for idx, stage := range b.Stages {
 		stage.Status = BuildPending
 		stage.Index = idx + 1
 		stage.ID = generateUUID()
+		stage.ResourceVersion = 1
 
 		parseStageTemplate(stage, p.Vars, stage.Vars)
-		if err := stage.Save(stagesPrefix, kvClient); err != nil {
-			return err
-		}
 	}
-
-	return nil
 }
 
 func parseStageTemplate(stage *Stage, varMaps ...map[string]interface{}) error {
@@ -217,39 +300,53 @@ func parseStageTemplate(stage *Stage, varMaps ...map[string]interface{}) error {
 
 // GetStages fetches all stages of the build from the store
 func (b *Build) GetStages(kvClient kv.KVClient) ([]*Stage, error) {
-	stagesPrefix := fmt.Sprintf("%s%s/builds/%d/stages", pipelineNamespace, b.Pipeline, b.Number)
-	stageDirs, err := kvClient.GetDir(stagesPrefix)
-	if err != nil {
-		if etcd.IsKeyNotFound(err) {
-			return make([]*Stage, 0), nil
-		}
-		return nil, err
+	stored, exists := getBuild(b.path(), kvClient)
+	if !exists {
+		return make([]*Stage, 0), nil
 	}
 
-	b.Stages = make([]*Stage, len(stageDirs))
-	for i, pair := range stageDirs {
-		b.Stages[i] = getStage(pair.Key, kvClient)
+	b.Stages = stored.Stages
+	if b.Stages == nil {
+		b.Stages = make([]*Stage, 0)
 	}
-
 	return b.Stages, nil
 }
 
 // GetStage fetches a specific stage by its index
 func (b *Build) GetStage(idx int, kvClient kv.KVClient) (*Stage, bool) {
-	path := fmt.Sprintf("%s%s/builds/%d/stages/%d", pipelineNamespace, b.Pipeline, b.Number, idx)
-	_, err := kvClient.GetDir(path)
-	if err != nil || etcd.IsKeyNotFound(err) {
+	stored, _, err := readBuild(b.path(), kvClient)
+	if err != nil {
 		return nil, false
 	}
 
-	return getStage(path, kvClient), true
+	if stored == nil {
+		path := fmt.Sprintf("%s/stages/%d", b.path(), idx)
+		if _, err := kvClient.GetDir(path); err != nil {
+			return nil, false
+		}
+		return getLegacyStage(path, kvClient), true
+	}
+
+	for _, stage := range stored.Stages {
+		if stage.Index == idx {
+			return stage, true
+		}
+	}
+	return nil, false
 }
 
-func (b *Build) Notify(kvClient kv.KVClient) error {
+func (b *Build) Notify(kvClient kv.KVClient, c scm.Client) error {
 	stageStatus := b.getStatus(kvClient)
 	p := getPipeline(fmt.Sprintf("%s%s", pipelineNamespace, b.Pipeline), kvClient)
 	var appNotifier notif.AppNotifier
 
+	// a failed comment doesn't keep the other notifiers from running
+	if b.PullRequest != 0 {
+		if err := b.commentSummary(p, kvClient, c); err != nil {
+			logrus.WithError(err).Warnf("Unable to comment on pull request #%d of %s", b.PullRequest, b.Pipeline)
+		}
+	}
+
 	//TODO: will add more notification engines
 
 	for _, notifier := range p.Notifiers {
@@ -278,14 +375,15 @@ func (b *Build) Notify(kvClient kv.KVClient) error {
 func (b *Build) getSecrets(pipelineSecrets []string, namespace string, metadata map[string]interface{}) map[string]interface{} {
 	secrets := make(map[string]string)
 
-	for _, secretName := range pipelineSecrets {
-		kubeClient, _ := kube.NewClient("https://kubernetes.default")
-		secretEnv, err := kubeClient.GetSecret(namespace, secretName)
-		if err != nil {
-			continue
-		}
-		for key, value := range secretEnv {
-			secrets[key] = strings.TrimSpace(value)
+	if kubeClient, err := NewKubeClient(); err == nil {
+		for _, secretName := range pipelineSecrets {
+			secretEnv, err := kubeClient.GetSecret(namespace, secretName)
+			if err != nil {
+				continue
+			}
+			for key, value := range secretEnv {
+				secrets[key] = strings.TrimSpace(value)
+			}
 		}
 	}
 
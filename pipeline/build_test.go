@@ -1,7 +1,10 @@
 package pipeline
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetStages(t *testing.T) {
@@ -44,3 +47,40 @@ func TestGetNonExistentStage(t *testing.T) {
 		t.Errorf("Not expecting a stage but got one")
 	}
 }
+
+func TestBuildSummary(t *testing.T) {
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	b := &Build{Number: 3, Status: BuildFailure, Commit: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"}
+	stages := []*Stage{
+		{Index: 1, Name: "build", Status: BuildSuccess, Started: 1, Finished: int64(2 * time.Second)},
+		{Index: 2, Name: "test", Status: BuildFailure, Failures: 4, Artifacts: []string{"reports/junit.xml"}},
+	}
+
+	summary := buildSummary(p, b, stages)
+
+	for _, expected := range []string{"#3", "0d1a26e", "| test | :x: FAIL | - | 4 |", "/stages/2/logs", "`junit.xml`"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected summary to contain `%s`, got:\n%s", expected, summary)
+		}
+	}
+}
+
+type failingCommentClient struct {
+	MockSCMClient
+}
+
+func (c failingCommentClient) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	return 0, errors.New("Resource not accessible by integration")
+}
+
+func TestNotifyWithFailedComment(t *testing.T) {
+	kvc := setupStoreWithSampleStage()
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	b, _ := p.GetBuild(1, kvc)
+	b.PullRequest = 7
+
+	if err := b.Notify(kvc, failingCommentClient{}); err != nil {
+		t.Errorf("Expected the failed comment not to fail the notifications, got `%s`", err)
+	}
+}
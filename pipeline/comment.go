@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+var statusIcons = map[string]string{
+	BuildSuccess: ":white_check_mark:",
+	BuildFailure: ":x:",
+	BuildRunning: ":hourglass:",
+	BuildWaiting: ":pause_button:",
+	BuildPending: ":clock3:",
+}
+
+// commentSummary posts the build's results on its pull request.
+// Each pull request has a single comment that is edited by later builds.
+func (b *Build) commentSummary(p *Pipeline, kvClient kv.KVClient, c scm.Client) error {
+	stages, err := b.GetStages(kvClient)
+	if err != nil {
+		return err
+	}
+
+	body := buildSummary(p, b, stages)
+	path := fmt.Sprintf("%s%s/pull-requests/%d/comment", pipelineNamespace, b.Pipeline, b.PullRequest)
+
+	// the comment is recreated when it can't be edited, eg. it was deleted
+	if id, err := kvClient.GetInt(path); err == nil && id != 0 {
+		if err := c.UpdateComment(p.Owner, p.Repo, b.PullRequest, id, body); err == nil {
+			return nil
+		}
+	}
+
+	id, err := c.CreateComment(p.Owner, p.Repo, b.PullRequest, body)
+	if err != nil {
+		return err
+	}
+	return kvClient.PutInt(path, id)
+}
+
+// buildSummary describes the stages of a build in Markdown
+func buildSummary(p *Pipeline, b *Build, stages []*Stage) string {
+	url := fmt.Sprintf("%s/api/v1/pipelines/%s/%s/builds/%d", os.Getenv("KONTINUOUS_URL"), p.Owner, p.Repo, b.Number)
+	lines := []string{
+		fmt.Sprintf("%s **Kontinuous build [#%d](%s) %s** for %s", statusIcon(b.Status), b.Number, url, b.Status, shortCommit(b.Commit)),
+		"",
+		"| Stage | Status | Duration | Failures | Logs |",
+		"| --- | --- | --- | --- | --- |",
+	}
+
+	var artifacts []string
+	for _, s := range stages {
+		duration := "-"
+		if s.Started != 0 && s.Finished != 0 {
+			duration = time.Duration(s.Finished - s.Started).String()
+		}
+		failures := "-"
+		if s.Failures > 0 {
+			failures = fmt.Sprintf("%d", s.Failures)
+		}
+		logs := fmt.Sprintf("[logs](%s/stages/%d/logs)", url, s.Index)
+
+		lines = append(lines, fmt.Sprintf("| %s | %s %s | %s | %s | %s |", s.Name, statusIcon(s.Status), s.Status, duration, failures, logs))
+
+		for _, artifact := range s.Artifacts {
+			artifacts = append(artifacts, artifactLink(p, b, artifact))
+		}
+	}
+
+	if len(artifacts) > 0 {
+		lines = append(lines, "", "**Artifacts:** "+strings.Join(artifacts, ", "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// artifactLink points to the artifact stored by the agent, if the store's address is known
+func artifactLink(p *Pipeline, b *Build, artifact string) string {
+	name := filepath.Base(artifact)
+	if os.Getenv("S3_URL") == "" {
+		return fmt.Sprintf("`%s`", name)
+	}
+	return fmt.Sprintf("[%s](%s/kontinuous/pipelines/%s/builds/%d/artifacts/%s)",
+		name, strings.TrimSuffix(os.Getenv("S3_URL"), "/"), p.ID, b.Number, name)
+}
+
+func statusIcon(status string) string {
+	if icon, ok := statusIcons[status]; ok {
+		return icon
+	}
+	return ":grey_question:"
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -1,8 +1,16 @@
 package pipeline
 
 import (
-	"github.com/AcalephStorage/kontinuous/store/kv"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+
+	etcd "github.com/coreos/etcd/client"
 	"github.com/satori/go.uuid"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
 )
 
 func generateUUID() string {
@@ -10,19 +18,60 @@ func generateUUID() string {
 	return uuid.NewV4().String()
 }
 
-func generateSequentialID(namespace string, kvClient kv.KVClient) int {
-	dirs, err := kvClient.GetDir(namespace)
-	if err != nil {
-		return 1
+// generateToken returns a random secret shared with the SCM or a build's agent
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(token), nil
+}
 
-	return len(dirs) + 1
+// maxCounterAttempts bounds the retries of a counter changed by concurrent requests
+const maxCounterAttempts = 100
+
+// nextSequentialID increments the counter with a compare and swap so concurrent
+// requests never get the same ID. A missing counter starts from the highest ID
+// under namespace, IDs of removed entries are not reused.
+func nextSequentialID(counter, namespace string, kvClient kv.KVClient) (int, error) {
+	for attempt := 0; attempt < maxCounterAttempts; attempt++ {
+		current, err := kvClient.Get(counter)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return 0, err
+		}
+
+		var id int
+		if current == "" {
+			id = highestID(namespace, kvClient)
+		} else if id, err = strconv.Atoi(current); err != nil {
+			return 0, err
+		}
+
+		err = kvClient.CompareAndSwap(counter, current, strconv.Itoa(id+1))
+		switch err {
+		case nil:
+			return id + 1, nil
+		case kv.ErrCompareFailed:
+			continue
+		default:
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("Unable to increment %s, too many concurrent updates", counter)
 }
 
-func handleSaveError(namespace string, isNew bool, err error, kvClient kv.KVClient) error {
-	if isNew {
-		kvClient.DeleteTree(namespace)
+// highestID returns the highest numeric child of namespace
+func highestID(namespace string, kvClient kv.KVClient) int {
+	dirs, err := kvClient.GetDir(namespace)
+	if err != nil {
+		return 0
 	}
 
-	return err
+	highest := 0
+	for _, dir := range dirs {
+		if id, err := strconv.Atoi(path.Base(dir.Key)); err == nil && id > highest {
+			highest = id
+		}
+	}
+	return highest
 }
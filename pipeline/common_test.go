@@ -147,6 +147,7 @@ func (s MockSCMClient) GetRepository(owner, name string) (*scm.Repository, bool)
 		ID:          1,
 		Owner:       owner,
 		Name:        name,
+		CloneURL:    "https://scm.example.com/" + owner + "/" + name + ".git",
 		Permissions: map[string]bool{"admin": true},
 	}
 	return repo, true
@@ -205,6 +206,22 @@ func (kv *MockKVClient) DeleteTree(key string) error {
 	return nil
 }
 
+func (kvc *MockKVClient) CompareAndSwap(key, prevValue, value string) error {
+	if kvc.data[key] != prevValue {
+		return kv.ErrCompareFailed
+	}
+	return kvc.Put(key, value)
+}
+
+func (kvc *MockKVClient) Watch(prefix string, stop <-chan struct{}) (<-chan *kv.Event, error) {
+	events := make(chan *kv.Event)
+	go func() {
+		<-stop
+		close(events)
+	}()
+	return events, nil
+}
+
 func (s MockSCMClient) SetAccessToken(string) {}
 
 func (s MockSCMClient) Name() string {
@@ -215,11 +232,23 @@ func (s MockSCMClient) HookExists(owner, repo, url string) bool {
 	return true
 }
 
-func (s MockSCMClient) CreateHook(owner, repo, callback string, events []string) error {
+func (s MockSCMClient) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	return "1", nil
+}
+
+func (s MockSCMClient) DeleteHook(owner, repo, callback string) error {
 	return nil
 }
 
-func (s MockSCMClient) CreateKey(owner, repo, key, title string) error {
+func (s MockSCMClient) DeleteHookByID(owner, repo, id string) error {
+	return nil
+}
+
+func (s MockSCMClient) CreateKey(owner, repo, key, title string) (int, error) {
+	return 1, nil
+}
+
+func (s MockSCMClient) DeleteKey(owner, repo string, id int) error {
 	return nil
 }
 
@@ -275,3 +304,9 @@ func (s MockSCMClient) CreateBranch(owner, repo, branchName, baseRef string) (st
 func (s MockSCMClient) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
 	return nil
 }
+func (s MockSCMClient) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	return 1, nil
+}
+func (s MockSCMClient) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	return nil
+}
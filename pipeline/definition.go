@@ -42,6 +42,22 @@ type DefinitionFile struct {
 	SHA     *string `json:"sha"`
 }
 
+// DeployStages keeps only the deploy stages of an environment, for builds of deployment events.
+// Stages without an environment deploy to any environment.
+func (d *Definition) DeployStages(environment string) {
+	stages := []Stage{}
+	for _, stage := range d.Spec.Template.Stages {
+		if stage.Type != "deploy" {
+			continue
+		}
+		if env, ok := stage.Params["environment"]; ok && environment != "" && fmt.Sprintf("%v", env) != environment {
+			continue
+		}
+		stages = append(stages, stage)
+	}
+	d.Spec.Template.Stages = stages
+}
+
 func (d *Definition) GetStages() []*Stage {
 	stages := make([]*Stage, len(d.Spec.Template.Stages))
 
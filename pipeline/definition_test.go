@@ -38,3 +38,20 @@ func TestReadEmptyPipeline(t *testing.T) {
 		t.Fatalf("Pipeline Parser must return error on empty yaml file")
 	}
 }
+
+func TestDeployStages(t *testing.T) {
+	definition := &Definition{}
+	definition.Spec.Template.Stages = []Stage{
+		{Name: "build", Type: "docker_build"},
+		{Name: "staging", Type: "deploy", Params: map[string]interface{}{"environment": "staging"}},
+		{Name: "production", Type: "deploy", Params: map[string]interface{}{"environment": "production"}},
+		{Name: "docs", Type: "deploy"},
+	}
+
+	definition.DeployStages("production")
+	stages := definition.GetStages()
+
+	if len(stages) != 2 || stages[0].Name != "production" || stages[1].Name != "docs" {
+		t.Errorf("Expected production and docs deploy stages, got %d stages", len(stages))
+	}
+}
@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"encoding/json"
+	"net/http"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// Delivery results
+const (
+	DeliveryReceived = "received"
+	DeliveryBuilt    = "built"
+	DeliveryIgnored  = "ignored"
+	DeliveryFailed   = "failed"
+)
+
+// headers sent by the remotes to identify a webhook delivery, retries keep the same ID
+var deliveryHeaders = []string{
+	"X-Github-Delivery",
+	"X-Gitlab-Event-Uuid",
+	"X-Request-Uuid",
+	"X-Request-Id",
+}
+
+// headers with credentials or the webhook secret, these are never stored
+var secretHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Gitlab-Token",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+}
+
+var validDeliveryID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Delivery is a webhook received by a pipeline, kept to find out why a build did or didn't start
+// and to replay it
+type Delivery struct {
+	ID          string            `json:"id"`
+	Event       string            `json:"event"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+	Received    int64             `json:"received"`
+	Result      string            `json:"result"`
+	Message     string            `json:"message,omitempty"`
+	BuildNumber int               `json:"build_number,omitempty"`
+}
+
+// NewDelivery records the remote event, headers and body of a webhook.
+// Webhooks without a delivery ID get a generated one and can't be deduplicated.
+func NewDelivery(event string, header http.Header, body []byte) *Delivery {
+	d := &Delivery{
+		Event:    event,
+		Headers:  make(map[string]string),
+		Body:     string(body),
+		Received: time.Now().UnixNano(),
+		Result:   DeliveryReceived,
+	}
+
+	for name := range header {
+		if isSecretHeader(name) {
+			continue
+		}
+		d.Headers[http.CanonicalHeaderKey(name)] = header.Get(name)
+	}
+
+	for _, name := range deliveryHeaders {
+		if id := header.Get(name); validDeliveryID.MatchString(id) {
+			d.ID = id
+			break
+		}
+	}
+	if d.ID == "" {
+		d.ID = generateUUID()
+	}
+
+	return d
+}
+
+func isSecretHeader(name string) bool {
+	for _, secret := range secretHeaders {
+		if strings.EqualFold(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pipeline) deliveriesPath() string {
+	return fmt.Sprintf("%s%s:%s/hooks", pipelineNamespace, p.Owner, p.Repo)
+}
+
+// getDelivery reads a webhook delivery, deliveries stored with a key per field
+// are read from their fields
+func getDelivery(path string, kvClient kv.KVClient) (*Delivery, string, error) {
+	prev, err := readDocument(path+documentKey, kvClient)
+	if err != nil {
+		return nil, "", err
+	}
+	if prev == "" {
+		return getLegacyDelivery(path, kvClient), "", nil
+	}
+
+	d := new(Delivery)
+	if err := json.Unmarshal([]byte(prev), d); err != nil {
+		return nil, "", err
+	}
+	return d, prev, nil
+}
+
+// FindDelivery returns a webhook delivery received by the pipeline
+func (p *Pipeline) FindDelivery(id string, kvClient kv.KVClient) (*Delivery, bool) {
+	if !validDeliveryID.MatchString(id) {
+		return nil, false
+	}
+
+	path := fmt.Sprintf("%s/%s", p.deliveriesPath(), id)
+	if _, err := kvClient.GetDir(path); err != nil {
+		return nil, false
+	}
+	d, _, err := getDelivery(path, kvClient)
+	return d, err == nil
+}
+
+// GetDeliveries returns the webhook deliveries of the pipeline, latest first
+func (p *Pipeline) GetDeliveries(kvClient kv.KVClient) ([]*Delivery, error) {
+	pairs, err := kvClient.GetDir(p.deliveriesPath())
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return make([]*Delivery, 0), nil
+		}
+		return nil, err
+	}
+
+	deliveries := make([]*Delivery, 0, len(pairs))
+	for _, pair := range pairs {
+		d, _, err := getDelivery(pair.Key, kvClient)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Sort(byReceived(deliveries))
+	return deliveries, nil
+}
+
+// ClaimDelivery records the ID of a new webhook delivery, it returns false when a delivery
+// with the same ID was already received, even by a concurrent request. The ID is kept next
+// to the delivery's document.
+func (p *Pipeline) ClaimDelivery(d *Delivery, kvClient kv.KVClient) (bool, error) {
+	path := fmt.Sprintf("%s/%s/id", p.deliveriesPath(), d.ID)
+	err := kvClient.CompareAndSwap(path, "", d.ID)
+	if err == kv.ErrCompareFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SaveDelivery persists a webhook delivery and its result as a document, only the
+// request that claimed the delivery saves it
+func (p *Pipeline) SaveDelivery(d *Delivery, kvClient kv.KVClient) error {
+	path := fmt.Sprintf("%s/%s", p.deliveriesPath(), d.ID)
+	prev, err := readDocument(path+documentKey, kvClient)
+	if err != nil {
+		return err
+	}
+	return writeDocument(path+documentKey, prev, d, kvClient)
+}
+
+func (p *Pipeline) deleteDelivery(id string, kvClient kv.KVClient) error {
+	return kvClient.DeleteTree(fmt.Sprintf("%s/%s", p.deliveriesPath(), id))
+}
+
+type byReceived []*Delivery
+
+func (d byReceived) Len() int           { return len(d) }
+func (d byReceived) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byReceived) Less(i, j int) bool { return d[i].Received > d[j].Received }
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+)
+
+func TestNewDelivery(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	header.Set("X-GitHub-Event", "push")
+	header.Set("Authorization", "Bearer secret")
+	header.Set("X-Hub-Signature-256", "sha256=0a1b2c")
+	header.Set("X-Gitlab-Token", "hook-secret")
+
+	d := NewDelivery("push", header, []byte(`{"ref":"refs/heads/master"}`))
+
+	if d.ID != "72d3162e-cc78-11e3-81ab-4c9367dc0958" {
+		t.Errorf("Expected the github delivery ID, got %s", d.ID)
+	}
+	for _, name := range []string{"Authorization", "X-Hub-Signature-256", "X-Gitlab-Token"} {
+		if _, ok := d.Headers[name]; ok {
+			t.Errorf("Expected the %s header to be dropped", name)
+		}
+	}
+	if d.Headers["X-Github-Event"] != "push" {
+		t.Errorf("Expected the event header to be kept, got %v", d.Headers)
+	}
+	if d.Result != DeliveryReceived {
+		t.Errorf("Expected result to be %s, got %s", DeliveryReceived, d.Result)
+	}
+}
+
+func TestNewDeliveryWithoutID(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Request-Id", "../../builds")
+
+	d := NewDelivery("push", header, nil)
+
+	if d.ID == "" || d.ID == "../../builds" {
+		t.Errorf("Expected a generated delivery ID, got %s", d.ID)
+	}
+}
+
+func TestFindDelivery(t *testing.T) {
+	kvClient := setupStore()
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	d := NewDelivery("push", http.Header{"X-Github-Delivery": {"abc-123"}}, []byte("{}"))
+	d.Result = DeliveryBuilt
+	d.BuildNumber = 3
+
+	if err := p.SaveDelivery(d, kvClient); err != nil {
+		t.Fatalf("Unexpected error saving delivery: %s", err)
+	}
+
+	found, exists := p.FindDelivery("abc-123", kvClient)
+	if !exists {
+		t.Fatal("Expected delivery to exist")
+	}
+	if found.Result != DeliveryBuilt || found.BuildNumber != 3 || found.Body != "{}" {
+		t.Errorf("Expected saved delivery, got %+v", found)
+	}
+	if _, exists := p.FindDelivery("missing", kvClient); exists {
+		t.Error("Expected missing delivery not to exist")
+	}
+}
+
+func TestClaimDelivery(t *testing.T) {
+	kvClient := setupStore()
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	d := NewDelivery("push", http.Header{"X-Github-Delivery": {"abc-123"}}, []byte("{}"))
+
+	if claimed, err := p.ClaimDelivery(d, kvClient); !claimed || err != nil {
+		t.Fatalf("Expected the first delivery to be claimed, got %t: %v", claimed, err)
+	}
+	if claimed, err := p.ClaimDelivery(d, kvClient); claimed || err != nil {
+		t.Errorf("Expected the retried delivery not to be claimed, got %t: %v", claimed, err)
+	}
+	if _, exists := p.FindDelivery("abc-123", kvClient); !exists {
+		t.Error("Expected the claimed delivery to exist")
+	}
+}
+
+func TestSaveDeliveryDocument(t *testing.T) {
+	kvClient := fake.NewClient()
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	d := NewDelivery("push", http.Header{"X-Github-Delivery": {"abc-123"}}, []byte("{}"))
+	p.ClaimDelivery(d, kvClient)
+
+	d.Result = DeliveryBuilt
+	if err := p.SaveDelivery(d, kvClient); err != nil {
+		t.Fatalf("Unexpected error saving delivery: %s", err)
+	}
+	d.Result = DeliveryFailed
+	if err := p.SaveDelivery(d, kvClient); err != nil {
+		t.Fatalf("Unexpected error saving delivery again: %s", err)
+	}
+
+	path := p.deliveriesPath() + "/abc-123"
+	if keys := kvClient.Keys(); !reflect.DeepEqual(keys, []string{path + documentKey, path + "/id"}) {
+		t.Errorf("Expected the claimed ID and one document, got %v", keys)
+	}
+
+	// deliveries stored with a key per field are read until they are pruned
+	kvClient.Put(p.deliveriesPath()+"/legacy-1/id", "legacy-1")
+	kvClient.Put(p.deliveriesPath()+"/legacy-1/result", DeliveryIgnored)
+	deliveries, err := p.GetDeliveries(kvClient)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d: %v", len(deliveries), err)
+	}
+	if found, _ := p.FindDelivery("abc-123", kvClient); found.Result != DeliveryFailed {
+		t.Errorf("Expected the saved result, got %s", found.Result)
+	}
+	if found, _ := p.FindDelivery("legacy-1", kvClient); found.Result != DeliveryIgnored {
+		t.Errorf("Expected the legacy delivery's result, got %s", found.Result)
+	}
+}
@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	skipDirective   = regexp.MustCompile(`(?i)\[\s*(skip ci|ci skip)\s*\]`)
+	paramsDirective = regexp.MustCompile(`(?i)\[\s*kontinuous\s+([^\]]*)\]`)
+
+	// the vars kontinuous sets on the jobs, commit messages can't override them
+	reservedParams = []string{"KONTINUOUS_", "GIT_", "S3_"}
+)
+
+// SkipBuild checks if a commit message asks not to be built with `[skip ci]` or `[ci skip]`
+func SkipBuild(message string) bool {
+	return skipDirective.MatchString(message)
+}
+
+// ParseDirectives returns the build params set in a commit message.
+// `[kontinuous deploy=staging notify=false]` sets `deploy` and `notify`,
+// these are available to the stages like the pipeline's vars. Params named like
+// the vars set by kontinuous are ignored.
+func ParseDirectives(message string) map[string]interface{} {
+	params := make(map[string]interface{})
+	for _, match := range paramsDirective.FindAllStringSubmatch(message, -1) {
+		for _, field := range strings.Fields(match[1]) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || isReservedParam(kv[0]) {
+				continue
+			}
+			params[kv[0]] = kv[1]
+		}
+	}
+
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+func isReservedParam(name string) bool {
+	for _, prefix := range reservedParams {
+		if strings.HasPrefix(strings.ToUpper(name), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+func TestSkipBuild(t *testing.T) {
+	cases := map[string]bool{
+		"Update README [skip ci]":     true,
+		"[CI SKIP] fix typo":          true,
+		"Fix build\n\n[ skip ci ]":    true,
+		"Add skip ci docs":            false,
+		"[kontinuous deploy=staging]": false,
+	}
+
+	for message, expected := range cases {
+		if actual := SkipBuild(message); actual != expected {
+			t.Errorf("Expected skip of `%s` to be %t, got %t", message, expected, actual)
+		}
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	params := ParseDirectives("Release 1.2\n\n[kontinuous deploy=staging notify=false invalid]")
+
+	if len(params) != 2 {
+		t.Fatalf("Expected 2 params, got %d", len(params))
+	}
+	if params["deploy"] != "staging" || params["notify"] != "false" {
+		t.Errorf("Expected deploy=staging and notify=false, got %v", params)
+	}
+
+	params = ParseDirectives("[kontinuous KONTINUOUS_BRANCH=master git_clone_url=git@evil.example.com:repo.git deploy=qa]")
+	if len(params) != 1 || params["deploy"] != "qa" {
+		t.Errorf("Expected reserved params to be ignored, got %v", params)
+	}
+
+	if params := ParseDirectives("Fix build"); params != nil {
+		t.Errorf("Expected no params, got %v", params)
+	}
+}
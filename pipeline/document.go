@@ -0,0 +1,410 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// Pipelines and builds are stored as one JSON document each so they are read and
+// written in a single request. A build's document holds its stages, listing the
+// builds of a pipeline reads all of them with their stages at once.
+//
+// Documents carry a resource version that is incremented on every save. Saving a
+// pipeline, build or stage read before the last save fails with ErrConflict, the
+// write itself is a compare and swap on the stored document.
+
+// documentKey is the key of a pipeline's document in its directory, the directory
+// also keeps its builds, the polled heads and the hook deliveries
+const documentKey = "/document"
+
+// maxSaveAttempts is how many times a document is read again when it was written
+// by someone else between reading and writing it
+const maxSaveAttempts = 10
+
+// buildMigrationNamespace keeps the documents of builds being moved from their keys,
+// the document of a build there is the lock of its migration
+const buildMigrationNamespace = appNamespace + "migrations/builds/"
+
+// migrationTimeout is how long a build migration holds its lock, a migration older
+// than this was interrupted and is finished by the next one
+const migrationTimeout = time.Minute
+
+// migrationRetryDelay is how long saving a build waits for someone else's migration
+const migrationRetryDelay = 100 * time.Millisecond
+
+// errMigrating is returned when the build is being migrated by someone else
+var errMigrating = errors.New("the build is being migrated")
+
+// ErrConflict is returned when saving a pipeline, build or stage that was saved by
+// someone else since it was read, it needs to be read again before saving.
+var ErrConflict = errors.New("the resource was modified since it was read")
+
+type (
+	// pipelineDocument is the stored pipeline with the details hidden from the API
+	pipelineDocument struct {
+		*Pipeline
+		LatestBuildNumber int              `json:"latest_build_number"`
+		Keys              Key              `json:"keys"`
+		HookSecret        string           `json:"hook_secret"`
+		HookID            string           `json:"hook_id,omitempty"`
+		Notifiers         []storedNotifier `json:"notif,omitempty"`
+	}
+
+	// storedNotifier is a notifier without its metadata, the metadata is read from
+	// the pipeline's secrets when notifying
+	storedNotifier struct {
+		Type      string `json:"type"`
+		Namespace string `json:"namespace"`
+	}
+
+	// buildDocument is the stored build and its stages
+	buildDocument struct {
+		*Build
+		Pipeline string `json:"pipeline"`
+		Token    string `json:"token,omitempty"`
+	}
+
+	// buildMigration is the lock of a build's migration and the document it writes
+	buildMigration struct {
+		Started  int64  `json:"started"`
+		Document string `json:"document"`
+	}
+)
+
+func newPipelineDocument(p *Pipeline) *pipelineDocument {
+	stored := *p
+	// builds are stored in their own documents
+	stored.Builds = nil
+	stored.LatestBuild = nil
+
+	doc := &pipelineDocument{
+		Pipeline:          &stored,
+		LatestBuildNumber: p.LatestBuildNumber,
+		Keys:              p.Keys,
+		HookSecret:        p.HookSecret,
+		HookID:            p.HookID,
+	}
+	for _, notifier := range p.Notifiers {
+		doc.Notifiers = append(doc.Notifiers, storedNotifier{notifier.Type, notifier.Namespace})
+	}
+	return doc
+}
+
+func decodePipeline(value []byte) (*Pipeline, error) {
+	doc := &pipelineDocument{Pipeline: new(Pipeline)}
+	if err := json.Unmarshal(value, doc); err != nil {
+		return nil, err
+	}
+
+	p := doc.Pipeline
+	p.LatestBuildNumber = doc.LatestBuildNumber
+	p.Keys = doc.Keys
+	p.HookSecret = doc.HookSecret
+	p.HookID = doc.HookID
+	p.Name = p.fullName()
+	p.Notifiers = nil
+	for _, notifier := range doc.Notifiers {
+		p.Notifiers = append(p.Notifiers, &Notifier{Type: notifier.Type, Namespace: notifier.Namespace})
+	}
+	return p, nil
+}
+
+func decodeBuild(value []byte) (*Build, error) {
+	doc := &buildDocument{Build: new(Build)}
+	if err := json.Unmarshal(value, doc); err != nil {
+		return nil, err
+	}
+	doc.Build.Pipeline = doc.Pipeline
+	doc.Build.Token = doc.Token
+	return doc.Build, nil
+}
+
+func newBuildDocument(b *Build) *buildDocument {
+	return &buildDocument{b, b.Pipeline, b.Token}
+}
+
+// readDocument returns the stored value of a document, empty if it does not exist
+func readDocument(key string, kvClient kv.KVClient) (string, error) {
+	value, err := kvClient.Get(key)
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return "", err
+	}
+	return value, nil
+}
+
+// writeDocument replaces the stored value of a document if it is still prev,
+// kv.ErrCompareFailed is returned when it was written in between
+func writeDocument(key, prev string, doc interface{}, kvClient kv.KVClient) error {
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return kvClient.CompareAndSwap(key, prev, string(value))
+}
+
+// loadPipeline reads a pipeline and the stored value of its document. Pipelines
+// stored with a key per field have no document yet and are read from their fields.
+// The pipeline is nil if it does not exist.
+func loadPipeline(path string, kvClient kv.KVClient) (*Pipeline, string, error) {
+	prev, err := readDocument(path+documentKey, kvClient)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if prev == "" {
+		if _, err := kvClient.GetDir(path); err != nil {
+			return nil, "", nil
+		}
+		return getLegacyPipeline(path, kvClient), "", nil
+	}
+
+	p, err := decodePipeline([]byte(prev))
+	return p, prev, err
+}
+
+// updatePipeline writes the pipeline returned by change for the stored pipeline. The
+// pipeline is read and changed again when it was written by someone else in between.
+func updatePipeline(path string, kvClient kv.KVClient, change func(stored *Pipeline) (*Pipeline, error)) (*Pipeline, error) {
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		stored, prev, err := loadPipeline(path, kvClient)
+		if err != nil {
+			return nil, err
+		}
+
+		next, err := change(stored)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeDocument(path+documentKey, prev, newPipelineDocument(next), kvClient)
+		if err == nil {
+			return next, nil
+		}
+		if err != kv.ErrCompareFailed {
+			return nil, err
+		}
+	}
+	return nil, ErrConflict
+}
+
+// readBuild reads a build and the stored value of its document, the build is nil if
+// it has no document
+func readBuild(path string, kvClient kv.KVClient) (*Build, string, error) {
+	prev, err := readDocument(path, kvClient)
+	if err != nil || prev == "" {
+		return nil, "", err
+	}
+
+	b, err := decodeBuild([]byte(prev))
+	return b, prev, err
+}
+
+// updateBuild writes the build returned by change for the stored build. The build is
+// read and changed again when it was written by someone else in between. Builds stored
+// with a key per field are moved to a document first. A build saved without its index
+// entries is returned with the error, it is missing from the lists until saved again.
+func updateBuild(path string, kvClient kv.KVClient, change func(stored *Build) (*Build, error)) (*Build, error) {
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		stored, prev, err := readBuild(path, kvClient)
+		if err != nil {
+			return nil, err
+		}
+
+		if stored == nil {
+			legacy, err := isLegacyBuild(path, kvClient)
+			if err != nil {
+				return nil, err
+			}
+			if legacy {
+				err := migrateBuild(path, kvClient)
+				if err == errMigrating {
+					time.Sleep(migrationRetryDelay)
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		next, err := change(stored)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeDocument(path, prev, newBuildDocument(next), kvClient)
+		if err == nil {
+			// the document is saved even when it is not indexed, the caller gets both
+			if err := indexBuild(path, stored, next, kvClient); err != nil {
+				return next, fmt.Errorf("build %s was saved but not indexed: %s", path, err)
+			}
+			return next, nil
+		}
+		if err != kv.ErrCompareFailed {
+			return nil, err
+		}
+	}
+	return nil, ErrConflict
+}
+
+// sortStages orders the stages of a build by their index
+func sortStages(stages []*Stage) {
+	sort.Sort(byIndex(stages))
+}
+
+type byIndex []*Stage
+
+func (s byIndex) Len() int           { return len(s) }
+func (s byIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byIndex) Less(i, j int) bool { return s[i].Index < s[j].Index }
+
+// MigrateDocuments moves the pipelines and builds stored with a key per field to
+// documents and returns the number of documents written. Pipelines and builds that
+// already have a document are skipped so it can be run again.
+func MigrateDocuments(kvClient kv.KVClient) (int, error) {
+	pipelineDirs, err := kvClient.GetDir(pipelineNamespace)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	migrated := 0
+	for _, pair := range pipelineDirs {
+		path := pair.Key
+
+		prev, err := readDocument(path+documentKey, kvClient)
+		if err != nil {
+			return migrated, err
+		}
+		if prev == "" {
+			err := writeDocument(path+documentKey, "", newPipelineDocument(getLegacyPipeline(path, kvClient)), kvClient)
+			if err != nil && err != kv.ErrCompareFailed {
+				return migrated, err
+			}
+			if err := deleteLegacyPipeline(path, kvClient); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		buildDirs, err := kvClient.GetDir(path + "/builds")
+		if err != nil {
+			if etcd.IsKeyNotFound(err) {
+				continue
+			}
+			return migrated, err
+		}
+		for _, build := range buildDirs {
+			// documents have a value, builds stored with a key per field are directories
+			if len(build.Value) != 0 {
+				continue
+			}
+			// the build is migrated by someone else
+			err := migrateBuild(build.Key, kvClient)
+			if err == errMigrating {
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// buildMigrationKey is the lock of a build's migration
+func buildMigrationKey(path string) string {
+	return buildMigrationNamespace + strings.TrimPrefix(path, pipelineNamespace)
+}
+
+// readBuildMigration returns the migration of a build and its stored value, the
+// migration is nil when the build is not being migrated
+func readBuildMigration(path string, kvClient kv.KVClient) (*buildMigration, string, error) {
+	value, err := readDocument(buildMigrationKey(path), kvClient)
+	if err != nil || value == "" {
+		return nil, "", err
+	}
+
+	m := &buildMigration{}
+	if err := json.Unmarshal([]byte(value), m); err != nil {
+		return nil, "", err
+	}
+	return m, value, nil
+}
+
+// isLegacyBuild checks if a build without a document is stored with a key per field
+// or its migration was interrupted
+func isLegacyBuild(path string, kvClient kv.KVClient) (bool, error) {
+	if _, err := kvClient.GetDir(path); err == nil {
+		return true, nil
+	}
+	m, _, err := readBuildMigration(path, kvClient)
+	return m != nil, err
+}
+
+// migrateBuild replaces the keys of a build stored with a key per field with its
+// document. The document can't be written over the build's directory, it is saved
+// as the migration's lock first so the build is kept when the migration is
+// interrupted after the keys are removed. Returns errMigrating when someone else
+// holds the lock.
+func migrateBuild(path string, kvClient kv.KVClient) error {
+	m, held, err := readBuildMigration(path, kvClient)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &buildMigration{}
+	} else if time.Since(time.Unix(0, m.Started)) < migrationTimeout {
+		return errMigrating
+	}
+
+	// an interrupted migration that wrote the document only left its lock
+	doc, err := readDocument(path, kvClient)
+	if err != nil {
+		return err
+	}
+	if doc != "" {
+		return kvClient.DeleteTree(buildMigrationKey(path))
+	}
+
+	// the keys are gone when an interrupted migration removed them, its document is kept
+	if _, err := kvClient.GetDir(path); err == nil {
+		value, err := json.Marshal(newBuildDocument(getLegacyBuild(path, kvClient)))
+		if err != nil {
+			return err
+		}
+		m.Document = string(value)
+	}
+	if m.Document == "" {
+		return nil
+	}
+
+	m.Started = time.Now().UnixNano()
+	if err := writeDocument(buildMigrationKey(path), held, m, kvClient); err != nil {
+		if err == kv.ErrCompareFailed {
+			return errMigrating
+		}
+		return err
+	}
+
+	if err := kvClient.DeleteTree(path); err != nil && !etcd.IsKeyNotFound(err) {
+		return err
+	}
+	// the interrupted migration finished after all, its document is kept
+	if err := kvClient.CompareAndSwap(path, "", m.Document); err != nil && err != kv.ErrCompareFailed {
+		return err
+	}
+	return kvClient.DeleteTree(buildMigrationKey(path))
+}
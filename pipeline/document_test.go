@@ -0,0 +1,230 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+)
+
+// putLegacyBuild writes a build and its stages with a key per field
+func putLegacyBuild(kvc kv.KVClient, number, stages int) {
+	path := fmt.Sprintf("%sSampleOwner:SampleRepo/builds/%d", pipelineNamespace, number)
+	kvc.Put(path+"/uuid", fmt.Sprintf("build-%d", number))
+	kvc.Put(path+"/pipeline", "SampleOwner:SampleRepo")
+	kvc.Put(path+"/status", BuildSuccess)
+	kvc.Put(path+"/branch", "master")
+	kvc.Put(path+"/commit", "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c")
+	kvc.Put(path+"/created", "1460183953")
+	kvc.PutInt(path+"/number", number)
+	kvc.PutInt(path+"/current-stage", stages)
+
+	for i := 1; i <= stages; i++ {
+		stage := fmt.Sprintf("%s/stages/%d", path, i)
+		kvc.Put(stage+"/name", fmt.Sprintf("stage %d", i))
+		kvc.Put(stage+"/status", BuildSuccess)
+		kvc.Put(stage+"/params", `{"command":["make"]}`)
+		kvc.PutInt(stage+"/index", i)
+	}
+}
+
+func setupLegacyStore(builds, stages int) *fake.Client {
+	kvc := fake.NewClient()
+	path := pipelineNamespace + "SampleOwner:SampleRepo"
+	kvc.Put(path+"/owner", "SampleOwner")
+	kvc.Put(path+"/repo", "SampleRepo")
+	kvc.Put(path+"/hook-secret", "secret")
+	kvc.PutInt(path+"/latest-build", builds)
+	for n := 1; n <= builds; n++ {
+		putLegacyBuild(kvc, n, stages)
+	}
+	return kvc
+}
+
+func TestMigrateDocuments(t *testing.T) {
+	kvc := setupLegacyStore(2, 3)
+
+	migrated, err := MigrateDocuments(kvc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if migrated != 3 {
+		t.Errorf("Expected the pipeline and 2 builds to be migrated, got %d", migrated)
+	}
+
+	path := pipelineNamespace + "SampleOwner:SampleRepo"
+	if _, err := kvc.Get(path + "/hook-secret"); err == nil {
+		t.Error("Expected the pipeline's fields to be removed")
+	}
+	if _, err := kvc.Get(path + "/builds/1/status"); err == nil {
+		t.Error("Expected the build's fields to be removed")
+	}
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	if p.HookSecret != "secret" || p.LatestBuildNumber != 2 || p.LatestBuild == nil {
+		t.Errorf("Expected the pipeline details to be kept, got %+v", p)
+	}
+
+	builds, _ := p.GetBuilds(kvc)
+	if len(builds) != 2 || len(builds[1].Stages) != 3 || builds[1].Stages[2].Params["command"] == nil {
+		t.Errorf("Expected 2 builds with 3 stages, got %+v", builds)
+	}
+
+	if migrated, _ := MigrateDocuments(kvc); migrated != 0 {
+		t.Errorf("Expected nothing to migrate again, got %d", migrated)
+	}
+}
+
+func TestSaveReadsLegacyBuild(t *testing.T) {
+	kvc := setupLegacyStore(1, 2)
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	b, _ := p.GetBuild(1, kvc)
+	b.Status = BuildFailure
+	if err := b.Save(kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	saved, _ := p.GetBuild(1, kvc)
+	if saved.Status != BuildFailure || len(saved.Stages) != 2 || saved.ResourceVersion != 1 {
+		t.Errorf("Expected the build to be saved as a document with its stages, got %+v", saved)
+	}
+}
+
+func TestSaveConflicts(t *testing.T) {
+	kvc := setupLegacyStore(1, 2)
+
+	first, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	second, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	if err := first.Save(kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := second.Save(kvc); err != ErrConflict {
+		t.Errorf("Expected saving a pipeline read before the last save to conflict, got %v", err)
+	}
+
+	b, _ := first.GetBuild(1, kvc)
+	s, _ := b.GetStage(1, kvc)
+	stale, _ := b.GetStage(1, kvc)
+	if err := s.Save(b.path()+"/stages", kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := stale.Save(b.path()+"/stages", kvc); err != ErrConflict {
+		t.Errorf("Expected saving a stage read before the last save to conflict, got %v", err)
+	}
+}
+
+func TestBuildSaveKeepsStages(t *testing.T) {
+	kvc := setupLegacyStore(1, 2)
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	b, _ := p.GetBuild(1, kvc)
+	s, _ := b.GetStage(2, kvc)
+	s.Status = BuildRunning
+	if err := s.Save(b.path()+"/stages", kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// b still has the stage as it was before
+	b.Status = BuildRunning
+	if err := b.Save(kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	saved, _ := b.GetStage(2, kvc)
+	if saved.Status != BuildRunning {
+		t.Errorf("Expected the stage saved before the build to be kept, got %s", saved.Status)
+	}
+}
+
+// roundTripClient adds the latency of a request to etcd to the calls of a store
+type roundTripClient struct {
+	kv.KVClient
+}
+
+const roundTrip = 200 * time.Microsecond
+
+func (c roundTripClient) Get(key string) (string, error) {
+	time.Sleep(roundTrip)
+	return c.KVClient.Get(key)
+}
+
+func (c roundTripClient) GetInt(key string) (int, error) {
+	time.Sleep(roundTrip)
+	return c.KVClient.GetInt(key)
+}
+
+func (c roundTripClient) GetDir(key string) ([]*kv.KVPair, error) {
+	time.Sleep(roundTrip)
+	return c.KVClient.GetDir(key)
+}
+
+// benchmarkListBuilds lists 20 builds with 5 stages each, every request to the store takes 200µs
+func benchmarkListBuilds(b *testing.B, kvc kv.KVClient) {
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	client := roundTripClient{kvc}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		builds, err := p.GetBuilds(client)
+		if err != nil || len(builds) != 20 {
+			b.Fatalf("Expected 20 builds, got %d: %v", len(builds), err)
+		}
+	}
+}
+
+func BenchmarkListBuildsLegacy(b *testing.B) {
+	benchmarkListBuilds(b, setupLegacyStore(20, 5))
+}
+
+func BenchmarkListBuildsDocuments(b *testing.B) {
+	kvc := setupLegacyStore(20, 5)
+	MigrateDocuments(kvc)
+	benchmarkListBuilds(b, kvc)
+}
+
+func TestInterruptedBuildMigration(t *testing.T) {
+	kvc := setupLegacyStore(1, 2)
+	path := pipelineNamespace + "SampleOwner:SampleRepo/builds/1"
+
+	// someone else's migration holds the lock
+	if err := writeDocument(buildMigrationKey(path), "", &buildMigration{Started: time.Now().UnixNano()}, kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := migrateBuild(path, kvc); err != errMigrating {
+		t.Fatalf("Expected the build to be migrated by someone else, got %v", err)
+	}
+	if _, err := kvc.GetDir(path); err != nil {
+		t.Fatalf("Expected the keys of the build to be kept, got %s", err)
+	}
+
+	// the migration was interrupted after removing the keys
+	doc, _ := json.Marshal(newBuildDocument(getLegacyBuild(path, kvc)))
+	interrupted := &buildMigration{Started: time.Now().Add(-2 * migrationTimeout).UnixNano(), Document: string(doc)}
+	kvc.DeleteTree(buildMigrationKey(path))
+	kvc.DeleteTree(path)
+	if err := writeDocument(buildMigrationKey(path), "", interrupted, kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	b, ok := p.GetBuild(1, kvc)
+	if !ok || len(b.Stages) != 2 {
+		t.Fatalf("Expected the build to be read from its migration, got %+v", b)
+	}
+	b.Status = BuildFailure
+	if err := b.Save(kvc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	saved, _ := p.GetBuild(1, kvc)
+	if saved.Status != BuildFailure || len(saved.Stages) != 2 {
+		t.Errorf("Expected the build to be saved as a document with its stages, got %+v", saved)
+	}
+	if m, _, _ := readBuildMigration(path, kvc); m != nil {
+		t.Errorf("Expected the lock of the migration to be removed, got %+v", m)
+	}
+}
@@ -0,0 +1,321 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// Builds are indexed by the fields the build lists are filtered by, so a page of
+// builds is listed from the indexes and only the builds of the page are read. An
+// entry is a key per build under the value of the field, holding the time the build
+// was created so time ranges are filtered on the index as well:
+//
+//	/kontinuous/pipelines/{owner}:{repo}/build-index/status/SUCCESS/12 = 1460183953000000000
+//
+// The entries are written after the build's document by every save. Saves racing each
+// other can leave the entries of a value the build no longer has, the builds listed are
+// checked against the query and the entries that don't match their build are removed.
+
+// buildIndexDir is the directory of the build indexes in a pipeline's directory
+const buildIndexDir = "/build-index/"
+
+// allBuildsIndex lists every build, for queries without filters
+const allBuildsIndex = "all"
+
+type (
+	// BuildQuery selects a page of builds, empty filters match every build
+	BuildQuery struct {
+		Status string
+		Branch string
+		Author string
+		Event  string
+
+		// Since and Until bound the creation time of the builds in unix nanoseconds,
+		// Since is included and Until is not. Zero is unbounded.
+		Since int64
+		Until int64
+
+		// Ascending lists the oldest builds first, the newest are first by default
+		Ascending bool
+
+		// Cursor is the number of the last build of the previous page, zero starts at the first page
+		Cursor int
+
+		// Limit is the size of the page, zero lists every matching build
+		Limit int
+	}
+
+	// BuildPage is a page of builds and the cursor of the next page, Next is zero on the last page
+	BuildPage struct {
+		Builds []*BuildSummary `json:"builds"`
+		Next   int             `json:"next,omitempty"`
+	}
+
+	// buildIndex is a field of the builds that is indexed
+	buildIndex struct {
+		name  string
+		value func(b *Build) string
+	}
+
+	// buildFilter is an indexed field a query filters by
+	buildFilter struct {
+		field string
+		value string
+		build func(b *BuildSummary) string
+	}
+)
+
+var buildIndexes = []buildIndex{
+	{"status", func(b *Build) string { return b.Status }},
+	{"branch", func(b *Build) string { return b.Branch }},
+	{"author", func(b *Build) string { return b.Author }},
+	{"event", func(b *Build) string { return b.Event }},
+}
+
+// indexRoot returns the index directory of the pipeline a build path belongs to
+func indexRoot(path string) string {
+	return path[:strings.Index(path, buildsDir)] + buildIndexDir
+}
+
+// indexDir returns the directory of the builds with value as the field, values are
+// escaped as they can contain slashes like branches
+func indexDir(root, field, value string) string {
+	return root + field + "/" + url.QueryEscape(value)
+}
+
+// indexEntries returns the index keys of a build, empty fields are not indexed
+func indexEntries(root string, b *Build) []string {
+	number := strconv.Itoa(b.Number)
+	entries := []string{root + allBuildsIndex + "/" + number}
+	for _, index := range buildIndexes {
+		if value := index.value(b); value != "" {
+			entries = append(entries, indexDir(root, index.name, value)+"/"+number)
+		}
+	}
+	return entries
+}
+
+// indexBuild replaces the index entries of the stored build with the entries of the
+// saved one, stored is nil for new builds
+func indexBuild(path string, stored, saved *Build, kvClient kv.KVClient) error {
+	root := indexRoot(path)
+
+	previous := map[string]bool{}
+	if stored != nil {
+		for _, entry := range indexEntries(root, stored) {
+			previous[entry] = true
+		}
+	}
+
+	created := strconv.FormatInt(saved.Created, 10)
+	for _, entry := range indexEntries(root, saved) {
+		indexed := previous[entry]
+		delete(previous, entry)
+		if indexed && stored.Created == saved.Created {
+			continue
+		}
+		if err := kvClient.Put(entry, created); err != nil {
+			return err
+		}
+	}
+
+	for entry := range previous {
+		if err := kvClient.DeleteTree(entry); err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBuild removes the index entries of a build
+func unindexBuild(path string, b *Build, kvClient kv.KVClient) error {
+	for _, entry := range indexEntries(indexRoot(path), b) {
+		if err := kvClient.DeleteTree(entry); err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBuilds returns a page of the builds matching the query, only the builds of the
+// page are read
+func (p *Pipeline) ListBuilds(q *BuildQuery, kvClient kv.KVClient) (*BuildPage, error) {
+	root := pipelineNamespace + p.fullName() + buildIndexDir
+
+	filters := q.filters()
+	dirs := []string{}
+	for _, filter := range filters {
+		dirs = append(dirs, indexDir(root, filter.field, filter.value))
+	}
+	if len(dirs) == 0 {
+		dirs = append(dirs, root+allBuildsIndex)
+	}
+
+	// the matching builds are in every index read
+	var matching map[int]int64
+	for _, dir := range dirs {
+		entries, err := readIndex(dir, kvClient)
+		if err != nil {
+			return nil, err
+		}
+		if matching != nil {
+			for number := range entries {
+				if _, ok := matching[number]; !ok {
+					delete(entries, number)
+				}
+			}
+		}
+		matching = entries
+	}
+
+	numbers := []int{}
+	for number, created := range matching {
+		if q.matches(number, created) {
+			numbers = append(numbers, number)
+		}
+	}
+	if q.Ascending {
+		sort.Ints(numbers)
+	} else {
+		sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	}
+
+	page := &BuildPage{Builds: []*BuildSummary{}}
+	for i, number := range numbers {
+		if q.Limit > 0 && len(page.Builds) == q.Limit {
+			page.Next = numbers[i-1]
+			break
+		}
+
+		b, exists := p.GetBuildSummary(number, kvClient)
+		stale := dirs
+		if exists {
+			stale = staleIndexDirs(root, filters, b)
+		}
+		if len(stale) > 0 {
+			if err := removeIndexEntries(stale, number, kvClient); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if q.matches(number, b.Created) {
+			page.Builds = append(page.Builds, b)
+		}
+	}
+	return page, nil
+}
+
+// filters returns the indexed fields the query filters by
+func (q *BuildQuery) filters() []buildFilter {
+	filters := []buildFilter{}
+	for _, filter := range []buildFilter{
+		{"status", q.Status, func(b *BuildSummary) string { return b.Status }},
+		{"branch", q.Branch, func(b *BuildSummary) string { return b.Branch }},
+		{"author", q.Author, func(b *BuildSummary) string { return b.Author }},
+		{"event", q.Event, func(b *BuildSummary) string { return b.Event }},
+	} {
+		if filter.value != "" {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// staleIndexDirs returns the index directories of the filters the build was listed in
+// while it no longer has their value
+func staleIndexDirs(root string, filters []buildFilter, b *BuildSummary) []string {
+	stale := []string{}
+	for _, filter := range filters {
+		if filter.build(b) != filter.value {
+			stale = append(stale, indexDir(root, filter.field, filter.value))
+		}
+	}
+	return stale
+}
+
+// removeIndexEntries removes the entries of a build from index directories
+func removeIndexEntries(dirs []string, number int, kvClient kv.KVClient) error {
+	for _, dir := range dirs {
+		if err := kvClient.DeleteTree(dir + "/" + strconv.Itoa(number)); err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches checks if a build is in the time range and after the cursor
+func (q *BuildQuery) matches(number int, created int64) bool {
+	if q.Since != 0 && created < q.Since || q.Until != 0 && created >= q.Until {
+		return false
+	}
+	if q.Cursor == 0 {
+		return true
+	}
+	if q.Ascending {
+		return number > q.Cursor
+	}
+	return number < q.Cursor
+}
+
+// readIndex returns the numbers of the builds in an index directory and their creation time
+func readIndex(dir string, kvClient kv.KVClient) (map[int]int64, error) {
+	pairs, err := kvClient.GetDir(dir)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return map[int]int64{}, nil
+		}
+		return nil, err
+	}
+
+	entries := make(map[int]int64, len(pairs))
+	for _, pair := range pairs {
+		number, err := strconv.Atoi(pair.Key[strings.LastIndex(pair.Key, "/")+1:])
+		if err != nil {
+			continue
+		}
+		entries[number], _ = strconv.ParseInt(string(pair.Value), 10, 64)
+	}
+	return entries, nil
+}
+
+// MigrateBuildIndex indexes the builds of every pipeline and returns the number of
+// builds indexed. The entries are written again when it is run again.
+func MigrateBuildIndex(kvClient kv.KVClient) (int, error) {
+	pipelineDirs, err := kvClient.GetDir(pipelineNamespace)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	indexed := 0
+	for _, pair := range pipelineDirs {
+		buildDirs, err := kvClient.GetDir(pair.Key + "/builds")
+		if err != nil {
+			if etcd.IsKeyNotFound(err) {
+				continue
+			}
+			return indexed, err
+		}
+
+		for _, build := range buildDirs {
+			b := listedBuild(build, kvClient)
+			if b == nil || b.Number == 0 {
+				continue
+			}
+			if err := indexBuild(build.Key, nil, b, kvClient); err != nil {
+				return indexed, fmt.Errorf("unable to index %s: %s", build.Key, err)
+			}
+			indexed++
+		}
+	}
+	return indexed, nil
+}
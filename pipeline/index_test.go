@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+)
+
+func summaryNumbers(builds []*BuildSummary) []int {
+	numbers := []int{}
+	for _, b := range builds {
+		numbers = append(numbers, b.Number)
+	}
+	return numbers
+}
+
+func setupIndexedBuilds(t *testing.T) (*Pipeline, *fake.Client, int64) {
+	kvc := fake.NewClient()
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	p.Save(kvc)
+
+	created := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	builds := []*Build{
+		{Status: BuildSuccess, Branch: "master", Author: "alice", Event: "push"},
+		{Status: BuildFailure, Branch: "feature/x", Author: "bob", Event: "pull_request"},
+		{Status: BuildSuccess, Branch: "feature/x", Author: "bob", Event: "pull_request"},
+		{Status: BuildFailure, Branch: "master", Author: "alice", Event: "push"},
+		{Status: BuildRunning, Branch: "master", Author: "bob", Event: "push"},
+	}
+	for i, b := range builds {
+		b.Number = i + 1
+		b.Pipeline = p.fullName()
+		b.Created = created + int64(i)*int64(time.Hour)
+		if err := b.Save(kvc); err != nil {
+			t.Fatalf("Unable to save build %d: %s", b.Number, err)
+		}
+	}
+	return p, kvc, created
+}
+
+func TestListBuildsPages(t *testing.T) {
+	p, kvc, _ := setupIndexedBuilds(t)
+
+	pages := [][]int{}
+	q := &BuildQuery{Limit: 2}
+	for {
+		page, err := p.ListBuilds(q, kvc)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		pages = append(pages, summaryNumbers(page.Builds))
+		if page.Next == 0 {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if expected := [][]int{{5, 4}, {3, 2}, {1}}; !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Expected pages %v, got %v", expected, pages)
+	}
+
+	page, _ := p.ListBuilds(&BuildQuery{Ascending: true, Cursor: 3}, kvc)
+	if numbers := summaryNumbers(page.Builds); !reflect.DeepEqual(numbers, []int{4, 5}) || page.Next != 0 {
+		t.Errorf("Expected builds 4 and 5, got %v", numbers)
+	}
+}
+
+func TestListBuildsFilters(t *testing.T) {
+	p, kvc, created := setupIndexedBuilds(t)
+
+	tests := []struct {
+		query    *BuildQuery
+		expected []int
+	}{
+		{&BuildQuery{Status: BuildSuccess}, []int{3, 1}},
+		{&BuildQuery{Branch: "feature/x"}, []int{3, 2}},
+		{&BuildQuery{Author: "bob", Event: "push"}, []int{5}},
+		{&BuildQuery{Status: BuildFailure, Branch: "master"}, []int{4}},
+		{&BuildQuery{Since: created + int64(time.Hour), Until: created + 3*int64(time.Hour)}, []int{3, 2}},
+		{&BuildQuery{Branch: "develop"}, []int{}},
+	}
+	for _, test := range tests {
+		page, err := p.ListBuilds(test.query, kvc)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if numbers := summaryNumbers(page.Builds); !reflect.DeepEqual(numbers, test.expected) {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.query, numbers)
+		}
+	}
+}
+
+func TestSaveUpdatesIndex(t *testing.T) {
+	p, kvc, _ := setupIndexedBuilds(t)
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	b, _ := p.GetBuild(5, kvc)
+	b.Status = BuildSuccess
+	b.Save(kvc)
+
+	if page, _ := p.ListBuilds(&BuildQuery{Status: BuildRunning}, kvc); len(page.Builds) != 0 {
+		t.Errorf("Expected no running builds, got %v", summaryNumbers(page.Builds))
+	}
+	if page, _ := p.ListBuilds(&BuildQuery{Status: BuildSuccess}, kvc); !reflect.DeepEqual(summaryNumbers(page.Builds), []int{5, 3, 1}) {
+		t.Errorf("Expected build 5 to succeed, got %v", summaryNumbers(page.Builds))
+	}
+
+	// builds are removed from the indexes when deleted, even with a stale status
+	b.Status = BuildRunning
+	if err := b.Delete(p.ID, kvc, objects); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if page, _ := p.ListBuilds(&BuildQuery{Status: BuildSuccess}, kvc); !reflect.DeepEqual(summaryNumbers(page.Builds), []int{3, 1}) {
+		t.Errorf("Expected build 5 to be deleted, got %v", summaryNumbers(page.Builds))
+	}
+	if _, err := kvc.Get(pipelineNamespace + "SampleOwner:SampleRepo/build-index/all/5"); err == nil {
+		t.Error("Expected the index entries of build 5 to be deleted")
+	}
+}
+
+func TestListBuildsDropsStaleEntries(t *testing.T) {
+	p, kvc, created := setupIndexedBuilds(t)
+	root := pipelineNamespace + p.fullName() + buildIndexDir
+
+	// left by saves racing each other and a build removed without its entries
+	kvc.Put(indexDir(root, "status", BuildRunning)+"/1", strconv.FormatInt(created, 10))
+	kvc.Put(root+allBuildsIndex+"/9", strconv.FormatInt(created, 10))
+
+	if page, _ := p.ListBuilds(&BuildQuery{Status: BuildRunning}, kvc); !reflect.DeepEqual(summaryNumbers(page.Builds), []int{5}) {
+		t.Errorf("Expected only build 5 to be running, got %v", summaryNumbers(page.Builds))
+	}
+	if page, _ := p.ListBuilds(&BuildQuery{}, kvc); !reflect.DeepEqual(summaryNumbers(page.Builds), []int{5, 4, 3, 2, 1}) {
+		t.Errorf("Expected the removed build not to be listed, got %v", summaryNumbers(page.Builds))
+	}
+	for _, entry := range []string{indexDir(root, "status", BuildRunning) + "/1", root + allBuildsIndex + "/9"} {
+		if _, err := kvc.Get(entry); err == nil {
+			t.Errorf("Expected the stale entry %s to be removed", entry)
+		}
+	}
+}
+
+// failingIndexClient fails to write the index entries
+type failingIndexClient struct {
+	*fake.Client
+}
+
+func (c failingIndexClient) Put(key, value string) error {
+	if strings.Contains(key, buildIndexDir) {
+		return errors.New("index unavailable")
+	}
+	return c.Client.Put(key, value)
+}
+
+func TestSaveReturnsIndexError(t *testing.T) {
+	p, kvc, _ := setupIndexedBuilds(t)
+	failing := failingIndexClient{kvc}
+
+	b, _ := p.GetBuild(5, failing)
+	b.Status = BuildSuccess
+	if err := b.Save(failing); err == nil {
+		t.Error("Expected the index error to be returned")
+	}
+
+	saved, _ := p.GetBuild(5, kvc)
+	if saved.Status != BuildSuccess || b.ResourceVersion != saved.ResourceVersion {
+		t.Errorf("Expected the build to be saved, got %s version %d", saved.Status, saved.ResourceVersion)
+	}
+}
+
+func TestMigrateBuildIndex(t *testing.T) {
+	kvc := setupLegacyStore(3, 1)
+	MigrateDocuments(kvc)
+
+	if indexed, err := MigrateBuildIndex(kvc); err != nil || indexed != 3 {
+		t.Fatalf("Expected 3 builds indexed, got %d: %v", indexed, err)
+	}
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	page, _ := p.ListBuilds(&BuildQuery{Status: BuildSuccess, Branch: "master"}, kvc)
+	if numbers := summaryNumbers(page.Builds); !reflect.DeepEqual(numbers, []int{3, 2, 1}) {
+		t.Errorf("Expected the migrated builds to be listed, got %v", numbers)
+	}
+}
+
+func TestListPipelines(t *testing.T) {
+	kvc := fake.NewClient()
+	for _, name := range [][]string{{"acaleph", "kontinuous"}, {"acaleph", "agent"}, {"other", "repo"}} {
+		p := &Pipeline{Owner: name[0], Repo: name[1]}
+		p.Save(kvc)
+	}
+
+	names := func(pipelines []*Pipeline) []string {
+		listed := []string{}
+		for _, p := range pipelines {
+			listed = append(listed, p.Owner+"/"+p.Repo)
+		}
+		return listed
+	}
+
+	pipelines, next, err := ListPipelines(&PipelineQuery{Limit: 2}, kvc)
+	if err != nil || !reflect.DeepEqual(names(pipelines), []string{"acaleph/agent", "acaleph/kontinuous"}) || next != "acaleph/kontinuous" {
+		t.Errorf("Expected the first page, got %v next %s: %v", names(pipelines), next, err)
+	}
+	pipelines, next, _ = ListPipelines(&PipelineQuery{Limit: 2, Cursor: next}, kvc)
+	if !reflect.DeepEqual(names(pipelines), []string{"other/repo"}) || next != "" {
+		t.Errorf("Expected the last page, got %v next %s", names(pipelines), next)
+	}
+
+	pipelines, _, _ = ListPipelines(&PipelineQuery{Owner: "acaleph", Descending: true}, kvc)
+	if !reflect.DeepEqual(names(pipelines), []string{"acaleph/kontinuous", "acaleph/agent"}) {
+		t.Errorf("Expected the pipelines of acaleph, got %v", names(pipelines))
+	}
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// Installation is a repository where the GitHub App is installed
+type Installation struct {
+	ID    int    `json:"id"`
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+}
+
+func installationPath(owner, repo string) string {
+	return fmt.Sprintf("%s%s:%s", installationNamespace, owner, repo)
+}
+
+// FindInstallation returns the GitHub App installation of a repository
+func FindInstallation(owner, repo string, kvClient kv.KVClient) (int, bool) {
+	id, err := kvClient.GetInt(installationPath(owner, repo))
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// FindAllInstallations returns all the repositories discovered from GitHub App installations
+func FindAllInstallations(kvClient kv.KVClient) ([]*Installation, error) {
+	pairs, err := kvClient.GetDir(installationNamespace)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return make([]*Installation, 0), nil
+		}
+		return nil, err
+	}
+
+	installations := make([]*Installation, 0, len(pairs))
+	for _, pair := range pairs {
+		names := strings.SplitN(strings.TrimPrefix(pair.Key, installationNamespace), ":", 2)
+		if len(names) != 2 {
+			continue
+		}
+
+		id, _ := strconv.Atoi(string(pair.Value))
+		installations = append(installations, &Installation{
+			ID:    id,
+			Owner: names[0],
+			Repo:  names[1],
+		})
+	}
+	return installations, nil
+}
+
+// Save records the installation of the GitHub App on the repository
+func (i *Installation) Save(kvClient kv.KVClient) error {
+	return kvClient.PutInt(installationPath(i.Owner, i.Repo), i.ID)
+}
+
+// Delete removes the installation of the GitHub App on the repository
+func (i *Installation) Delete(kvClient kv.KVClient) error {
+	return kvClient.DeleteTree(installationPath(i.Owner, i.Repo))
+}
@@ -13,16 +13,53 @@ import (
 	"text/template"
 
 	"github.com/AcalephStorage/kontinuous/kube"
+	"github.com/AcalephStorage/kontinuous/registry"
 	"github.com/AcalephStorage/kontinuous/scm"
 	"github.com/Masterminds/sprig"
 	"github.com/Sirupsen/logrus"
 )
 
+// NewKubeClient returns the client that runs the build jobs and reads the pipeline secrets.
+// It connects to the cluster kontinuous is running in, tests replace it with a fake cluster.
+var NewKubeClient = func() (kube.KubeClient, error) {
+	return kube.NewClient("https://kubernetes.default")
+}
+
+// NewRegistryClient returns the client of the internal registry the builds push their
+// images to, tests replace it with a fake registry.
+var NewRegistryClient = func() (registry.RegistryClient, error) {
+	address := os.Getenv("INTERNAL_REGISTRY")
+	if address == "" {
+		return nil, errors.New("INTERNAL_REGISTRY is not set")
+	}
+	return registry.NewClient(address), nil
+}
+
+// tokenUsers are the usernames remotes expect with an access token when cloning over
+// HTTPS, GitHub takes the token itself as the username
+var tokenUsers = map[string]string{
+	scm.RepoGitlab:    "oauth2",
+	scm.RepoBitbucket: "x-token-auth",
+}
+
+// buildImage is the name of the image a build pushes to the internal registry, tagged
+// with the build's commit
+func buildImage(pipelineID, buildNumber string) string {
+	return fmt.Sprintf("%s-%s", pipelineID, buildNumber)
+}
+
 // CreateJob creates a kubernetes Job for the given build information
 func CreateJob(definition *Definition, jobInfo *JobBuildInfo, scmClient scm.Client) (j *kube.Job, err error) {
 
 	newJob, _ := build(definition, jobInfo, scmClient)
 
+	if jobInfo.CloneKey != "" {
+		if err := deployCloneSecret(getNamespace(definition), jobInfo); err != nil {
+			logrus.WithError(err).Errorln("Unable to Create Clone Secret")
+			return nil, err
+		}
+	}
+
 	err = deployJob(newJob)
 	if err != nil {
 		logrus.WithError(err).Errorln("Unable to Create Job")
@@ -74,47 +111,50 @@ func addSpecDetails(j *kube.Job, definitions *Definition, jobInfo *JobBuildInfo,
 
 	stage := getCurrentStage(definitions, jobInfo)
 	kontinuousVars := getKontinuousVars(definitions, jobInfo)
-	parseStageTemplate(stage, kontinuousVars, definitions.Spec.Template.Vars, stage.Vars)
+	parseStageTemplate(stage, kontinuousVars, definitions.Spec.Template.Vars, stage.Vars, jobInfo.Params)
 
 	source := j.AddPodVolume("kontinuous-source", "/kontinuous/src")
 	status := j.AddPodVolume("kontinuous-status", "/kontinuous/status")
-	docker := j.AddPodVolume("kontinuous-docker", "/var/run/docker.sock")
-	secrets := getSecrets(getNamespace(definitions), definitions.Spec.Template.Secrets, stage.Secrets)
-	allVars := getVars(kontinuousVars, definitions.Spec.Template.Vars, stage.Vars)
+
+	// the docker socket gives root on the node, untrusted builds don't get it
+	var docker *kube.Volume
+	if !jobInfo.Untrusted {
+		docker = j.AddPodVolume("kontinuous-docker", "/var/run/docker.sock")
+	}
+	secrets := getSecrets(getNamespace(definitions), jobInfo, definitions.Spec.Template.Secrets, stage.Secrets)
+	allVars := getVars(kontinuousVars, definitions.Spec.Template.Vars, stage.Vars, jobInfo.Params)
 
 	agentContainer := createAgentContainer(definitions, jobInfo)
-	agentContainer.AddVolumeMountPoint(source, "/kontinuous/src", false)
-	agentContainer.AddVolumeMountPoint(status, "/kontinuous/status", false)
-	agentContainer.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+	mountBuildVolumes(agentContainer, source, status, docker)
 	setContainerEnv(agentContainer, secrets)
 	setContainerEnv(agentContainer, allVars)
 	addJobContainer(j, agentContainer)
 
+	// the deploy key is mounted from a secret, env vars can be read by anyone reading the job
+	if jobInfo.CloneKey != "" {
+		ssh := j.AddSecretVolume("kontinuous-ssh", cloneSecretName(jobInfo))
+		agentContainer.AddVolumeMountPoint(ssh, "/kontinuous/ssh", true)
+	}
+
 	switch stage.Type {
 	case "docker_build":
 
 		dockerContainer := createDockerContainer(stage, jobInfo, "BUILD")
-		dockerContainer.AddVolumeMountPoint(source, "/kontinuous/src", false)
-		dockerContainer.AddVolumeMountPoint(status, "/kontinuous/status", false)
-		dockerContainer.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+		mountBuildVolumes(dockerContainer, source, status, docker)
 		setContainerEnv(dockerContainer, secrets)
 		setContainerEnv(dockerContainer, allVars)
 		addJobContainer(j, dockerContainer)
 
 	case "docker_publish":
 		dockerContainer := createDockerContainer(stage, jobInfo, "PUBLISH")
-		dockerContainer.AddVolumeMountPoint(source, "/kontinuous/src", false)
-		dockerContainer.AddVolumeMountPoint(status, "/kontinuous/status", false)
-		dockerContainer.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+		mountBuildVolumes(dockerContainer, source, status, docker)
 		setContainerEnv(dockerContainer, secrets)
 		setContainerEnv(dockerContainer, allVars)
 		addJobContainer(j, dockerContainer)
 
 	case "command":
 		commandContainer := createCommandContainer(stage, jobInfo)
-		commandContainer.AddVolumeMountPoint(source, "/kontinuous/src", false)
-		commandContainer.AddVolumeMountPoint(status, "/kontinuous/status", false)
-		commandContainer.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+		mountBuildVolumes(commandContainer, source, status, docker)
 		setContainerEnv(commandContainer, secrets)
 		setContainerEnv(commandContainer, allVars)
 
@@ -127,10 +167,12 @@ func addSpecDetails(j *kube.Job, definitions *Definition, jobInfo *JobBuildInfo,
 		addJobContainer(j, commandContainer)
 
 	case "deploy":
+		if jobInfo.Untrusted {
+			logrus.Infof("Skipping deploy stage %s of untrusted build %s", stage.Name, jobInfo.Build)
+			break
+		}
 		deployContainer := createDeployContainer(allVars, stage, definitions, jobInfo, scmClient)
-		deployContainer.AddVolumeMountPoint(source, "/kontinuous/src", false)
-		deployContainer.AddVolumeMountPoint(status, "/kontinuous/status", false)
-		deployContainer.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+		mountBuildVolumes(deployContainer, source, status, docker)
 		setContainerEnv(deployContainer, secrets)
 		setContainerEnv(deployContainer, allVars)
 		addJobContainer(j, deployContainer)
@@ -142,6 +184,16 @@ func addSpecDetails(j *kube.Job, definitions *Definition, jobInfo *JobBuildInfo,
 
 }
 
+// mountBuildVolumes mounts the source and status of the build in the container, and the
+// docker socket when the build has it
+func mountBuildVolumes(container *kube.Container, source, status, docker *kube.Volume) {
+	container.AddVolumeMountPoint(source, "/kontinuous/src", false)
+	container.AddVolumeMountPoint(status, "/kontinuous/status", false)
+	if docker != nil {
+		container.AddVolumeMountPoint(docker, "/var/run/docker.sock", false)
+	}
+}
+
 func getCurrentStage(definitions *Definition, jobInfo *JobBuildInfo) (stage *Stage) {
 
 	index, _ := strconv.Atoi(jobInfo.Stage)
@@ -154,6 +206,11 @@ func getCurrentStage(definitions *Definition, jobInfo *JobBuildInfo) (stage *Sta
 }
 
 func getKontinuousVars(definitions *Definition, jobInfo *JobBuildInfo) map[string]interface{} {
+	prNumber := ""
+	if jobInfo.PullRequest > 0 {
+		prNumber = strconv.Itoa(jobInfo.PullRequest)
+	}
+
 	return map[string]interface{}{
 		"KONTINUOUS_PIPELINE_ID":       jobInfo.PipelineUUID,
 		"KONTINUOUS_BUILD_ID":          jobInfo.Build,
@@ -164,6 +221,10 @@ func getKontinuousVars(definitions *Definition, jobInfo *JobBuildInfo) map[strin
 		"KONTINUOUS_INTERNAL_REGISTRY": os.Getenv("INTERNAL_REGISTRY"),
 		"KONTINUOUS_COMMIT":            jobInfo.Commit,
 		"KONTINUOUS_URL":               os.Getenv("KONTINUOUS_URL"),
+		"KONTINUOUS_PR_NUMBER":         prNumber,
+		"KONTINUOUS_BASE_BRANCH":       jobInfo.BaseBranch,
+		"KONTINUOUS_TAG":               jobInfo.Tag,
+		"KONTINUOUS_ENVIRONMENT":       jobInfo.Environment,
 	}
 
 }
@@ -177,9 +238,26 @@ func createAgentContainer(definitions *Definition, jobInfo *JobBuildInfo) *kube.
 		"GIT_USER":            jobInfo.User,
 		"GIT_REPO":            jobInfo.Repo,
 		"GIT_OWNER":           jobInfo.Owner,
-		"S3_URL":              os.Getenv("S3_URL"),
-		"S3_ACCESS_KEY":       os.Getenv("S3_ACCESS_KEY"),
-		"S3_SECRET_KEY":       os.Getenv("S3_SECRET_KEY"),
+
+		"KONTINUOUS_BUILD_TOKEN": jobInfo.Token,
+	}
+
+	// untrusted builds upload their logs and artifacts through kontinuous instead of
+	// getting the object store's credentials
+	if !jobInfo.Untrusted {
+		envVars["S3_URL"] = os.Getenv("S3_URL")
+		envVars["S3_ACCESS_KEY"] = os.Getenv("S3_ACCESS_KEY")
+		envVars["S3_SECRET_KEY"] = os.Getenv("S3_SECRET_KEY")
+	}
+
+	// pull request commits, possibly from forks, are fetched from this ref
+	if jobInfo.Ref != "" {
+		envVars["GIT_REF"] = jobInfo.Ref
+	}
+
+	if jobInfo.CloneURL != "" {
+		envVars["GIT_CLONE_URL"] = jobInfo.CloneURL
+		envVars["GIT_CLONE_USER"] = jobInfo.CloneUser
 	}
 
 	setContainerEnv(container, envVars)
@@ -230,7 +308,7 @@ func createDeployContainer(deploymentVars map[string]string, stage *Stage, defin
 }
 
 func createDockerContainer(stage *Stage, jobInfo *JobBuildInfo, mode string) *kube.Container {
-	imageName := fmt.Sprintf("%s-%s", jobInfo.PipelineUUID, jobInfo.Build)
+	imageName := buildImage(jobInfo.PipelineUUID, jobInfo.Build)
 	container := createJobContainer("docker-agent", "quay.io/acaleph/docker-agent:latest")
 
 	envVar := map[string]string{
@@ -253,7 +331,7 @@ func createDockerContainer(stage *Stage, jobInfo *JobBuildInfo, mode string) *ku
 func createCommandContainer(stage *Stage, jobInfo *JobBuildInfo) *kube.Container {
 
 	containerName := "command-agent"
-	cmdImageName := fmt.Sprintf("%s-%s", jobInfo.PipelineUUID, jobInfo.Build)
+	cmdImageName := buildImage(jobInfo.PipelineUUID, jobInfo.Build)
 	cmdImage := fmt.Sprintf("%s/%s:%s", os.Getenv("INTERNAL_REGISTRY"), cmdImageName, jobInfo.Commit)
 	imageName := "quay.io/acaleph/command-agent:latest"
 	container := createJobContainer(containerName, imageName)
@@ -299,8 +377,28 @@ func createCommandContainer(stage *Stage, jobInfo *JobBuildInfo) *kube.Container
 	return container
 }
 
+// cloneSecretName is the secret holding the deploy key and known hosts of a pipeline
+func cloneSecretName(jobInfo *JobBuildInfo) string {
+	return fmt.Sprintf("%s-git", jobInfo.PipelineUUID)
+}
+
+// deployCloneSecret creates or updates the secret the agent clones plain git remotes with
+func deployCloneSecret(namespace string, jobInfo *JobBuildInfo) error {
+	kubeClient, err := NewKubeClient()
+	if err != nil {
+		return err
+	}
+	return kubeClient.CreateSecret(namespace, cloneSecretName(jobInfo), map[string]string{
+		"ssh-privatekey": jobInfo.CloneKey,
+		"known_hosts":    jobInfo.KnownHosts,
+	})
+}
+
 func deployJob(j *kube.Job) error {
-	kubeClient, _ := kube.NewClient("https://kubernetes.default")
+	kubeClient, err := NewKubeClient()
+	if err != nil {
+		return err
+	}
 	return kubeClient.CreateJob(j)
 }
 
@@ -311,10 +409,20 @@ func setContainerEnv(container *kube.Container, envVars map[string]string) {
 
 }
 
-func getSecrets(namespace string, allSecrets ...[]string) map[string]string {
-	kubeClient, _ := kube.NewClient("https://kubernetes.default")
+func getSecrets(namespace string, jobInfo *JobBuildInfo, allSecrets ...[]string) map[string]string {
 	secrets := make(map[string]string)
 
+	// untrusted builds, like pull requests from forks, run code that can leak secrets
+	if jobInfo.Untrusted {
+		return secrets
+	}
+
+	kubeClient, err := NewKubeClient()
+	if err != nil {
+		logrus.WithError(err).Println("Unable to get secrets")
+		return secrets
+	}
+
 	for _, secretArr := range allSecrets {
 		for _, secret := range secretArr {
 			secretEnv, err := kubeClient.GetSecret(namespace, secret)
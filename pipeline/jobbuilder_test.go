@@ -3,8 +3,11 @@ package pipeline
 import (
 	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/AcalephStorage/kontinuous/kube"
+	fakekube "github.com/AcalephStorage/kontinuous/kube/fake"
 	"github.com/AcalephStorage/kontinuous/scm/github"
 )
 
@@ -213,3 +216,91 @@ func TestValidInfoCommandJob(t *testing.T) {
 	}
 
 }
+
+func TestPullRequestKontinuousVars(t *testing.T) {
+	definition, _ := GetDefinition([]byte(validYamlSpec))
+	jobInfo, _ := GetJobBuildInfo([]byte(validJobBuildInfo))
+	jobInfo.PullRequest = 42
+	jobInfo.BaseBranch = "master"
+
+	vars := getKontinuousVars(definition, jobInfo)
+	if vars["KONTINUOUS_PR_NUMBER"] != "42" {
+		t.Errorf("Expected KONTINUOUS_PR_NUMBER to be `42`, got `%v`", vars["KONTINUOUS_PR_NUMBER"])
+	}
+	if vars["KONTINUOUS_BASE_BRANCH"] != "master" {
+		t.Errorf("Expected KONTINUOUS_BASE_BRANCH to be `master`, got `%v`", vars["KONTINUOUS_BASE_BRANCH"])
+	}
+}
+
+func TestUntrustedBuildHasNoSecrets(t *testing.T) {
+	jobInfo, _ := GetJobBuildInfo([]byte(validJobBuildInfo))
+	jobInfo.Untrusted = true
+
+	secrets := getSecrets("default", jobInfo, []string{"aws-credentials"})
+	if len(secrets) != 0 {
+		t.Errorf("Expected no secrets for an untrusted build, got `%v`", secrets)
+	}
+}
+
+func TestUntrustedBuildHasNoDockerSocket(t *testing.T) {
+	definition, _ := GetDefinition([]byte(validCommandYamlSpec))
+	jobInfo, _ := GetJobBuildInfo([]byte(validJobBuildInfo))
+	jobInfo.Untrusted = true
+
+	job, err := build(definition, jobInfo, MockSCMClient{})
+	if err != nil {
+		t.Fatalf("Expected the job to be built, got error: %s", err)
+	}
+
+	for _, volume := range job.Spec.Template.Spec.Volumes {
+		if volume.Name == "kontinuous-docker" {
+			t.Errorf("Expected no docker socket for an untrusted build")
+		}
+	}
+	for _, container := range job.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if strings.HasPrefix(env.Name, "S3_") {
+				t.Errorf("Expected no object store credentials for an untrusted build, found %s in %s", env.Name, container.Name)
+			}
+		}
+	}
+}
+
+func TestGitCloneKeyIsMountedFromSecret(t *testing.T) {
+	cluster := fakekube.NewClient()
+	defaultKubeClient := NewKubeClient
+	NewKubeClient = func() (kube.KubeClient, error) {
+		return cluster, nil
+	}
+	defer func() { NewKubeClient = defaultKubeClient }()
+
+	definition, _ := GetDefinition([]byte(validCommandYamlSpec))
+	jobInfo, _ := GetJobBuildInfo([]byte(validJobBuildInfo))
+	jobInfo.CloneURL = "git@git.example.com:mirrors/project.git"
+	jobInfo.CloneKey = "private key"
+	jobInfo.KnownHosts = "git.example.com ssh-rsa AAAA"
+
+	job, err := CreateJob(definition, jobInfo, MockSCMClient{})
+	if err != nil {
+		t.Fatalf("Expected the job to be created, got error: %s", err)
+	}
+
+	secret, err := cluster.GetSecret(getNamespace(definition), "XYZ-git")
+	if err != nil || secret["ssh-privatekey"] != "private key" || secret["known_hosts"] != jobInfo.KnownHosts {
+		t.Errorf("Expected the deploy key and known hosts in the clone secret, got %v: %v", secret, err)
+	}
+
+	agent := job.Spec.Template.Spec.Containers[0]
+	for _, env := range agent.Env {
+		if env.Value == "private key" {
+			t.Errorf("Expected the deploy key not to be in the env of the job, found in %s", env.Name)
+		}
+	}
+	mounted := false
+	for _, mount := range agent.VolumeMounts {
+		mounted = mounted || mount.Name == "kontinuous-ssh" && mount.MountPath == "/kontinuous/ssh" && mount.ReadOnly
+	}
+	if !mounted {
+		t.Error("Expected the clone secret to be mounted in the agent")
+	}
+}
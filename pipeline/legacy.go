@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// Pipelines, builds and stages were stored with a key per field before they were
+// stored as documents. These are read until they are migrated with MigrateDocuments
+// or saved again. Hook deliveries are read until they are pruned.
+
+// getLegacyPipeline reads a pipeline stored with a key per field
+func getLegacyPipeline(path string, kvClient kv.KVClient) *Pipeline {
+	p := new(Pipeline)
+
+	keys := Key{}
+	keys.Public, _ = kvClient.Get(path + "/keys/public")
+	keys.Private, _ = kvClient.Get(path + "/keys/private")
+	keys.ID, _ = kvClient.GetInt(path + "/keys/id")
+	events, _ := kvClient.Get(path + "/events")
+	branches, _ := kvClient.Get(path + "/branches")
+	tags, _ := kvClient.Get(path + "/tags")
+	secrets, _ := kvClient.Get(path + "/secrets")
+	vars, _ := kvClient.Get(path + "/vars")
+
+	p.ID, _ = kvClient.Get(path + "/uuid")
+	p.Repo, _ = kvClient.Get(path + "/repo")
+	p.Owner, _ = kvClient.Get(path + "/owner")
+	p.Login, _ = kvClient.Get(path + "/login")
+	p.Source, _ = kvClient.Get(path + "/source")
+	p.Remote, _ = kvClient.Get(path + "/remote")
+	p.ForkPolicy, _ = kvClient.Get(path + "/fork-policy")
+	p.HookSecret, _ = kvClient.Get(path + "/hook-secret")
+	checks, _ := kvClient.Get(path + "/checks")
+	p.Checks, _ = strconv.ParseBool(checks)
+	p.LatestBuildNumber, _ = kvClient.GetInt(path + "/latest-build")
+	p.Events = strings.Split(events, ",")
+	if branches != "" {
+		p.Branches = strings.Split(branches, ",")
+	}
+	if tags != "" {
+		p.Tags = strings.Split(tags, ",")
+	}
+	p.Keys = keys
+	p.Name = p.fullName()
+	p.Secrets = strings.Split(secrets, ",")
+	json.Unmarshal([]byte(vars), &p.Vars)
+
+	pipelineNotifiers := []*Notifier{}
+	notifiers, _ := kvClient.Get(path + "/notif/type")
+
+	if len(notifiers) > 0 {
+		notifierType := strings.Split(notifiers, " ")
+		notifnamespace, _ := kvClient.Get(path + "/notif/namespace")
+
+		for _, notifier := range notifierType {
+			pipelineNotifier := &Notifier{}
+			pipelineNotifier.Type = notifier
+			pipelineNotifier.Namespace = notifnamespace
+			pipelineNotifiers = append(pipelineNotifiers, pipelineNotifier)
+		}
+		p.Notifiers = pipelineNotifiers
+	}
+	return p
+}
+
+// legacyPipelineKeys are the keys of a pipeline stored with a key per field
+var legacyPipelineKeys = []string{
+	"uuid", "repo", "owner", "events", "keys", "login", "source", "remote", "branches",
+	"tags", "fork-policy", "hook-secret", "checks", "vars", "secrets", "latest-build", "notif",
+}
+
+// deleteLegacyPipeline removes the keys of a pipeline stored with a key per field,
+// the pipeline's builds and the other keys in its directory are kept
+func deleteLegacyPipeline(path string, kvClient kv.KVClient) error {
+	for _, key := range legacyPipelineKeys {
+		if err := kvClient.DeleteTree(path + "/" + key); err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLegacyBuild reads a build stored with a key per field and its stages
+func getLegacyBuild(path string, kvClient kv.KVClient) *Build {
+	b := new(Build)
+	b.ID, _ = kvClient.Get(path + "/uuid")
+	b.Status, _ = kvClient.Get(path + "/status")
+	b.Branch, _ = kvClient.Get(path + "/branch")
+	b.Commit, _ = kvClient.Get(path + "/commit")
+	b.Author, _ = kvClient.Get(path + "/author")
+	b.Event, _ = kvClient.Get(path + "/event")
+	b.CloneURL, _ = kvClient.Get(path + "/clone-url")
+	b.PullRequest, _ = kvClient.GetInt(path + "/pull-request")
+	b.BaseBranch, _ = kvClient.Get(path + "/base-branch")
+	b.HeadRepo, _ = kvClient.Get(path + "/head-repo")
+	b.Ref, _ = kvClient.Get(path + "/ref")
+	b.Tag, _ = kvClient.Get(path + "/tag")
+	untrusted, _ := kvClient.Get(path + "/untrusted")
+	b.Untrusted = untrusted == "true"
+	b.Message, _ = kvClient.Get(path + "/message")
+	b.Environment, _ = kvClient.Get(path + "/environment")
+	b.DeploymentID, _ = kvClient.GetInt(path + "/deployment-id")
+	params, _ := kvClient.Get(path + "/params")
+	json.Unmarshal([]byte(params), &b.Params)
+	b.Pipeline, _ = kvClient.Get(path + "/pipeline")
+	b.Number, _ = kvClient.GetInt(path + "/number")
+	b.CurrentStage, _ = kvClient.GetInt(path + "/current-stage")
+	created, _ := kvClient.Get(path + "/created")
+	started, _ := kvClient.Get(path + "/started")
+	finished, _ := kvClient.Get(path + "/finished")
+	b.Created, _ = strconv.ParseInt(created, 10, 64)
+	b.Started, _ = strconv.ParseInt(started, 10, 64)
+	b.Finished, _ = strconv.ParseInt(finished, 10, 64)
+	b.Stages = getLegacyStages(path+"/stages", kvClient)
+
+	return b
+}
+
+func getLegacyBuildSummary(path string, kvClient kv.KVClient) *BuildSummary {
+	b := new(BuildSummary)
+	b.ID, _ = kvClient.Get(path + "/uuid")
+	b.Status, _ = kvClient.Get(path + "/status")
+	b.Branch, _ = kvClient.Get(path + "/branch")
+	b.Commit, _ = kvClient.Get(path + "/commit")
+	b.Author, _ = kvClient.Get(path + "/author")
+	b.Tag, _ = kvClient.Get(path + "/tag")
+	b.Message, _ = kvClient.Get(path + "/message")
+	b.Number, _ = kvClient.GetInt(path + "/number")
+	created, _ := kvClient.Get(path + "/created")
+	started, _ := kvClient.Get(path + "/started")
+	finished, _ := kvClient.Get(path + "/finished")
+	b.Created, _ = strconv.ParseInt(created, 10, 64)
+	b.Started, _ = strconv.ParseInt(started, 10, 64)
+	b.Finished, _ = strconv.ParseInt(finished, 10, 64)
+
+	return b
+}
+
+func getLegacyStage(path string, kvClient kv.KVClient) *Stage {
+	s := new(Stage)
+	started, _ := kvClient.Get(path + "/started")
+	finished, _ := kvClient.Get(path + "/finished")
+	params, _ := kvClient.Get(path + "/params")
+	labels, _ := kvClient.Get(path + "/labels")
+	secrets, _ := kvClient.Get(path + "/secrets")
+	artifacts, _ := kvClient.Get(path + "/artifacts")
+	vars, _ := kvClient.Get(path + "/vars")
+
+	s.ID, _ = kvClient.Get(path + "/uuid")
+	s.Index, _ = kvClient.GetInt(path + "/index")
+	s.Failures, _ = kvClient.GetInt(path + "/failures")
+	s.CheckRunID, _ = kvClient.GetInt(path + "/check-run-id")
+	s.DeploymentID, _ = kvClient.GetInt(path + "/deployment-id")
+	s.Name, _ = kvClient.Get(path + "/name")
+	s.Type, _ = kvClient.Get(path + "/type")
+	s.DockerImage, _ = kvClient.Get(path + "/docker-image")
+	s.PodName, _ = kvClient.Get(path + "/pod-name")
+	s.JobName, _ = kvClient.Get(path + "/job-name")
+	s.Namespace, _ = kvClient.Get(path + "/namespace")
+	s.Status, _ = kvClient.Get(path + "/status")
+	s.Message, _ = kvClient.Get(path + "/message")
+	s.Started, _ = strconv.ParseInt(started, 10, 64)
+	s.Finished, _ = strconv.ParseInt(finished, 10, 64)
+	s.Secrets = strings.Split(secrets, ",")
+	if artifacts != "" {
+		s.Artifacts = strings.Split(artifacts, ",")
+	}
+
+	json.Unmarshal([]byte(params), &s.Params)
+	json.Unmarshal([]byte(labels), &s.Labels)
+	json.Unmarshal([]byte(vars), &s.Vars)
+
+	return s
+}
+
+// getLegacyStages reads the stages of a build stored with a key per field
+func getLegacyStages(path string, kvClient kv.KVClient) []*Stage {
+	stageDirs, err := kvClient.GetDir(path)
+	if err != nil {
+		return []*Stage{}
+	}
+
+	stages := make([]*Stage, len(stageDirs))
+	for i, pair := range stageDirs {
+		stages[i] = getLegacyStage(pair.Key, kvClient)
+	}
+	return stages
+}
+
+// getLegacyDelivery reads a webhook delivery stored with a key per field
+func getLegacyDelivery(path string, kvClient kv.KVClient) *Delivery {
+	d := new(Delivery)
+	headers, _ := kvClient.Get(path + "/headers")
+	received, _ := kvClient.Get(path + "/received")
+
+	d.ID, _ = kvClient.Get(path + "/id")
+	d.Event, _ = kvClient.Get(path + "/event")
+	d.Body, _ = kvClient.Get(path + "/body")
+	d.Result, _ = kvClient.Get(path + "/result")
+	d.Message, _ = kvClient.Get(path + "/message")
+	d.BuildNumber, _ = kvClient.GetInt(path + "/build-number")
+	d.Received, _ = strconv.ParseInt(received, 10, 64)
+	json.Unmarshal([]byte(headers), &d.Headers)
+
+	return d
+}
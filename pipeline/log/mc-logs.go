@@ -58,7 +58,7 @@ func FetchRunningLogs(k8s kube.KubeClient, namespace, pipeline, build, stage str
 }
 
 // FetchLogs returns a list of logs for a given stage
-func FetchLogs(mc *mc.MinioClient, uuid, buildNumber, stageIndex string) ([]Log, error) {
+func FetchLogs(mc mc.ObjectStore, uuid, buildNumber, stageIndex string) ([]Log, error) {
 	path := fmt.Sprintf(logPathTemplate, uuid, buildNumber, stageIndex)
 	logNames, err := fetchLogNames(mc, path)
 	if err != nil {
@@ -80,20 +80,16 @@ func FetchLogs(mc *mc.MinioClient, uuid, buildNumber, stageIndex string) ([]Log,
 	return logs, nil
 }
 
-func fetchLogNames(mc *mc.MinioClient, path string) ([]string, error) {
-	objects, err := mc.ListObjects(bucket, path)
+func fetchLogNames(mc mc.ObjectStore, path string) ([]string, error) {
+	logNames, err := mc.ListObjects(bucket, path)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
-	logNames := make([]string, len(objects))
-	for i, object := range objects {
-		logNames[i] = object.Key
-	}
 	return logNames, nil
 }
 
-func fetchContent(mc *mc.MinioClient, log string) (string, error) {
+func fetchContent(mc mc.ObjectStore, log string) (string, error) {
 	// create temp file
 	tmpfile, err := ioutil.TempFile("/tmp", "log-")
 	if err != nil {
@@ -0,0 +1,253 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// The layout of the pipelines, builds and stages in the store is versioned. Every
+// change to the layout is a migration with the next schema version, the pending
+// migrations are run in order from the stored version. A migration interrupted
+// before the version is written is run again so migrations need to skip what they
+// already changed.
+
+// schemaVersionKey keeps the version of the last migration run, stores from before
+// versioning have none and are at version 0
+const schemaVersionKey = appNamespace + "schema-version"
+
+// backupPrefix is where the keys are backed up in the object store before migrating
+const backupPrefix = "backups/"
+
+// ErrSchemaTooNew is returned when the store was migrated by a newer version of kontinuous
+var ErrSchemaTooNew = errors.New("the store was migrated by a newer version of kontinuous")
+
+type (
+	// Migration moves the stored records to the layout of its schema version
+	Migration struct {
+		Version int    `json:"version"`
+		Name    string `json:"name"`
+
+		// run changes the records and returns how many were changed
+		run func(kvClient kv.KVClient) (int, error)
+	}
+
+	// MigrationResult is a migration that was run and the number of records it changed
+	MigrationResult struct {
+		Version int    `json:"version"`
+		Name    string `json:"name"`
+		Changed int    `json:"changed"`
+	}
+
+	// MigrationReport describes a run of the pending migrations
+	MigrationReport struct {
+		From       int                `json:"from"`
+		To         int                `json:"to"`
+		DryRun     bool               `json:"dry_run"`
+		Backup     string             `json:"backup,omitempty"`
+		Migrations []*MigrationResult `json:"migrations"`
+	}
+
+	// migrationBackup is the object written before migrating
+	migrationBackup struct {
+		SchemaVersion int         `json:"schema_version"`
+		Created       int64       `json:"created"`
+		Keys          []*kv.Entry `json:"keys"`
+
+		// Salt derives the key of the encrypted secrets from AUTH_SECRET
+		Salt string `json:"salt"`
+	}
+)
+
+// migrations are ordered by version, new migrations are added at the end with the next version
+var migrations = []*Migration{
+	{Version: 1, Name: "documents", run: MigrateDocuments},
+	{Version: 2, Name: "build-index", run: MigrateBuildIndex},
+}
+
+// LatestSchemaVersion is the version of the layout this version of kontinuous reads
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the stored layout
+func SchemaVersion(kvClient kv.KVClient) (int, error) {
+	version, err := kvClient.GetInt(schemaVersionKey)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+// PendingMigrations returns the migrations that were not run on the store yet
+func PendingMigrations(kvClient kv.KVClient) ([]*Migration, error) {
+	version, err := SchemaVersion(kvClient)
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version)
+}
+
+func pendingMigrations(version int) ([]*Migration, error) {
+	if version > LatestSchemaVersion() {
+		return nil, ErrSchemaTooNew
+	}
+
+	pending := []*Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate runs the pending migrations. The keys are backed up to the object store
+// first, a dry run runs the migrations on an in-memory copy of the keys instead and
+// nothing is written.
+func Migrate(kvClient kv.KVClient, objectStore mc.ObjectStore, dryRun bool) (*MigrationReport, error) {
+	from, err := SchemaVersion(kvClient)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(from)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{
+		From:       from,
+		To:         from,
+		DryRun:     dryRun,
+		Migrations: []*MigrationResult{},
+	}
+	if len(pending) == 0 {
+		return report, nil
+	}
+
+	entries, err := kv.Dump(kvClient, appNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	target := kvClient
+	if dryRun {
+		inMemory := fake.NewClient()
+		if err := kv.Restore(inMemory, entries); err != nil {
+			return nil, err
+		}
+		target = inMemory
+	} else {
+		name, err := backupKeys(from, entries, objectStore)
+		if err != nil {
+			return nil, fmt.Errorf("unable to back up the store before migrating: %s", err)
+		}
+		report.Backup = name
+	}
+
+	for _, m := range pending {
+		changed, err := m.run(target)
+		if err != nil {
+			return report, fmt.Errorf("migration %d (%s) failed after %d changes: %s", m.Version, m.Name, changed, err)
+		}
+		if err := setSchemaVersion(report.To, m.Version, target); err != nil {
+			return report, err
+		}
+
+		report.To = m.Version
+		report.Migrations = append(report.Migrations, &MigrationResult{m.Version, m.Name, changed})
+	}
+	return report, nil
+}
+
+// setSchemaVersion moves the stored version from prev to next. Instances starting at
+// the same time run the same migrations, the version is kept when another instance
+// already moved it as far.
+func setSchemaVersion(prev, next int, kvClient kv.KVClient) error {
+	prevValue := ""
+	if prev > 0 {
+		prevValue = strconv.Itoa(prev)
+	}
+
+	err := kvClient.CompareAndSwap(schemaVersionKey, prevValue, strconv.Itoa(next))
+	if err != kv.ErrCompareFailed {
+		return err
+	}
+
+	current, err := SchemaVersion(kvClient)
+	if err != nil {
+		return err
+	}
+	if current < next {
+		return fmt.Errorf("schema version changed to %d while migrating to %d", current, next)
+	}
+	return nil
+}
+
+// restoreSchemaVersion stores the version of restored keys, stores at version 0 have none
+func restoreSchemaVersion(version int, kvClient kv.KVClient) error {
+	if version > 0 {
+		return kvClient.PutInt(schemaVersionKey, version)
+	}
+	if err := kvClient.DeleteTree(schemaVersionKey); err != nil && !etcd.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// backupKeys writes the keys to the object store and returns the name of the backup.
+// Agents can read the object store, the secrets are encrypted with AUTH_SECRET like
+// in a backup with a passphrase.
+func backupKeys(version int, entries []*kv.Entry, objectStore mc.ObjectStore) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	c, err := newBackupCipher(os.Getenv("AUTH_SECRET"), salt)
+	if err != nil {
+		return "", err
+	}
+
+	// the entries are migrated after the backup, the secrets are encrypted in copies
+	encrypted := make([]*kv.Entry, len(entries))
+	for i, entry := range entries {
+		copied := *entry
+		if err := transformSecrets(&copied, c.encrypt); err != nil {
+			return "", fmt.Errorf("unable to encrypt %s: %s", entry.Key, err)
+		}
+		encrypted[i] = &copied
+	}
+
+	now := time.Now()
+	content, err := json.Marshal(&migrationBackup{
+		SchemaVersion: version,
+		Created:       now.UnixNano(),
+		Keys:          encrypted,
+		Salt:          base64.StdEncoding.EncodeToString(salt),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%sschema-%d-%d.json", backupPrefix, version, now.Unix())
+	if err := objectStore.PutObject("kontinuous", name, bytes.NewReader(content)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+func newTestObjectStore(t *testing.T) (*mc.LocalStore, func()) {
+	dir, err := ioutil.TempDir("", "kontinuous-objects-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := mc.NewLocalStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	kvc := setupLegacyStore(2, 3)
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	report, err := Migrate(kvc, objects, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report.From != 0 || report.To != LatestSchemaVersion() || len(report.Migrations) != len(migrations) || report.Migrations[0].Changed != 3 {
+		t.Fatalf("Expected the documents migration to change 3 records, got %+v", report)
+	}
+	if report.Migrations[1].Changed != 2 {
+		t.Errorf("Expected the 2 builds to be indexed, got %d", report.Migrations[1].Changed)
+	}
+
+	if version, _ := SchemaVersion(kvc); version != 0 {
+		t.Errorf("Expected a dry run to keep the schema version, got %d", version)
+	}
+	if _, err := kvc.Get(pipelineNamespace + "SampleOwner:SampleRepo/hook-secret"); err != nil {
+		t.Error("Expected a dry run to keep the stored records")
+	}
+	if backups, _ := objects.ListObjects("kontinuous", backupPrefix); len(backups) != 0 {
+		t.Errorf("Expected a dry run not to back up, got %v", backups)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	os.Setenv("AUTH_SECRET", "c2VjcmV0")
+	kvc := setupLegacyStore(2, 3)
+	kvc.Put(pipelineNamespace+"SampleOwner:SampleRepo/keys/private", "private key")
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	report, err := Migrate(kvc, objects, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if version, _ := SchemaVersion(kvc); version != LatestSchemaVersion() || report.To != version {
+		t.Errorf("Expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+	if backups, _ := objects.ListObjects("kontinuous", backupPrefix); len(backups) != 1 || backups[0] != report.Backup {
+		t.Errorf("Expected backup %s, got %v", report.Backup, backups)
+	}
+	backup, _ := ioutil.TempFile("", "kontinuous-backup-")
+	defer os.Remove(backup.Name())
+	backup.Close()
+	if err := objects.CopyLocally("kontinuous", report.Backup, backup.Name()); err != nil {
+		t.Fatalf("Unable to read backup: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(backup.Name()); strings.Contains(string(content), "private key") {
+		t.Error("Expected the secrets of the backup to be encrypted")
+	}
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	if builds, _ := p.GetBuilds(kvc); len(builds) != 2 {
+		t.Errorf("Expected the migrated builds to be read, got %d", len(builds))
+	}
+
+	again, err := Migrate(kvc, objects, false)
+	if err != nil || len(again.Migrations) != 0 || again.Backup != "" {
+		t.Errorf("Expected nothing to migrate again, got %+v: %v", again, err)
+	}
+
+	kvc.PutInt(schemaVersionKey, LatestSchemaVersion()+1)
+	if _, err := Migrate(kvc, objects, false); err != ErrSchemaTooNew {
+		t.Errorf("Expected a newer schema to fail, got %v", err)
+	}
+}
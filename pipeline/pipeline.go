@@ -4,18 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"encoding/base64"
+	"net/url"
+	"path/filepath"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/choodur/drone/shared/crypto"
 	etcd "github.com/coreos/etcd/client"
 	"github.com/dgrijalva/jwt-go"
 
-	"encoding/json"
 	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/AcalephStorage/kontinuous/scm/git"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 	"github.com/AcalephStorage/kontinuous/store/mc"
 )
@@ -39,12 +43,26 @@ const (
 	// BuildWaiting indicates that the build is waiting for user input
 	BuildWaiting = "WAITING"
 
+	// BuildPendingApproval indicates that the build is from a fork and waits for a maintainer's approval
+	BuildPendingApproval = "PENDING_APPROVAL"
+
+	// ForkPolicyNever doesn't build pull requests from forks
+	ForkPolicyNever = "never"
+
+	// ForkPolicyApproval holds builds of pull requests from forks until a maintainer approves them
+	ForkPolicyApproval = "approval"
+
+	// ForkPolicyAllow runs builds of pull requests from forks like any other build
+	ForkPolicyAllow = "allow"
+
 	claimsIssuer      = "http://kontinuous.io"
 	claimsSubject     = "kontinuous"
 	buildEndpoint     = "%s/api/v1/pipelines/%s/%s/builds"
 	appNamespace      = "/kontinuous/"
 	userNamespace     = appNamespace + "users/"
 	pipelineNamespace = appNamespace + "pipelines/"
+
+	installationNamespace = appNamespace + "installations/"
 )
 
 type (
@@ -52,6 +70,9 @@ type (
 	Key struct {
 		Private string
 		Public  string
+
+		// ID of the deploy key in the remote, removed with the pipeline
+		ID int
 	}
 
 	// NextJobInfo contains the data needed to get the details for creating a job
@@ -59,6 +80,20 @@ type (
 		Commit      string
 		BuildNumber int
 		StageIndex  int
+		Branch      string
+		Ref         string
+		PullRequest int
+		BaseBranch  string
+		Tag         string
+		Untrusted   bool
+		Params      map[string]interface{}
+
+		// deployment events only run the deploy stages of the environment
+		Environment  string
+		DeploymentID int
+
+		// Token authenticates the agent's requests for the build's objects
+		Token string
 	}
 
 	Notifier struct {
@@ -79,11 +114,23 @@ type Pipeline struct {
 	LatestBuildNumber int                    `json:"-"`
 	LatestBuild       *BuildSummary          `json:"latest_build,omitempty"`
 	Keys              Key                    `json:"-"`
+	HookSecret        string                 `json:"-"`
+	HookID            string                 `json:"-"`
 	Login             string                 `json:"login"`
-	Source            string                 `json:"-"`
+	Source            string                 `json:"source,omitempty"`
+	Remote            string                 `json:"remote,omitempty"`
+	KnownHosts        string                 `json:"known_hosts,omitempty"`
+	Branches          []string               `json:"branches,omitempty"`
+	Tags              []string               `json:"tags,omitempty"`
+	ForkPolicy        string                 `json:"fork_policy,omitempty"`
+	Checks            bool                   `json:"checks,omitempty"`
 	Notifiers         []*Notifier            `json:"notif,omitempty"`
 	Secrets           []string               `json:"secrets,omitempty"`
 	Vars              map[string]interface{} `json:"vars, omitempty"`
+	Retention         *RetentionPolicy       `json:"retention,omitempty"`
+
+	// ResourceVersion is incremented when the pipeline is saved
+	ResourceVersion int `json:"resource_version"`
 }
 
 // CreatePipeline persists the pipeline details and setups
@@ -119,35 +166,36 @@ func CreatePipeline(p *Pipeline, c scm.Client, k kv.KVClient) (err error) {
 		return err
 	}
 
-	// persist pipeline
-	if err = p.Save(k); err != nil {
+	if err = p.generateHookSecret(); err != nil {
 		return err
 	}
 
-	// create hook
-	secret, err := p.GenerateHookSecret(os.Getenv("AUTH_SECRET"))
-	if err != nil {
+	// persist pipeline
+	if err = p.Save(k); err != nil {
 		return err
 	}
 
-	deployURL := os.Getenv("KONTINUOUS_URL")
-	callback := fmt.Sprintf(buildEndpoint+"?id_token=%s", deployURL, p.Owner, p.Repo, secret)
+	// create hook
+	callback := p.HookCallback()
 
-	// hook might already be created from a previous install
+	// hook might already be created from a previous install, its secret is replaced by recreating it
 	// TODO: ensure hooks are unique per install
-	if !c.HookExists(p.Owner, p.Repo, callback) {
-		if err = c.CreateHook(p.Owner, p.Repo, callback, p.Events); err != nil {
+	if c.HookExists(p.Owner, p.Repo, callback) {
+		if err = c.DeleteHook(p.Owner, p.Repo, callback); err != nil {
 			return err
 		}
 	}
+	if p.HookID, err = c.CreateHook(p.Owner, p.Repo, callback, p.HookSecret, p.Events); err != nil {
+		return err
+	}
 
 	// create deploy keys for repo
 	// always create a new one since we persist this with the pipeline details
-	if err = c.CreateKey(p.Owner, p.Repo, p.Keys.Public, callback); err != nil {
+	if p.Keys.ID, err = c.CreateKey(p.Owner, p.Repo, p.Keys.Public, callback); err != nil {
 		return err
 	}
 
-	return nil
+	return p.Save(k)
 }
 
 // FindPipeline returns a pipeline based on the given owner & repo details
@@ -192,44 +240,81 @@ func FindAllPipelines(kvClient kv.KVClient) ([]*Pipeline, error) {
 	return pipelines, nil
 }
 
-func getPipeline(path string, kvClient kv.KVClient) *Pipeline {
-	p := new(Pipeline)
-
-	keys := Key{}
-	keys.Public, _ = kvClient.Get(path + "/keys/public")
-	keys.Private, _ = kvClient.Get(path + "/keys/private")
-	events, _ := kvClient.Get(path + "/events")
-	secrets, _ := kvClient.Get(path + "/secrets")
-	vars, _ := kvClient.Get(path + "/vars")
-
-	p.ID, _ = kvClient.Get(path + "/uuid")
-	p.Repo, _ = kvClient.Get(path + "/repo")
-	p.Owner, _ = kvClient.Get(path + "/owner")
-	p.Login, _ = kvClient.Get(path + "/login")
-	p.Source, _ = kvClient.Get(path + "/source")
-	p.LatestBuildNumber, _ = kvClient.GetInt(path + "/latest-build")
-	p.LatestBuild, _ = p.GetBuildSummary(p.LatestBuildNumber, kvClient)
-	p.Events = strings.Split(events, ",")
-	p.Keys = keys
-	p.Name = p.fullName()
-	p.Secrets = strings.Split(secrets, ",")
-	json.Unmarshal([]byte(vars), &p.Vars)
+// PipelineQuery selects a page of pipelines ordered by owner and repository
+type PipelineQuery struct {
+	// Owner only lists the pipelines of the owner when set
+	Owner string
 
-	pipelineNotifiers := []*Notifier{}
-	notifiers, _ := kvClient.Get(path + "/notif/type")
+	// Descending lists the pipelines in reverse order
+	Descending bool
 
-	if len(notifiers) > 0 {
-		notifierType := strings.Split(notifiers, " ")
-		notifnamespace, _ := kvClient.Get(path + "/notif/namespace")
+	// Cursor is the owner/repo of the last pipeline of the previous page, empty starts at the first page
+	Cursor string
 
-		for _, notifier := range notifierType {
-			pipelineNotifier := &Notifier{}
-			pipelineNotifier.Type = notifier
-			pipelineNotifier.Namespace = notifnamespace
-			pipelineNotifiers = append(pipelineNotifiers, pipelineNotifier)
+	// Limit is the size of the page, zero lists every pipeline
+	Limit int
+}
+
+// ListPipelines returns a page of the pipelines and the cursor of the next page, empty
+// on the last page. Only the pipelines of the page are read.
+func ListPipelines(q *PipelineQuery, kvClient kv.KVClient) ([]*Pipeline, string, error) {
+	// the pipelines are directories, only their names are read and not the keys under
+	// them, etcd v3 lists the keys without their values
+	pipelineDirs, err := kvClient.GetDir(pipelineNamespace)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return make([]*Pipeline, 0), "", nil
 		}
-		p.Notifiers = pipelineNotifiers
+		return nil, "", err
+	}
+
+	// pipelines are stored as owner:repo and listed as owner/repo
+	names := []string{}
+	for _, pair := range pipelineDirs {
+		name := strings.Replace(strings.TrimPrefix(pair.Key, pipelineNamespace), ":", "/", 1)
+		if q.matches(name) {
+			names = append(names, name)
+		}
+	}
+	if q.Descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	} else {
+		sort.Strings(names)
+	}
+
+	next := ""
+	if q.Limit > 0 && len(names) > q.Limit {
+		names = names[:q.Limit]
+		next = names[q.Limit-1]
+	}
+
+	pipelines := make([]*Pipeline, len(names))
+	for i, name := range names {
+		pipelines[i] = getPipeline(pipelineNamespace+strings.Replace(name, "/", ":", 1), kvClient)
+	}
+	return pipelines, next, nil
+}
+
+// matches checks if a pipeline is of the owner and after the cursor
+func (q *PipelineQuery) matches(name string) bool {
+	if q.Owner != "" && !strings.HasPrefix(name, q.Owner+"/") {
+		return false
+	}
+	if q.Cursor == "" {
+		return true
+	}
+	if q.Descending {
+		return name < q.Cursor
+	}
+	return name > q.Cursor
+}
+
+func getPipeline(path string, kvClient kv.KVClient) *Pipeline {
+	p, _, err := loadPipeline(path, kvClient)
+	if err != nil || p == nil {
+		p = new(Pipeline)
 	}
+	p.LatestBuild, _ = p.GetBuildSummary(p.LatestBuildNumber, kvClient)
 	return p
 }
 
@@ -251,80 +336,140 @@ func (p *Pipeline) GenerateHookSecret(secret string) (string, error) {
 	return tokenString, nil
 }
 
-// Save persists the pipeline details to `etcd`
-func (p *Pipeline) Save(kvClient kv.KVClient) (err error) {
-	p.Name = p.fullName()
-	path := pipelineNamespace + p.Name
-	events := strings.Join(p.Events, ",")
-	pipelineSecrets := strings.Join(p.Secrets, ",")
-	isNew := false
+// HookCallback returns the url the remote sends webhooks to
+func (p *Pipeline) HookCallback() string {
+	return fmt.Sprintf(buildEndpoint, os.Getenv("KONTINUOUS_URL"), p.Owner, p.Repo)
+}
 
-	_, err = kvClient.GetDir(path)
-	if err != nil || etcd.IsKeyNotFound(err) {
-		isNew = true
+// LegacyHookCallback returns the callback of hooks created before webhook secrets,
+// these authenticate with a JWT from GenerateHookSecret in the url
+func (p *Pipeline) LegacyHookCallback() (string, error) {
+	token, err := p.GenerateHookSecret(os.Getenv("AUTH_SECRET"))
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf(buildEndpoint+"?id_token=%s", os.Getenv("KONTINUOUS_URL"), p.Owner, p.Repo, token), nil
+}
 
-	if err = kvClient.Put(path+"/uuid", p.ID); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/repo", p.Repo); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/owner", p.Owner); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/events", events); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/keys/public", p.Keys.Public); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/keys/private", p.Keys.Private); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/login", p.Login); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(path+"/source", p.Source); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+// ValidLegacyHookToken checks the JWT of a hook created before webhook secrets
+func (p *Pipeline) ValidLegacyHookToken(tokenString, secret string) bool {
+	s, _ := base64.URLEncoding.DecodeString(secret)
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+		}
+		return s, nil
+	})
+	if err != nil || !token.Valid {
+		return false
 	}
 
-	vars, _ := json.Marshal(p.Vars)
-	if err = kvClient.Put(path+"/vars", string(vars)); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	return token.Claims["owner"] == p.Owner && token.Claims["repo"] == p.Repo
+}
+
+// RotateHookSecret replaces the pipeline's webhook with one signed by a new secret.
+// Hooks authenticating with a token in the url are removed as well.
+func (p *Pipeline) RotateHookSecret(c scm.Client, kvClient kv.KVClient) error {
+	if err := p.generateHookSecret(); err != nil {
+		return err
 	}
 
-	if err = kvClient.Put(path+"/secrets", pipelineSecrets); err != nil {
-		return handleSaveError(path, isNew, err, kvClient)
+	if err := p.deleteHook(c); err != nil {
+		return err
 	}
 
-	if !isNew {
-		if err = kvClient.PutInt(path+"/latest-build", p.LatestBuildNumber); err != nil {
-			return handleSaveError(path, isNew, err, kvClient)
-		}
+	hookID, err := c.CreateHook(p.Owner, p.Repo, p.HookCallback(), p.HookSecret, p.Events)
+	if err != nil {
+		return err
 	}
 
-	if p.Notifiers != nil && len(p.Notifiers) > 0 {
+	p.HookID = hookID
+	return p.Save(kvClient)
+}
 
-		types := make([]string, len(p.Notifiers))
-		for _, notifier := range p.Notifiers {
-			types = append(types, notifier.Type)
+// Save persists the pipeline details to `etcd`. Returns ErrConflict when the pipeline
+// was saved by someone else since it was read.
+func (p *Pipeline) Save(kvClient kv.KVClient) error {
+	p.Name = p.fullName()
+	saved, err := updatePipeline(pipelineNamespace+p.Name, kvClient, func(stored *Pipeline) (*Pipeline, error) {
+		if stored != nil && stored.ResourceVersion != p.ResourceVersion {
+			return nil, ErrConflict
 		}
 
-		notifValue := strings.Join(types, " ")
-		if err = kvClient.Put(path+"/notif/type", notifValue); err != nil {
-			return handleSaveError(path, isNew, err, kvClient)
+		next := *p
+		next.ResourceVersion++
+		return &next, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.ResourceVersion = saved.ResourceVersion
+	return nil
+}
+
+// setLatestBuild records the latest build of the pipeline. Hooks create builds of the
+// same pipeline at the same time so it is set on the stored pipeline instead of saving p.
+func (p *Pipeline) setLatestBuild(number int, kvClient kv.KVClient) error {
+	previous := 0
+	saved, err := updatePipeline(pipelineNamespace+p.fullName(), kvClient, func(stored *Pipeline) (*Pipeline, error) {
+		if stored == nil {
+			stored = p
 		}
+		next := *stored
+		previous = next.ResourceVersion
 
-		if err = kvClient.Put(path+"/notif/namespace", p.Notifiers[0].Namespace); err != nil {
-			return handleSaveError(path, isNew, err, kvClient)
+		if number > next.LatestBuildNumber {
+			next.LatestBuildNumber = number
 		}
+		next.ResourceVersion++
+		return &next, nil
+	})
+	if err != nil {
+		return err
 	}
 
+	// p is still current if the latest build is the only change since it was read
+	if p.ResourceVersion == previous {
+		p.ResourceVersion = saved.ResourceVersion
+	}
+	p.LatestBuildNumber = saved.LatestBuildNumber
 	return nil
 }
 
-func (p *Pipeline) DeletePipeline(kvClient kv.KVClient, mcClient *mc.MinioClient) (err error) {
+// DeleteHookAndKey removes the webhook and deploy key created for the pipeline from the remote.
+// Pipelines created before deploy key IDs were tracked keep their key.
+func (p *Pipeline) DeleteHookAndKey(c scm.Client) error {
+	if err := p.deleteHook(c); err != nil {
+		return err
+	}
+
+	if p.Keys.ID == 0 {
+		logrus.Warnf("Unknown deploy key of %s/%s, it needs to be removed manually", p.Owner, p.Repo)
+		return nil
+	}
+	return c.DeleteKey(p.Owner, p.Repo, p.Keys.ID)
+}
+
+// deleteHook removes the webhook created for the pipeline by its ID, and the legacy webhook
+// authenticating with a token in its url. The webhooks of pipelines created before the IDs
+// were tracked are found by their callback.
+func (p *Pipeline) deleteHook(c scm.Client) error {
+	legacyCallback, err := p.LegacyHookCallback()
+	if err != nil {
+		return err
+	}
+	if err := c.DeleteHook(p.Owner, p.Repo, legacyCallback); err != nil {
+		return err
+	}
+
+	if p.HookID != "" {
+		return c.DeleteHookByID(p.Owner, p.Repo, p.HookID)
+	}
+	return c.DeleteHook(p.Owner, p.Repo, p.HookCallback())
+}
+
+func (p *Pipeline) DeletePipeline(kvClient kv.KVClient, mcClient mc.ObjectStore) (err error) {
 	path := fmt.Sprintf("%s%s", pipelineNamespace, p.fullName())
 	pipelinePrefix := fmt.Sprintf("pipelines/%s", p.ID)
 	bucket := "kontinuous"
@@ -354,37 +499,109 @@ func (p *Pipeline) Validate() error {
 	if p.Source == "" {
 		return errors.New("Source is required.")
 	}
+	// owner and repo are path segments of the API, GitLab subgroups can't be built
+	if strings.Contains(p.Owner, "/") || strings.Contains(p.Repo, "/") {
+		return errors.New("Owner and repo can't contain `/`, GitLab subgroups are not supported.")
+	}
+	if p.Source == scm.RepoGit && p.Remote == "" {
+		return errors.New("Remote is required for git pipelines.")
+	}
+	if p.Source == scm.RepoGit && git.IsSSH(p.Remote) && strings.TrimSpace(p.KnownHosts) == "" {
+		return errors.New("Known hosts are required for git pipelines with SSH remotes.")
+	}
 
-	optEvents := []string{}
-	reqEvents := []string{scm.EventPush}
+	switch p.ForkPolicy {
+	case "", ForkPolicyNever, ForkPolicyApproval, ForkPolicyAllow:
+	default:
+		return fmt.Errorf("Fork policy must be any of the following: %s, %s, %s",
+			ForkPolicyNever,
+			ForkPolicyApproval,
+			ForkPolicyAllow)
+	}
+
+	if p.Checks && p.Source != scm.RepoGithub {
+		return errors.New("Check runs are only supported on GitHub pipelines.")
+	}
+
+	// release pipelines only need tag or release events instead of push
+	optEvents := []string{scm.EventPullRequest}
+	reqEvents := []string{scm.EventPush, scm.EventTag, scm.EventRelease, scm.EventDeployment}
 	allEvents := append(optEvents, reqEvents...)
 	if len(p.Events) == 0 {
 		return fmt.Errorf("Events is required. Must be any of the following: %s",
 			strings.Join(allEvents, ", "))
 	}
 
-	missingReqEvents := []string{}
+	for _, event := range p.Events {
+		if !contains(allEvents, event) {
+			return fmt.Errorf("Unknown event %s. Must be any of the following: %s",
+				event,
+				strings.Join(allEvents, ", "))
+		}
+	}
+
+	hasReqEvent := false
 	for _, req := range reqEvents {
-		missing := req
-		for _, event := range p.Events {
-			if req == event {
-				missing = ""
-				break
-			}
+		if p.HasEvent(req) {
+			hasReqEvent = true
+			break
 		}
-		if missing != "" {
-			missingReqEvents = append(missingReqEvents, missing)
+	}
+
+	if !hasReqEvent {
+		return fmt.Errorf("At least one of the following events is required: %s",
+			strings.Join(reqEvents, ", "))
+	}
+
+	for _, tag := range p.Tags {
+		if _, err := filepath.Match(tag, ""); err != nil {
+			return fmt.Errorf("Invalid tag filter %s", tag)
 		}
 	}
 
-	if len(missingReqEvents) != 0 {
-		return fmt.Errorf("The following events are required: %s",
-			strings.Join(missingReqEvents, ", "))
+	if p.Retention != nil {
+		if err := p.Retention.Validate(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// HasEvent checks if the pipeline builds the given event
+func (p *Pipeline) HasEvent(event string) bool {
+	return contains(p.Events, event)
+}
+
+// Triggers checks if a hook should create a build of the pipeline.
+// Tags are matched against the pipeline's tag filters, all tags are built when there are none.
+// Commits with a `[skip ci]` directive are not built, nor are pull requests from forks
+// unless the fork policy allows them.
+func (p *Pipeline) Triggers(hook *scm.Hook) bool {
+	if !p.HasEvent(hook.Event) || SkipBuild(hook.Message) {
+		return false
+	}
+
+	forkPolicy := p.ForkPolicy
+	if forkPolicy == "" {
+		forkPolicy = ForkPolicyNever
+	}
+	if forkPolicy == ForkPolicyNever && p.isFork(hook.PullRequest, hook.HeadRepo) {
+		return false
+	}
+
+	if hook.Event != scm.EventTag && hook.Event != scm.EventRelease || len(p.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range p.Tags {
+		if matched, _ := filepath.Match(tag, hook.Tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Definition retrieves the pipeline definition from a given reference
 func (p *Pipeline) Definition(ref string, c scm.Client) (*Definition, error) {
 	file, ok := c.GetFileContent(p.Owner, p.Repo, PipelineYAML, ref)
@@ -418,7 +635,7 @@ func (p *Pipeline) GetAllBuildsSummary(kvClient kv.KVClient) ([]*BuildSummary, e
 
 	builds := make([]*BuildSummary, len(buildDirs))
 	for i, pair := range buildDirs {
-		builds[i] = getBuildSummary(pair.Key, kvClient)
+		builds[i] = listedBuildSummary(pair, kvClient)
 	}
 
 	return builds, nil
@@ -437,7 +654,7 @@ func (p *Pipeline) GetBuilds(kvClient kv.KVClient) ([]*Build, error) {
 
 	p.Builds = make([]*Build, len(buildDirs))
 	for i, pair := range buildDirs {
-		p.Builds[i] = getBuild(pair.Key, kvClient)
+		p.Builds[i] = listedBuild(pair, kvClient)
 	}
 
 	return p.Builds, nil
@@ -446,23 +663,13 @@ func (p *Pipeline) GetBuilds(kvClient kv.KVClient) ([]*Build, error) {
 // GetBuild fetches a specific build by its number
 func (p *Pipeline) GetBuild(num int, kvClient kv.KVClient) (*Build, bool) {
 	path := fmt.Sprintf("%s%s:%s/builds/%d", pipelineNamespace, p.Owner, p.Repo, num)
-	_, err := kvClient.GetDir(path)
-	if err != nil || etcd.IsKeyNotFound(err) {
-		return nil, false
-	}
-
-	return getBuild(path, kvClient), true
+	return getBuild(path, kvClient)
 }
 
 // GetBuildSummary fetches a specific build by its number and returns a summarized details
 func (p *Pipeline) GetBuildSummary(num int, kvClient kv.KVClient) (*BuildSummary, bool) {
 	path := fmt.Sprintf("%s%s:%s/builds/%d", pipelineNamespace, p.Owner, p.Repo, num)
-	_, err := kvClient.GetDir(path)
-	if err != nil || etcd.IsKeyNotFound(err) {
-		return nil, false
-	}
-
-	return getBuildSummary(path, kvClient), true
+	return getBuildSummary(path, kvClient)
 }
 
 // CreateBuild persists build & stage details based on the given definition
@@ -470,25 +677,50 @@ func (p *Pipeline) CreateBuild(b *Build, stages []*Stage, kvClient kv.KVClient,
 	b.Created = time.Now().UnixNano()
 	b.CurrentStage = 1
 	b.Status = BuildPending
+	p.applyForkPolicy(b)
+	b.Params = ParseDirectives(b.Message)
 	b.Pipeline = p.fullName()
 	b.ID = generateUUID()
-	b.Number = generateSequentialID(fmt.Sprintf("%s%s/builds", pipelineNamespace, b.Pipeline), kvClient)
 	b.Stages = stages
 
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	b.Token = token
+
+	number, err := nextSequentialID(
+		fmt.Sprintf("%s%s/build-counter", pipelineNamespace, b.Pipeline),
+		fmt.Sprintf("%s%s/builds", pipelineNamespace, b.Pipeline),
+		kvClient)
+	if err != nil {
+		return err
+	}
+	b.Number = number
+
 	if err := b.Save(kvClient); err != nil {
 		return err
 	}
 
 	if b.Branch != b.Commit {
+		checks, useChecks := p.checksClient(scmClient)
 		for _, stage := range b.Stages {
+			if useChecks {
+				err := stage.queueCheckRun(p, b, kvClient, checks)
+				if err == nil {
+					continue
+				}
+				if err != scm.ErrChecksUnavailable {
+					return err
+				}
+			}
 			if err := scmClient.CreateStatus(p.Owner, p.Repo, b.Commit, stage.Index, stage.Name, scm.StatePending); err != nil {
 				return err
 			}
 		}
 	}
 
-	p.LatestBuildNumber = b.Number
-	if err := p.Save(kvClient); err != nil {
+	if err := p.setLatestBuild(b.Number, kvClient); err != nil {
 		return err
 	}
 
@@ -502,19 +734,106 @@ func (p *Pipeline) PrepareBuildStage(n *NextJobInfo, scmClient scm.Client) (*Def
 		return nil, nil, err
 	}
 
+	// stage indexes of deployment builds only count the deploy stages
+	if n.DeploymentID != 0 {
+		definition.DeployStages(n.Environment)
+	}
+
 	jobInfo := &JobBuildInfo{
 		PipelineUUID: p.ID,
 		Build:        strconv.Itoa(n.BuildNumber),
 		Stage:        strconv.Itoa(n.StageIndex),
 		Commit:       n.Commit,
+		Branch:       n.Branch,
+		Ref:          n.Ref,
+		PullRequest:  n.PullRequest,
+		BaseBranch:   n.BaseBranch,
+		Tag:          n.Tag,
+		Untrusted:    n.Untrusted,
+		Params:       n.Params,
+		Environment:  n.Environment,
+		Token:        n.Token,
 		User:         scmClient.AccessToken(),
 		Repo:         p.Repo,
 		Owner:        p.Owner,
 	}
 
+	// untrusted code must not get the user's token or override the pipeline's vars
+	if n.Untrusted {
+		jobInfo.User = ""
+		jobInfo.Params = nil
+	}
+
+	// plain git remotes are cloned with the deploy key instead of the user's token,
+	// the agent clones from github.com when there is no clone url
+	if p.Source == scm.RepoGit {
+		jobInfo.CloneURL = p.Remote
+		jobInfo.CloneKey = p.Keys.Private
+		jobInfo.KnownHosts = p.KnownHosts
+	} else if p.Source != scm.RepoGithub && p.Source != "" {
+		repo, ok := scmClient.GetRepository(p.Owner, p.Repo)
+		if !ok {
+			return nil, nil, fmt.Errorf("Unable to get the clone url of %s/%s", p.Owner, p.Repo)
+		}
+		jobInfo.CloneURL = repo.CloneURL
+		jobInfo.CloneUser = tokenUsers[p.Source]
+	}
+
 	return definition, jobInfo, nil
 }
 
+// checksClient returns the client used to report stages as check runs
+// when the pipeline has them enabled and the SCM supports them
+func (p *Pipeline) checksClient(c scm.Client) (scm.ChecksClient, bool) {
+	if !p.Checks {
+		return nil, false
+	}
+	checks, ok := c.(scm.ChecksClient)
+	return checks, ok
+}
+
+// isFork checks if a pull request comes from another repository
+func (p *Pipeline) isFork(pullRequest int, headRepo string) bool {
+	if pullRequest == 0 || headRepo == "" {
+		return false
+	}
+	return !strings.EqualFold(headRepo, fmt.Sprintf("%s/%s", p.Owner, p.Repo))
+}
+
+// applyForkPolicy marks builds of pull requests from forks as untrusted
+// and holds them for approval when the pipeline requires it. Forks are not
+// built with the never policy, builds still created are untrusted.
+func (p *Pipeline) applyForkPolicy(b *Build) {
+	if !b.IsFork(p) {
+		return
+	}
+
+	switch p.ForkPolicy {
+	case ForkPolicyAllow:
+		b.Untrusted = false
+	case ForkPolicyApproval:
+		b.Untrusted = true
+		b.Status = BuildPendingApproval
+	default:
+		b.Untrusted = true
+	}
+}
+
+// GetPolledHead returns the last head commit of a branch seen when polling the remote
+func (p *Pipeline) GetPolledHead(branch string, kvClient kv.KVClient) string {
+	head, _ := kvClient.Get(p.polledHeadPath(branch))
+	return head
+}
+
+// SavePolledHead persists the head commit of a branch seen when polling the remote
+func (p *Pipeline) SavePolledHead(branch, commit string, kvClient kv.KVClient) error {
+	return kvClient.Put(p.polledHeadPath(branch), commit)
+}
+
+func (p *Pipeline) polledHeadPath(branch string) string {
+	return fmt.Sprintf("%s%s/heads/%s", pipelineNamespace, p.fullName(), url.QueryEscape(branch))
+}
+
 func (p *Pipeline) fullName() string {
 	return p.Owner + ":" + p.Repo
 }
@@ -535,6 +854,16 @@ func (p *Pipeline) generateKeys() error {
 	return nil
 }
 
+func (p *Pipeline) generateHookSecret() error {
+	secret, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	p.HookSecret = secret
+	return nil
+}
+
 func (p *Pipeline) UpdatePipeline(definition *Definition, kvClient kv.KVClient) {
 
 	pipelineNotifiers := []*Notifier{}
@@ -577,3 +906,12 @@ func (p *Pipeline) GetDefinitionFile(c scm.Client, ref string) (*DefinitionFile,
 func (p *Pipeline) UpdateDefinitionFile(c scm.Client, file *DefinitionFile, commit map[string]string) (*DefinitionFile, error) {
 	return file.SaveToRepo(c, p.Owner, p.Repo, commit)
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
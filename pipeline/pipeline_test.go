@@ -2,7 +2,14 @@ package pipeline
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+
+	"encoding/base64"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+	fakescm "github.com/AcalephStorage/kontinuous/scm/fake"
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
 )
 
 func TestCreateValidPipeline(t *testing.T) {
@@ -95,6 +102,95 @@ func TestCreateBuild(t *testing.T) {
 	}
 }
 
+func TestConcurrentBuildNumbers(t *testing.T) {
+	kvc := fake.NewClient()
+	kvc.PutDir(pipelineNamespace + "SampleOwner:SampleRepo/builds")
+
+	const hooks = 20
+	numbers := make(chan int, hooks)
+	var wg sync.WaitGroup
+	for i := 0; i < hooks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+			build := &Build{}
+			if err := p.CreateBuild(build, nil, kvc, nil); err != nil {
+				t.Errorf("Expected to create build without an error, got `%s`", err)
+				return
+			}
+			numbers <- build.Number
+		}()
+	}
+	wg.Wait()
+	close(numbers)
+
+	seen := map[int]bool{}
+	for number := range numbers {
+		if seen[number] || number < 1 || number > hooks {
+			t.Errorf("Expected unique build numbers from 1 to %d, got `%d` twice or out of range", hooks, number)
+		}
+		seen[number] = true
+	}
+
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	if builds, _ := p.GetBuilds(kvc); len(builds) != hooks {
+		t.Errorf("Expected %d builds, got %d", hooks, len(builds))
+	}
+}
+
+func TestBuildNumbersAreNotReused(t *testing.T) {
+	kvc := fake.NewClient()
+	buildsKey := pipelineNamespace + "SampleOwner:SampleRepo/builds"
+	kvc.PutIntDir(buildsKey, 1)
+	kvc.PutIntDir(buildsKey, 3)
+
+	// pipelines without a counter continue from their highest build
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	build := &Build{}
+	p.CreateBuild(build, nil, kvc, nil)
+	if build.Number != 4 {
+		t.Errorf("Expected build number `4`, got `%d`", build.Number)
+	}
+
+	kvc.DeleteTree(buildsKey + "/4")
+	build = &Build{}
+	p.CreateBuild(build, nil, kvc, nil)
+	if build.Number != 5 {
+		t.Errorf("Expected deleted build number not to be reused, got `%d`", build.Number)
+	}
+}
+
+func TestCreateForkBuildPendingApproval(t *testing.T) {
+	kvc := setupStoreWithSampleRepo()
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	p.Owner, p.Repo = "SampleOwner", "SampleRepo"
+	p.ForkPolicy = ForkPolicyApproval
+	build := &Build{PullRequest: 1, HeadRepo: "SomeoneElse/SampleRepo"}
+
+	if err := p.CreateBuild(build, []*Stage{}, kvc, nil); err != nil {
+		t.Fatalf("Expected to create build without an error, got `%s`", err.Error())
+	}
+	if build.Status != BuildPendingApproval || !build.Untrusted {
+		t.Errorf("Expected untrusted build pending approval, got status `%s`", build.Status)
+	}
+
+	if err := build.Approve(kvc); err != nil {
+		t.Fatalf("Expected to approve build without an error, got `%s`", err.Error())
+	}
+	if build.Status != BuildPending || build.Untrusted {
+		t.Errorf("Expected trusted pending build after approval, got status `%s`", build.Status)
+	}
+
+	if err := build.RevokeApproval(kvc); err != nil {
+		t.Fatalf("Expected to revoke the approval without an error, got `%s`", err.Error())
+	}
+	if stored, _ := p.GetBuild(build.Number, kvc); stored.Status != BuildPendingApproval || !stored.Untrusted {
+		t.Errorf("Expected untrusted build pending approval again, got status `%s`", stored.Status)
+	}
+}
+
 func TestGetBuilds(t *testing.T) {
 	kvc := setupStoreWithSampleBuild()
 
@@ -127,7 +223,7 @@ func TestPrepareBuildStage(t *testing.T) {
 
 	buildNum := 1
 	build, _ := p.GetBuild(buildNum, kvc)
-	info := &NextJobInfo{build.Commit, build.Number, 1}
+	info := build.NextJobInfo(1)
 
 	definition, jobInfo, _ := p.PrepareBuildStage(info, git)
 
@@ -139,3 +235,195 @@ func TestPrepareBuildStage(t *testing.T) {
 		t.Error("Expected job info to be defined!")
 	}
 }
+
+func TestPrepareGitlabBuildStage(t *testing.T) {
+	kvc := setupStoreWithSampleBuild()
+	gitlab := MockSCMClient{name: "gitlab", success: true, token: "gitlab-token"}
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	p.Source = "gitlab"
+
+	build, _ := p.GetBuild(1, kvc)
+	_, jobInfo, err := p.PrepareBuildStage(build.NextJobInfo(1), gitlab)
+	if err != nil {
+		t.Fatalf("Expected the stage to be prepared, got error: %s", err)
+	}
+	if jobInfo.CloneURL != "https://scm.example.com/SampleOwner/SampleRepo.git" || jobInfo.CloneUser != "oauth2" {
+		t.Errorf("Expected the GitLab clone url with the oauth2 user, got `%s` as `%s`", jobInfo.CloneURL, jobInfo.CloneUser)
+	}
+}
+
+func TestCreateSubgroupPipeline(t *testing.T) {
+	kvc := setupStore()
+
+	gitlab := MockSCMClient{name: "gitlab", success: true}
+
+	p := &Pipeline{
+		Owner:  "group/subgroup",
+		Repo:   "SampleRepo",
+		Login:  "gitlab-user",
+		Source: "gitlab",
+		Events: []string{"push"},
+	}
+	if err := CreatePipeline(p, gitlab, kvc); err == nil {
+		t.Error("Expected pipeline creation for a GitLab subgroup to fail")
+	}
+}
+
+func TestCreateGitPipelineWithoutKnownHosts(t *testing.T) {
+	kvc := setupStore()
+
+	git := MockSCMClient{name: "git", success: true}
+
+	p := &Pipeline{
+		Owner:  "SampleOwner",
+		Repo:   "SampleRepo",
+		Login:  "github-user",
+		Source: "git",
+		Remote: "git@git.example.com:mirrors/project.git",
+		Events: []string{"push"},
+	}
+	if err := CreatePipeline(p, git, kvc); err == nil {
+		t.Error("Expected git pipeline creation over SSH without known hosts to fail")
+	}
+
+	p.KnownHosts = "git.example.com ssh-rsa AAAA"
+	if err := CreatePipeline(p, git, kvc); err != nil {
+		t.Errorf("Expected git pipeline creation with known hosts to succeed, got error: %s", err)
+	}
+}
+
+func TestCreateGitPipelineWithoutRemote(t *testing.T) {
+	kvc := setupStore()
+
+	git := MockSCMClient{name: "git", success: true}
+
+	p := &Pipeline{
+		Owner:  "SampleOwner",
+		Repo:   "SampleRepo",
+		Login:  "github-user",
+		Events: []string{"push"},
+	}
+	if err := CreatePipeline(p, git, kvc); err == nil {
+		t.Error("Expected git pipeline creation without a remote to fail")
+	}
+}
+
+func TestCreateTagOnlyPipeline(t *testing.T) {
+	kvc := setupStore()
+
+	git := MockSCMClient{name: "github", success: true}
+
+	p := &Pipeline{
+		Owner:  "SampleOwner",
+		Repo:   "SampleRepo",
+		Login:  "github-user",
+		Source: "github",
+		Events: []string{"tag", "release"},
+		Tags:   []string{"v*"},
+	}
+	if err := CreatePipeline(p, git, kvc); err != nil {
+		t.Errorf("Expected tag only pipeline creation to succeed, got error: %s", err)
+	}
+}
+
+func TestPipelineTriggers(t *testing.T) {
+	p := &Pipeline{
+		Events: []string{"tag"},
+		Tags:   []string{"v*"},
+	}
+
+	cases := []struct {
+		hook     *scm.Hook
+		expected bool
+	}{
+		{&scm.Hook{Event: scm.EventTag, Tag: "v1.0.0"}, true},
+		{&scm.Hook{Event: scm.EventTag, Tag: "nightly"}, false},
+		{&scm.Hook{Event: scm.EventPush, Branch: "master"}, false},
+	}
+
+	for _, c := range cases {
+		if actual := p.Triggers(c.hook); actual != c.expected {
+			t.Errorf("Expected %s event of `%s` to trigger a build: %t, got %t", c.hook.Event, c.hook.Tag, c.expected, actual)
+		}
+	}
+}
+
+func TestForkPullRequestTriggers(t *testing.T) {
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo", Events: []string{"pull_request"}}
+	hook := &scm.Hook{Event: scm.EventPullRequest, PullRequest: 1, HeadRepo: "SomeoneElse/SampleRepo"}
+
+	if p.Triggers(hook) {
+		t.Errorf("Expected pull requests from forks not to be built by default")
+	}
+	if !p.Triggers(&scm.Hook{Event: scm.EventPullRequest, PullRequest: 1, HeadRepo: "sampleowner/samplerepo"}) {
+		t.Errorf("Expected pull requests from the repository to be built")
+	}
+
+	p.ForkPolicy = ForkPolicyApproval
+	if !p.Triggers(hook) {
+		t.Errorf("Expected pull requests from forks to be built with the `%s` policy", p.ForkPolicy)
+	}
+}
+
+func TestValidLegacyHookToken(t *testing.T) {
+	secret := base64.URLEncoding.EncodeToString([]byte("auth-secret"))
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+	token, _ := p.GenerateHookSecret(secret)
+
+	if !p.ValidLegacyHookToken(token, secret) {
+		t.Error("Expected hook token of the pipeline to be valid")
+	}
+
+	other := &Pipeline{Owner: "SampleOwner", Repo: "OtherRepo"}
+	if other.ValidLegacyHookToken(token, secret) {
+		t.Error("Expected hook token of another pipeline to be invalid")
+	}
+}
+
+func TestDeleteHookByID(t *testing.T) {
+	c := fakescm.NewClient(scm.RepoGithub)
+	c.AddRepository("SampleOwner", "SampleRepo", "admin")
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo"}
+
+	// another kontinuous with the same url, eg. a staging install
+	c.CreateHook(p.Owner, p.Repo, p.HookCallback(), "other-secret", []string{scm.EventPush})
+	p.HookID, _ = c.CreateHook(p.Owner, p.Repo, p.HookCallback(), "secret", []string{scm.EventPush})
+
+	if err := p.DeleteHookAndKey(c); err != nil {
+		t.Fatalf("Expected the hook to be deleted, got error: %s", err)
+	}
+	if hooks := c.Hooks(p.Owner, p.Repo); len(hooks) != 1 || hooks[0].Secret != "other-secret" {
+		t.Errorf("Expected only the pipeline's own hook to be deleted, got %+v", hooks)
+	}
+}
+
+func TestRecreatePipelineWithKeptHook(t *testing.T) {
+	kvc := fake.NewClient()
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+	c := fakescm.NewClient(scm.RepoGithub)
+	c.AddRepository("SampleOwner", "SampleRepo", "admin")
+
+	p := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo", Login: "github-user", Events: []string{scm.EventPush}}
+	if err := CreatePipeline(p, c, kvc); err != nil {
+		t.Fatalf("Expected pipeline creation to succeed, got error: %s", err)
+	}
+
+	// deleted with keep_hooks, the hook stays in the remote
+	if err := p.DeletePipeline(kvc, objects); err != nil {
+		t.Fatalf("Expected pipeline deletion to succeed, got error: %s", err)
+	}
+
+	recreated := &Pipeline{Owner: "SampleOwner", Repo: "SampleRepo", Login: "github-user", Events: []string{scm.EventPush}}
+	if err := CreatePipeline(recreated, c, kvc); err != nil {
+		t.Fatalf("Expected pipeline recreation to succeed, got error: %s", err)
+	}
+	if recreated.HookSecret == p.HookSecret {
+		t.Fatal("Expected the recreated pipeline to have a new hook secret")
+	}
+
+	hooks := c.Hooks("SampleOwner", "SampleRepo")
+	if len(hooks) != 1 || hooks[0].Secret != recreated.HookSecret || fmt.Sprint(hooks[0].ID) != recreated.HookID {
+		t.Errorf("Expected the kept hook to be replaced with the new secret, got %+v", hooks)
+	}
+}
@@ -0,0 +1,270 @@
+// Package report parses test and lint reports of a stage into annotations
+// that are shown inline on the commit or pull request.
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"encoding/xml"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+// Report formats
+const (
+	FormatJUnit      = "junit"
+	FormatCheckstyle = "checkstyle"
+	FormatLint       = "lint"
+)
+
+// Report is the output of a test or lint tool run by a stage.
+// Root is stripped from the file paths so they are relative to the repository.
+type Report struct {
+	Format  string `json:"format"`
+	Root    string `json:"root,omitempty"`
+	Content string `json:"content"`
+}
+
+// Annotations parses the report based on its format
+func (r *Report) Annotations() ([]*scm.Annotation, error) {
+	var (
+		annotations []*scm.Annotation
+		err         error
+	)
+
+	switch r.Format {
+	case FormatJUnit:
+		annotations, err = ParseJUnit([]byte(r.Content))
+	case FormatCheckstyle:
+		annotations, err = ParseCheckstyle([]byte(r.Content))
+	case FormatLint:
+		annotations, err = ParseLint(r.Content)
+	default:
+		return nil, fmt.Errorf("Unknown report format %s", r.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range annotations {
+		a.Path = relativePath(a.Path, r.Root)
+	}
+	return annotations, nil
+}
+
+type junitSuites struct {
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	File   string       `xml:"file,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// fileLine finds `path/to/file.ext:line` references in failure output
+var fileLine = regexp.MustCompile(`([\w./-]+\.\w+):(\d+)`)
+
+// ParseJUnit creates a failure annotation for each failed test case.
+// Test cases without a file attribute are located from the first
+// `file:line` in the failure output.
+func ParseJUnit(content []byte) ([]*scm.Annotation, error) {
+	suites := new(junitSuites)
+	if err := xml.Unmarshal(content, suites); err != nil {
+		// reports with a single suite have no testsuites element
+		suite := junitSuite{}
+		if err := xml.Unmarshal(content, &suite); err != nil {
+			return nil, err
+		}
+		suites.Suites = []junitSuite{suite}
+	}
+
+	annotations := []*scm.Annotation{}
+	var walk func(suites []junitSuite)
+	walk = func(suites []junitSuite) {
+		for _, suite := range suites {
+			for _, c := range suite.Cases {
+				failure := c.Failure
+				if failure == nil {
+					failure = c.Error
+				}
+				if failure == nil {
+					continue
+				}
+
+				path, line := c.File, c.Line
+				if path == "" {
+					path = suite.File
+				}
+				if match := fileLine.FindStringSubmatch(failure.Body + " " + failure.Message); (path == "" || line == 0) && match != nil {
+					path = match[1]
+					line, _ = strconv.Atoi(match[2])
+				}
+				if path == "" {
+					continue
+				}
+				if line == 0 {
+					line = 1
+				}
+
+				message := strings.TrimSpace(failure.Body)
+				if message == "" {
+					message = failure.Message
+				}
+				annotations = append(annotations, &scm.Annotation{
+					Path:      path,
+					StartLine: line,
+					EndLine:   line,
+					Level:     scm.AnnotationFailure,
+					Title:     strings.TrimSpace(c.ClassName + " " + c.Name),
+					Message:   message,
+				})
+			}
+			walk(suite.Suites)
+		}
+	}
+	walk(suites.Suites)
+
+	return annotations, nil
+}
+
+type checkstyleResult struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int    `xml:"line,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+// ParseCheckstyle creates an annotation for each error of a checkstyle report,
+// the format most linters can output
+func ParseCheckstyle(content []byte) ([]*scm.Annotation, error) {
+	result := new(checkstyleResult)
+	if err := xml.Unmarshal(content, result); err != nil {
+		return nil, err
+	}
+
+	annotations := []*scm.Annotation{}
+	for _, file := range result.Files {
+		for _, e := range file.Errors {
+			line := e.Line
+			if line == 0 {
+				line = 1
+			}
+			annotations = append(annotations, &scm.Annotation{
+				Path:      file.Name,
+				StartLine: line,
+				EndLine:   line,
+				Level:     severityLevel(e.Severity),
+				Title:     e.Source,
+				Message:   e.Message,
+			})
+		}
+	}
+	return annotations, nil
+}
+
+// lintLine matches `path:line[:column]: message`, the output of go vet, golint and others
+var lintLine = regexp.MustCompile(`^([^\s:]+):(\d+)(?::\d+)?:\s*(.+)$`)
+
+// ParseLint creates a warning annotation for each line of lint output,
+// lines that do not point to a file are ignored
+func ParseLint(content string) ([]*scm.Annotation, error) {
+	annotations := []*scm.Annotation{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		match := lintLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+
+		line, _ := strconv.Atoi(match[2])
+		annotations = append(annotations, &scm.Annotation{
+			Path:      match[1],
+			StartLine: line,
+			EndLine:   line,
+			Level:     scm.AnnotationWarning,
+			Message:   match[3],
+		})
+	}
+	return annotations, scanner.Err()
+}
+
+// Summary describes the annotations in Markdown
+func Summary(annotations []*scm.Annotation) string {
+	if len(annotations) == 0 {
+		return ""
+	}
+
+	counts := map[string]int{}
+	for _, a := range annotations {
+		counts[a.Level]++
+	}
+
+	var summary []string
+	for _, level := range []string{scm.AnnotationFailure, scm.AnnotationWarning, scm.AnnotationNotice} {
+		if counts[level] > 0 {
+			summary = append(summary, fmt.Sprintf("**%d** %s", counts[level], plural(level, counts[level])))
+		}
+	}
+
+	lines := []string{strings.Join(summary, ", "), "", "| File | Line | Message |", "| --- | --- | --- |"}
+	for i, a := range annotations {
+		// keep the summary readable, every annotation is still shown inline
+		if i == 20 {
+			lines = append(lines, "", fmt.Sprintf("_and %d more_", len(annotations)-i))
+			break
+		}
+		message := strings.Replace(strings.SplitN(a.Message, "\n", 2)[0], "|", "\\|", -1)
+		lines = append(lines, fmt.Sprintf("| `%s` | %d | %s |", a.Path, a.StartLine, message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func severityLevel(severity string) string {
+	switch strings.ToLower(severity) {
+	case "error":
+		return scm.AnnotationFailure
+	case "info":
+		return scm.AnnotationNotice
+	default:
+		return scm.AnnotationWarning
+	}
+}
+
+func plural(level string, count int) string {
+	if count == 1 {
+		return level
+	}
+	return level + "s"
+}
+
+func relativePath(path, root string) string {
+	if root != "" {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(root, "/")+"/")
+	}
+	return strings.TrimPrefix(path, "./")
+}
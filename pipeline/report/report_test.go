@@ -0,0 +1,74 @@
+package report
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+func TestParseJUnit(t *testing.T) {
+	content := `<testsuites>
+  <testsuite name="api">
+    <testcase classname="api" name="TestPass"></testcase>
+    <testcase classname="api" name="TestFail">
+      <failure message="Failed">build_test.go:42: Expected 1, got 2</failure>
+    </testcase>
+  </testsuite>
+</testsuites>`
+
+	annotations, err := ParseJUnit([]byte(content))
+	if err != nil {
+		t.Fatalf("Expected report to be parsed, got error: %s", err)
+	}
+	if len(annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(annotations))
+	}
+	a := annotations[0]
+	if a.Path != "build_test.go" || a.StartLine != 42 || a.Level != scm.AnnotationFailure {
+		t.Errorf("Expected failure at build_test.go:42, got %s at %s:%d", a.Level, a.Path, a.StartLine)
+	}
+}
+
+func TestParseCheckstyle(t *testing.T) {
+	content := `<checkstyle>
+  <file name="/src/api/build.go">
+    <error line="10" severity="error" message="unused variable" source="vet"></error>
+    <error line="12" severity="warning" message="missing comment" source="golint"></error>
+  </file>
+</checkstyle>`
+
+	r := &Report{Format: FormatCheckstyle, Root: "/src", Content: content}
+	annotations, err := r.Annotations()
+	if err != nil {
+		t.Fatalf("Expected report to be parsed, got error: %s", err)
+	}
+	if len(annotations) != 2 {
+		t.Fatalf("Expected 2 annotations, got %d", len(annotations))
+	}
+	if annotations[0].Path != "api/build.go" {
+		t.Errorf("Expected path relative to root, got `%s`", annotations[0].Path)
+	}
+	if annotations[0].Level != scm.AnnotationFailure || annotations[1].Level != scm.AnnotationWarning {
+		t.Errorf("Expected failure and warning, got %s and %s", annotations[0].Level, annotations[1].Level)
+	}
+}
+
+func TestParseLint(t *testing.T) {
+	content := `api/build.go:15:2: exported func Run should have comment
+# github.com/AcalephStorage/kontinuous/api
+pipeline/stage.go:7: unreachable code`
+
+	annotations, _ := ParseLint(content)
+	if len(annotations) != 2 {
+		t.Fatalf("Expected 2 annotations, got %d", len(annotations))
+	}
+	if annotations[1].Path != "pipeline/stage.go" || annotations[1].StartLine != 7 || annotations[1].Message != "unreachable code" {
+		t.Errorf("Unexpected annotation %+v", annotations[1])
+	}
+
+	summary := Summary(annotations)
+	if !strings.HasPrefix(summary, "**2** warnings") {
+		t.Errorf("Expected summary to count warnings, got `%s`", summary)
+	}
+}
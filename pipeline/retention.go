@@ -0,0 +1,268 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+// Finished builds are deleted once they are outside the retention policy of their
+// pipeline, pipelines without a policy use the global one set by RETENTION_KEEP_LAST,
+// RETENTION_KEEP_DAYS and RETENTION_PROTECTED_BRANCHES. A build is kept when any rule
+// keeps it, a policy with neither a count nor an age keeps everything. The latest
+// build and the builds still running are never deleted. Webhook deliveries are kept
+// by the same counts.
+
+// janitorKey keeps the instance running the janitor, other instances skip pruning
+const janitorKey = appNamespace + "janitor"
+
+type (
+	// RetentionPolicy decides which finished builds of a pipeline are kept
+	RetentionPolicy struct {
+		// KeepLast keeps the builds among the last KeepLast builds
+		KeepLast int `json:"keep_last,omitempty"`
+
+		// KeepDays keeps the builds created in the last KeepDays days
+		KeepDays int `json:"keep_days,omitempty"`
+
+		// ProtectedBranches keeps the successful builds of the matching branches, eg. master or release-*
+		ProtectedBranches []string `json:"protected_branches,omitempty"`
+	}
+
+	// PruneReport describes the builds deleted, or that would be deleted on a dry run
+	PruneReport struct {
+		DryRun    bool              `json:"dry_run"`
+		Deleted   int               `json:"deleted"`
+		Pipelines []*PrunedPipeline `json:"pipelines"`
+	}
+
+	// PrunedPipeline is a pipeline with expired builds and the builds deleted
+	PrunedPipeline struct {
+		Pipeline          string           `json:"pipeline"`
+		Policy            *RetentionPolicy `json:"policy"`
+		Kept              int              `json:"kept"`
+		Deleted           []int            `json:"deleted"`
+		DeletedDeliveries int              `json:"deleted_deliveries"`
+		Error             string           `json:"error,omitempty"`
+	}
+)
+
+// DefaultRetentionPolicy is the global policy of the pipelines without their own
+func DefaultRetentionPolicy() *RetentionPolicy {
+	policy := &RetentionPolicy{}
+	policy.KeepLast, _ = strconv.Atoi(os.Getenv("RETENTION_KEEP_LAST"))
+	policy.KeepDays, _ = strconv.Atoi(os.Getenv("RETENTION_KEEP_DAYS"))
+	for _, branch := range strings.Split(os.Getenv("RETENTION_PROTECTED_BRANCHES"), ",") {
+		if branch = strings.TrimSpace(branch); branch != "" {
+			policy.ProtectedBranches = append(policy.ProtectedBranches, branch)
+		}
+	}
+	return policy
+}
+
+// Validate checks the counts and the branch patterns of the policy
+func (r *RetentionPolicy) Validate() error {
+	if r.KeepLast < 0 || r.KeepDays < 0 {
+		return fmt.Errorf("Retention counts can't be negative")
+	}
+	for _, branch := range r.ProtectedBranches {
+		if _, err := filepath.Match(branch, ""); err != nil {
+			return fmt.Errorf("Invalid protected branch %s", branch)
+		}
+	}
+	return nil
+}
+
+// Enabled checks if the policy deletes builds at all
+func (r *RetentionPolicy) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepDays > 0
+}
+
+// protects checks if the build is a successful build of a protected branch
+func (r *RetentionPolicy) protects(b *Build) bool {
+	if b.Status != BuildSuccess || b.PullRequest != 0 || b.Tag != "" {
+		return false
+	}
+	for _, branch := range r.ProtectedBranches {
+		if matched, _ := filepath.Match(branch, b.Branch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns the builds the policy doesn't keep, newest first
+func (r *RetentionPolicy) Expired(builds []*Build, now time.Time) []*Build {
+	if !r.Enabled() {
+		return []*Build{}
+	}
+
+	sorted := make([]*Build, len(builds))
+	copy(sorted, builds)
+	sort.Sort(sort.Reverse(byNumber(sorted)))
+
+	cutoff := now.AddDate(0, 0, -r.KeepDays).UnixNano()
+	expired := []*Build{}
+	for i, b := range sorted {
+		kept := i == 0 ||
+			b.Status != BuildSuccess && b.Status != BuildFailure ||
+			r.KeepLast > 0 && i < r.KeepLast ||
+			r.KeepDays > 0 && b.Created > cutoff ||
+			r.protects(b)
+		if !kept {
+			expired = append(expired, b)
+		}
+	}
+	return expired
+}
+
+// ExpiredDeliveries returns the webhook deliveries the policy doesn't keep, the latest is always kept
+func (r *RetentionPolicy) ExpiredDeliveries(deliveries []*Delivery, now time.Time) []*Delivery {
+	if !r.Enabled() {
+		return []*Delivery{}
+	}
+
+	sorted := make([]*Delivery, len(deliveries))
+	copy(sorted, deliveries)
+	sort.Sort(byReceived(sorted))
+
+	cutoff := now.AddDate(0, 0, -r.KeepDays).UnixNano()
+	expired := []*Delivery{}
+	for i, d := range sorted {
+		kept := i == 0 ||
+			r.KeepLast > 0 && i < r.KeepLast ||
+			r.KeepDays > 0 && d.Received > cutoff
+		if !kept {
+			expired = append(expired, d)
+		}
+	}
+	return expired
+}
+
+// RetentionPolicy returns the policy of the pipeline, or the global one when it has none
+func (p *Pipeline) RetentionPolicy() *RetentionPolicy {
+	if p.Retention != nil {
+		return p.Retention
+	}
+	return DefaultRetentionPolicy()
+}
+
+// Prune deletes the expired builds of every pipeline with Build.Delete, a dry run only
+// reports them. A pipeline that fails is reported and the others are still pruned.
+func Prune(kvClient kv.KVClient, objectStore mc.ObjectStore, dryRun bool) (*PruneReport, error) {
+	pipelines, err := FindAllPipelines(kvClient)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{
+		DryRun:    dryRun,
+		Pipelines: []*PrunedPipeline{},
+	}
+	now := time.Now()
+	for _, p := range pipelines {
+		// pipelines that can't be read are listed empty
+		if p.Owner == "" {
+			continue
+		}
+
+		pruned := p.prune(kvClient, objectStore, now, dryRun)
+		if len(pruned.Deleted) == 0 && pruned.DeletedDeliveries == 0 && pruned.Error == "" {
+			continue
+		}
+		report.Deleted += len(pruned.Deleted)
+		report.Pipelines = append(report.Pipelines, pruned)
+	}
+	return report, nil
+}
+
+func (p *Pipeline) prune(kvClient kv.KVClient, objectStore mc.ObjectStore, now time.Time, dryRun bool) *PrunedPipeline {
+	policy := p.RetentionPolicy()
+	pruned := &PrunedPipeline{
+		Pipeline: p.Owner + "/" + p.Repo,
+		Policy:   policy,
+		Deleted:  []int{},
+	}
+	if !policy.Enabled() {
+		return pruned
+	}
+
+	deliveries, err := p.GetDeliveries(kvClient)
+	if err != nil {
+		pruned.Error = err.Error()
+		return pruned
+	}
+	for _, d := range policy.ExpiredDeliveries(deliveries, now) {
+		if !dryRun {
+			if err := p.deleteDelivery(d.ID, kvClient); err != nil {
+				pruned.Error = fmt.Sprintf("unable to delete hook delivery %s: %s", d.ID, err)
+				return pruned
+			}
+		}
+		pruned.DeletedDeliveries++
+	}
+
+	builds, err := p.GetBuilds(kvClient)
+	if err != nil {
+		pruned.Error = err.Error()
+		return pruned
+	}
+
+	expired := policy.Expired(builds, now)
+	pruned.Kept = len(builds) - len(expired)
+	for _, b := range expired {
+		if !dryRun {
+			if err := b.Delete(p.ID, kvClient, objectStore); err != nil {
+				pruned.Error = fmt.Sprintf("unable to delete build %d: %s", b.Number, err)
+				pruned.Kept += len(expired) - len(pruned.Deleted)
+				return pruned
+			}
+		}
+		pruned.Deleted = append(pruned.Deleted, b.Number)
+	}
+	return pruned
+}
+
+// janitorLease is the instance running the janitor until it expires
+type janitorLease struct {
+	Holder  string `json:"holder"`
+	Expires int64  `json:"expires"`
+}
+
+// ClaimJanitor makes holder the only instance running the janitor for ttl, holder
+// renews it before pruning. It returns false while another instance holds it, the
+// lease of an instance that stopped is taken over once it expires.
+func ClaimJanitor(holder string, ttl time.Duration, kvClient kv.KVClient) (bool, error) {
+	prev, err := readDocument(janitorKey, kvClient)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if prev != "" {
+		lease := &janitorLease{}
+		if err := json.Unmarshal([]byte(prev), lease); err == nil && lease.Holder != holder && now.UnixNano() < lease.Expires {
+			return false, nil
+		}
+	}
+
+	err = writeDocument(janitorKey, prev, &janitorLease{holder, now.Add(ttl).UnixNano()}, kvClient)
+	if err == kv.ErrCompareFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type byNumber []*Build
+
+func (b byNumber) Len() int           { return len(b) }
+func (b byNumber) Less(i, j int) bool { return b[i].Number < b[j].Number }
+func (b byNumber) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,247 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/registry"
+	fakeregistry "github.com/AcalephStorage/kontinuous/registry/fake"
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+	"github.com/AcalephStorage/kontinuous/store/mc"
+)
+
+func buildNumbers(builds []*Build) []int {
+	numbers := []int{}
+	for _, b := range builds {
+		numbers = append(numbers, b.Number)
+	}
+	return numbers
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Now()
+	old := now.AddDate(0, 0, -30).UnixNano()
+	builds := []*Build{
+		{Number: 1, Status: BuildFailure, Branch: "master", Created: old},
+		{Number: 2, Status: BuildSuccess, Branch: "master", PullRequest: 7, Created: now.AddDate(0, 0, -1).UnixNano()},
+		{Number: 3, Status: BuildSuccess, Branch: "release-1", Created: old},
+		{Number: 4, Status: BuildRunning, Branch: "master", Created: old},
+		{Number: 5, Status: BuildFailure, Branch: "master", Created: old},
+		{Number: 6, Status: BuildSuccess, Branch: "master", Created: old},
+	}
+
+	policy := &RetentionPolicy{KeepLast: 2, ProtectedBranches: []string{"release-*"}}
+	if expired := buildNumbers(policy.Expired(builds, now)); !reflect.DeepEqual(expired, []int{2, 1}) {
+		t.Errorf("Expected builds 2 and 1 to expire, got %v", expired)
+	}
+
+	policy.KeepDays = 7
+	if expired := buildNumbers(policy.Expired(builds, now)); !reflect.DeepEqual(expired, []int{1}) {
+		t.Errorf("Expected build 1 to expire, got %v", expired)
+	}
+
+	// only the latest build is kept by the age alone
+	policy = &RetentionPolicy{KeepDays: 7}
+	if expired := buildNumbers(policy.Expired(builds, now)); !reflect.DeepEqual(expired, []int{5, 3, 1}) {
+		t.Errorf("Expected builds 5, 3 and 1 to expire, got %v", expired)
+	}
+
+	policy = &RetentionPolicy{ProtectedBranches: []string{"master"}}
+	if expired := policy.Expired(builds, now); len(expired) != 0 {
+		t.Errorf("Expected a policy without a count or age to keep everything, got %v", buildNumbers(expired))
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	defer os.Unsetenv("RETENTION_KEEP_LAST")
+	defer os.Unsetenv("RETENTION_PROTECTED_BRANCHES")
+	os.Setenv("RETENTION_KEEP_LAST", "10")
+	os.Setenv("RETENTION_PROTECTED_BRANCHES", "master, release-*")
+
+	p := &Pipeline{}
+	expected := &RetentionPolicy{KeepLast: 10, ProtectedBranches: []string{"master", "release-*"}}
+	if policy := p.RetentionPolicy(); !reflect.DeepEqual(policy, expected) {
+		t.Errorf("Expected the global policy, got %+v", policy)
+	}
+
+	p.Retention = &RetentionPolicy{KeepDays: 3}
+	if policy := p.RetentionPolicy(); policy != p.Retention {
+		t.Errorf("Expected the pipeline's policy, got %+v", policy)
+	}
+
+	p.Retention.ProtectedBranches = []string{"release-["}
+	if err := p.Retention.Validate(); err == nil {
+		t.Error("Expected an invalid branch pattern to be rejected")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	kvc := setupLegacyStore(4, 1)
+	MigrateDocuments(kvc)
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	images := fakeregistry.NewClient()
+	defaultRegistryClient := NewRegistryClient
+	NewRegistryClient = func() (registry.RegistryClient, error) {
+		return images, nil
+	}
+	defer func() { NewRegistryClient = defaultRegistryClient }()
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	p.Retention = &RetentionPolicy{KeepLast: 2}
+	p.Save(kvc)
+
+	b, _ := p.GetBuild(1, kvc)
+	images.AddImage(buildImage(p.ID, "1"), b.Commit)
+	objects.PutObject("kontinuous", "pipelines/"+p.ID+"/builds/1/stages/1/logs/agent.log", strings.NewReader("building"))
+
+	for i := 1; i <= 3; i++ {
+		d := NewDelivery("push", http.Header{"X-Github-Delivery": {fmt.Sprintf("delivery-%d", i)}}, []byte("{}"))
+		d.Received = int64(i)
+		p.SaveDelivery(d, kvc)
+	}
+
+	report, err := Prune(kvc, objects, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report.Deleted != 2 || !reflect.DeepEqual(report.Pipelines[0].Deleted, []int{2, 1}) || report.Pipelines[0].Kept != 2 || report.Pipelines[0].DeletedDeliveries != 1 {
+		t.Errorf("Expected builds 2 and 1 to be reported, got %+v", report.Pipelines)
+	}
+	if builds, _ := p.GetBuilds(kvc); len(builds) != 4 {
+		t.Errorf("Expected a dry run to keep every build, got %d", len(builds))
+	}
+
+	if report, err = Prune(kvc, objects, false); err != nil || report.Deleted != 2 {
+		t.Fatalf("Expected 2 builds deleted, got %+v: %v", report, err)
+	}
+	if builds, _ := p.GetBuilds(kvc); !reflect.DeepEqual(buildNumbers(builds), []int{3, 4}) {
+		t.Errorf("Expected builds 3 and 4 to be kept, got %v", buildNumbers(builds))
+	}
+	if logs, _ := objects.ListObjects("kontinuous", "pipelines/"+p.ID+"/builds/1"); len(logs) != 0 {
+		t.Errorf("Expected the logs of build 1 to be deleted, got %v", logs)
+	}
+	if images.HasImage(buildImage(p.ID, "1"), b.Commit) {
+		t.Error("Expected the image of build 1 to be deleted")
+	}
+
+	if deliveries, _ := p.GetDeliveries(kvc); len(deliveries) != 2 {
+		t.Errorf("Expected the last 2 hook deliveries to be kept, got %d", len(deliveries))
+	}
+
+	if report, _ = Prune(kvc, objects, false); report.Deleted != 0 || len(report.Pipelines) != 0 {
+		t.Errorf("Expected nothing left to prune, got %+v", report)
+	}
+}
+
+func TestPruneKeepsBuildWithUndeletedImage(t *testing.T) {
+	kvc := setupLegacyStore(3, 1)
+	MigrateDocuments(kvc)
+	objects, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	images := fakeregistry.NewClient()
+	defaultRegistryClient := NewRegistryClient
+	NewRegistryClient = func() (registry.RegistryClient, error) {
+		return images, nil
+	}
+	defer func() { NewRegistryClient = defaultRegistryClient }()
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	p.Retention = &RetentionPolicy{KeepLast: 2}
+	p.Save(kvc)
+	b, _ := p.GetBuild(1, kvc)
+	images.AddImage(buildImage(p.ID, "1"), b.Commit)
+
+	images.FailDeletes(errors.New("registry unavailable"))
+	if report, _ := Prune(kvc, objects, false); report.Deleted != 0 || report.Pipelines[0].Error == "" {
+		t.Errorf("Expected the build to be kept while its image can't be deleted, got %+v", report.Pipelines)
+	}
+	if _, exists := p.GetBuild(1, kvc); !exists {
+		t.Fatal("Expected build 1 to be deleted again later")
+	}
+
+	// registries that don't allow deletes keep the images
+	images.FailDeletes(registry.ErrDeleteDisabled)
+	if report, _ := Prune(kvc, objects, false); report.Deleted != 1 {
+		t.Errorf("Expected build 1 to be deleted, got %+v", report.Pipelines)
+	}
+}
+
+// prefixStore deletes every object starting with a prefix like minio does,
+// including the objects of sibling directories
+type prefixStore struct {
+	*mc.LocalStore
+}
+
+func (s prefixStore) DeleteTree(bucket, prefix string) error {
+	objects, err := s.ListObjects(bucket, "")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if strings.HasPrefix(object, prefix) {
+			if err := s.DeleteObject(bucket, object); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestPruneKeepsObjectsOfNeighbourBuilds(t *testing.T) {
+	kvc := setupLegacyStore(10, 1)
+	MigrateDocuments(kvc)
+	local, cleanup := newTestObjectStore(t)
+	defer cleanup()
+	objects := prefixStore{local}
+
+	defaultRegistryClient := NewRegistryClient
+	NewRegistryClient = func() (registry.RegistryClient, error) {
+		return fakeregistry.NewClient(), nil
+	}
+	defer func() { NewRegistryClient = defaultRegistryClient }()
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	p.ID = "pipeline-id"
+	p.Retention = &RetentionPolicy{KeepLast: 9}
+	p.Save(kvc)
+
+	for _, number := range []int{1, 10} {
+		objects.PutObject("kontinuous", fmt.Sprintf("pipelines/%s/builds/%d/stages/1/logs/agent.log", p.ID, number), strings.NewReader("building"))
+	}
+
+	if report, err := Prune(kvc, objects, false); err != nil || !reflect.DeepEqual(report.Pipelines[0].Deleted, []int{1}) {
+		t.Fatalf("Expected only build 1 to be deleted, got %+v: %v", report, err)
+	}
+	if logs, _ := objects.ListObjects("kontinuous", "pipelines/"+p.ID+"/builds/1/"); len(logs) != 0 {
+		t.Errorf("Expected the logs of build 1 to be deleted, got %v", logs)
+	}
+	if logs, _ := objects.ListObjects("kontinuous", "pipelines/"+p.ID+"/builds/10/"); len(logs) != 1 {
+		t.Errorf("Expected the logs of build 10 to be kept, got %v", logs)
+	}
+}
+
+func TestClaimJanitor(t *testing.T) {
+	kvc := fake.NewClient()
+
+	if claimed, err := ClaimJanitor("first", time.Minute, kvc); !claimed || err != nil {
+		t.Fatalf("Expected the janitor to be claimed, got %v: %v", claimed, err)
+	}
+	if claimed, _ := ClaimJanitor("second", time.Minute, kvc); claimed {
+		t.Error("Expected the janitor to be held by the first instance")
+	}
+	if claimed, _ := ClaimJanitor("first", -time.Minute, kvc); !claimed {
+		t.Error("Expected the holder to renew the janitor")
+	}
+	if claimed, _ := ClaimJanitor("second", time.Minute, kvc); !claimed {
+		t.Error("Expected an expired janitor to be taken over")
+	}
+}
@@ -2,13 +2,13 @@ package pipeline
 
 import (
 	"fmt"
-	"strconv"
+	"os"
 	"strings"
+	"time"
 
-	"encoding/json"
-
-	etcd "github.com/coreos/etcd/client"
+	"github.com/Sirupsen/logrus"
 
+	"github.com/AcalephStorage/kontinuous/pipeline/report"
 	"github.com/AcalephStorage/kontinuous/scm"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 )
@@ -22,18 +22,33 @@ type (
 		Timestamp   int64  `json:"timestamp"`
 		DockerImage string `json:"docker_image"`
 		Message     string `json:"message"`
+
+		// Reports are test or lint results shown as annotations on check runs
+		Reports []*report.Report `json:"reports,omitempty"`
 	}
 
 	// JobBuildInfo contains the required details for creating a job
 	JobBuildInfo struct {
-		PipelineUUID string `json:"pipeline_uuid"`
-		Build        string `json:"build"`
-		Stage        string `json:"stage"`
-		Commit       string `json:"commit"`
-		Branch       string `json:"branch"`
-		User         string `json:"user,omitempty"`
-		Repo         string `json:"repo,omitempty"`
-		Owner        string `json:"owner,omitempty"`
+		PipelineUUID string                 `json:"pipeline_uuid"`
+		Build        string                 `json:"build"`
+		Stage        string                 `json:"stage"`
+		Commit       string                 `json:"commit"`
+		Branch       string                 `json:"branch"`
+		Ref          string                 `json:"ref,omitempty"`
+		PullRequest  int                    `json:"pull_request,omitempty"`
+		BaseBranch   string                 `json:"base_branch,omitempty"`
+		Tag          string                 `json:"tag,omitempty"`
+		Untrusted    bool                   `json:"untrusted,omitempty"`
+		Params       map[string]interface{} `json:"params,omitempty"`
+		Environment  string                 `json:"environment,omitempty"`
+		Token        string                 `json:"token,omitempty"`
+		User         string                 `json:"user,omitempty"`
+		Repo         string                 `json:"repo,omitempty"`
+		Owner        string                 `json:"owner,omitempty"`
+		CloneURL     string                 `json:"clone_url,omitempty"`
+		CloneKey     string                 `json:"clone_key,omitempty"`
+		CloneUser    string                 `json:"clone_user,omitempty"`
+		KnownHosts   string                 `json:"known_hosts,omitempty"`
 	}
 )
 
@@ -56,105 +71,45 @@ type Stage struct {
 	Artifacts   []string               `json:"artifacts,omitempty"`
 	Secrets     []string               `json:"secrets"`
 	Vars        map[string]interface{} `json:"vars"`
-}
+	Failures    int                    `json:"failures,omitempty"`
+	CheckRunID  int                    `json:"check_run_id,omitempty"`
 
-func getStage(path string, kvClient kv.KVClient) *Stage {
-	s := new(Stage)
-	started, _ := kvClient.Get(path + "/started")
-	finished, _ := kvClient.Get(path + "/finished")
-	params, _ := kvClient.Get(path + "/params")
-	labels, _ := kvClient.Get(path + "/labels")
-	secrets, _ := kvClient.Get(path + "/secrets")
-	vars, _ := kvClient.Get(path + "/vars")
-
-	s.ID, _ = kvClient.Get(path + "/uuid")
-	s.Index, _ = kvClient.GetInt(path + "/index")
-	s.Name, _ = kvClient.Get(path + "/name")
-	s.Type, _ = kvClient.Get(path + "/type")
-	s.DockerImage, _ = kvClient.Get(path + "/docker-image")
-	s.PodName, _ = kvClient.Get(path + "/pod-name")
-	s.JobName, _ = kvClient.Get(path + "/job-name")
-	s.Namespace, _ = kvClient.Get(path + "/namespace")
-	s.Status, _ = kvClient.Get(path + "/status")
-	s.Message, _ = kvClient.Get(path + "/message")
-	s.Started, _ = strconv.ParseInt(started, 10, 64)
-	s.Finished, _ = strconv.ParseInt(finished, 10, 64)
-	s.Secrets = strings.Split(secrets, ",")
-
-	json.Unmarshal([]byte(params), &s.Params)
-	json.Unmarshal([]byte(labels), &s.Labels)
-	json.Unmarshal([]byte(vars), &s.Vars)
-
-	return s
-}
+	// DeploymentID is the remote deployment tracking a deploy stage
+	DeploymentID int `json:"deployment_id,omitempty"`
 
-// Save persists the stage details to `etcd`
-func (s *Stage) Save(namespace string, kvClient kv.KVClient) (err error) {
-	stagePrefix := namespace + "/" + strconv.Itoa(s.Index)
-	isNew := false
+	// ResourceVersion is incremented when the stage is saved
+	ResourceVersion int `json:"resource_version"`
+}
 
-	_, err = kvClient.GetDir(stagePrefix)
-	if err != nil || etcd.IsKeyNotFound(err) {
-		isNew = true
-	}
+// Save persists the stage details to the document of its build in the namespace of the
+// build's stages. Returns ErrConflict when the stage was saved by someone else since it was read.
+func (s *Stage) Save(namespace string, kvClient kv.KVClient) error {
+	buildPath := strings.TrimSuffix(namespace, "/stages")
+	saved, err := updateBuild(buildPath, kvClient, func(stored *Build) (*Build, error) {
+		if stored == nil {
+			return nil, fmt.Errorf("Build of stage %d not found.", s.Index)
+		}
 
-	if err = kvClient.Put(stagePrefix+"/uuid", s.ID); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(stagePrefix+"/name", s.Name); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(stagePrefix+"/type", s.Type); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(stagePrefix+"/status", s.Status); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(stagePrefix+"/namespace", s.Namespace); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	params, _ := json.Marshal(s.Params)
-	if err = kvClient.Put(stagePrefix+"/params", string(params)); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	labels, _ := json.Marshal(s.Labels)
-	if err = kvClient.Put(stagePrefix+"/labels", string(labels)); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	secrets := strings.Join(s.Secrets, ",")
-	if err = kvClient.Put(stagePrefix+"/secrets", secrets); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	vars, _ := json.Marshal(s.Vars)
-	if err = kvClient.Put(stagePrefix+"/vars", string(vars)); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
+		next := *s
+		next.ResourceVersion++
+		for i, current := range stored.Stages {
+			if current.Index == s.Index {
+				if current.ResourceVersion != s.ResourceVersion {
+					return nil, ErrConflict
+				}
+				stored.Stages[i] = &next
+				return stored, nil
+			}
+		}
 
-	if err = kvClient.PutInt(stagePrefix+"/index", s.Index); err != nil {
-		return handleSaveError(stagePrefix, isNew, err, kvClient)
-	}
-	if err = kvClient.Put(stagePrefix+"/pod-name", s.PodName); err != nil {
-		kvClient.DeleteTree(namespace)
-		return err
-	}
-	if err = kvClient.Put(stagePrefix+"/job-name", s.JobName); err != nil {
-		kvClient.DeleteTree(namespace)
-		return err
-	}
-	if err = kvClient.Put(stagePrefix+"/docker-image", s.DockerImage); err != nil {
-		kvClient.DeleteTree(namespace)
-		return err
-	}
-	if err = kvClient.Put(stagePrefix+"/started", strconv.FormatInt(s.Started, 10)); err != nil {
-		kvClient.DeleteTree(namespace)
-		return err
+		stored.Stages = append(stored.Stages, &next)
+		sortStages(stored.Stages)
+		return stored, nil
+	})
+	if saved != nil {
+		s.ResourceVersion++
 	}
-	if err = kvClient.Put(stagePrefix+"/finished", strconv.FormatInt(s.Finished, 10)); err != nil {
-		kvClient.DeleteTree(namespace)
-		return err
-	}
-
-	return nil
+	return err
 }
 
 // UpdateStatus updates the status of a build stage
@@ -189,9 +144,10 @@ func (s *Stage) UpdateStatus(u *StatusUpdate, p *Pipeline, b *Build, kvClient kv
 	s.JobName = u.JobName
 	s.PodName = u.PodName
 
-	// ideally only build will be saved, which will also update the stage details
-	namespace := fmt.Sprintf("%s%s/builds/%d/stages", pipelineNamespace, b.Pipeline, b.Number)
-	if err := s.Save(namespace, kvClient); err != nil {
+	annotations := s.parseReports(u.Reports)
+
+	// the stage is saved in the build's document, the build keeps the stored stages
+	if err := s.Save(b.path()+"/stages", kvClient); err != nil {
 		return nil, err
 	}
 
@@ -200,9 +156,15 @@ func (s *Stage) UpdateStatus(u *StatusUpdate, p *Pipeline, b *Build, kvClient kv
 	}
 
 	if b.Branch != b.Commit {
-		if err := c.CreateStatus(p.Owner, p.Repo, b.Commit, s.Index, s.Name, scmStatus); err != nil {
+		if err := s.reportStatus(u, scmStatus, annotations, p, b, kvClient, c); err != nil {
 			return nil, err
 		}
+
+		if deployments, ok := c.(scm.DeploymentsClient); ok && s.Type == "deploy" && !b.Untrusted {
+			if err := s.reportDeployment(scmStatus, p, b, kvClient, deployments); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if s.Status == BuildSuccess {
@@ -236,7 +198,7 @@ func (s *Stage) UpdateStatus(u *StatusUpdate, p *Pipeline, b *Build, kvClient kv
 	}
 
 	if b.Finished != 0 {
-		err := b.Notify(kvClient)
+		err := b.Notify(kvClient, c)
 		if err != nil {
 			return nil, err
 		}
@@ -244,3 +206,143 @@ func (s *Stage) UpdateStatus(u *StatusUpdate, p *Pipeline, b *Build, kvClient kv
 
 	return nil, nil
 }
+
+// queueCheckRun creates the check run of a stage that has not started yet
+func (s *Stage) queueCheckRun(p *Pipeline, b *Build, kvClient kv.KVClient, c scm.ChecksClient) error {
+	run := s.checkRun(p, b)
+	run.Status = scm.CheckQueued
+
+	id, err := c.CreateCheckRun(p.Owner, p.Repo, b.Commit, run)
+	if err != nil {
+		return err
+	}
+
+	s.CheckRunID = id
+	return s.Save(b.path()+"/stages", kvClient)
+}
+
+// parseReports returns the annotations of the stage's test and lint reports and counts its failures,
+// reports that can't be parsed are skipped so they don't fail the status update
+func (s *Stage) parseReports(reports []*report.Report) []*scm.Annotation {
+	if len(reports) == 0 {
+		return nil
+	}
+
+	annotations := []*scm.Annotation{}
+	for _, r := range reports {
+		parsed, err := r.Annotations()
+		if err != nil {
+			logrus.WithError(err).Warnf("Unable to parse %s report of stage %s", r.Format, s.Name)
+			continue
+		}
+		annotations = append(annotations, parsed...)
+	}
+
+	s.Failures = 0
+	for _, a := range annotations {
+		if a.Level == scm.AnnotationFailure {
+			s.Failures++
+		}
+	}
+	return annotations
+}
+
+// reportStatus reports the stage as a check run when the pipeline has them enabled,
+// or as a commit status when check runs are disabled or not available to the credentials
+func (s *Stage) reportStatus(u *StatusUpdate, state string, annotations []*scm.Annotation, p *Pipeline, b *Build, kvClient kv.KVClient, c scm.Client) error {
+	if checks, ok := p.checksClient(c); ok {
+		err := s.reportCheckRun(u, state, annotations, p, b, kvClient, checks)
+		if err != scm.ErrChecksUnavailable {
+			return err
+		}
+		logrus.WithError(err).Warnf("Reporting stage %s of %s/%s with a commit status", s.Name, p.Owner, p.Repo)
+	}
+	return c.CreateStatus(p.Owner, p.Repo, b.Commit, s.Index, s.Name, state)
+}
+
+// reportCheckRun updates the check run of a stage with its status and annotations,
+// the check run is created if the stage was queued before check runs were enabled
+func (s *Stage) reportCheckRun(u *StatusUpdate, state string, annotations []*scm.Annotation, p *Pipeline, b *Build, kvClient kv.KVClient, c scm.ChecksClient) error {
+	run := s.checkRun(p, b)
+	run.Status = scm.CheckInProgress
+	run.Annotations = annotations
+	if s.Finished != 0 {
+		run.Status = scm.CheckCompleted
+		run.Conclusion = state
+	}
+
+	summary := []string{fmt.Sprintf("Stage **%s** of build #%d is `%s`.", s.Name, b.Number, s.Status)}
+	if s.Started != 0 && s.Finished != 0 {
+		summary = append(summary, fmt.Sprintf("Finished in %s.", time.Duration(s.Finished-s.Started)))
+	}
+	if u.Message != "" {
+		summary = append(summary, "", u.Message)
+	}
+	if annotations := report.Summary(run.Annotations); annotations != "" {
+		summary = append(summary, "", annotations)
+	}
+	run.Summary = strings.Join(summary, "\n")
+
+	if s.CheckRunID != 0 {
+		return c.UpdateCheckRun(p.Owner, p.Repo, s.CheckRunID, run)
+	}
+
+	id, err := c.CreateCheckRun(p.Owner, p.Repo, b.Commit, run)
+	if err != nil {
+		return err
+	}
+	s.CheckRunID = id
+	return s.Save(b.path()+"/stages", kvClient)
+}
+
+// reportDeployment updates the deployment of a deploy stage. The deployment is created when the stage starts,
+// builds of deployment events report to the deployment that triggered them.
+func (s *Stage) reportDeployment(state string, p *Pipeline, b *Build, kvClient kv.KVClient, c scm.DeploymentsClient) error {
+	if s.DeploymentID == 0 {
+		id := b.DeploymentID
+		if id == 0 {
+			var err error
+			description := fmt.Sprintf("Kontinuous build #%d stage %s", b.Number, s.Name)
+			if id, err = c.CreateDeployment(p.Owner, p.Repo, b.Commit, s.environment(b), description); err != nil {
+				return err
+			}
+		}
+
+		s.DeploymentID = id
+		if err := s.Save(b.path()+"/stages", kvClient); err != nil {
+			return err
+		}
+	}
+
+	environmentURL := ""
+	if url, ok := s.Params["environment_url"]; ok {
+		environmentURL = fmt.Sprintf("%v", url)
+	}
+	logURL := fmt.Sprintf("%s/api/v1/pipelines/%s/%s/builds/%d/stages/%d/logs",
+		os.Getenv("KONTINUOUS_URL"), p.Owner, p.Repo, b.Number, s.Index)
+
+	return c.CreateDeploymentStatus(p.Owner, p.Repo, s.DeploymentID, state, environmentURL, logURL)
+}
+
+// environment is where a deploy stage deploys to, from its params, the deployment event or its namespace
+func (s *Stage) environment(b *Build) string {
+	if env, ok := s.Params["environment"]; ok {
+		return fmt.Sprintf("%v", env)
+	}
+	if b.Environment != "" {
+		return b.Environment
+	}
+	if s.Namespace != "" {
+		return s.Namespace
+	}
+	return "default"
+}
+
+func (s *Stage) checkRun(p *Pipeline, b *Build) *scm.CheckRun {
+	return &scm.CheckRun{
+		Name:  fmt.Sprintf("kontinuous:%d %s", s.Index, s.Name),
+		Title: s.Name,
+		DetailsURL: fmt.Sprintf("%s/api/v1/pipelines/%s/%s/builds/%d/stages/%d",
+			os.Getenv("KONTINUOUS_URL"), p.Owner, p.Repo, b.Number, s.Index),
+	}
+}
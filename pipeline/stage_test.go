@@ -4,6 +4,7 @@ import (
 	// "fmt"
 	"testing"
 
+	"github.com/AcalephStorage/kontinuous/scm"
 	"github.com/AcalephStorage/kontinuous/store/kv"
 )
 
@@ -103,3 +104,36 @@ func TestUpdateSuccessStatus(t *testing.T) {
 		t.Errorf("Expected updated stage status to be %s", BuildSuccess)
 	}
 }
+
+type unavailableChecksClient struct {
+	MockSCMClient
+	statuses *[]string
+}
+
+func (c unavailableChecksClient) CreateStatus(owner, repo, sha string, stageID int, stageName, state string) error {
+	*c.statuses = append(*c.statuses, state)
+	return nil
+}
+
+func (c unavailableChecksClient) CreateCheckRun(owner, repo, sha string, run *scm.CheckRun) (int, error) {
+	return 0, scm.ErrChecksUnavailable
+}
+
+func (c unavailableChecksClient) UpdateCheckRun(owner, repo string, id int, run *scm.CheckRun) error {
+	return scm.ErrChecksUnavailable
+}
+
+func TestUnavailableCheckRunsFallBackToStatus(t *testing.T) {
+	u, p, b, s, kvc, git := getUpdateStatusResources(BuildRunning)
+	p.Checks = true
+	b.Branch, b.Commit = "master", "4d5e6f7"
+	s.CheckRunID = 5
+	c := unavailableChecksClient{MockSCMClient: git, statuses: &[]string{}}
+
+	if _, err := s.UpdateStatus(u, p, b, kvc, c); err != nil {
+		t.Fatalf("Expected the status to be updated, got error: %s", err)
+	}
+	if len(*c.statuses) != 1 || (*c.statuses)[0] != scm.StatePending {
+		t.Errorf("Expected the stage to be reported with a pending commit status, got %v", *c.statuses)
+	}
+}
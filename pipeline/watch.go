@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+// buildsDir is the directory of the builds in a pipeline's directory
+const buildsDir = "/builds/"
+
+// WatchBuilds reports the builds of the pipeline every time one is created or saved,
+// with its stages. The channel is closed when stop is closed or the watch ends, eg.
+// when the watcher fell behind, list the builds and watch again to not miss a change.
+func (p *Pipeline) WatchBuilds(kvClient kv.KVClient, stop <-chan struct{}) (<-chan *Build, error) {
+	return watchBuilds(pipelineNamespace+p.fullName()+"/builds", false, kvClient, stop)
+}
+
+// Watch reports the build every time it is saved, with its stages. The channel is
+// closed when the build is deleted, when stop is closed or when the watch ends.
+func (b *Build) Watch(kvClient kv.KVClient, stop <-chan struct{}) (<-chan *Build, error) {
+	return watchBuilds(b.path(), true, kvClient, stop)
+}
+
+func watchBuilds(prefix string, single bool, kvClient kv.KVClient, stop <-chan struct{}) (<-chan *Build, error) {
+	events, err := kvClient.Watch(prefix, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	builds := make(chan *Build)
+	go func() {
+		defer close(builds)
+		for event := range events {
+			path, ok := buildPath(event.Key)
+			if !ok {
+				// the pipeline or all of its builds were deleted
+				if event.Type == kv.EventDelete {
+					return
+				}
+				continue
+			}
+
+			b, exists := changedBuild(path, event, kvClient)
+			if !exists {
+				if single && event.Type == kv.EventDelete {
+					return
+				}
+				continue
+			}
+
+			select {
+			case builds <- b:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return builds, nil
+}
+
+// changedBuild returns the build of a change, the document is decoded from the event
+// and builds stored with a key per field are read again
+func changedBuild(path string, event *kv.Event, kvClient kv.KVClient) (*Build, bool) {
+	if event.Key == path && len(event.Value) != 0 {
+		if b, err := decodeBuild(event.Value); err == nil {
+			return b, true
+		}
+	}
+	return getBuild(path, kvClient)
+}
+
+// buildPath returns the path of the build a key belongs to
+func buildPath(key string) (string, bool) {
+	i := strings.Index(key, buildsDir)
+	if i < 0 {
+		return "", false
+	}
+
+	start := i + len(buildsDir)
+	number := key[start:]
+	if j := strings.Index(number, "/"); j >= 0 {
+		number = number[:j]
+	}
+	if number == "" {
+		return "", false
+	}
+	return key[:start] + number, true
+}
@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func receiveBuild(t *testing.T, builds <-chan *Build) *Build {
+	select {
+	case b, open := <-builds:
+		if !open {
+			t.Fatal("Expected a build, the watch ended")
+		}
+		return b
+	case <-time.After(time.Second):
+		t.Fatal("Expected a build, got none")
+	}
+	return nil
+}
+
+func TestWatchBuilds(t *testing.T) {
+	kvc := setupLegacyStore(2, 2)
+	MigrateDocuments(kvc)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	builds, err := p.WatchBuilds(kvc, stop)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	b, _ := p.GetBuild(2, kvc)
+	b.Status = BuildRunning
+	b.Save(kvc)
+	if saved := receiveBuild(t, builds); saved.Number != 2 || saved.Status != BuildRunning {
+		t.Errorf("Expected build 2 to be running, got %d %s", saved.Number, saved.Status)
+	}
+
+	s, _ := b.GetStage(1, kvc)
+	s.Status = BuildFailure
+	s.Save(b.path()+"/stages", kvc)
+	if saved := receiveBuild(t, builds); saved.Stages[0].Status != BuildFailure {
+		t.Errorf("Expected the stage saved with the build, got %s", saved.Stages[0].Status)
+	}
+
+	// builds stored with a key per field are read again on every change, until
+	// all the fields are written the build is partial
+	putLegacyBuild(kvc, 3, 1)
+	for saved := receiveBuild(t, builds); saved.Number != 3 || saved.CurrentStage != 1; saved = receiveBuild(t, builds) {
+	}
+}
+
+func TestWatchBuildEndsWhenDeleted(t *testing.T) {
+	kvc := setupLegacyStore(1, 1)
+	MigrateDocuments(kvc)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	b, _ := p.GetBuild(1, kvc)
+	builds, err := b.Watch(kvc, stop)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	kvc.DeleteTree(b.path())
+	select {
+	case _, open := <-builds:
+		if open {
+			t.Error("Expected no build after it was deleted")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the watch to end when the build is deleted")
+	}
+}
+
+func TestWatchBuildsEndsWhenBehind(t *testing.T) {
+	kvc := setupLegacyStore(1, 1)
+	MigrateDocuments(kvc)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	p, _ := FindPipeline("SampleOwner", "SampleRepo", kvc)
+	builds, err := p.WatchBuilds(kvc, stop)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// nothing is received while the build is saved more times than the watch buffers
+	b, _ := p.GetBuild(1, kvc)
+	for i := 0; i < 200; i++ {
+		if err := b.Save(kvc); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, open := <-builds:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the watch to end once it fell behind")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"net/http"
+)
+
+// manifestV2 is the media type of the manifests pushed by docker, the digest of the
+// manifest is only returned for the media type it was pushed with
+const manifestV2 = "application/vnd.docker.distribution.manifest.v2+json"
+
+// ErrDeleteDisabled is returned when the registry doesn't allow deleting images,
+// deletes are enabled with REGISTRY_STORAGE_DELETE_ENABLED=true on the registry
+var ErrDeleteDisabled = errors.New("deleting images is disabled on the registry")
+
+// RegistryClient is the interface to the internal docker registry the builds push
+// their images to
+type RegistryClient interface {
+	// DeleteImage removes the tagged image, images already gone are not an error
+	DeleteImage(name, tag string) error
+}
+
+// concrete implementation of a registry client
+type realRegistryClient struct {
+	*http.Client
+	address string
+}
+
+// NewClient returns a RegistryClient for the registry at address, eg. registry:5000.
+// The internal registry is plain http unless the address has a scheme.
+func NewClient(address string) RegistryClient {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &realRegistryClient{http.DefaultClient, strings.TrimSuffix(address, "/")}
+}
+
+func (r *realRegistryClient) DeleteImage(name, tag string) error {
+	manifest := fmt.Sprintf("%s/v2/%s/manifests/", r.address, name)
+
+	// manifests are deleted by digest, the tag is resolved first
+	req, err := http.NewRequest("HEAD", manifest+tag, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", manifestV2)
+	res, err := r.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil
+	case res.StatusCode >= 400:
+		return fmt.Errorf("unable to find image %s:%s: %s", name, tag, res.Status)
+	}
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return fmt.Errorf("no digest returned for image %s:%s", name, tag)
+	}
+
+	req, err = http.NewRequest("DELETE", manifest+digest, nil)
+	if err != nil {
+		return err
+	}
+	res, err = r.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil
+	case res.StatusCode == http.StatusMethodNotAllowed:
+		return ErrDeleteDisabled
+	case res.StatusCode >= 400:
+		return fmt.Errorf("unable to delete image %s:%s: %s", name, tag, res.Status)
+	}
+	return nil
+}
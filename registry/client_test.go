@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestDeleteImage(t *testing.T) {
+	deleted := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/v2/pipeline-1/manifests/abc123":
+			if r.Header.Get("Accept") != manifestV2 {
+				t.Errorf("Expected the v2 manifest to be requested, got %s", r.Header.Get("Accept"))
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:digest")
+		case r.Method == "DELETE" && r.URL.Path == "/v2/pipeline-1/manifests/sha256:digest":
+			deleted = r.URL.Path
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	if err := client.DeleteImage("pipeline-1", "abc123"); err != nil || deleted == "" {
+		t.Errorf("Expected the manifest to be deleted by digest, got %v", err)
+	}
+	if err := client.DeleteImage("pipeline-2", "abc123"); err != nil {
+		t.Errorf("Expected a missing image to be ignored, got %s", err)
+	}
+}
+
+func TestDeleteImageDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Docker-Content-Digest", "sha256:digest")
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.URL).DeleteImage("pipeline-1", "abc123"); err != ErrDeleteDisabled {
+		t.Errorf("Expected ErrDeleteDisabled, got %v", err)
+	}
+}
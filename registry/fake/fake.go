@@ -0,0 +1,64 @@
+// Package fake is an in-memory registry.RegistryClient for tests. It keeps the images
+// added to it and records the ones deleted.
+package fake
+
+import (
+	"sync"
+)
+
+// Client is an in-memory registry
+type Client struct {
+	mu      sync.Mutex
+	images  map[string]bool
+	deleted []string
+	err     error
+}
+
+// NewClient returns an empty fake registry
+func NewClient() *Client {
+	return &Client{images: make(map[string]bool)}
+}
+
+// AddImage adds a tagged image, like a build pushing it
+func (c *Client) AddImage(name, tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.images[name+":"+tag] = true
+}
+
+// HasImage checks if the tagged image is in the registry
+func (c *Client) HasImage(name, tag string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.images[name+":"+tag]
+}
+
+// Deleted returns the images deleted, as name:tag
+func (c *Client) Deleted() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.deleted...)
+}
+
+// FailDeletes makes the deletes fail with err, nil lets them succeed again
+func (c *Client) FailDeletes(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *Client) DeleteImage(name, tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	image := name + ":" + tag
+	if c.images[image] {
+		delete(c.images, image)
+		c.deleted = append(c.deleted, image)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package bitbucket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+const (
+	// CloudURL is the API address of Bitbucket Cloud
+	CloudURL = "https://api.bitbucket.org"
+
+	// bitbucket build states
+	stateInProgress = "INPROGRESS"
+	stateSuccessful = "SUCCESSFUL"
+	stateFailed     = "FAILED"
+)
+
+// NewClient returns a Bitbucket Server client when the address of a self-hosted
+// instance is given, otherwise a Bitbucket Cloud client
+func NewClient(serverURL string) scm.Client {
+	if serverURL == "" {
+		return &CloudClient{client{baseURL: CloudURL}}
+	}
+	return &ServerClient{client{baseURL: strings.TrimSuffix(serverURL, "/")}}
+}
+
+// client holds the details shared by the cloud and server clients
+type client struct {
+	token   string
+	baseURL string
+}
+
+// AccessToken returns the client's access token
+func (c *client) AccessToken() string {
+	return c.token
+}
+
+// SetAccessToken sets the client's access token
+func (c *client) SetAccessToken(token string) {
+	c.token = token
+}
+
+// Name returns the client's remote source name
+func (c *client) Name() string {
+	return scm.RepoBitbucket
+}
+
+// doJSON sends a json request and decodes the json response to `out` when given
+func (c *client) doJSON(method, endpoint string, data, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	res, content, err := c.do(method, endpoint, "application/json", body)
+	if err != nil {
+		return res, err
+	}
+
+	if out != nil && len(content) > 0 {
+		if err := json.Unmarshal(content, out); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// doForm sends a multipart form request, used for committing files
+func (c *client) doForm(method, endpoint string, fields map[string]string) ([]byte, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	_, content, err := c.do(method, endpoint, writer.FormDataContentType(), body)
+	return content, err
+}
+
+func (c *client) do(method, endpoint, contentType string, body io.Reader) (*http.Response, []byte, error) {
+	url := endpoint
+	if !strings.HasPrefix(endpoint, "http") {
+		url = c.baseURL + endpoint
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res, nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		return res, content, apiError(res, content)
+	}
+	return res, content, nil
+}
+
+// apiError extracts the error message from both cloud and server error bodies
+func apiError(res *http.Response, content []byte) error {
+	body := new(struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	})
+
+	if err := json.Unmarshal(content, body); err == nil {
+		if body.Error.Message != "" {
+			return errors.New(body.Error.Message)
+		}
+		if len(body.Errors) > 0 {
+			return errors.New(body.Errors[0].Message)
+		}
+	}
+	return errors.New(res.Status)
+}
+
+// buildState converts scm states to bitbucket build states
+func buildState(state string) string {
+	switch state {
+	case scm.StateSuccess:
+		return stateSuccessful
+	case scm.StateError, scm.StateFailure:
+		return stateFailed
+	default:
+		return stateInProgress
+	}
+}
+
+// buildStatus is the payload of the build status API, shared by cloud and server
+func buildStatus(stageID int, stageName, state string) map[string]interface{} {
+	return map[string]interface{}{
+		"state":       buildState(state),
+		"key":         fmt.Sprintf("kontinuous:%d", stageID),
+		"name":        stageName,
+		"description": stageName,
+		"url":         os.Getenv("KONTINUOUS_URL"),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package bitbucket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+var (
+	cloudPushHook = `{
+  "actor": {"username": "jsmith", "nickname": "jsmith"},
+  "repository": {"full_name": "team/repo"},
+  "push": {
+    "changes": [
+      {"new": null},
+      {"new": {"type": "branch", "name": "develop", "target": {"hash": "709d658dc5b6d6afcd46049c2f332ee3f515a67d"}}}
+    ]
+  }
+}`
+
+	cloudPullRequestHook = `{
+  "actor": {"username": "jsmith", "nickname": "jsmith"},
+  "pullrequest": {
+    "id": 3,
+    "source": {
+      "branch": {"name": "feature"},
+      "commit": {"hash": "d3022fc0ca3d"},
+      "repository": {"full_name": "fork/repo"}
+    },
+    "destination": {
+      "branch": {"name": "master"},
+      "repository": {"full_name": "team/repo"}
+    }
+  }
+}`
+
+	serverPushHook = `{
+  "actor": {"name": "admin", "slug": "admin"},
+  "repository": {
+    "slug": "repo",
+    "project": {"key": "PRJ"},
+    "links": {"clone": [{"href": "https://bitbucket.example.com/scm/prj/repo.git", "name": "http"}]}
+  },
+  "changes": [
+    {"ref": {"id": "refs/heads/master", "displayId": "master", "type": "BRANCH"}, "toHash": "a00945762949b7787ecf4d86cd3d2d9d41f1eb19", "type": "UPDATE"}
+  ]
+}`
+)
+
+func TestParseCloudPushHook(t *testing.T) {
+	client := NewClient("")
+	hook, err := client.ParseHook([]byte(cloudPushHook), "repo:push")
+	if err != nil {
+		t.Fatalf("Expected push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Branch != "develop" {
+		t.Errorf("Expected branch `develop`, got `%s`", hook.Branch)
+	}
+	if hook.CloneURL != "https://bitbucket.org/team/repo.git" {
+		t.Errorf("Expected clone url of team/repo, got `%s`", hook.CloneURL)
+	}
+	if hook.Event != scm.EventPush {
+		t.Errorf("Expected event `%s`, got `%s`", scm.EventPush, hook.Event)
+	}
+}
+
+func TestParseCloudPullRequestHook(t *testing.T) {
+	client := NewClient("")
+	hook, err := client.ParseHook([]byte(cloudPullRequestHook), "pullrequest:created")
+	if err != nil {
+		t.Fatalf("Expected pull request hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Branch != "feature" {
+		t.Errorf("Expected source branch `feature`, got `%s`", hook.Branch)
+	}
+	if hook.Event != scm.EventPullRequest {
+		t.Errorf("Expected event `%s`, got `%s`", scm.EventPullRequest, hook.Event)
+	}
+}
+
+func TestParseServerPushHook(t *testing.T) {
+	client := NewClient("https://bitbucket.example.com")
+	hook, err := client.ParseHook([]byte(serverPushHook), "repo:refs_changed")
+	if err != nil {
+		t.Fatalf("Expected push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Branch != "master" {
+		t.Errorf("Expected branch `master`, got `%s`", hook.Branch)
+	}
+	if hook.Commit != "a00945762949b7787ecf4d86cd3d2d9d41f1eb19" {
+		t.Errorf("Expected toHash as commit, got `%s`", hook.Commit)
+	}
+	if hook.CloneURL != "https://bitbucket.example.com/scm/prj/repo.git" {
+		t.Errorf("Expected http clone url, got `%s`", hook.CloneURL)
+	}
+}
+
+func TestParseServerTagPushHook(t *testing.T) {
+	body := strings.Replace(strings.Replace(serverPushHook, "BRANCH", "TAG", 1), `"displayId": "master"`, `"displayId": "v2.0"`, 1)
+
+	client := NewClient("https://bitbucket.example.com")
+	hook, err := client.ParseHook([]byte(body), "repo:refs_changed")
+	if err != nil {
+		t.Fatalf("Expected tag push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Event != scm.EventTag || hook.Tag != "v2.0" {
+		t.Errorf("Expected tag event for `v2.0`, got `%s` for `%s`", hook.Event, hook.Tag)
+	}
+	if hook.Branch != "" {
+		t.Errorf("Expected no branch for tag pushes, got `%s`", hook.Branch)
+	}
+}
+
+func TestParseUnknownHook(t *testing.T) {
+	client := NewClient("")
+	if _, err := client.ParseHook([]byte(`{}`), "repo:fork"); err == nil {
+		t.Error("Expected unsupported hooks to return an error")
+	}
+}
@@ -0,0 +1,441 @@
+package bitbucket
+
+import (
+	"fmt"
+	"strings"
+
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+// CloudClient is used for making requests to Bitbucket Cloud
+type CloudClient struct {
+	client
+}
+
+func cloudRepoPath(owner, repo string) string {
+	return fmt.Sprintf("/2.0/repositories/%s/%s", url.QueryEscape(owner), url.QueryEscape(repo))
+}
+
+func cloudSrcPath(owner, repo, ref, path string) string {
+	return fmt.Sprintf("%s/src/%s/%s", cloudRepoPath(owner, repo), url.QueryEscape(ref), strings.TrimPrefix(path, "/"))
+}
+
+// CreateHook creates a repository webhook and returns its UUID, payloads are signed with the secret
+func (c *CloudClient) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	hookEvents := []string{}
+	for _, event := range events {
+		switch event {
+		case scm.EventPush, scm.EventTag:
+			if !contains(hookEvents, "repo:push") {
+				hookEvents = append(hookEvents, "repo:push")
+			}
+		case scm.EventPullRequest:
+			hookEvents = append(hookEvents, "pullrequest:created", "pullrequest:updated")
+		}
+	}
+
+	hook := map[string]interface{}{
+		"description": "kontinuous",
+		"url":         callback,
+		"active":      true,
+		"secret":      secret,
+		"events":      hookEvents,
+	}
+
+	created := new(struct {
+		UUID string `json:"uuid"`
+	})
+	if _, err := c.doJSON("POST", cloudRepoPath(owner, repo)+"/hooks", hook, created); err != nil {
+		return "", err
+	}
+	return created.UUID, nil
+}
+
+// CreateKey creates a repository access key and returns the key ID
+func (c *CloudClient) CreateKey(owner, repo, key, title string) (int, error) {
+	deployKey := map[string]interface{}{
+		"key":   key,
+		"label": title,
+	}
+
+	created := new(cloudKey)
+	if _, err := c.doJSON("POST", cloudRepoPath(owner, repo)+"/deploy-keys", deployKey, created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+// DeleteKey removes a repository access key
+func (c *CloudClient) DeleteKey(owner, repo string, id int) error {
+	endpoint := fmt.Sprintf("%s/deploy-keys/%d", cloudRepoPath(owner, repo), id)
+	_, err := c.doJSON("DELETE", endpoint, nil, nil)
+	return err
+}
+
+// CreateStatus reports the stage state through the build status API
+func (c *CloudClient) CreateStatus(owner, repo, ref string, stageID int, stageName, state string) error {
+	endpoint := fmt.Sprintf("%s/commit/%s/statuses/build", cloudRepoPath(owner, repo), ref)
+	_, err := c.doJSON("POST", endpoint, buildStatus(stageID, stageName, state), nil)
+	return err
+}
+
+// GetFileContent fetches a file from the given commit or branch
+func (c *CloudClient) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	_, content, err := c.do("GET", cloudSrcPath(owner, repo, ref, path), "", nil)
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// GetContents gets the content of a file from the given commit or branch.
+// Bitbucket has no file blobs so the SHA is the commit that last changed the file.
+func (c *CloudClient) GetContents(owner, repo, path, ref string) (*scm.RepositoryContent, bool) {
+	content, ok := c.GetFileContent(owner, repo, path, ref)
+	if !ok {
+		return nil, false
+	}
+
+	meta := new(cloudFileMeta)
+	if _, err := c.doJSON("GET", cloudSrcPath(owner, repo, ref, path)+"?format=meta", nil, meta); err != nil {
+		return nil, false
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	return &scm.RepositoryContent{
+		Content: &encoded,
+		SHA:     &meta.Commit.Hash,
+	}, true
+}
+
+// GetDirectoryContent gets the contents of the files in a directory
+func (c *CloudClient) GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool) {
+	page := new(cloudTreePage)
+	endpoint := strings.TrimSuffix(cloudSrcPath(owner, repo, ref, path), "/") + "/?pagelen=100"
+	if _, err := c.doJSON("GET", endpoint, nil, page); err != nil || len(page.Values) == 0 {
+		return nil, false
+	}
+
+	contents := make([]interface{}, 0)
+	for _, node := range page.Values {
+		if node.Type != "commit_file" {
+			continue
+		}
+		decoded, ok := c.GetFileContent(owner, repo, node.Path, ref)
+		if !ok {
+			continue
+		}
+		contents = append(contents, decoded)
+	}
+	return contents, true
+}
+
+// CreateFile commits a new file to a repository
+func (c *CloudClient) CreateFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Create %s", path)
+	}
+	return c.commitFile(owner, repo, path, message, branch, content)
+}
+
+// UpdateFile commits diff of a file content
+func (c *CloudClient) UpdateFile(owner, repo, path, blob, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Update %s", path)
+	}
+	return c.commitFile(owner, repo, path, message, branch, content)
+}
+
+func (c *CloudClient) commitFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	fields := map[string]string{
+		"/" + strings.TrimPrefix(path, "/"): string(content),
+		"message":                           message,
+		"branch":                            branch,
+	}
+	if _, err := c.doForm("POST", cloudRepoPath(owner, repo)+"/src", fields); err != nil {
+		return nil, err
+	}
+
+	meta := new(cloudFileMeta)
+	if _, err := c.doJSON("GET", cloudSrcPath(owner, repo, branch, path)+"?format=meta", nil, meta); err != nil {
+		return &scm.RepositoryContent{}, nil
+	}
+	return &scm.RepositoryContent{SHA: &meta.Commit.Hash}, nil
+}
+
+// GetRepository fetches repository details from Bitbucket
+func (c *CloudClient) GetRepository(owner, name string) (*scm.Repository, bool) {
+	data := new(cloudRepository)
+	if _, err := c.doJSON("GET", cloudRepoPath(owner, name), nil, data); err != nil {
+		return nil, false
+	}
+
+	q := url.Values{}
+	q.Set("q", fmt.Sprintf(`repository.full_name="%s"`, data.FullName))
+	page := new(cloudPermissionPage)
+	if _, err := c.doJSON("GET", "/2.0/user/permissions/repositories?"+q.Encode(), nil, page); err != nil {
+		return nil, false
+	}
+
+	permission := ""
+	if len(page.Values) > 0 {
+		permission = page.Values[0].Permission
+	}
+
+	return data.toRepository(permission), true
+}
+
+// ListRepositories lists the repositories accessible by the current user
+func (c *CloudClient) ListRepositories(user string) (repos []*scm.Repository, err error) {
+	next := "/2.0/user/permissions/repositories?pagelen=100"
+	for next != "" {
+		page := new(cloudPermissionPage)
+		if _, err := c.doJSON("GET", next, nil, page); err != nil {
+			return nil, err
+		}
+
+		for _, value := range page.Values {
+			if value.Repository == nil {
+				continue
+			}
+			repos = append(repos, value.Repository.toRepository(value.Permission))
+		}
+		next = page.Next
+	}
+
+	return repos, nil
+}
+
+// ParseHook parses the contents of a push or pull request webhook
+func (c *CloudClient) ParseHook(body []byte, event string) (*scm.Hook, error) {
+	switch event {
+	case "repo:push":
+		payload := new(CloudPushHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		hook := &scm.Hook{
+			Author:   payload.Actor.Nickname,
+			CloneURL: cloudCloneURL(payload.Repository.FullName),
+			Event:    scm.EventPush,
+		}
+		if hook.Author == "" {
+			hook.Author = payload.Actor.Username
+		}
+
+		// use the latest branch update from the push, tags are built when no branch was updated
+		tag, tagCommit, tagMessage := "", "", ""
+		for _, change := range payload.Push.Changes {
+			if change.New == nil {
+				continue
+			}
+			switch change.New.Type {
+			case "branch":
+				hook.Branch = change.New.Name
+				hook.Commit = change.New.Target.Hash
+				hook.Message = change.New.Target.Message
+			case "tag":
+				tag = change.New.Name
+				tagCommit = change.New.Target.Hash
+				tagMessage = change.New.Target.Message
+			}
+		}
+
+		if hook.Commit == "" && tag != "" {
+			hook.Event = scm.EventTag
+			hook.Tag = tag
+			hook.Commit = tagCommit
+			hook.Message = tagMessage
+		}
+
+		if hook.Commit == "" {
+			return nil, fmt.Errorf("No branch updates found in %s event", event)
+		}
+		return hook, nil
+
+	case "pullrequest:created", "pullrequest:updated":
+		payload := new(CloudPullRequestHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		pr := payload.PullRequest
+		hook := &scm.Hook{
+			Author:      payload.Actor.Nickname,
+			Branch:      pr.Source.Branch.Name,
+			CloneURL:    cloudCloneURL(pr.Source.Repository.FullName),
+			Commit:      pr.Source.Commit.Hash,
+			Event:       scm.EventPullRequest,
+			PullRequest: pr.ID,
+			BaseBranch:  pr.Destination.Branch.Name,
+			HeadRepo:    pr.Source.Repository.FullName,
+		}
+		if hook.Author == "" {
+			hook.Author = payload.Actor.Username
+		}
+		return hook, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported bitbucket event %s", event)
+}
+
+// HookExists checks whether a webhook with the given callback already exists
+func (c *CloudClient) HookExists(owner, repo, url string) bool {
+	next := cloudRepoPath(owner, repo) + "/hooks?pagelen=100"
+	for next != "" {
+		page := new(cloudHookPage)
+		if _, err := c.doJSON("GET", next, nil, page); err != nil {
+			return false
+		}
+
+		for _, hook := range page.Values {
+			if hook.URL == url {
+				return true
+			}
+		}
+		next = page.Next
+	}
+
+	return false
+}
+
+// DeleteHook removes the webhooks with the given callback
+func (c *CloudClient) DeleteHook(owner, repo, callback string) error {
+	next := cloudRepoPath(owner, repo) + "/hooks?pagelen=100"
+	uuids := []string{}
+	for next != "" {
+		page := new(cloudHookPage)
+		if _, err := c.doJSON("GET", next, nil, page); err != nil {
+			return err
+		}
+
+		for _, hook := range page.Values {
+			if hook.URL == callback {
+				uuids = append(uuids, hook.UUID)
+			}
+		}
+		next = page.Next
+	}
+
+	for _, uuid := range uuids {
+		endpoint := fmt.Sprintf("%s/hooks/%s", cloudRepoPath(owner, repo), url.QueryEscape(uuid))
+		if _, err := c.doJSON("DELETE", endpoint, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteHookByID removes the webhook with the given UUID
+func (c *CloudClient) DeleteHookByID(owner, repo, id string) error {
+	_, err := c.doJSON("DELETE", fmt.Sprintf("%s/hooks/%s", cloudRepoPath(owner, repo), url.QueryEscape(id)), nil, nil)
+	return err
+}
+
+// GetHead gets the HEAD commit of a branch
+func (c *CloudClient) GetHead(owner, repo, branch string) (string, error) {
+	b := new(cloudBranch)
+	endpoint := fmt.Sprintf("%s/refs/branches/%s", cloudRepoPath(owner, repo), url.QueryEscape(branch))
+	if _, err := c.doJSON("GET", endpoint, nil, b); err != nil {
+		return "", err
+	}
+	return b.Target.Hash, nil
+}
+
+// CreateBranch creates a new branch of the repository from a commit as baseRef
+func (c *CloudClient) CreateBranch(owner, repo, branchName, baseRef string) (string, error) {
+	data := map[string]interface{}{
+		"name": branchName,
+		"target": map[string]string{
+			"hash": baseRef,
+		},
+	}
+
+	b := new(cloudBranch)
+	if _, err := c.doJSON("POST", cloudRepoPath(owner, repo)+"/refs/branches", data, b); err != nil {
+		return "", err
+	}
+	return "refs/heads/" + b.Name, nil
+}
+
+// CreatePullRequest starts a pull request of the changes from headRef to baseRef
+func (c *CloudClient) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
+	data := map[string]interface{}{
+		"title": title,
+		"source": map[string]interface{}{
+			"branch": map[string]string{"name": headRef},
+		},
+		"destination": map[string]interface{}{
+			"branch": map[string]string{"name": baseRef},
+		},
+	}
+
+	if _, err := c.doJSON("POST", cloudRepoPath(owner, repo)+"/pullrequests", data, nil); err != nil {
+		logrus.WithError(err).Error("Error creating pull request")
+		return err
+	}
+	return nil
+}
+
+// CreateComment comments on a pull request and returns the comment's ID
+func (c *CloudClient) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	comment := new(cloudComment)
+	endpoint := fmt.Sprintf("%s/pullrequests/%d/comments", cloudRepoPath(owner, repo), pullRequest)
+	data := map[string]interface{}{
+		"content": map[string]string{"raw": body},
+	}
+	if _, err := c.doJSON("POST", endpoint, data, comment); err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+// UpdateComment replaces the content of a pull request comment
+func (c *CloudClient) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	endpoint := fmt.Sprintf("%s/pullrequests/%d/comments/%d", cloudRepoPath(owner, repo), pullRequest, commentID)
+	data := map[string]interface{}{
+		"content": map[string]string{"raw": body},
+	}
+	_, err := c.doJSON("PUT", endpoint, data, nil)
+	return err
+}
+
+func cloudCloneURL(fullName string) string {
+	return fmt.Sprintf("https://bitbucket.org/%s.git", fullName)
+}
+
+func (r *cloudRepository) toRepository(permission string) *scm.Repository {
+	names := strings.SplitN(r.FullName, "/", 2)
+	owner, name := names[0], r.Name
+	if len(names) == 2 {
+		name = names[1]
+	}
+
+	cloneURL := ""
+	for _, link := range r.Links.Clone {
+		if link.Name == "https" {
+			cloneURL = link.Href
+		}
+	}
+
+	return &scm.Repository{
+		Owner:         owner,
+		Name:          name,
+		FullName:      r.FullName,
+		Avatar:        r.Links.Avatar.Href,
+		CloneURL:      cloneURL,
+		DefaultBranch: r.MainBranch.Name,
+		Permissions: map[string]bool{
+			"admin": permission == "admin",
+			"push":  permission == "admin" || permission == "write",
+			"pull":  permission != "",
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package bitbucket
+
+type (
+	cloudLink struct {
+		Href string `json:"href"`
+		Name string `json:"name"`
+	}
+
+	cloudRepository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+
+		Links struct {
+			Clone  []cloudLink `json:"clone"`
+			Avatar cloudLink   `json:"avatar"`
+		} `json:"links"`
+
+		MainBranch struct {
+			Name string `json:"name"`
+		} `json:"mainbranch"`
+	}
+
+	cloudPermission struct {
+		Permission string           `json:"permission"`
+		Repository *cloudRepository `json:"repository"`
+	}
+
+	cloudPermissionPage struct {
+		Values []*cloudPermission `json:"values"`
+		Next   string             `json:"next"`
+	}
+
+	cloudHookPage struct {
+		Values []struct {
+			UUID string `json:"uuid"`
+			URL  string `json:"url"`
+		} `json:"values"`
+		Next string `json:"next"`
+	}
+
+	cloudTreePage struct {
+		Values []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"values"`
+		Next string `json:"next"`
+	}
+
+	cloudBranch struct {
+		Name   string `json:"name"`
+		Target struct {
+			Hash string `json:"hash"`
+		} `json:"target"`
+	}
+
+	cloudFileMeta struct {
+		Path   string `json:"path"`
+		Commit struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+	}
+
+	cloudComment struct {
+		ID int `json:"id"`
+	}
+
+	cloudKey struct {
+		ID int `json:"id"`
+	}
+)
+
+type (
+	serverProject struct {
+		Key string `json:"key"`
+	}
+
+	serverLink struct {
+		Href string `json:"href"`
+		Name string `json:"name"`
+	}
+
+	serverRepository struct {
+		ID      int           `json:"id"`
+		Slug    string        `json:"slug"`
+		Name    string        `json:"name"`
+		Project serverProject `json:"project"`
+
+		Links struct {
+			Clone []serverLink `json:"clone"`
+		} `json:"links"`
+	}
+
+	serverRepositoryPage struct {
+		Values        []*serverRepository `json:"values"`
+		IsLastPage    bool                `json:"isLastPage"`
+		NextPageStart int                 `json:"nextPageStart"`
+	}
+
+	serverWebhookPage struct {
+		Values []struct {
+			ID  int    `json:"id"`
+			URL string `json:"url"`
+		} `json:"values"`
+	}
+
+	serverFilePage struct {
+		Values        []string `json:"values"`
+		IsLastPage    bool     `json:"isLastPage"`
+		NextPageStart int      `json:"nextPageStart"`
+	}
+
+	serverBranch struct {
+		ID           string `json:"id"`
+		DisplayID    string `json:"displayId"`
+		LatestCommit string `json:"latestCommit"`
+	}
+
+	serverBranchPage struct {
+		Values []*serverBranch `json:"values"`
+	}
+
+	serverCommit struct {
+		ID string `json:"id"`
+	}
+
+	serverComment struct {
+		ID      int `json:"id"`
+		Version int `json:"version"`
+	}
+
+	serverAccessKey struct {
+		Key struct {
+			ID int `json:"id"`
+		} `json:"key"`
+	}
+)
+
+// CloudPushHook is used to make bitbucket cloud `repo:push` webhooks easily accessible
+type CloudPushHook struct {
+	Actor struct {
+		Username    string `json:"username"`
+		Nickname    string `json:"nickname"`
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+
+	Push struct {
+		Changes []struct {
+			New *struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Target struct {
+					Hash    string `json:"hash"`
+					Message string `json:"message"`
+				} `json:"target"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// CloudPullRequestHook is used to make bitbucket cloud `pullrequest:*` webhooks easily accessible
+type CloudPullRequestHook struct {
+	Actor struct {
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+	} `json:"actor"`
+
+	PullRequest struct {
+		ID     int    `json:"id"`
+		Title  string `json:"title"`
+		Source struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+			Commit struct {
+				Hash string `json:"hash"`
+			} `json:"commit"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"source"`
+		Destination struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"destination"`
+	} `json:"pullrequest"`
+}
+
+// ServerPushHook is used to make bitbucket server `repo:refs_changed` webhooks easily accessible
+type ServerPushHook struct {
+	Actor struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"actor"`
+
+	Repository serverRepository `json:"repository"`
+
+	Changes []struct {
+		Ref struct {
+			ID        string `json:"id"`
+			DisplayID string `json:"displayId"`
+			Type      string `json:"type"`
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+}
+
+// ServerPullRequestHook is used to make bitbucket server `pr:*` webhooks easily accessible
+type ServerPullRequestHook struct {
+	Actor struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"actor"`
+
+	PullRequest struct {
+		ID      int `json:"id"`
+		FromRef struct {
+			ID           string           `json:"id"`
+			DisplayID    string           `json:"displayId"`
+			LatestCommit string           `json:"latestCommit"`
+			Repository   serverRepository `json:"repository"`
+		} `json:"fromRef"`
+		ToRef struct {
+			ID         string           `json:"id"`
+			DisplayID  string           `json:"displayId"`
+			Repository serverRepository `json:"repository"`
+		} `json:"toRef"`
+	} `json:"pullRequest"`
+}
@@ -0,0 +1,460 @@
+package bitbucket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+// ServerClient is used for making requests to a Bitbucket Server instance
+type ServerClient struct {
+	client
+}
+
+func serverRepoPath(owner, repo string) string {
+	return fmt.Sprintf("/rest/api/1.0/projects/%s/repos/%s", url.QueryEscape(owner), url.QueryEscape(repo))
+}
+
+func serverKeysPath(owner, repo string) string {
+	return fmt.Sprintf("/rest/keys/1.0/projects/%s/repos/%s/ssh", url.QueryEscape(owner), url.QueryEscape(repo))
+}
+
+// CreateHook creates a repository webhook and returns its ID, payloads are signed with the secret
+func (c *ServerClient) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	hookEvents := []string{}
+	for _, event := range events {
+		switch event {
+		case scm.EventPush, scm.EventTag:
+			if !contains(hookEvents, "repo:refs_changed") {
+				hookEvents = append(hookEvents, "repo:refs_changed")
+			}
+		case scm.EventPullRequest:
+			hookEvents = append(hookEvents, "pr:opened", "pr:from_ref_updated")
+		}
+	}
+
+	hook := map[string]interface{}{
+		"name":   "kontinuous",
+		"url":    callback,
+		"active": true,
+		"events": hookEvents,
+		"configuration": map[string]string{
+			"secret": secret,
+		},
+	}
+
+	created := new(struct {
+		ID int `json:"id"`
+	})
+	if _, err := c.doJSON("POST", serverRepoPath(owner, repo)+"/webhooks", hook, created); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(created.ID), nil
+}
+
+// CreateKey creates a read only repository access key and returns the key ID
+func (c *ServerClient) CreateKey(owner, repo, key, title string) (int, error) {
+	accessKey := map[string]interface{}{
+		"key": map[string]string{
+			"text":  key,
+			"label": title,
+		},
+		"permission": "REPO_READ",
+	}
+
+	created := new(serverAccessKey)
+	if _, err := c.doJSON("POST", serverKeysPath(owner, repo), accessKey, created); err != nil {
+		return 0, err
+	}
+	return created.Key.ID, nil
+}
+
+// DeleteKey revokes a repository access key
+func (c *ServerClient) DeleteKey(owner, repo string, id int) error {
+	endpoint := fmt.Sprintf("%s/%d", serverKeysPath(owner, repo), id)
+	_, err := c.doJSON("DELETE", endpoint, nil, nil)
+	return err
+}
+
+// CreateStatus reports the stage state through the build status API
+func (c *ServerClient) CreateStatus(owner, repo, ref string, stageID int, stageName, state string) error {
+	endpoint := fmt.Sprintf("/rest/build-status/1.0/commits/%s", ref)
+	_, err := c.doJSON("POST", endpoint, buildStatus(stageID, stageName, state), nil)
+	return err
+}
+
+// GetFileContent fetches a file from the given commit or branch
+func (c *ServerClient) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	endpoint := fmt.Sprintf("%s/raw/%s?at=%s", serverRepoPath(owner, repo), strings.TrimPrefix(path, "/"), url.QueryEscape(ref))
+	_, content, err := c.do("GET", endpoint, "", nil)
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// GetContents gets the content of a file from the given commit or branch.
+// Bitbucket has no file blobs so the SHA is the commit that last changed the file.
+func (c *ServerClient) GetContents(owner, repo, path, ref string) (*scm.RepositoryContent, bool) {
+	content, ok := c.GetFileContent(owner, repo, path, ref)
+	if !ok {
+		return nil, false
+	}
+
+	sha, err := c.lastCommit(owner, repo, path, ref)
+	if err != nil {
+		return nil, false
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	return &scm.RepositoryContent{
+		Content: &encoded,
+		SHA:     &sha,
+	}, true
+}
+
+// GetDirectoryContent gets the contents of the files in a directory
+func (c *ServerClient) GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool) {
+	dir := strings.Trim(path, "/")
+	files := []string{}
+	start := 0
+	for {
+		page := new(serverFilePage)
+		endpoint := fmt.Sprintf("%s/files/%s?at=%s&start=%d", serverRepoPath(owner, repo), dir, url.QueryEscape(ref), start)
+		if _, err := c.doJSON("GET", endpoint, nil, page); err != nil {
+			return nil, false
+		}
+		files = append(files, page.Values...)
+		if page.IsLastPage {
+			break
+		}
+		start = page.NextPageStart
+	}
+
+	if len(files) == 0 {
+		return nil, false
+	}
+
+	contents := make([]interface{}, 0)
+	for _, file := range files {
+		// the files endpoint is recursive, only keep direct children
+		if strings.Contains(file, "/") {
+			continue
+		}
+		decoded, ok := c.GetFileContent(owner, repo, dir+"/"+file, ref)
+		if !ok {
+			continue
+		}
+		contents = append(contents, decoded)
+	}
+	return contents, true
+}
+
+// CreateFile commits a new file to a repository
+func (c *ServerClient) CreateFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Create %s", path)
+	}
+	return c.commitFile(owner, repo, path, "", message, branch, content)
+}
+
+// UpdateFile commits diff of a file content
+func (c *ServerClient) UpdateFile(owner, repo, path, blob, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Update %s", path)
+	}
+	return c.commitFile(owner, repo, path, blob, message, branch, content)
+}
+
+func (c *ServerClient) commitFile(owner, repo, path, sourceCommit, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	fields := map[string]string{
+		"branch":  branch,
+		"content": string(content),
+		"message": message,
+	}
+	if sourceCommit != "" {
+		fields["sourceCommitId"] = sourceCommit
+	}
+
+	endpoint := fmt.Sprintf("%s/browse/%s", serverRepoPath(owner, repo), strings.TrimPrefix(path, "/"))
+	body, err := c.doForm("PUT", endpoint, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	commit := new(serverCommit)
+	if err := json.Unmarshal(body, commit); err != nil {
+		return &scm.RepositoryContent{}, nil
+	}
+	return &scm.RepositoryContent{SHA: &commit.ID}, nil
+}
+
+// lastCommit gets the latest commit on ref that modified path
+func (c *ServerClient) lastCommit(owner, repo, path, ref string) (string, error) {
+	page := new(struct {
+		Values []*serverCommit `json:"values"`
+	})
+	endpoint := fmt.Sprintf("%s/commits?path=%s&until=%s&limit=1", serverRepoPath(owner, repo), url.QueryEscape(path), url.QueryEscape(ref))
+	if _, err := c.doJSON("GET", endpoint, nil, page); err != nil {
+		return "", err
+	}
+	if len(page.Values) == 0 {
+		return "", fmt.Errorf("No commits found for %s", path)
+	}
+	return page.Values[0].ID, nil
+}
+
+// GetRepository fetches repository details from Bitbucket Server
+func (c *ServerClient) GetRepository(owner, name string) (*scm.Repository, bool) {
+	data := new(serverRepository)
+	if _, err := c.doJSON("GET", serverRepoPath(owner, name), nil, data); err != nil {
+		return nil, false
+	}
+
+	branch := new(serverBranch)
+	c.doJSON("GET", serverRepoPath(owner, name)+"/branches/default", nil, branch)
+
+	// only repository admins can list the repository permissions
+	_, err := c.doJSON("GET", serverRepoPath(owner, name)+"/permissions/users?limit=1", nil, nil)
+	admin := err == nil
+
+	repository := data.toRepository(admin)
+	repository.DefaultBranch = branch.DisplayID
+	return repository, true
+}
+
+// ListRepositories lists the repositories accessible by the current user
+func (c *ServerClient) ListRepositories(user string) (repos []*scm.Repository, err error) {
+	start := 0
+	for {
+		page := new(serverRepositoryPage)
+		endpoint := fmt.Sprintf("/rest/api/1.0/repos?permission=REPO_READ&limit=100&start=%d", start)
+		if _, err := c.doJSON("GET", endpoint, nil, page); err != nil {
+			return nil, err
+		}
+
+		for _, repo := range page.Values {
+			repos = append(repos, repo.toRepository(false))
+		}
+		if page.IsLastPage {
+			break
+		}
+		start = page.NextPageStart
+	}
+
+	return repos, nil
+}
+
+// ParseHook parses the contents of a push or pull request webhook
+func (c *ServerClient) ParseHook(body []byte, event string) (*scm.Hook, error) {
+	switch event {
+	case "repo:refs_changed":
+		payload := new(ServerPushHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		hook := &scm.Hook{
+			Author:   payload.Actor.Slug,
+			CloneURL: payload.Repository.cloneURL(),
+			Event:    scm.EventPush,
+		}
+
+		// use the latest branch update from the push, tags are built when no branch was updated
+		tag, tagCommit := "", ""
+		for _, change := range payload.Changes {
+			if change.Type == "DELETE" {
+				continue
+			}
+			switch change.Ref.Type {
+			case "BRANCH":
+				hook.Branch = change.Ref.DisplayID
+				hook.Commit = change.ToHash
+			case "TAG":
+				tag = change.Ref.DisplayID
+				tagCommit = change.ToHash
+			}
+		}
+
+		if hook.Commit == "" && tag != "" {
+			hook.Event = scm.EventTag
+			hook.Tag = tag
+			hook.Commit = tagCommit
+		}
+
+		if hook.Commit == "" {
+			return nil, fmt.Errorf("No branch updates found in %s event", event)
+		}
+		return hook, nil
+
+	case "pr:opened", "pr:from_ref_updated":
+		payload := new(ServerPullRequestHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		pr := payload.PullRequest
+		return &scm.Hook{
+			Author:      payload.Actor.Slug,
+			Branch:      pr.FromRef.DisplayID,
+			CloneURL:    pr.FromRef.Repository.cloneURL(),
+			Commit:      pr.FromRef.LatestCommit,
+			Event:       scm.EventPullRequest,
+			PullRequest: pr.ID,
+			BaseBranch:  pr.ToRef.DisplayID,
+			HeadRepo:    fmt.Sprintf("%s/%s", pr.FromRef.Repository.Project.Key, pr.FromRef.Repository.Slug),
+			Ref:         fmt.Sprintf("refs/pull-requests/%d/from", pr.ID),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported bitbucket event %s", event)
+}
+
+// HookExists checks whether a webhook with the given callback already exists
+func (c *ServerClient) HookExists(owner, repo, url string) bool {
+	page := new(serverWebhookPage)
+	if _, err := c.doJSON("GET", serverRepoPath(owner, repo)+"/webhooks?limit=100", nil, page); err != nil {
+		return false
+	}
+
+	for _, hook := range page.Values {
+		if hook.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteHook removes the webhooks with the given callback
+func (c *ServerClient) DeleteHook(owner, repo, callback string) error {
+	page := new(serverWebhookPage)
+	if _, err := c.doJSON("GET", serverRepoPath(owner, repo)+"/webhooks?limit=100", nil, page); err != nil {
+		return err
+	}
+
+	for _, hook := range page.Values {
+		if hook.URL != callback {
+			continue
+		}
+		endpoint := fmt.Sprintf("%s/webhooks/%d", serverRepoPath(owner, repo), hook.ID)
+		if _, err := c.doJSON("DELETE", endpoint, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteHookByID removes the webhook with the given ID
+func (c *ServerClient) DeleteHookByID(owner, repo, id string) error {
+	_, err := c.doJSON("DELETE", fmt.Sprintf("%s/webhooks/%s", serverRepoPath(owner, repo), url.QueryEscape(id)), nil, nil)
+	return err
+}
+
+// GetHead gets the HEAD commit of a branch
+func (c *ServerClient) GetHead(owner, repo, branch string) (string, error) {
+	page := new(serverBranchPage)
+	endpoint := fmt.Sprintf("%s/branches?filterText=%s", serverRepoPath(owner, repo), url.QueryEscape(branch))
+	if _, err := c.doJSON("GET", endpoint, nil, page); err != nil {
+		return "", err
+	}
+
+	for _, b := range page.Values {
+		if b.DisplayID == branch {
+			return b.LatestCommit, nil
+		}
+	}
+	return "", fmt.Errorf("Branch %s not found", branch)
+}
+
+// CreateBranch creates a new branch of the repository from a commit as baseRef
+func (c *ServerClient) CreateBranch(owner, repo, branchName, baseRef string) (string, error) {
+	data := map[string]string{
+		"name":       branchName,
+		"startPoint": baseRef,
+	}
+
+	b := new(serverBranch)
+	endpoint := fmt.Sprintf("/rest/branch-utils/1.0/projects/%s/repos/%s/branches", url.QueryEscape(owner), url.QueryEscape(repo))
+	if _, err := c.doJSON("POST", endpoint, data, b); err != nil {
+		return "", err
+	}
+	return b.ID, nil
+}
+
+// CreatePullRequest starts a pull request of the changes from headRef to baseRef
+func (c *ServerClient) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
+	data := map[string]interface{}{
+		"title": title,
+		"fromRef": map[string]string{
+			"id": "refs/heads/" + strings.TrimPrefix(headRef, "refs/heads/"),
+		},
+		"toRef": map[string]string{
+			"id": "refs/heads/" + strings.TrimPrefix(baseRef, "refs/heads/"),
+		},
+	}
+
+	if _, err := c.doJSON("POST", serverRepoPath(owner, repo)+"/pull-requests", data, nil); err != nil {
+		logrus.WithError(err).Error("Error creating pull request")
+		return err
+	}
+	return nil
+}
+
+// CreateComment comments on a pull request and returns the comment's ID
+func (c *ServerClient) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	comment := new(serverComment)
+	endpoint := fmt.Sprintf("%s/pull-requests/%d/comments", serverRepoPath(owner, repo), pullRequest)
+	if _, err := c.doJSON("POST", endpoint, map[string]string{"text": body}, comment); err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+// UpdateComment replaces the text of a pull request comment,
+// the server only accepts updates of the comment's latest version
+func (c *ServerClient) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	comment := new(serverComment)
+	endpoint := fmt.Sprintf("%s/pull-requests/%d/comments/%d", serverRepoPath(owner, repo), pullRequest, commentID)
+	if _, err := c.doJSON("GET", endpoint, nil, comment); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"text":    body,
+		"version": comment.Version,
+	}
+	_, err := c.doJSON("PUT", endpoint, data, nil)
+	return err
+}
+
+func (r *serverRepository) cloneURL() string {
+	for _, link := range r.Links.Clone {
+		if link.Name == "http" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+func (r *serverRepository) toRepository(admin bool) *scm.Repository {
+	return &scm.Repository{
+		ID:       r.ID,
+		Owner:    r.Project.Key,
+		Name:     r.Slug,
+		FullName: fmt.Sprintf("%s/%s", r.Project.Key, r.Slug),
+		CloneURL: r.cloneURL(),
+		Permissions: map[string]bool{
+			"admin": admin,
+			"push":  admin,
+			"pull":  true,
+		},
+	}
+}
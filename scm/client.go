@@ -1,5 +1,7 @@
 package scm
 
+import "errors"
+
 const (
 	// EventDashboard indicates a dashboard event
 	EventDashboard = "dashboard"
@@ -19,9 +21,24 @@ const (
 	// EventDeployment indicates a deployment
 	EventDeployment = "deployment"
 
+	// EventTag indicates a tag push
+	EventTag = "tag"
+
+	// EventRelease indicates a published release
+	EventRelease = "release"
+
 	// RepoGithub represents GitHub
 	RepoGithub = "github"
 
+	// RepoGitlab represents GitLab
+	RepoGitlab = "gitlab"
+
+	// RepoBitbucket represents Bitbucket
+	RepoBitbucket = "bitbucket"
+
+	// RepoGit represents a plain git remote without an API
+	RepoGit = "git"
+
 	// StatePending represents a pending build/stage state
 	StatePending = "pending"
 
@@ -35,14 +52,20 @@ const (
 	StateFailure = "failure"
 )
 
+// ErrIgnoredEvent is returned when parsing a hook for an event that does not trigger builds
+var ErrIgnoredEvent = errors.New("Event does not trigger a build")
+
 // Client is an interface for accessing remote SCMs
 type Client interface {
 	AccessToken() string
 	SetAccessToken(string)
 	Name() string
 	HookExists(owner, repo, url string) bool
-	CreateHook(owner, repo, callback string, events []string) error
-	CreateKey(owner, repo, key, title string) error
+	CreateHook(owner, repo, callback, secret string, events []string) (string, error)
+	DeleteHook(owner, repo, callback string) error
+	DeleteHookByID(owner, repo, id string) error
+	CreateKey(owner, repo, key, title string) (int, error)
+	DeleteKey(owner, repo string, id int) error
 	CreateStatus(owner, repo, sha string, stageID int, stageName, state string) error
 	GetFileContent(owner, repo, path, ref string) ([]byte, bool)
 	GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool)
@@ -55,6 +78,8 @@ type Client interface {
 	GetHead(owner, repo, branch string) (string, error)
 	CreateBranch(owner, repo, branchName, baseRef string) (string, error)
 	CreatePullRequest(owner, repo, baseRef, headRef, title string) error
+	CreateComment(owner, repo string, pullRequest int, body string) (int, error)
+	UpdateComment(owner, repo string, pullRequest, commentID int, body string) error
 }
 
 // Repository holds common repository details from SCMs
@@ -87,4 +112,73 @@ type Hook struct {
 	CloneURL string
 	Commit   string
 	Event    string
+
+	// pull request details, Ref is the remote ref holding the commit
+	PullRequest int
+	BaseBranch  string
+	HeadRepo    string
+	Ref         string
+
+	// tag of tag pushes and releases
+	Tag string
+
+	// message of the head commit, when the remote sends it
+	Message string
+
+	// deployment details of deployment events
+	DeploymentID int
+	Environment  string
+}
+
+// DeploymentsClient is implemented by SCMs that track the deployments of a repository
+type DeploymentsClient interface {
+	CreateDeployment(owner, repo, ref, environment, description string) (int, error)
+	CreateDeploymentStatus(owner, repo string, id int, state, environmentURL, logURL string) error
+}
+
+// ErrChecksUnavailable is returned when the credentials can't create check runs on the repository,
+// stages are then reported with commit statuses
+var ErrChecksUnavailable = errors.New("Check runs are not available for the repository")
+
+// ChecksClient is implemented by SCMs that can report stages as check runs
+// with a summary and annotations instead of commit statuses
+type ChecksClient interface {
+	CreateCheckRun(owner, repo, sha string, run *CheckRun) (int, error)
+	UpdateCheckRun(owner, repo string, id int, run *CheckRun) error
+}
+
+// Check run statuses
+const (
+	CheckQueued     = "queued"
+	CheckInProgress = "in_progress"
+	CheckCompleted  = "completed"
+)
+
+// CheckRun holds the progress of a stage reported as a check run.
+// Conclusion is one of the commit states once the check run is completed.
+type CheckRun struct {
+	Name        string
+	Status      string
+	Conclusion  string
+	Title       string
+	Summary     string
+	DetailsURL  string
+	Annotations []*Annotation
+}
+
+// Annotation levels
+const (
+	AnnotationNotice  = "notice"
+	AnnotationWarning = "warning"
+	AnnotationFailure = "failure"
+)
+
+// Annotation is a message about a line of a file in the repository
+type Annotation struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Level     string `json:"annotation_level"`
+	Title     string `json:"title,omitempty"`
+	Message   string `json:"message"`
 }
@@ -0,0 +1,536 @@
+// Package fake is an in-memory scm.Client for tests. It serves the repositories and files
+// added to it, records the hooks, keys, statuses and comments created through it
+// and parses the hook payloads it builds.
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+var errNotFound = errors.New("Not Found")
+
+type (
+	// Hook is a webhook created through the client
+	Hook struct {
+		ID       int
+		Owner    string
+		Repo     string
+		Callback string
+		Secret   string
+		Events   []string
+	}
+
+	// Key is a deploy key created through the client
+	Key struct {
+		ID    int
+		Owner string
+		Repo  string
+		Key   string
+		Title string
+	}
+
+	// Status is a commit status reported through the client
+	Status struct {
+		Owner     string
+		Repo      string
+		Commit    string
+		StageID   int
+		StageName string
+		State     string
+	}
+
+	// Comment is a pull request comment created through the client
+	Comment struct {
+		ID          int
+		Owner       string
+		Repo        string
+		PullRequest int
+		Body        string
+	}
+)
+
+// Client is an in-memory remote. Files are served for any ref and branches
+// created through the client point to the head given when they were created.
+type Client struct {
+	mu     sync.Mutex
+	source string
+	token  string
+	lastID int
+
+	repos    map[string]*scm.Repository
+	files    map[string]map[string][]byte
+	heads    map[string]string
+	hooks    []*Hook
+	keys     []*Key
+	statuses []*Status
+	comments []*Comment
+}
+
+// NewClient returns an empty fake remote named after the given source, github when empty
+func NewClient(source string) *Client {
+	if source == "" {
+		source = scm.RepoGithub
+	}
+	return &Client{
+		source: source,
+		repos:  make(map[string]*scm.Repository),
+		files:  make(map[string]map[string][]byte),
+		heads:  make(map[string]string),
+	}
+}
+
+func fullName(owner, repo string) string {
+	return owner + "/" + repo
+}
+
+// AddRepository adds a repository where the client's user has the given permissions, like `admin` or `push`
+func (c *Client) AddRepository(owner, repo string, permissions ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastID++
+	r := &scm.Repository{
+		ID:            c.lastID,
+		Owner:         owner,
+		Name:          repo,
+		FullName:      fullName(owner, repo),
+		CloneURL:      fmt.Sprintf("https://fake.scm/%s/%s.git", owner, repo),
+		DefaultBranch: "master",
+		Permissions:   make(map[string]bool),
+	}
+	for _, permission := range permissions {
+		r.Permissions[permission] = true
+	}
+	c.repos[r.FullName] = r
+}
+
+// SetFile adds or replaces a file of a repository
+func (c *Client) SetFile(owner, repo, path string, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setFile(owner, repo, path, content)
+}
+
+func (c *Client) setFile(owner, repo, path string, content []byte) {
+	name := fullName(owner, repo)
+	if c.files[name] == nil {
+		c.files[name] = make(map[string][]byte)
+	}
+	c.files[name][strings.TrimPrefix(path, "/")] = content
+}
+
+// SetHead sets the HEAD commit of a branch
+func (c *Client) SetHead(owner, repo, branch, commit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heads[fullName(owner, repo)+"@"+branch] = commit
+}
+
+// Hooks returns the webhooks of a repository
+func (c *Client) Hooks(owner, repo string) []*Hook {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hooks := []*Hook{}
+	for _, h := range c.hooks {
+		if h.Owner == owner && h.Repo == repo {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+// Keys returns the deploy keys of a repository
+func (c *Client) Keys(owner, repo string) []*Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []*Key{}
+	for _, k := range c.keys {
+		if k.Owner == owner && k.Repo == repo {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Statuses returns the statuses reported for a commit, oldest first
+func (c *Client) Statuses(owner, repo, commit string) []*Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := []*Status{}
+	for _, s := range c.statuses {
+		if s.Owner == owner && s.Repo == repo && s.Commit == commit {
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses
+}
+
+// Comments returns the comments of a pull request
+func (c *Client) Comments(owner, repo string, pullRequest int) []*Comment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	comments := []*Comment{}
+	for _, comment := range c.comments {
+		if comment.Owner == owner && comment.Repo == repo && comment.PullRequest == pullRequest {
+			comments = append(comments, comment)
+		}
+	}
+	return comments
+}
+
+// PushHook returns the payload of a push to a branch, parsed by the client with the `push` event
+func (c *Client) PushHook(owner, repo, branch, commit, message string) []byte {
+	payload, _ := json.Marshal(&scm.Hook{
+		Author:   owner,
+		Branch:   branch,
+		CloneURL: fmt.Sprintf("https://fake.scm/%s/%s.git", owner, repo),
+		Commit:   commit,
+		Event:    scm.EventPush,
+		Message:  message,
+	})
+	return payload
+}
+
+// PullRequestHook returns the payload of a pull request from headRepo,
+// parsed by the client with the `pull_request` event
+func (c *Client) PullRequestHook(owner, repo string, number int, headRepo, branch, baseBranch, commit string) []byte {
+	payload, _ := json.Marshal(&scm.Hook{
+		Author:      strings.Split(headRepo, "/")[0],
+		Branch:      branch,
+		CloneURL:    fmt.Sprintf("https://fake.scm/%s.git", headRepo),
+		Commit:      commit,
+		Event:       scm.EventPullRequest,
+		PullRequest: number,
+		BaseBranch:  baseBranch,
+		HeadRepo:    headRepo,
+		Ref:         fmt.Sprintf("refs/pull/%d/head", number),
+	})
+	return payload
+}
+
+// AccessToken returns the client's access token
+func (c *Client) AccessToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// SetAccessToken sets the client's access token
+func (c *Client) SetAccessToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// Name returns the client's remote source name
+func (c *Client) Name() string {
+	return c.source
+}
+
+// HookExists checks whether a webhook with the given callback already exists
+func (c *Client) HookExists(owner, repo, url string) bool {
+	for _, h := range c.Hooks(owner, repo) {
+		if h.Callback == url {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateHook records a webhook and returns its ID
+func (c *Client) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.repos[fullName(owner, repo)]; !exists {
+		return "", errNotFound
+	}
+
+	c.lastID++
+	c.hooks = append(c.hooks, &Hook{
+		ID:       c.lastID,
+		Owner:    owner,
+		Repo:     repo,
+		Callback: callback,
+		Secret:   secret,
+		Events:   events,
+	})
+	return strconv.Itoa(c.lastID), nil
+}
+
+// DeleteHook removes the webhooks with the given callback
+func (c *Client) DeleteHook(owner, repo, callback string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hooks := []*Hook{}
+	for _, h := range c.hooks {
+		if h.Owner != owner || h.Repo != repo || h.Callback != callback {
+			hooks = append(hooks, h)
+		}
+	}
+	c.hooks = hooks
+	return nil
+}
+
+// DeleteHookByID removes the webhook with the given ID
+func (c *Client) DeleteHookByID(owner, repo, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hooks := []*Hook{}
+	for _, h := range c.hooks {
+		if h.Owner != owner || h.Repo != repo || strconv.Itoa(h.ID) != id {
+			hooks = append(hooks, h)
+		}
+	}
+	c.hooks = hooks
+	return nil
+}
+
+// CreateKey records a deploy key and returns its ID
+func (c *Client) CreateKey(owner, repo, key, title string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.repos[fullName(owner, repo)]; !exists {
+		return 0, errNotFound
+	}
+
+	c.lastID++
+	c.keys = append(c.keys, &Key{
+		ID:    c.lastID,
+		Owner: owner,
+		Repo:  repo,
+		Key:   key,
+		Title: title,
+	})
+	return c.lastID, nil
+}
+
+// DeleteKey removes a deploy key
+func (c *Client) DeleteKey(owner, repo string, id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, k := range c.keys {
+		if k.Owner == owner && k.Repo == repo && k.ID == id {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// CreateStatus records the commit status of a stage
+func (c *Client) CreateStatus(owner, repo, sha string, stageID int, stageName, state string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statuses = append(c.statuses, &Status{
+		Owner:     owner,
+		Repo:      repo,
+		Commit:    sha,
+		StageID:   stageID,
+		StageName: stageName,
+		State:     state,
+	})
+	return nil
+}
+
+// GetFileContent returns the content of a file
+func (c *Client) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	content, exists := c.files[fullName(owner, repo)][strings.TrimPrefix(path, "/")]
+	return content, exists
+}
+
+// GetDirectoryContent returns the contents of the files in a directory, sorted by name
+func (c *Client) GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := strings.Trim(path, "/") + "/"
+	files := c.files[fullName(owner, repo)]
+	names := []string{}
+	for name := range files {
+		if strings.HasPrefix(name, dir) && !strings.Contains(strings.TrimPrefix(name, dir), "/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+	sort.Strings(names)
+
+	contents := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		contents = append(contents, files[name])
+	}
+	return contents, true
+}
+
+// GetContents returns a file with its content base64 encoded, like the github API
+func (c *Client) GetContents(owner, repo, path, ref string) (*scm.RepositoryContent, bool) {
+	file, exists := c.GetFileContent(owner, repo, path, ref)
+	if !exists {
+		return nil, false
+	}
+
+	content := base64.StdEncoding.EncodeToString(file)
+	sha := blobSHA(file)
+	return &scm.RepositoryContent{Content: &content, SHA: &sha}, true
+}
+
+// CreateFile adds a file to the repository
+func (c *Client) CreateFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if _, exists := c.GetFileContent(owner, repo, path, branch); exists {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+
+	c.SetFile(owner, repo, path, content)
+	sha := blobSHA(content)
+	return &scm.RepositoryContent{SHA: &sha}, nil
+}
+
+// UpdateFile replaces the file if blob is the SHA of its current content
+func (c *Client) UpdateFile(owner, repo, path, blob, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, exists := c.files[fullName(owner, repo)][strings.TrimPrefix(path, "/")]
+	if !exists {
+		return nil, errNotFound
+	}
+	if blobSHA(current) != blob {
+		return nil, fmt.Errorf("%s does not match %s", path, blob)
+	}
+
+	c.setFile(owner, repo, path, content)
+	sha := blobSHA(content)
+	return &scm.RepositoryContent{SHA: &sha}, nil
+}
+
+// GetRepository returns a repository added to the client
+func (c *Client) GetRepository(owner, repo string) (*scm.Repository, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, exists := c.repos[fullName(owner, repo)]
+	return r, exists
+}
+
+// ListRepositories returns all the repositories of the client, sorted by name
+func (c *Client) ListRepositories(user string) ([]*scm.Repository, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := []string{}
+	for name := range c.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	repos := make([]*scm.Repository, 0, len(names))
+	for _, name := range names {
+		repos = append(repos, c.repos[name])
+	}
+	return repos, nil
+}
+
+// ParseHook parses the payloads built by PushHook and PullRequestHook
+func (c *Client) ParseHook(payload []byte, event string) (*scm.Hook, error) {
+	switch event {
+	case scm.EventPush, scm.EventPullRequest, scm.EventTag, scm.EventRelease, scm.EventDeployment:
+	default:
+		return nil, scm.ErrIgnoredEvent
+	}
+
+	hook := new(scm.Hook)
+	if err := json.Unmarshal(payload, hook); err != nil {
+		return nil, err
+	}
+	if hook.Event == "" {
+		hook.Event = event
+	}
+	return hook, nil
+}
+
+// GetHead gets the HEAD commit of a branch
+func (c *Client) GetHead(owner, repo, branch string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	commit, exists := c.heads[fullName(owner, repo)+"@"+branch]
+	if !exists {
+		return "", errNotFound
+	}
+	return commit, nil
+}
+
+// CreateBranch creates a branch pointing to baseRef
+func (c *Client) CreateBranch(owner, repo, branchName, baseRef string) (string, error) {
+	c.SetHead(owner, repo, branchName, baseRef)
+	return "refs/heads/" + branchName, nil
+}
+
+// CreatePullRequest is a no-op, pull requests are sent to the API with PullRequestHook
+func (c *Client) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
+	return nil
+}
+
+// CreateComment records a pull request comment and returns its ID
+func (c *Client) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastID++
+	c.comments = append(c.comments, &Comment{
+		ID:          c.lastID,
+		Owner:       owner,
+		Repo:        repo,
+		PullRequest: pullRequest,
+		Body:        body,
+	})
+	return c.lastID, nil
+}
+
+// UpdateComment replaces the body of a pull request comment
+func (c *Client) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, comment := range c.comments {
+		if comment.Owner == owner && comment.Repo == repo && comment.ID == commentID {
+			comment.Body = body
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// blobSHA returns the git blob SHA of a file content
+func blobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
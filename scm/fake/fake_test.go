@@ -0,0 +1,71 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+func TestParsePushHook(t *testing.T) {
+	var client scm.Client = NewClient("")
+
+	payload := NewClient("").PushHook("acaleph", "kontinuous", "master", "0a1b2c3", "Add feature")
+	hook, err := client.ParseHook(payload, scm.EventPush)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing hook: %s", err)
+	}
+	if hook.Event != scm.EventPush || hook.Branch != "master" || hook.Commit != "0a1b2c3" || hook.Message != "Add feature" {
+		t.Errorf("Expected push to master of 0a1b2c3, got %+v", hook)
+	}
+
+	if _, err := client.ParseHook(payload, "issues"); err != scm.ErrIgnoredEvent {
+		t.Errorf("Expected issues event to be ignored, got %v", err)
+	}
+}
+
+func TestHooksAndKeys(t *testing.T) {
+	client := NewClient(scm.RepoGitlab)
+	if _, err := client.CreateHook("acaleph", "kontinuous", "http://kontinuous/hook", "secret", nil); err == nil {
+		t.Error("Expected hook of unknown repository to fail")
+	}
+
+	client.AddRepository("acaleph", "kontinuous", "admin")
+	client.CreateHook("acaleph", "kontinuous", "http://kontinuous/hook", "secret", []string{scm.EventPush})
+	hookID, _ := client.CreateHook("acaleph", "kontinuous", "http://kontinuous/other", "secret", []string{scm.EventPush})
+	id, _ := client.CreateKey("acaleph", "kontinuous", "ssh-rsa AAAA", "kontinuous")
+
+	if !client.HookExists("acaleph", "kontinuous", "http://kontinuous/hook") {
+		t.Error("Expected hook to exist")
+	}
+
+	client.DeleteHook("acaleph", "kontinuous", "http://kontinuous/hook")
+	client.DeleteHookByID("acaleph", "kontinuous", hookID)
+	if err := client.DeleteKey("acaleph", "kontinuous", id); err != nil {
+		t.Errorf("Unexpected error deleting key: %s", err)
+	}
+	if len(client.Hooks("acaleph", "kontinuous")) != 0 || len(client.Keys("acaleph", "kontinuous")) != 0 {
+		t.Error("Expected hooks and keys to be deleted")
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	client := NewClient("")
+	client.SetFile("acaleph", "kontinuous", ".pipeline.yml", []byte("stages: []"))
+
+	file, exists := client.GetContents("acaleph", "kontinuous", ".pipeline.yml", "master")
+	if !exists {
+		t.Fatal("Expected file to exist")
+	}
+
+	if _, err := client.UpdateFile("acaleph", "kontinuous", ".pipeline.yml", "stale", "", "master", []byte("")); err == nil {
+		t.Error("Expected update with a stale blob to fail")
+	}
+	if _, err := client.UpdateFile("acaleph", "kontinuous", ".pipeline.yml", *file.SHA, "", "master", []byte("vars: {}")); err != nil {
+		t.Errorf("Unexpected error updating file: %s", err)
+	}
+
+	content, _ := client.GetFileContent("acaleph", "kontinuous", ".pipeline.yml", "master")
+	if string(content) != "vars: {}" {
+		t.Errorf("Expected updated content, got %s", content)
+	}
+}
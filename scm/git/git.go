@@ -0,0 +1,502 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os/exec"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+// ErrNoWebhooks is returned when parsing hooks, plain git remotes are polled instead
+var ErrNoWebhooks = errors.New("Plain git remotes do not send webhooks")
+
+var mirrorLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// ErrNoKnownHosts is returned when accessing an SSH remote without pinned host keys
+var ErrNoKnownHosts = errors.New("SSH remotes need the known_hosts entries of the remote's host")
+
+// Client is used for accessing a plain git remote over SSH or HTTPS.
+// Files are read from a local bare mirror of the remote that is fetched on demand.
+type Client struct {
+	token      string
+	remote     string
+	privateKey string
+	knownHosts string
+	cacheDir   string
+}
+
+// NewClient returns a client for the remote url, authenticating over SSH with
+// the pipeline's private deploy key. The host of SSH remotes is only trusted when
+// its key is in knownHosts, in the format of ssh's known_hosts file.
+func NewClient(remote, privateKey, knownHosts string) *Client {
+	cacheDir := os.Getenv("GIT_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "kontinuous-git")
+	}
+
+	return &Client{
+		remote:     remote,
+		privateKey: privateKey,
+		knownHosts: knownHosts,
+		cacheDir:   cacheDir,
+	}
+}
+
+// IsSSH checks if the remote is accessed over SSH, like ssh://host/repo.git or
+// user@host:repo.git
+func IsSSH(remote string) bool {
+	if strings.HasPrefix(remote, "ssh://") {
+		return true
+	}
+	return !strings.Contains(remote, "://") && strings.Contains(remote, ":") && !filepath.IsAbs(remote)
+}
+
+// AccessToken returns the client's access token
+func (c *Client) AccessToken() string {
+	return c.token
+}
+
+// SetAccessToken sets the client's access token, used as a bearer token for HTTPS remotes
+func (c *Client) SetAccessToken(token string) {
+	c.token = token
+}
+
+// Name returns the client's remote source name
+func (c *Client) Name() string {
+	return scm.RepoGit
+}
+
+// HookExists always returns false, plain git remotes have no webhooks
+func (c *Client) HookExists(owner, repo, url string) bool {
+	return false
+}
+
+// CreateHook is a no-op, plain git remotes are polled for changes
+func (c *Client) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	return "", nil
+}
+
+// DeleteHook is a no-op, plain git remotes have no webhooks
+func (c *Client) DeleteHook(owner, repo, callback string) error {
+	return nil
+}
+
+// DeleteHookByID is a no-op, plain git remotes have no webhooks
+func (c *Client) DeleteHookByID(owner, repo, id string) error {
+	return nil
+}
+
+// CreateKey is a no-op, the public deploy key needs to be added to the remote manually
+func (c *Client) CreateKey(owner, repo, key, title string) (int, error) {
+	return 0, nil
+}
+
+// DeleteKey is a no-op, the public deploy key needs to be removed from the remote manually
+func (c *Client) DeleteKey(owner, repo string, id int) error {
+	return nil
+}
+
+// CreateStatus is a no-op, plain git remotes have no commit statuses
+func (c *Client) CreateStatus(owner, repo, sha string, stageID int, stageName, state string) error {
+	return nil
+}
+
+// CreatePullRequest is a no-op, plain git remotes have no pull requests
+func (c *Client) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
+	return nil
+}
+
+// CreateComment is a no-op, plain git remotes have no pull requests
+func (c *Client) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	return 0, nil
+}
+
+// UpdateComment is a no-op, plain git remotes have no pull requests
+func (c *Client) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	return nil
+}
+
+// ListRepositories returns nothing, a plain git remote is a single repository
+func (c *Client) ListRepositories(user string) ([]*scm.Repository, error) {
+	return []*scm.Repository{}, nil
+}
+
+// ParseHook always fails, plain git remotes do not send webhooks
+func (c *Client) ParseHook(payload []byte, event string) (*scm.Hook, error) {
+	return nil, ErrNoWebhooks
+}
+
+// GetRepository returns the remote's details. There is no permission model,
+// access is only granted through the deploy key so the user is treated as an admin.
+func (c *Client) GetRepository(owner, repo string) (*scm.Repository, bool) {
+	if c.remote == "" {
+		return nil, false
+	}
+
+	defaultBranch, err := c.DefaultBranch()
+	if err != nil {
+		defaultBranch = "master"
+	}
+
+	return &scm.Repository{
+		Owner:         owner,
+		Name:          repo,
+		FullName:      fmt.Sprintf("%s/%s", owner, repo),
+		CloneURL:      c.remote,
+		DefaultBranch: defaultBranch,
+		Permissions: map[string]bool{
+			"admin": true,
+			"push":  true,
+			"pull":  true,
+		},
+	}, true
+}
+
+// DefaultBranch gets the branch pointed to by the remote's HEAD
+func (c *Client) DefaultBranch() (string, error) {
+	out, err := c.git("", nil, nil, "ls-remote", "--symref", c.remote, "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "ref: ") {
+			ref := strings.Fields(strings.TrimPrefix(line, "ref: "))[0]
+			return strings.TrimPrefix(ref, "refs/heads/"), nil
+		}
+	}
+	return "", errors.New("Unable to find HEAD of remote")
+}
+
+// LsRemote gets the head commits of the given branches, keyed by branch name
+func (c *Client) LsRemote(branches ...string) (map[string]string, error) {
+	args := []string{"ls-remote", "--heads", c.remote}
+	for _, branch := range branches {
+		args = append(args, "refs/heads/"+branch)
+	}
+
+	out, err := c.git("", nil, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	heads := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		heads[strings.TrimPrefix(fields[1], "refs/heads/")] = fields[0]
+	}
+	return heads, nil
+}
+
+// GetHead gets the HEAD commit of a branch
+func (c *Client) GetHead(owner, repo, branch string) (string, error) {
+	heads, err := c.LsRemote(branch)
+	if err != nil {
+		return "", err
+	}
+
+	head, ok := heads[branch]
+	if !ok {
+		return "", fmt.Errorf("Branch %s not found", branch)
+	}
+	return head, nil
+}
+
+// GetFileContent fetches a file from the given commit or branch
+func (c *Client) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	dir, unlock, err := c.mirror(ref)
+	if err != nil {
+		logrus.WithError(err).Errorf("Unable to fetch %s", c.remote)
+		return nil, false
+	}
+	defer unlock()
+
+	content, err := c.git(dir, nil, nil, "show", objectName(ref, path))
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// GetContents gets the content and blob SHA of a file from the given commit or branch
+func (c *Client) GetContents(owner, repo, path, ref string) (*scm.RepositoryContent, bool) {
+	dir, unlock, err := c.mirror(ref)
+	if err != nil {
+		logrus.WithError(err).Errorf("Unable to fetch %s", c.remote)
+		return nil, false
+	}
+	defer unlock()
+
+	object := objectName(ref, path)
+	content, err := c.git(dir, nil, nil, "show", object)
+	if err != nil {
+		return nil, false
+	}
+	sha, err := c.git(dir, nil, nil, "rev-parse", object)
+	if err != nil {
+		return nil, false
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	blob := strings.TrimSpace(string(sha))
+	return &scm.RepositoryContent{
+		Content: &encoded,
+		SHA:     &blob,
+	}, true
+}
+
+// GetDirectoryContent gets the contents of the files in a directory
+func (c *Client) GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool) {
+	dir, unlock, err := c.mirror(ref)
+	if err != nil {
+		logrus.WithError(err).Errorf("Unable to fetch %s", c.remote)
+		return nil, false
+	}
+	defer unlock()
+
+	tree, err := c.git(dir, nil, nil, "ls-tree", objectName(ref, path))
+	if err != nil {
+		return nil, false
+	}
+
+	contents := make([]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(tree)), "\n") {
+		// <mode> SP <type> SP <object> TAB <file>
+		entry := strings.SplitN(line, "\t", 2)
+		if len(entry) != 2 || strings.Fields(entry[0])[1] != "blob" {
+			continue
+		}
+
+		content, err := c.git(dir, nil, nil, "show", objectName(ref, filepath.Join(path, entry[1])))
+		if err != nil {
+			continue
+		}
+		contents = append(contents, content)
+	}
+	return contents, true
+}
+
+// CreateFile commits a new file to a branch of the remote
+func (c *Client) CreateFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Create %s", path)
+	}
+	return c.commitFile(path, message, branch, content)
+}
+
+// UpdateFile commits diff of a file content to a branch of the remote
+func (c *Client) UpdateFile(owner, repo, path, blob, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Update %s", path)
+	}
+	return c.commitFile(path, message, branch, content)
+}
+
+// CreateBranch pushes a new branch to the remote from a commit as baseRef
+func (c *Client) CreateBranch(owner, repo, branchName, baseRef string) (string, error) {
+	dir, unlock, err := c.mirror(baseRef)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	ref := "refs/heads/" + branchName
+	if _, err := c.git(dir, nil, nil, "push", c.remote, baseRef+":"+ref); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// commitFile writes the file on top of the branch head without a working tree and pushes the commit
+func (c *Client) commitFile(path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	dir, unlock, err := c.mirror(branch)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	index, err := ioutil.TempFile("", "kontinuous-index")
+	if err != nil {
+		return nil, err
+	}
+	index.Close()
+	defer os.Remove(index.Name())
+
+	env := []string{
+		"GIT_INDEX_FILE=" + index.Name(),
+		"GIT_AUTHOR_NAME=kontinuous",
+		"GIT_AUTHOR_EMAIL=kontinuous@localhost",
+		"GIT_COMMITTER_NAME=kontinuous",
+		"GIT_COMMITTER_EMAIL=kontinuous@localhost",
+	}
+	parent := "refs/heads/" + branch
+	path = strings.TrimPrefix(path, "/")
+
+	blob, err := c.git(dir, env, content, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.git(dir, env, nil, "read-tree", parent); err != nil {
+		return nil, err
+	}
+	cacheInfo := fmt.Sprintf("100644,%s,%s", strings.TrimSpace(string(blob)), path)
+	if _, err := c.git(dir, env, nil, "update-index", "--add", "--cacheinfo", cacheInfo); err != nil {
+		return nil, err
+	}
+	tree, err := c.git(dir, env, nil, "write-tree")
+	if err != nil {
+		return nil, err
+	}
+	commit, err := c.git(dir, env, nil, "commit-tree", strings.TrimSpace(string(tree)), "-p", parent, "-m", message)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.git(dir, env, nil, "push", c.remote, strings.TrimSpace(string(commit))+":"+parent); err != nil {
+		return nil, err
+	}
+
+	sha := strings.TrimSpace(string(blob))
+	return &scm.RepositoryContent{SHA: &sha}, nil
+}
+
+// mirror locks and returns the local bare mirror of the remote, fetching it
+// unless ref is a commit that is already available
+func (c *Client) mirror(ref string) (dir string, unlock func(), err error) {
+	if c.remote == "" {
+		return "", nil, errors.New("Remote url is required")
+	}
+
+	sum := sha1.Sum([]byte(c.remote))
+	dir = filepath.Join(c.cacheDir, fmt.Sprintf("%x.git", sum))
+
+	mirrorLocks.Lock()
+	lock, ok := mirrorLocks.m[dir]
+	if !ok {
+		lock = new(sync.Mutex)
+		mirrorLocks.m[dir] = lock
+	}
+	mirrorLocks.Unlock()
+
+	lock.Lock()
+	unlock = lock.Unlock
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := c.git("", nil, nil, "init", "--bare", dir); err != nil {
+			unlock()
+			return "", nil, err
+		}
+	}
+
+	if isCommit(ref) {
+		if _, err := c.git(dir, nil, nil, "cat-file", "-e", ref+"^{commit}"); err == nil {
+			return dir, unlock, nil
+		}
+	}
+
+	if _, err := c.git(dir, nil, nil, "fetch", "--prune", "--force", c.remote, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	return dir, unlock, nil
+}
+
+// git runs a git command in dir with the deploy key and token configured for the remote
+func (c *Client) git(dir string, env []string, stdin []byte, args ...string) ([]byte, error) {
+	command := args[0]
+	if c.token != "" && strings.HasPrefix(c.remote, "https://") {
+		args = append([]string{"-c", "http.extraHeader=Authorization: Bearer " + c.token}, args...)
+	}
+	if dir != "" {
+		args = append([]string{"--git-dir", dir}, args...)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+
+	if IsSSH(c.remote) {
+		sshDir, err := c.sshConfig()
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(sshDir)
+
+		sshCommand := fmt.Sprintf("ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", filepath.Join(sshDir, "known_hosts"))
+		if c.privateKey != "" {
+			sshCommand += fmt.Sprintf(" -i %s -o IdentitiesOnly=yes", filepath.Join(sshDir, "id_rsa"))
+		}
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s", command, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// sshConfig writes the deploy key and the pinned host keys to a temporary directory
+// only readable by kontinuous, the directory needs to be removed after use
+func (c *Client) sshConfig() (string, error) {
+	if strings.TrimSpace(c.knownHosts) == "" {
+		return "", ErrNoKnownHosts
+	}
+
+	dir, err := ioutil.TempDir("", "kontinuous-ssh")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(c.knownHosts), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if c.privateKey != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "id_rsa"), []byte(c.privateKey), 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// objectName returns the git object name of a path in ref, e.g. `master:.pipeline.yml`
+func objectName(ref, path string) string {
+	return fmt.Sprintf("%s:%s", ref, strings.Trim(path, "/"))
+}
+
+// isCommit checks if the ref is a full commit SHA, branches always need to be fetched
+func isCommit(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, r := range ref {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
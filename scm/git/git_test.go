@@ -0,0 +1,118 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"io/ioutil"
+	"os/exec"
+)
+
+// setupRemote creates a bare repository with a single commit on master
+func setupRemote(t *testing.T) (remote string, cleanup func()) {
+	root, err := ioutil.TempDir("", "kontinuous-git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote = filepath.Join(root, "remote.git")
+	work := filepath.Join(root, "work")
+	run := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@localhost",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@localhost")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+
+	run(root, "init", "--bare", remote)
+	run(root, "init", work)
+	ioutil.WriteFile(filepath.Join(work, ".pipeline.yml"), []byte("kind: Pipeline"), 0644)
+	run(work, "add", ".pipeline.yml")
+	run(work, "commit", "-m", "initial")
+	run(work, "push", remote, "HEAD:refs/heads/master")
+	run(root, "--git-dir", remote, "symbolic-ref", "HEAD", "refs/heads/master")
+
+	os.Setenv("GIT_CACHE_DIR", filepath.Join(root, "cache"))
+	return remote, func() { os.RemoveAll(root) }
+}
+
+func TestLsRemote(t *testing.T) {
+	remote, cleanup := setupRemote(t)
+	defer cleanup()
+
+	client := NewClient(remote, "", "")
+	heads, err := client.LsRemote("master")
+	if err != nil {
+		t.Fatalf("Expected ls-remote to succeed, got error: %s", err)
+	}
+	if len(heads["master"]) != 40 {
+		t.Errorf("Expected head commit of master, got `%s`", heads["master"])
+	}
+
+	if branch, _ := client.DefaultBranch(); branch != "master" {
+		t.Errorf("Expected default branch `master`, got `%s`", branch)
+	}
+}
+
+func TestGetFileContent(t *testing.T) {
+	remote, cleanup := setupRemote(t)
+	defer cleanup()
+
+	client := NewClient(remote, "", "")
+	content, ok := client.GetFileContent("owner", "repo", ".pipeline.yml", "master")
+	if !ok {
+		t.Fatal("Expected .pipeline.yml to be found on master")
+	}
+	if string(content) != "kind: Pipeline" {
+		t.Errorf("Unexpected file content `%s`", content)
+	}
+
+	if _, ok := client.GetFileContent("owner", "repo", "missing.yml", "master"); ok {
+		t.Error("Expected missing file to not be found")
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	remote, cleanup := setupRemote(t)
+	defer cleanup()
+
+	client := NewClient(remote, "", "")
+	before, _ := client.GetHead("owner", "repo", "master")
+	if _, err := client.CreateFile("owner", "repo", "docs/README", "", "master", []byte("docs")); err != nil {
+		t.Fatalf("Expected file to be committed, got error: %s", err)
+	}
+
+	after, _ := client.GetHead("owner", "repo", "master")
+	if before == after {
+		t.Error("Expected a new commit to be pushed to master")
+	}
+	if content, ok := client.GetFileContent("owner", "repo", "docs/README", after); !ok || string(content) != "docs" {
+		t.Errorf("Expected committed file on the new head, got `%s`", content)
+	}
+}
+
+func TestIsSSH(t *testing.T) {
+	remotes := map[string]bool{
+		"git@git.example.com:mirrors/project.git":     true,
+		"ssh://git@git.example.com/mirrors/project":   true,
+		"https://git.example.com/mirrors/project.git": false,
+		"/var/git/project.git":                        false,
+	}
+	for remote, expected := range remotes {
+		if IsSSH(remote) != expected {
+			t.Errorf("Expected IsSSH(%s) to be %t", remote, expected)
+		}
+	}
+}
+
+func TestSSHRemoteWithoutKnownHosts(t *testing.T) {
+	client := NewClient("git@git.example.com:mirrors/project.git", "", "")
+	if _, err := client.LsRemote("master"); err != ErrNoKnownHosts {
+		t.Errorf("Expected the unpinned host to be rejected, got %v", err)
+	}
+}
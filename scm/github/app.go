@@ -0,0 +1,170 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// app JWTs are valid for at most 10 minutes
+	appTokenDuration = 9 * time.Minute
+
+	// installation tokens are refreshed before they expire
+	installationTokenLeeway = time.Minute
+)
+
+// ErrAppNotConfigured is returned when no GitHub App credentials are set
+var ErrAppNotConfigured = errors.New("GitHub App is not configured")
+
+// App authenticates as a GitHub App to create installation access tokens
+type App struct {
+	ID         int
+	PrivateKey *rsa.PrivateKey
+
+	mu     sync.Mutex
+	tokens map[int]*installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	apiURL = "https://api.github.com"
+
+	envApp     *App
+	envAppErr  error
+	envAppOnce sync.Once
+)
+
+// NewApp creates an App from its ID and PEM encoded private key
+func NewApp(id int, privateKey []byte) (*App, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &App{
+		ID:         id,
+		PrivateKey: key,
+		tokens:     make(map[int]*installationToken),
+	}, nil
+}
+
+// AppFromEnv returns the App configured with GITHUB_APP_ID and GITHUB_APP_KEY.
+// The App is shared so installation tokens are cached across clients.
+func AppFromEnv() (*App, error) {
+	envAppOnce.Do(func() {
+		id := os.Getenv("GITHUB_APP_ID")
+		key := os.Getenv("GITHUB_APP_KEY")
+		if id == "" || key == "" {
+			envAppErr = ErrAppNotConfigured
+			return
+		}
+
+		appID, err := strconv.Atoi(id)
+		if err != nil {
+			envAppErr = fmt.Errorf("Invalid GitHub App ID %s", id)
+			return
+		}
+		envApp, envAppErr = NewApp(appID, []byte(key))
+	})
+	return envApp, envAppErr
+}
+
+// JWT creates the token used to authenticate as the App
+func (a *App) JWT() (string, error) {
+	now := time.Now()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Claims = map[string]interface{}{
+		// backdated to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appTokenDuration).Unix(),
+		"iss": a.ID,
+	}
+	return token.SignedString(a.PrivateKey)
+}
+
+// InstallationToken returns an access token of an installation,
+// a new one is only requested when the cached token is about to expire
+func (a *App) InstallationToken(installationID int) (*oauth2.Token, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if t, ok := a.tokens[installationID]; ok && time.Now().Add(installationTokenLeeway).Before(t.ExpiresAt) {
+		return &oauth2.Token{AccessToken: t.Token, Expiry: t.ExpiresAt}, nil
+	}
+
+	t := new(installationToken)
+	endpoint := fmt.Sprintf("/app/installations/%d/access_tokens", installationID)
+	if err := a.do("POST", endpoint, t); err != nil {
+		return nil, err
+	}
+
+	a.tokens[installationID] = t
+	return &oauth2.Token{AccessToken: t.Token, Expiry: t.ExpiresAt}, nil
+}
+
+// FindInstallation returns the installation of the App on a repository
+func (a *App) FindInstallation(owner, repo string) (int, error) {
+	installation := new(struct {
+		ID int `json:"id"`
+	})
+	if err := a.do("GET", fmt.Sprintf("/repos/%s/%s/installation", owner, repo), installation); err != nil {
+		return 0, err
+	}
+	return installation.ID, nil
+}
+
+func (a *App) do(method, endpoint string, out interface{}) error {
+	token, err := a.JWT()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, apiURL+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s: %s", res.Status, content)
+	}
+	return json.Unmarshal(content, out)
+}
+
+// installationTokenSource provides the access tokens of an installation to the github client
+type installationTokenSource struct {
+	app          *App
+	installation int
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	return s.app.InstallationToken(s.installation)
+}
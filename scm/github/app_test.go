@@ -0,0 +1,74 @@
+package github
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestApp(t *testing.T) *App {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	app, err := NewApp(42, pem.EncodeToMemory(block))
+	if err != nil {
+		t.Fatalf("Expected app to be created, got error: %s", err)
+	}
+	return app
+}
+
+func TestAppJWT(t *testing.T) {
+	app := newTestApp(t)
+
+	signed, err := app.JWT()
+	if err != nil {
+		t.Fatalf("Expected app JWT to be signed, got error: %s", err)
+	}
+
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return &app.PrivateKey.PublicKey, nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("Expected app JWT to be valid, got error: %v", err)
+	}
+	if token.Claims["iss"] != float64(42) {
+		t.Errorf("Expected issuer to be the app ID, got `%v`", token.Claims["iss"])
+	}
+}
+
+func TestInstallationTokenCached(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, `{"token": "token-%d", "expires_at": "%s"}`, requests, expires)
+	}))
+	defer server.Close()
+
+	defaultURL := apiURL
+	apiURL = server.URL
+	defer func() { apiURL = defaultURL }()
+
+	app := newTestApp(t)
+	first, err := app.InstallationToken(7)
+	if err != nil {
+		t.Fatalf("Expected installation token, got error: %s", err)
+	}
+	second, _ := app.InstallationToken(7)
+
+	if requests != 1 || first.AccessToken != second.AccessToken {
+		t.Errorf("Expected installation token to be cached, got %d requests", requests)
+	}
+}
@@ -0,0 +1,348 @@
+package github
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	headerRateLimit     = "X-RateLimit-Limit"
+	headerRateRemaining = "X-RateLimit-Remaining"
+	headerRateReset     = "X-RateLimit-Reset"
+	headerRetryAfter    = "Retry-After"
+
+	// maxCachedResponses and maxCachedContents bound the memory used by the caches
+	maxCachedResponses = 2000
+	maxCachedContents  = 1000
+	maxCachedBody      = 1 << 20
+)
+
+var (
+	// rateLimitReserve is the number of remaining requests kept for each token,
+	// requests wait for the rate limit to reset instead of using them up
+	rateLimitReserve = 10
+
+	// maxRateLimitWait caps how long a request waits for the rate limit to reset
+	maxRateLimitWait = 15 * time.Minute
+
+	// sleep and now are replaced in tests
+	sleep = time.Sleep
+	now   = time.Now
+
+	commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+	// metrics are published with the other expvars at /api/v1/admin/vars
+	metrics = expvar.NewMap("github")
+
+	// sharedTransport keeps the ETags and rate limits of all the clients
+	sharedTransport = newTransport(http.DefaultTransport)
+
+	// contents caches files by commit and blob SHA, these never change
+	contents = newLRU(maxCachedContents)
+)
+
+// lru is a bounded cache that evicts the least recently used entry
+type lru struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+func (c *lru) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// cachedResponse is a response that can be revalidated with its ETag
+type cachedResponse struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// rateLimit is the last known rate limit of a token
+type rateLimit struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// transport makes conditional requests for responses it has seen before and waits
+// for the rate limit to reset when a token is close to running out of requests.
+// Responses to conditional requests that are not modified don't count against the rate limit.
+type transport struct {
+	base      http.RoundTripper
+	responses *lru
+
+	mu     sync.Mutex
+	limits map[string]*rateLimit
+}
+
+func newTransport(base http.RoundTripper) *transport {
+	return &transport{
+		base:      base,
+		responses: newLRU(maxCachedResponses),
+		limits:    make(map[string]*rateLimit),
+	}
+}
+
+// tokenKey identifies the token of a request without keeping the token itself
+func tokenKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RoundTrip sends the request, revalidating cached responses and backing off when rate limited
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := tokenKey(req.Header.Get("Authorization"))
+	t.wait(token)
+
+	// the same url can be seen differently by other tokens and media types
+	key := token + " " + req.Header.Get("Accept") + " " + req.URL.String()
+	var cached *cachedResponse
+	if req.Method == "GET" {
+		if value, ok := t.responses.get(key); ok {
+			cached = value.(*cachedResponse)
+			req = cloneRequest(req)
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+	}
+
+	metrics.Add("requests", 1)
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.record(token, res)
+
+	// requests with a body can't be sent again
+	if wait, limited := rateLimited(res); limited && req.Body == nil {
+		res.Body.Close()
+		logrus.WithField("url", req.URL.Path).Warnf("GitHub rate limit exceeded, retrying in %s", wait)
+		metrics.Add("rate_limit_waits", 1)
+		sleep(wait)
+
+		metrics.Add("requests", 1)
+		if res, err = t.base.RoundTrip(req); err != nil {
+			return nil, err
+		}
+		t.record(token, res)
+	}
+
+	switch {
+	case cached != nil && res.StatusCode == http.StatusNotModified:
+		metrics.Add("not_modified", 1)
+		res.Body.Close()
+		return cached.response(req), nil
+	case req.Method == "GET" && res.StatusCode == http.StatusOK && res.Header.Get("ETag") != "":
+		return t.store(key, res)
+	}
+	return res, nil
+}
+
+// store keeps a copy of the response to revalidate it on the next request
+func (t *transport) store(key string, res *http.Response) (*http.Response, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) <= maxCachedBody {
+		t.responses.add(key, &cachedResponse{
+			etag:   res.Header.Get("ETag"),
+			header: res.Header,
+			body:   body,
+		})
+	}
+	return res, nil
+}
+
+func (c *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// record keeps the rate limit of a token from the response headers
+func (t *transport) record(token string, res *http.Response) {
+	remaining, err := strconv.Atoi(res.Header.Get(headerRateRemaining))
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(res.Header.Get(headerRateLimit))
+	reset, _ := strconv.ParseInt(res.Header.Get(headerRateReset), 10, 64)
+
+	t.mu.Lock()
+	previous, seen := t.limits[token]
+	t.limits[token] = &rateLimit{
+		limit:     limit,
+		remaining: remaining,
+		reset:     time.Unix(reset, 0),
+	}
+	t.mu.Unlock()
+
+	remainingVar := new(expvar.Int)
+	remainingVar.Set(int64(remaining))
+	metrics.Set("rate_limit_remaining", remainingVar)
+
+	log := logrus.WithFields(logrus.Fields{
+		"limit":     limit,
+		"remaining": remaining,
+		"reset":     time.Unix(reset, 0),
+	})
+	// warn once when the token drops below a tenth of its limit
+	if remaining <= limit/10 && (!seen || previous.remaining > limit/10) {
+		log.Warn("GitHub rate limit is running low")
+	} else {
+		log.Debug("GitHub rate limit")
+	}
+}
+
+// wait blocks until the rate limit resets when the token has no requests to spare
+func (t *transport) wait(token string) {
+	t.mu.Lock()
+	limit, ok := t.limits[token]
+	t.mu.Unlock()
+
+	if !ok || limit.remaining > rateLimitReserve {
+		return
+	}
+
+	wait := limit.reset.Sub(now())
+	if wait <= 0 {
+		return
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+
+	logrus.WithField("remaining", limit.remaining).Warnf("GitHub rate limit almost exceeded, waiting %s for reset", wait)
+	metrics.Add("rate_limit_waits", 1)
+	sleep(wait)
+
+	// allow the next request through to learn the new limit
+	t.mu.Lock()
+	delete(t.limits, token)
+	t.mu.Unlock()
+}
+
+// rateLimited checks if the request was rejected by the primary or secondary
+// rate limits and returns how long to wait before retrying
+func rateLimited(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(res.Header.Get(headerRetryAfter)); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if res.Header.Get(headerRateRemaining) == "0" {
+		reset, _ := strconv.ParseInt(res.Header.Get(headerRateReset), 10, 64)
+		wait = time.Unix(reset, 0).Sub(now())
+	} else {
+		// not a rate limit, eg. missing permissions
+		return 0, false
+	}
+
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	return wait, true
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
+
+// cachedContent returns the content of a file at a commit fetched before
+func cachedContent(key string) ([]byte, bool) {
+	value, ok := contents.get(key)
+	if !ok {
+		return nil, false
+	}
+	metrics.Add("content_cache_hits", 1)
+	return value.([]byte), true
+}
+
+// contentKey identifies a file of a commit, only commit SHAs are cached since branches move
+func contentKey(token, owner, repo, path, ref string) (string, bool) {
+	if !commitSHA.MatchString(ref) {
+		return "", false
+	}
+	return fmt.Sprintf("%s %s/%s/%s@%s", token, owner, repo, path, ref), true
+}
+
+// blobKey identifies a file by its git blob SHA
+func blobKey(token, owner, repo, sha string) string {
+	return fmt.Sprintf("%s %s/%s blob %s", token, owner, repo, sha)
+}
@@ -0,0 +1,116 @@
+package github
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestTransportRevalidatesWithETag(t *testing.T) {
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"name": ".pipeline.yml"}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTransport(http.DefaultTransport)}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL + "/repos/owner/repo/contents/.pipeline.yml")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || string(body) != `{"name": ".pipeline.yml"}` {
+			t.Errorf("Expected cached content on request %d, got %d: %s", i+1, res.StatusCode, body)
+		}
+	}
+
+	if requests != 3 || notModified != 2 {
+		t.Errorf("Expected 2 of 3 requests to be revalidated, got %d of %d", notModified, requests)
+	}
+}
+
+func TestTransportWaitsForRateLimitReset(t *testing.T) {
+	reset := time.Unix(1460183953, 0)
+	defaultNow, defaultSleep := now, sleep
+	defer func() { now, sleep = defaultNow, defaultSleep }()
+
+	var waited time.Duration
+	now = func() time.Time { return reset.Add(-time.Minute) }
+	sleep = func(d time.Duration) { waited += d }
+
+	remaining := 11
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining--
+		w.Header().Set(headerRateLimit, "5000")
+		w.Header().Set(headerRateRemaining, fmt.Sprint(remaining))
+		w.Header().Set(headerRateReset, fmt.Sprint(reset.Unix()))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTransport(http.DefaultTransport)}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		res.Body.Close()
+	}
+
+	if waited != time.Minute {
+		t.Errorf("Expected to wait a minute for the reset, waited %s", waited)
+	}
+}
+
+func TestTransportRetriesRateLimitedRequests(t *testing.T) {
+	defaultSleep := sleep
+	defer func() { sleep = defaultSleep }()
+
+	var waited time.Duration
+	sleep = func(d time.Duration) { waited += d }
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set(headerRetryAfter, "30")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTransport(http.DefaultTransport)}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || requests != 2 || waited != 30*time.Second {
+		t.Errorf("Expected a retry after 30s, got %d after %d requests and %s", res.StatusCode, requests, waited)
+	}
+}
+
+func TestContentKeyOnlyCachesCommits(t *testing.T) {
+	if _, ok := contentKey("token", "owner", "repo", ".pipeline.yml", "master"); ok {
+		t.Error("Expected branches not to be cached")
+	}
+	if _, ok := contentKey("token", "owner", "repo", ".pipeline.yml", "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"); !ok {
+		t.Error("Expected commits to be cached")
+	}
+}
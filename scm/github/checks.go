@@ -0,0 +1,140 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+const (
+	checksPreview = "application/vnd.github.antiope-preview+json"
+
+	// github accepts at most 50 annotations per request
+	maxAnnotations = 50
+)
+
+type checkRunOutput struct {
+	Title       string            `json:"title"`
+	Summary     string            `json:"summary"`
+	Annotations []*scm.Annotation `json:"annotations,omitempty"`
+}
+
+type checkRunRequest struct {
+	Name        string          `json:"name,omitempty"`
+	HeadSHA     string          `json:"head_sha,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Conclusion  string          `json:"conclusion,omitempty"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	DetailsURL  string          `json:"details_url,omitempty"`
+	Output      *checkRunOutput `json:"output,omitempty"`
+}
+
+// CreateCheckRun creates a check run on a commit and returns its ID
+func (gc *Client) CreateCheckRun(owner, repo, sha string, run *scm.CheckRun) (int, error) {
+	body, rest := toCheckRunRequest(run)
+	body.HeadSHA = sha
+
+	created := new(struct {
+		ID int `json:"id"`
+	})
+	if err := gc.doPreview("POST", fmt.Sprintf("/repos/%s/%s/check-runs", owner, repo), checksPreview, body, created); err != nil {
+		return 0, checksError(err)
+	}
+
+	if err := gc.addAnnotations(owner, repo, created.ID, run, rest); err != nil {
+		return created.ID, err
+	}
+	return created.ID, nil
+}
+
+// UpdateCheckRun updates the status, output and annotations of a check run
+func (gc *Client) UpdateCheckRun(owner, repo string, id int, run *scm.CheckRun) error {
+	body, rest := toCheckRunRequest(run)
+	if err := gc.doPreview("PATCH", fmt.Sprintf("/repos/%s/%s/check-runs/%d", owner, repo, id), checksPreview, body, nil); err != nil {
+		return checksError(err)
+	}
+	return gc.addAnnotations(owner, repo, id, run, rest)
+}
+
+// checksError reports the check runs as unavailable when github refuses them,
+// only github apps can create check runs and oauth tokens get a 403 or a 404
+func checksError(err error) error {
+	if e, ok := err.(*previewError); ok && (e.code == http.StatusForbidden || e.code == http.StatusNotFound) {
+		return scm.ErrChecksUnavailable
+	}
+	return err
+}
+
+// addAnnotations sends the annotations that did not fit the first request,
+// github appends the annotations of each update to the check run
+func (gc *Client) addAnnotations(owner, repo string, id int, run *scm.CheckRun, annotations []*scm.Annotation) error {
+	endpoint := fmt.Sprintf("/repos/%s/%s/check-runs/%d", owner, repo, id)
+	for len(annotations) > 0 {
+		n := len(annotations)
+		if n > maxAnnotations {
+			n = maxAnnotations
+		}
+
+		body := &checkRunRequest{
+			Output: &checkRunOutput{
+				Title:       run.Title,
+				Summary:     run.Summary,
+				Annotations: annotations[:n],
+			},
+		}
+		if err := gc.doPreview("PATCH", endpoint, checksPreview, body, nil); err != nil {
+			return err
+		}
+		annotations = annotations[n:]
+	}
+	return nil
+}
+
+// toCheckRunRequest maps a check run to the github payload,
+// the annotations over the request limit are returned separately
+func toCheckRunRequest(run *scm.CheckRun) (*checkRunRequest, []*scm.Annotation) {
+	now := time.Now().UTC()
+	req := &checkRunRequest{
+		Name:       run.Name,
+		Status:     run.Status,
+		DetailsURL: run.DetailsURL,
+	}
+
+	switch run.Status {
+	case scm.CheckInProgress:
+		req.StartedAt = &now
+	case scm.CheckCompleted:
+		req.CompletedAt = &now
+		req.Conclusion = checkConclusion(run.Conclusion)
+	}
+
+	annotations := run.Annotations
+	if run.Summary != "" || len(annotations) > 0 {
+		n := len(annotations)
+		if n > maxAnnotations {
+			n = maxAnnotations
+		}
+		req.Output = &checkRunOutput{
+			Title:       run.Title,
+			Summary:     run.Summary,
+			Annotations: annotations[:n],
+		}
+		annotations = annotations[n:]
+	}
+
+	return req, annotations
+}
+
+func checkConclusion(state string) string {
+	switch state {
+	case scm.StateSuccess:
+		return "success"
+	case scm.StatePending:
+		return "neutral"
+	default:
+		return "failure"
+	}
+}
@@ -0,0 +1,74 @@
+package github
+
+import (
+	"testing"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+func TestCreateCheckRunBatchesAnnotations(t *testing.T) {
+	var requests []*checkRunRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := new(checkRunRequest)
+		json.NewDecoder(r.Body).Decode(body)
+		requests = append(requests, body)
+		w.Write([]byte(`{"id": 5}`))
+	}))
+	defer server.Close()
+
+	defaultURL := apiURL
+	apiURL = server.URL
+	defer func() { apiURL = defaultURL }()
+
+	run := &scm.CheckRun{
+		Name:       "kontinuous:1",
+		Status:     scm.CheckCompleted,
+		Conclusion: scm.StateFailure,
+		Title:      "test",
+		Summary:    "120 failures",
+	}
+	for i := 0; i < 120; i++ {
+		run.Annotations = append(run.Annotations, &scm.Annotation{Path: "main.go", StartLine: i + 1, EndLine: i + 1, Level: scm.AnnotationFailure})
+	}
+
+	id, err := (&Client{token: "token"}).CreateCheckRun("owner", "repo", "sha", run)
+	if err != nil {
+		t.Fatalf("Expected check run to be created, got error: %s", err)
+	}
+	if id != 5 {
+		t.Errorf("Expected check run ID 5, got %d", id)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("Expected annotations to be sent in 3 requests, got %d", len(requests))
+	}
+	if requests[0].Conclusion != "failure" || requests[0].HeadSHA != "sha" {
+		t.Errorf("Expected failed check run on sha, got `%s` on `%s`", requests[0].Conclusion, requests[0].HeadSHA)
+	}
+	if len(requests[2].Output.Annotations) != 20 {
+		t.Errorf("Expected 20 remaining annotations, got %d", len(requests[2].Output.Annotations))
+	}
+}
+
+func TestCheckRunsUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "Resource not accessible by integration"}`))
+	}))
+	defer server.Close()
+
+	defaultURL := apiURL
+	apiURL = server.URL
+	defer func() { apiURL = defaultURL }()
+
+	run := &scm.CheckRun{Name: "kontinuous:1", Status: scm.CheckQueued}
+	if _, err := (&Client{token: "token"}).CreateCheckRun("owner", "repo", "sha", run); err != scm.ErrChecksUnavailable {
+		t.Errorf("Expected check runs to be unavailable, got `%v`", err)
+	}
+	if err := (&Client{token: "token"}).UpdateCheckRun("owner", "repo", 5, run); err != scm.ErrChecksUnavailable {
+		t.Errorf("Expected check runs to be unavailable, got `%v`", err)
+	}
+}
@@ -0,0 +1,84 @@
+package github
+
+import (
+	"fmt"
+
+	"encoding/json"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+// in_progress deployment statuses and environment urls need both previews
+const deploymentsPreview = "application/vnd.github.ant-man-preview+json, application/vnd.github.flash-preview+json"
+
+// deploymentTask marks the deployments created by kontinuous, their webhooks don't start builds
+const deploymentTask = "deploy:kontinuous"
+
+// CreateDeployment creates a deployment of a commit to an environment and returns its ID
+func (gc *Client) CreateDeployment(owner, repo, ref, environment, description string) (int, error) {
+	body := map[string]interface{}{
+		"ref":         ref,
+		"task":        deploymentTask,
+		"environment": environment,
+		"description": description,
+		"auto_merge":  false,
+		// the build's own commit statuses are still pending while it deploys
+		"required_contexts": []string{},
+	}
+
+	deployment := new(struct {
+		ID int `json:"id"`
+	})
+	endpoint := fmt.Sprintf("/repos/%s/%s/deployments", owner, repo)
+	if err := gc.doPreview("POST", endpoint, deploymentsPreview, body, deployment); err != nil {
+		return 0, err
+	}
+	return deployment.ID, nil
+}
+
+// CreateDeploymentStatus updates the state of a deployment, pending is reported as in progress
+func (gc *Client) CreateDeploymentStatus(owner, repo string, id int, state, environmentURL, logURL string) error {
+	body := map[string]interface{}{
+		"state":           deploymentState(state),
+		"environment_url": environmentURL,
+		"log_url":         logURL,
+	}
+
+	endpoint := fmt.Sprintf("/repos/%s/%s/deployments/%d/statuses", owner, repo, id)
+	return gc.doPreview("POST", endpoint, deploymentsPreview, body, nil)
+}
+
+func deploymentState(state string) string {
+	switch state {
+	case scm.StatePending:
+		return "in_progress"
+	case scm.StateSuccess, scm.StateFailure, scm.StateError:
+		return state
+	default:
+		return "error"
+	}
+}
+
+// parseDeploymentHook builds the commit of a deployment requested through the API or another integration,
+// the deployments of kontinuous' own deploy stages are ignored
+func parseDeploymentHook(body []byte) (*scm.Hook, error) {
+	payload := new(DeploymentHook)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return nil, err
+	}
+
+	deployment := payload.Deployment
+	if deployment.Task == deploymentTask {
+		return nil, scm.ErrIgnoredEvent
+	}
+
+	return &scm.Hook{
+		Author:       payload.Sender.Login,
+		Branch:       deployment.Ref,
+		CloneURL:     payload.Repo.CloneURL,
+		Commit:       deployment.SHA,
+		Event:        scm.EventDeployment,
+		DeploymentID: deployment.ID,
+		Environment:  deployment.Environment,
+	}, nil
+}
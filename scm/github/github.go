@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
@@ -15,49 +19,158 @@ import (
 	"github.com/AcalephStorage/kontinuous/scm"
 )
 
-// Client is used for making requests to GitHub
+// Client is used for making requests to GitHub, either with a user's
+// OAuth token or as an installation of the GitHub App
 type Client struct {
 	token string
+
+	app          *App
+	installation int
+
+	mu sync.Mutex
+	gh *github.Client
 }
 
-func (gc *Client) client() *github.Client {
-	ts := oauth2.StaticTokenSource(
+// NewInstallationClient creates a client that acts as an installation of the GitHub App
+func NewInstallationClient(app *App, installationID int) *Client {
+	return &Client{
+		app:          app,
+		installation: installationID,
+	}
+}
+
+func (gc *Client) tokenSource() oauth2.TokenSource {
+	if gc.app != nil {
+		return &installationTokenSource{gc.app, gc.installation}
+	}
+	return oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: gc.token},
 	)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-	return github.NewClient(tc)
 }
 
-// CreateHook creates a webhook
-func (gc *Client) CreateHook(owner, repo, callback string, events []string) error {
+// httpClient authenticates the requests and sends them through the shared caching transport
+func (gc *Client) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: gc.tokenSource(),
+			Base:   sharedTransport,
+		},
+	}
+}
+
+func (gc *Client) client() *github.Client {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.gh == nil {
+		gc.gh = github.NewClient(gc.httpClient())
+	}
+	return gc.gh
+}
+
+// cacheToken identifies the client's credentials in the content cache
+func (gc *Client) cacheToken() string {
+	if gc.app != nil {
+		return fmt.Sprintf("installation-%d", gc.installation)
+	}
+	return tokenKey(gc.token)
+}
+
+// previewError is the error response of a preview endpoint
+type previewError struct {
+	code    int
+	message string
+}
+
+func (e *previewError) Error() string {
+	return e.message
+}
+
+// doPreview sends a JSON request to the endpoints missing from go-github,
+// these are only available with the preview media type in accept
+func (gc *Client) doPreview(method, endpoint, accept string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, apiURL+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+
+	res, err := gc.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 400 {
+		return &previewError{code: res.StatusCode, message: fmt.Sprintf("%s: %s", res.Status, content)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
+
+// CreateHook creates a webhook and returns its ID, payloads are signed with the secret
+func (gc *Client) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	// tag pushes are sent with the push event
+	hookEvents := []string{}
+	for _, event := range events {
+		if event == scm.EventTag {
+			event = scm.EventPush
+		}
+		if !contains(hookEvents, event) {
+			hookEvents = append(hookEvents, event)
+		}
+	}
+
 	hook := &github.Hook{
-		Events: events,
+		Events: hookEvents,
 		Name:   github.String("web"),
 		Config: map[string]interface{}{
 			"url":          callback,
 			"content_type": "json",
+			"secret":       secret,
 		},
 	}
 
-	if _, _, err := gc.client().Repositories.CreateHook(owner, repo, hook); err != nil {
-		return err
+	created, _, err := gc.client().Repositories.CreateHook(owner, repo, hook)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return strconv.Itoa(*created.ID), nil
 }
 
-// CreateKey creates repository deploy keys
-func (gc *Client) CreateKey(owner, repo, key, title string) error {
+// CreateKey creates repository deploy keys and returns the key ID
+func (gc *Client) CreateKey(owner, repo, key, title string) (int, error) {
 	deployKey := &github.Key{
 		Key:   github.String(key),
 		Title: github.String(title),
 	}
 
-	if _, _, err := gc.client().Repositories.CreateKey(owner, repo, deployKey); err != nil {
-		return err
+	created, _, err := gc.client().Repositories.CreateKey(owner, repo, deployKey)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return *created.ID, nil
+}
+
+// DeleteKey removes a repository deploy key
+func (gc *Client) DeleteKey(owner, repo string, id int) error {
+	_, err := gc.client().Repositories.DeleteKey(owner, repo, id)
+	return err
 }
 
 func (gc *Client) CreateStatus(owner, repo, ref string, stageID int, stageName, state string) error {
@@ -77,13 +190,21 @@ func (gc *Client) CreateStatus(owner, repo, ref string, stageID int, stageName,
 	return nil
 }
 
-// GetFileContent fetches a file from the given commit or branch
+// GetFileContent fetches a file from the given commit or branch,
+// files of a commit are cached since every stage of a build reads them
 func (gc *Client) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	key, cacheable := contentKey(gc.cacheToken(), owner, repo, path, ref)
+	if cacheable {
+		if content, ok := cachedContent(key); ok {
+			return content, true
+		}
+	}
+
 	file, _, _, err := gc.client().Repositories.GetContents(owner,
 		repo,
 		path,
 		&github.RepositoryContentGetOptions{ref})
-	if err != nil {
+	if err != nil || file == nil {
 		return nil, false
 	}
 
@@ -92,6 +213,12 @@ func (gc *Client) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
 		return nil, false
 	}
 
+	if cacheable {
+		contents.add(key, decoded)
+	}
+	if file.SHA != nil {
+		contents.add(blobKey(gc.cacheToken(), owner, repo, *file.SHA), decoded)
+	}
 	return decoded, true
 }
 
@@ -129,9 +256,15 @@ func (gc *Client) GetDirectoryContent(owner, repo, path, ref string) ([]interfac
 		v := reflect.Indirect(val)
 		fmt.Fprintf(&buf, `%s`, v)
 		contentPath := buf.String()
-		decoded, ok := gc.GetFileContent(owner, repo, contentPath, ref)
+		// unchanged files are fetched once, whatever the commit
+		decoded, ok := []byte(nil), false
+		if content.SHA != nil {
+			decoded, ok = cachedContent(blobKey(gc.cacheToken(), owner, repo, *content.SHA))
+		}
 		if !ok {
-			continue
+			if decoded, ok = gc.GetFileContent(owner, repo, contentPath, ref); !ok {
+				continue
+			}
 		}
 		contents = append(contents, decoded)
 	}
@@ -184,6 +317,12 @@ func (gc *Client) GetRepository(owner, name string) (*scm.Repository, bool) {
 		return nil, false
 	}
 
+	// installation tokens have no user permissions
+	permissions := map[string]bool{}
+	if data.Permissions != nil {
+		permissions = *data.Permissions
+	}
+
 	repo := &scm.Repository{
 		ID:            *data.ID,
 		Owner:         *data.Owner.Login,
@@ -191,7 +330,7 @@ func (gc *Client) GetRepository(owner, name string) (*scm.Repository, bool) {
 		FullName:      *data.FullName,
 		Avatar:        *data.Owner.AvatarURL,
 		CloneURL:      *data.CloneURL,
-		Permissions:   *data.Permissions,
+		Permissions:   permissions,
 		DefaultBranch: *data.DefaultBranch,
 	}
 
@@ -231,22 +370,114 @@ func (gc *Client) ListRepositories(user string) (repos []*scm.Repository, err er
 
 // ParseHook parses the contents of a webhook to build useful data
 func (gc *Client) ParseHook(body []byte, event string) (*scm.Hook, error) {
+	switch event {
+	case scm.EventPullRequest:
+		return gc.parsePullRequestHook(body)
+	case scm.EventRelease:
+		return gc.parseReleaseHook(body)
+	case scm.EventDeployment:
+		return parseDeploymentHook(body)
+	}
+
 	payload := new(PushHook)
 	if err := json.Unmarshal(body, payload); err != nil {
 		return nil, err
 	}
 
+	if strings.HasPrefix(payload.Ref, "refs/tags/") {
+		if payload.Deleted {
+			return nil, scm.ErrIgnoredEvent
+		}
+
+		return &scm.Hook{
+			Author:   payload.Sender.Login,
+			CloneURL: payload.Repo.CloneURL,
+			Commit:   payload.Head.ID,
+			Event:    scm.EventTag,
+			Tag:      strings.TrimPrefix(payload.Ref, "refs/tags/"),
+			Message:  payload.Head.Message,
+		}, nil
+	}
+
 	hook := &scm.Hook{
 		Author:   payload.Sender.Login,
 		Branch:   strings.Replace(payload.Ref, "refs/heads/", "", -1),
 		CloneURL: payload.Repo.CloneURL,
 		Commit:   payload.Head.ID,
 		Event:    event,
+		Message:  payload.Head.Message,
 	}
 
 	return hook, nil
 }
 
+// parsePullRequestHook builds the head of a pull request when it is opened or updated
+func (gc *Client) parsePullRequestHook(body []byte) (*scm.Hook, error) {
+	payload := new(PullRequestHook)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return nil, err
+	}
+
+	switch payload.Action {
+	case "opened", "synchronize", "reopened":
+	default:
+		return nil, scm.ErrIgnoredEvent
+	}
+
+	pr := payload.PullRequest
+	hook := &scm.Hook{
+		Author:      payload.Sender.Login,
+		Branch:      pr.Head.Ref,
+		CloneURL:    pr.Head.Repo.CloneURL,
+		Commit:      pr.Head.SHA,
+		Event:       scm.EventPullRequest,
+		PullRequest: payload.Number,
+		BaseBranch:  pr.Base.Ref,
+		HeadRepo:    pr.Head.Repo.FullName,
+		Ref:         fmt.Sprintf("refs/pull/%d/head", payload.Number),
+	}
+
+	// the payload doesn't have the message of the head commit, it is needed for the directives
+	if base := strings.SplitN(pr.Base.Repo.FullName, "/", 2); len(base) == 2 {
+		commit, _, err := gc.client().Repositories.GetCommit(base[0], base[1], pr.Head.SHA)
+		if err != nil {
+			return nil, err
+		}
+		if commit.Commit != nil && commit.Commit.Message != nil {
+			hook.Message = *commit.Commit.Message
+		}
+	}
+
+	return hook, nil
+}
+
+// parseReleaseHook builds the tagged commit when a release is published
+func (gc *Client) parseReleaseHook(body []byte) (*scm.Hook, error) {
+	payload := new(ReleaseHook)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Action != "published" {
+		return nil, scm.ErrIgnoredEvent
+	}
+
+	// the payload only has the tag name so the commit is resolved from it
+	tag := payload.Release.TagName
+	commit, _, err := gc.client().Repositories.GetCommit(payload.Repo.Owner.Login, payload.Repo.Name, "refs/tags/"+tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scm.Hook{
+		Author:   payload.Sender.Login,
+		CloneURL: payload.Repo.CloneURL,
+		Commit:   *commit.SHA,
+		Event:    scm.EventRelease,
+		Tag:      tag,
+	}, nil
+}
+
 // HookExists checks whether a webhook with the given callback already exists
 func (gc *Client) HookExists(owner, repo, url string) bool {
 	hooks, _, err := gc.client().Repositories.ListHooks(owner, repo, nil)
@@ -263,14 +494,59 @@ func (gc *Client) HookExists(owner, repo, url string) bool {
 	return false
 }
 
+// DeleteHook removes the webhooks with the given callback
+func (gc *Client) DeleteHook(owner, repo, callback string) error {
+	hooks, _, err := gc.client().Repositories.ListHooks(owner, repo, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if url, _ := hook.Config["url"].(string); url != callback {
+			continue
+		}
+		if _, err := gc.client().Repositories.DeleteHook(owner, repo, *hook.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteHookByID removes the webhook with the given ID, a webhook that was already removed is ignored
+func (gc *Client) DeleteHookByID(owner, repo, id string) error {
+	hookID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := gc.client().Repositories.DeleteHook(owner, repo, hookID)
+	if err != nil && (res == nil || res.StatusCode != http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
 // AccessToken returns the client's access token
 func (gc *Client) AccessToken() string {
+	if gc.app != nil {
+		token, err := gc.app.InstallationToken(gc.installation)
+		if err != nil {
+			logrus.WithError(err).Errorf("Unable to get access token of installation %d", gc.installation)
+			return ""
+		}
+		return token.AccessToken
+	}
 	return gc.token
 }
 
 // SetAccessToken sets the client's access token
 func (gc *Client) SetAccessToken(token string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
 	gc.token = token
+	gc.gh = nil
 }
 
 // Name returns the client's remote source name
@@ -325,3 +601,27 @@ func (gc *Client) CreatePullRequest(owner, repo, baseRef, headRef, title string)
 	}
 	return nil
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateComment comments on a pull request and returns the comment's ID
+func (gc *Client) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	comment, _, err := gc.client().Issues.CreateComment(owner, repo, pullRequest, &github.IssueComment{Body: &body})
+	if err != nil {
+		return 0, err
+	}
+	return *comment.ID, nil
+}
+
+// UpdateComment replaces the body of a pull request comment
+func (gc *Client) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	_, _, err := gc.client().Issues.EditComment(owner, repo, commentID, &github.IssueComment{Body: &body})
+	return err
+}
@@ -0,0 +1,132 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+	"github.com/google/go-github/github"
+)
+
+var pullRequestHook = `{
+  "action": "%s",
+  "number": 7,
+  "pull_request": {
+    "head": {
+      "ref": "feature",
+      "sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+      "repo": {"full_name": "fork/repo", "clone_url": "https://github.com/fork/repo.git"}
+    },
+    "base": {
+      "ref": "master",
+      "repo": {"full_name": "owner/repo", "clone_url": "https://github.com/owner/repo.git"}
+    }
+  },
+  "sender": {"login": "contributor"}
+}`
+
+func TestParsePullRequestHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/commits/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c", "commit": {"message": "Fix typo [skip ci]"}}`))
+	}))
+	defer server.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(server.URL + "/")
+	client := &Client{gh: gh}
+	hook, err := client.ParseHook([]byte(fmt.Sprintf(pullRequestHook, "synchronize")), scm.EventPullRequest)
+	if err != nil {
+		t.Fatalf("Expected pull request hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Commit != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" {
+		t.Errorf("Expected head sha as commit, got `%s`", hook.Commit)
+	}
+	if hook.PullRequest != 7 || hook.BaseBranch != "master" || hook.HeadRepo != "fork/repo" {
+		t.Errorf("Unexpected pull request details %d, `%s`, `%s`", hook.PullRequest, hook.BaseBranch, hook.HeadRepo)
+	}
+	if hook.Ref != "refs/pull/7/head" {
+		t.Errorf("Expected ref `refs/pull/7/head`, got `%s`", hook.Ref)
+	}
+	if hook.Message != "Fix typo [skip ci]" {
+		t.Errorf("Expected the message of the head commit, got `%s`", hook.Message)
+	}
+}
+
+func TestParseClosedPullRequestHook(t *testing.T) {
+	client := new(Client)
+	_, err := client.ParseHook([]byte(fmt.Sprintf(pullRequestHook, "closed")), scm.EventPullRequest)
+	if err != scm.ErrIgnoredEvent {
+		t.Errorf("Expected closed pull requests to be ignored, got `%v`", err)
+	}
+}
+
+func TestParseTagPushHook(t *testing.T) {
+	body := `{
+  "ref": "refs/tags/v1.2.0",
+  "head_commit": {"id": "6113728f27ae82c7b1a177c8d03f9e96e0adf246"},
+  "sender": {"login": "maintainer"},
+  "repository": {"clone_url": "https://github.com/owner/repo.git"}
+}`
+
+	client := new(Client)
+	hook, err := client.ParseHook([]byte(body), scm.EventPush)
+	if err != nil {
+		t.Fatalf("Expected tag push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Event != scm.EventTag || hook.Tag != "v1.2.0" {
+		t.Errorf("Expected tag event for `v1.2.0`, got `%s` for `%s`", hook.Event, hook.Tag)
+	}
+	if hook.Branch != "" {
+		t.Errorf("Expected no branch for tag pushes, got `%s`", hook.Branch)
+	}
+}
+
+func TestParseEditedReleaseHook(t *testing.T) {
+	body := `{"action": "edited", "release": {"tag_name": "v1.2.0"}}`
+
+	client := new(Client)
+	_, err := client.ParseHook([]byte(body), scm.EventRelease)
+	if err != scm.ErrIgnoredEvent {
+		t.Errorf("Expected edited releases to be ignored, got `%v`", err)
+	}
+}
+
+func TestParseDeploymentHook(t *testing.T) {
+	payload := `{
+  "deployment": {"id": 42, "sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c", "ref": "master", "environment": "staging"},
+  "repository": {"full_name": "owner/repo", "clone_url": "https://github.com/owner/repo.git"},
+  "sender": {"login": "releaser"}
+}`
+
+	hook, err := new(Client).ParseHook([]byte(payload), scm.EventDeployment)
+	if err != nil {
+		t.Fatalf("Expected deployment hook to be parsed, got error: %s", err)
+	}
+	if hook.Event != scm.EventDeployment || hook.DeploymentID != 42 || hook.Environment != "staging" {
+		t.Errorf("Expected deployment 42 to staging, got %s %d to %s", hook.Event, hook.DeploymentID, hook.Environment)
+	}
+	if hook.Commit != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" || hook.Branch != "master" {
+		t.Errorf("Expected deployment of master head, got %s on %s", hook.Commit, hook.Branch)
+	}
+}
+
+func TestParseOwnDeploymentHook(t *testing.T) {
+	payload := `{
+  "deployment": {"id": 43, "sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c", "ref": "master", "task": "deploy:kontinuous", "environment": "staging"},
+  "repository": {"full_name": "owner/repo", "clone_url": "https://github.com/owner/repo.git"},
+  "sender": {"login": "kontinuous"}
+}`
+
+	if _, err := new(Client).ParseHook([]byte(payload), scm.EventDeployment); err != scm.ErrIgnoredEvent {
+		t.Errorf("Expected deployments created by kontinuous to be ignored, got `%v`", err)
+	}
+}
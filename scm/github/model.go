@@ -44,3 +44,108 @@ type PushHook struct {
 		DefaultBranch string `json:"default_branch"`
 	} `json:"repository"`
 }
+
+// PullRequestHook is used to make github pull request webhooks easily accessible
+type PullRequestHook struct {
+	Action string `json:"action"`
+	Number int    `json:"number"`
+
+	PullRequest struct {
+		Title string `json:"title"`
+
+		Head struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+				CloneURL string `json:"clone_url"`
+			} `json:"repo"`
+		} `json:"head"`
+
+		Base struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+				CloneURL string `json:"clone_url"`
+			} `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+
+	Sender struct {
+		Login  string `json:"login"`
+		Avatar string `json:"avatar_url"`
+	} `json:"sender"`
+}
+
+// ReleaseHook is used to make github release webhooks easily accessible
+type ReleaseHook struct {
+	Action string `json:"action"`
+
+	Release struct {
+		TagName         string `json:"tag_name"`
+		TargetCommitish string `json:"target_commitish"`
+		Name            string `json:"name"`
+		Prerelease      bool   `json:"prerelease"`
+	} `json:"release"`
+
+	Repo struct {
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+	} `json:"repository"`
+
+	Sender struct {
+		Login  string `json:"login"`
+		Avatar string `json:"avatar_url"`
+	} `json:"sender"`
+}
+
+// DeploymentHook is used to make github `deployment` webhooks easily accessible
+type DeploymentHook struct {
+	Deployment struct {
+		ID          int    `json:"id"`
+		SHA         string `json:"sha"`
+		Ref         string `json:"ref"`
+		Task        string `json:"task"`
+		Environment string `json:"environment"`
+	} `json:"deployment"`
+
+	Repo struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+	} `json:"repository"`
+
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// InstallationHook is used to make github app `installation` and `installation_repositories` webhooks easily accessible
+type InstallationHook struct {
+	Action string `json:"action"`
+
+	Installation struct {
+		ID      int `json:"id"`
+		Account struct {
+			Login string `json:"login"`
+		} `json:"account"`
+	} `json:"installation"`
+
+	// repositories of `installation` events
+	Repositories []InstallationRepository `json:"repositories"`
+
+	// repositories of `installation_repositories` events
+	RepositoriesAdded   []InstallationRepository `json:"repositories_added"`
+	RepositoriesRemoved []InstallationRepository `json:"repositories_removed"`
+}
+
+// InstallationRepository is a repository of an app installation
+type InstallationRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+}
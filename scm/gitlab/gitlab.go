@@ -0,0 +1,550 @@
+package gitlab
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+const (
+	// DefaultURL is used when no self-hosted gitlab address is configured
+	DefaultURL = "https://gitlab.com"
+
+	apiPath = "/api/v4"
+
+	// gitlab access levels, see https://docs.gitlab.com/ce/api/members.html
+	reporterAccess   = 20
+	developerAccess  = 30
+	maintainerAccess = 40
+)
+
+// Client is used for making requests to GitLab
+type Client struct {
+	token   string
+	baseURL string
+}
+
+// NewClient creates a GitLab client for the given instance address.
+// The address from `GITLAB_URL` or gitlab.com is used if none is given.
+func NewClient(baseURL string) *Client {
+	return &Client{baseURL: baseURL}
+}
+
+func (gc *Client) host() string {
+	switch {
+	case gc.baseURL != "":
+		return strings.TrimSuffix(gc.baseURL, "/")
+	case os.Getenv("GITLAB_URL") != "":
+		return strings.TrimSuffix(os.Getenv("GITLAB_URL"), "/")
+	default:
+		return DefaultURL
+	}
+}
+
+// do sends a request to the gitlab API and decodes the response to `out` when given
+func (gc *Client) do(method, endpoint string, data, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, gc.host()+apiPath+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+gc.token)
+	req.Header.Set("Accept", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res, err
+	}
+
+	if res.StatusCode >= 400 {
+		apiErr := new(apiError)
+		if err := json.Unmarshal(content, apiErr); err != nil || (apiErr.Message == nil && apiErr.Error == "") {
+			return res, errors.New(res.Status)
+		}
+		if apiErr.Error != "" {
+			return res, errors.New(apiErr.Error)
+		}
+		return res, fmt.Errorf("%v", apiErr.Message)
+	}
+
+	if out != nil && len(content) > 0 {
+		if err := json.Unmarshal(content, out); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// projectPath returns the url encoded project id used by the gitlab API
+func projectPath(owner, repo string) string {
+	return "/projects/" + url.QueryEscape(owner+"/"+repo)
+}
+
+func filePath(owner, repo, path string) string {
+	return fmt.Sprintf("%s/repository/files/%s", projectPath(owner, repo), url.QueryEscape(strings.TrimPrefix(path, "/")))
+}
+
+// CreateHook creates a project webhook and returns its ID
+func (gc *Client) CreateHook(owner, repo, callback, secret string, events []string) (string, error) {
+	hook := map[string]interface{}{
+		"url":                     callback,
+		"enable_ssl_verification": true,
+		"token":                   secret,
+	}
+	for _, event := range events {
+		switch event {
+		case scm.EventPush:
+			hook["push_events"] = true
+		case scm.EventPullRequest:
+			hook["merge_requests_events"] = true
+		case scm.EventTag:
+			hook["tag_push_events"] = true
+		}
+	}
+
+	created := new(struct {
+		ID int `json:"id"`
+	})
+	if _, err := gc.do("POST", projectPath(owner, repo)+"/hooks", hook, created); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(created.ID), nil
+}
+
+// CreateKey creates project deploy keys and returns the key ID
+func (gc *Client) CreateKey(owner, repo, key, title string) (int, error) {
+	deployKey := map[string]interface{}{
+		"title":    title,
+		"key":      key,
+		"can_push": false,
+	}
+
+	created := new(projectKey)
+	if _, err := gc.do("POST", projectPath(owner, repo)+"/deploy_keys", deployKey, created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+// DeleteKey removes a project deploy key
+func (gc *Client) DeleteKey(owner, repo string, id int) error {
+	endpoint := fmt.Sprintf("%s/deploy_keys/%d", projectPath(owner, repo), id)
+	_, err := gc.do("DELETE", endpoint, nil, nil)
+	return err
+}
+
+// CreateStatus sets the commit status of a stage
+func (gc *Client) CreateStatus(owner, repo, ref string, stageID int, stageName, state string) error {
+	// gitlab has no separate error state
+	switch state {
+	case scm.StateError, scm.StateFailure:
+		state = "failed"
+	}
+
+	status := map[string]interface{}{
+		"state":       state,
+		"name":        fmt.Sprintf("kontinuous:%d", stageID),
+		"description": stageName,
+	}
+
+	endpoint := fmt.Sprintf("%s/statuses/%s", projectPath(owner, repo), ref)
+	_, err := gc.do("POST", endpoint, status, nil)
+	return err
+}
+
+// GetFileContent fetches a file from the given commit or branch
+func (gc *Client) GetFileContent(owner, repo, path, ref string) ([]byte, bool) {
+	f, ok := gc.getFile(owner, repo, path, ref)
+	if !ok {
+		return nil, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(f.Content)
+	if err != nil {
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+// GetContents gets the metadata and content of a file from the given commit or branch
+func (gc *Client) GetContents(owner, repo, path, ref string) (*scm.RepositoryContent, bool) {
+	f, ok := gc.getFile(owner, repo, path, ref)
+	if !ok {
+		return nil, false
+	}
+
+	return &scm.RepositoryContent{
+		Content: &f.Content,
+		SHA:     &f.BlobID,
+	}, true
+}
+
+func (gc *Client) getFile(owner, repo, path, ref string) (*file, bool) {
+	f := new(file)
+	endpoint := filePath(owner, repo, path) + "?ref=" + url.QueryEscape(ref)
+	if _, err := gc.do("GET", endpoint, nil, f); err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// GetDirectoryContent gets the contents of the files in a directory
+func (gc *Client) GetDirectoryContent(owner, repo, path, ref string) ([]interface{}, bool) {
+	q := url.Values{}
+	q.Set("path", strings.TrimPrefix(path, "/"))
+	q.Set("ref", ref)
+	q.Set("per_page", "100")
+
+	nodes := []*treeNode{}
+	endpoint := projectPath(owner, repo) + "/repository/tree?" + q.Encode()
+	if _, err := gc.do("GET", endpoint, nil, &nodes); err != nil || len(nodes) == 0 {
+		return nil, false
+	}
+
+	contents := make([]interface{}, 0)
+	for _, node := range nodes {
+		if node.Type != "blob" {
+			continue
+		}
+		decoded, ok := gc.GetFileContent(owner, repo, node.Path, ref)
+		if !ok {
+			continue
+		}
+		contents = append(contents, decoded)
+	}
+	return contents, true
+}
+
+// CreateFile commits a new file to a repository
+func (gc *Client) CreateFile(owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Create %s", path)
+	}
+	return gc.commitFile("POST", owner, repo, path, message, branch, content)
+}
+
+// UpdateFile commits diff of a file content. GitLab does not require the file blob.
+func (gc *Client) UpdateFile(owner, repo, path, blob, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	if len(message) == 0 {
+		message = fmt.Sprintf("Update %s", path)
+	}
+	return gc.commitFile("PUT", owner, repo, path, message, branch, content)
+}
+
+func (gc *Client) commitFile(method, owner, repo, path, message, branch string, content []byte) (*scm.RepositoryContent, error) {
+	data := map[string]interface{}{
+		"branch":         branch,
+		"commit_message": message,
+		"encoding":       "base64",
+		"content":        base64.StdEncoding.EncodeToString(content),
+	}
+
+	if _, err := gc.do(method, filePath(owner, repo, path), data, nil); err != nil {
+		return nil, err
+	}
+
+	// gitlab does not return the blob of the commited file
+	f, ok := gc.getFile(owner, repo, path, branch)
+	if !ok {
+		return &scm.RepositoryContent{}, nil
+	}
+	return &scm.RepositoryContent{SHA: &f.BlobID}, nil
+}
+
+// GetRepository fetches project details from GitLab
+func (gc *Client) GetRepository(owner, name string) (*scm.Repository, bool) {
+	p := new(project)
+	if _, err := gc.do("GET", projectPath(owner, name), nil, p); err != nil {
+		return nil, false
+	}
+
+	return p.toRepository(), true
+}
+
+// ListRepositories lists the projects the current user is a member of
+func (gc *Client) ListRepositories(user string) (repos []*scm.Repository, err error) {
+	page := "1"
+	for page != "" {
+		projects := []*project{}
+		endpoint := "/projects?membership=true&per_page=100&page=" + page
+		res, err := gc.do("GET", endpoint, nil, &projects)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range projects {
+			repos = append(repos, p.toRepository())
+		}
+		page = res.Header.Get("X-Next-Page")
+	}
+
+	return repos, nil
+}
+
+// ParseHook parses the contents of a push or merge request webhook
+func (gc *Client) ParseHook(body []byte, event string) (*scm.Hook, error) {
+	kind := new(struct {
+		ObjectKind string `json:"object_kind"`
+	})
+	if err := json.Unmarshal(body, kind); err != nil {
+		return nil, err
+	}
+
+	switch kind.ObjectKind {
+	case "push":
+		payload := new(PushHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		return &scm.Hook{
+			Author:   payload.UserUsername,
+			Branch:   strings.TrimPrefix(payload.Ref, "refs/heads/"),
+			CloneURL: payload.Project.HTTPURL,
+			Commit:   payload.CheckoutSHA,
+			Event:    scm.EventPush,
+			Message:  payload.headMessage(),
+		}, nil
+
+	case "tag_push":
+		payload := new(PushHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		// deleted tags have no checkout sha
+		if payload.CheckoutSHA == "" {
+			return nil, scm.ErrIgnoredEvent
+		}
+
+		return &scm.Hook{
+			Author:   payload.UserUsername,
+			CloneURL: payload.Project.HTTPURL,
+			Commit:   payload.CheckoutSHA,
+			Event:    scm.EventTag,
+			Tag:      strings.TrimPrefix(payload.Ref, "refs/tags/"),
+			Message:  payload.headMessage(),
+		}, nil
+
+	case "merge_request":
+		payload := new(MergeRequestHook)
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, err
+		}
+
+		// updates without new commits (title, labels, etc.) are not built
+		attrs := payload.Attributes
+		switch {
+		case attrs.Action == "open", attrs.Action == "reopen":
+		case attrs.Action == "update" && attrs.OldRev != "":
+		default:
+			return nil, scm.ErrIgnoredEvent
+		}
+
+		return &scm.Hook{
+			Author:      payload.User.Username,
+			Branch:      attrs.SourceBranch,
+			CloneURL:    attrs.Source.HTTPURL,
+			Commit:      attrs.LastCommit.ID,
+			Event:       scm.EventPullRequest,
+			PullRequest: attrs.IID,
+			BaseBranch:  attrs.TargetBranch,
+			HeadRepo:    attrs.Source.PathWithNamespace,
+			Ref:         fmt.Sprintf("refs/merge-requests/%d/head", attrs.IID),
+			Message:     attrs.LastCommit.Message,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported gitlab event %s", event)
+}
+
+// HookExists checks whether a webhook with the given callback already exists
+func (gc *Client) HookExists(owner, repo, url string) bool {
+	hooks := []*hook{}
+	if _, err := gc.do("GET", projectPath(owner, repo)+"/hooks", nil, &hooks); err != nil {
+		return false
+	}
+
+	for _, h := range hooks {
+		if h.URL == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeleteHook removes the webhooks with the given callback
+func (gc *Client) DeleteHook(owner, repo, callback string) error {
+	hooks := []*hook{}
+	if _, err := gc.do("GET", projectPath(owner, repo)+"/hooks", nil, &hooks); err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		if h.URL != callback {
+			continue
+		}
+		endpoint := fmt.Sprintf("%s/hooks/%d", projectPath(owner, repo), h.ID)
+		if _, err := gc.do("DELETE", endpoint, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteHookByID removes the webhook with the given ID
+func (gc *Client) DeleteHookByID(owner, repo, id string) error {
+	_, err := gc.do("DELETE", fmt.Sprintf("%s/hooks/%s", projectPath(owner, repo), url.QueryEscape(id)), nil, nil)
+	return err
+}
+
+// AccessToken returns the client's access token
+func (gc *Client) AccessToken() string {
+	return gc.token
+}
+
+// SetAccessToken sets the client's access token
+func (gc *Client) SetAccessToken(token string) {
+	gc.token = token
+}
+
+// Name returns the client's remote source name
+func (gc *Client) Name() string {
+	return scm.RepoGitlab
+}
+
+// GetHead gets the HEAD commit of a branch
+func (gc *Client) GetHead(owner, repo, branchName string) (string, error) {
+	b := new(branch)
+	endpoint := fmt.Sprintf("%s/repository/branches/%s", projectPath(owner, repo), url.QueryEscape(branchName))
+	if _, err := gc.do("GET", endpoint, nil, b); err != nil {
+		return "", err
+	}
+
+	return b.Commit.ID, nil
+}
+
+// CreateBranch creates a new branch of the repository from a commit as baseRef
+func (gc *Client) CreateBranch(owner, repo, branchName, baseRef string) (string, error) {
+	data := map[string]interface{}{
+		"branch": branchName,
+		"ref":    baseRef,
+	}
+
+	b := new(branch)
+	if _, err := gc.do("POST", projectPath(owner, repo)+"/repository/branches", data, b); err != nil {
+		return "", err
+	}
+	return "refs/heads/" + b.Name, nil
+}
+
+// CreatePullRequest opens a merge request of the changes from headRef to baseRef
+func (gc *Client) CreatePullRequest(owner, repo, baseRef, headRef, title string) error {
+	data := map[string]interface{}{
+		"source_branch": headRef,
+		"target_branch": baseRef,
+		"title":         title,
+	}
+
+	if _, err := gc.do("POST", projectPath(owner, repo)+"/merge_requests", data, nil); err != nil {
+		logrus.WithError(err).Error("Error creating merge request")
+		return err
+	}
+	return nil
+}
+
+// CreateComment adds a note to a merge request and returns the note's ID
+func (gc *Client) CreateComment(owner, repo string, pullRequest int, body string) (int, error) {
+	n := new(note)
+	endpoint := fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(owner, repo), pullRequest)
+	if _, err := gc.do("POST", endpoint, map[string]string{"body": body}, n); err != nil {
+		return 0, err
+	}
+	return n.ID, nil
+}
+
+// UpdateComment replaces the body of a merge request note
+func (gc *Client) UpdateComment(owner, repo string, pullRequest, commentID int, body string) error {
+	endpoint := fmt.Sprintf("%s/merge_requests/%d/notes/%d", projectPath(owner, repo), pullRequest, commentID)
+	_, err := gc.do("PUT", endpoint, map[string]string{"body": body}, nil)
+	return err
+}
+
+// User returns the user owning the client's access token
+func (gc *Client) User() (*User, error) {
+	user := new(User)
+	if _, err := gc.do("GET", "/user", nil, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (p *project) toRepository() *scm.Repository {
+	level := 0
+	if p.Permissions.ProjectAccess != nil {
+		level = p.Permissions.ProjectAccess.AccessLevel
+	}
+	if p.Permissions.GroupAccess != nil && p.Permissions.GroupAccess.AccessLevel > level {
+		level = p.Permissions.GroupAccess.AccessLevel
+	}
+
+	avatar := p.AvatarURL
+	if avatar == "" {
+		avatar = p.Namespace.AvatarURL
+	}
+
+	owner := p.Namespace.FullPath
+	if owner == "" {
+		owner = strings.TrimSuffix(p.PathWithNamespace, "/"+p.Path)
+	}
+
+	return &scm.Repository{
+		ID:            p.ID,
+		Owner:         owner,
+		Name:          p.Path,
+		FullName:      p.PathWithNamespace,
+		Avatar:        avatar,
+		CloneURL:      p.HTTPURL,
+		DefaultBranch: p.DefaultBranch,
+		Permissions: map[string]bool{
+			"admin": level >= maintainerAccess,
+			"push":  level >= developerAccess,
+			"pull":  level >= reporterAccess,
+		},
+	}
+}
@@ -0,0 +1,102 @@
+package gitlab
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/scm"
+)
+
+var (
+	pushHook = `{
+  "object_kind": "push",
+  "ref": "refs/heads/develop",
+  "checkout_sha": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "user_username": "jsmith",
+  "project": {
+    "path_with_namespace": "mike/diaspora",
+    "git_http_url": "http://example.com/mike/diaspora.git"
+  }
+}`
+
+	mergeRequestHook = `{
+  "object_kind": "merge_request",
+  "user": {"username": "root"},
+  "object_attributes": {
+    "iid": 1,
+    "action": "open",
+    "source_branch": "ms-viewport",
+    "target_branch": "master",
+    "source": {"git_http_url": "http://example.com/awesome_space/awesome_project.git"},
+    "last_commit": {"id": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7"}
+  }
+}`
+)
+
+func TestParsePushHook(t *testing.T) {
+	client := NewClient("")
+	hook, err := client.ParseHook([]byte(pushHook), "Push Hook")
+	if err != nil {
+		t.Fatalf("Expected push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Branch != "develop" {
+		t.Errorf("Expected branch `develop`, got `%s`", hook.Branch)
+	}
+	if hook.Commit != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Errorf("Expected checkout sha as commit, got `%s`", hook.Commit)
+	}
+	if hook.Event != scm.EventPush {
+		t.Errorf("Expected event `%s`, got `%s`", scm.EventPush, hook.Event)
+	}
+}
+
+func TestParseTagPushHook(t *testing.T) {
+	body := strings.Replace(strings.Replace(pushHook, "push", "tag_push", 1), "refs/heads/develop", "refs/tags/v1.0.0", 1)
+
+	client := NewClient("")
+	hook, err := client.ParseHook([]byte(body), "Tag Push Hook")
+	if err != nil {
+		t.Fatalf("Expected tag push hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Event != scm.EventTag || hook.Tag != "v1.0.0" {
+		t.Errorf("Expected tag event for `v1.0.0`, got `%s` for `%s`", hook.Event, hook.Tag)
+	}
+	if hook.Branch != "" {
+		t.Errorf("Expected no branch for tag pushes, got `%s`", hook.Branch)
+	}
+}
+
+func TestParseMergeRequestHook(t *testing.T) {
+	client := NewClient("")
+	hook, err := client.ParseHook([]byte(mergeRequestHook), "Merge Request Hook")
+	if err != nil {
+		t.Fatalf("Expected merge request hook to be parsed, got error: %s", err)
+	}
+
+	if hook.Branch != "ms-viewport" {
+		t.Errorf("Expected source branch `ms-viewport`, got `%s`", hook.Branch)
+	}
+	if hook.Event != scm.EventPullRequest {
+		t.Errorf("Expected event `%s`, got `%s`", scm.EventPullRequest, hook.Event)
+	}
+	if hook.PullRequest != 1 || hook.BaseBranch != "master" {
+		t.Errorf("Expected merge request !1 into `master`, got !%d into `%s`", hook.PullRequest, hook.BaseBranch)
+	}
+}
+
+func TestParseMergeRequestUpdateWithoutCommits(t *testing.T) {
+	client := NewClient("")
+	payload := strings.Replace(mergeRequestHook, `"action": "open"`, `"action": "update"`, 1)
+	if _, err := client.ParseHook([]byte(payload), "Merge Request Hook"); err != scm.ErrIgnoredEvent {
+		t.Errorf("Expected merge request updates without new commits to be ignored, got `%v`", err)
+	}
+}
+
+func TestParseUnknownHook(t *testing.T) {
+	client := NewClient("")
+	if _, err := client.ParseHook([]byte(`{"object_kind": "note"}`), "Note Hook"); err == nil {
+		t.Error("Expected unsupported hooks to return an error")
+	}
+}
@@ -0,0 +1,141 @@
+package gitlab
+
+// PushHook is used to make gitlab push and tag push webhooks easily accessible
+type PushHook struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	Before       string `json:"before"`
+	After        string `json:"after"`
+	CheckoutSHA  string `json:"checkout_sha"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+
+	Project struct {
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+		HTTPURL           string `json:"git_http_url"`
+		SSHURL            string `json:"git_ssh_url"`
+	} `json:"project"`
+
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	} `json:"commits"`
+}
+
+// headMessage returns the message of the pushed commit that was checked out
+func (p *PushHook) headMessage() string {
+	for _, commit := range p.Commits {
+		if commit.ID == p.CheckoutSHA {
+			return commit.Message
+		}
+	}
+	return ""
+}
+
+// MergeRequestHook is used to make gitlab merge request webhooks easily accessible
+type MergeRequestHook struct {
+	ObjectKind string `json:"object_kind"`
+
+	User struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"user"`
+
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		HTTPURL           string `json:"git_http_url"`
+	} `json:"project"`
+
+	Attributes struct {
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		State        string `json:"state"`
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		OldRev       string `json:"oldrev"`
+
+		Source struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			HTTPURL           string `json:"git_http_url"`
+		} `json:"source"`
+
+		LastCommit struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// User is the authenticated gitlab user
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type project struct {
+	ID                int    `json:"id"`
+	Name              string `json:"name"`
+	Path              string `json:"path"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	AvatarURL         string `json:"avatar_url"`
+	HTTPURL           string `json:"http_url_to_repo"`
+	DefaultBranch     string `json:"default_branch"`
+
+	Namespace struct {
+		FullPath  string `json:"full_path"`
+		AvatarURL string `json:"avatar_url"`
+	} `json:"namespace"`
+
+	Permissions struct {
+		ProjectAccess *accessLevel `json:"project_access"`
+		GroupAccess   *accessLevel `json:"group_access"`
+	} `json:"permissions"`
+}
+
+type accessLevel struct {
+	AccessLevel int `json:"access_level"`
+}
+
+type hook struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+}
+
+type file struct {
+	FilePath string `json:"file_path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+	BlobID   string `json:"blob_id"`
+}
+
+type treeNode struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+type branch struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+type note struct {
+	ID int `json:"id"`
+}
+
+type projectKey struct {
+	ID int `json:"id"`
+}
+
+// apiError is the error body returned by the gitlab API
+type apiError struct {
+	Message interface{} `json:"message"`
+	Error   string      `json:"error"`
+}
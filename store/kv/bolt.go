@@ -0,0 +1,207 @@
+package kv
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltBucket = []byte("kontinuous")
+
+// boltClient stores the keys in an embedded BoltDB file, for installs without etcd.
+// Like v3 the keyspace is flat, empty directories are kept as a key with a trailing slash.
+// Only one process can open the file, the changes are watched in the process.
+type boltClient struct {
+	// index orders the events, bolt keeps no revisions. It is first to be aligned for atomic
+	index uint64
+
+	db       *bolt.DB
+	watchers Watchers
+}
+
+// NewBoltClient opens or creates the database file
+func NewBoltClient(path string) (KVClient, error) {
+	log := kvLog.InFunc("NewBoltClient")
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.WithError(err).Errorf("unable to open %s", path)
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltClient{db: db}, nil
+}
+
+func (kv *boltClient) Put(key, value string) error {
+	key = trimKey(key)
+	var events []*Event
+	err := kv.db.Update(func(tx *bolt.Tx) error {
+		events = kv.changeEvents(tx.Bucket(boltBucket), key, value)
+		return tx.Bucket(boltBucket).Put([]byte(key), []byte(value))
+	})
+	return kv.notify(events, err)
+}
+
+// changeEvents returns the event of setting a key, directory markers are not reported
+func (kv *boltClient) changeEvents(b *bolt.Bucket, key, value string) []*Event {
+	if strings.HasSuffix(key, "/") {
+		return nil
+	}
+	event := &Event{Type: EventCreate, Key: key, Value: []byte(value)}
+	if b.Get([]byte(key)) != nil {
+		event.Type = EventUpdate
+	}
+	return []*Event{event}
+}
+
+// notify reports the events of a committed transaction
+func (kv *boltClient) notify(events []*Event, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		event.Index = atomic.AddUint64(&kv.index, 1)
+		kv.watchers.Notify(event)
+	}
+	return nil
+}
+
+// Get returns the value of a key, directories have no value
+func (kv *boltClient) Get(key string) (value string, err error) {
+	key = trimKey(key)
+	err = kv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if v := b.Get([]byte(key)); v != nil {
+			value = string(v)
+			return nil
+		}
+
+		prefix := []byte(key + "/")
+		if k, _ := b.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		return keyNotFound(key)
+	})
+	return value, err
+}
+
+func (kv *boltClient) PutInt(key string, value int) error {
+	return kv.Put(key, strconv.Itoa(value))
+}
+
+func (kv *boltClient) GetInt(key string) (int, error) {
+	val, err := kv.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(val)
+}
+
+// GetDir returns the direct children of a directory, bolt keeps no index of the changes
+func (kv *boltClient) GetDir(key string) ([]*KVPair, error) {
+	key = trimKey(key)
+	all := []*KVPair{}
+	err := kv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		prefix := []byte(key + "/")
+
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			// bolt's slices are only valid in the transaction
+			all = append(all, &KVPair{
+				Key:   string(k),
+				Value: append([]byte{}, v...),
+			})
+		}
+
+		// a key with a value is an empty directory in v2
+		if len(all) == 0 && b.Get([]byte(key)) == nil {
+			return keyNotFound(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return children(key, all), nil
+}
+
+// PutDir creates an empty directory, the marker is kept when keys are added to it
+func (kv *boltClient) PutDir(key string) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(trimKey(key)+"/"), []byte{})
+	})
+}
+
+func (kv *boltClient) PutIntDir(key string, value int) error {
+	dirName := key + "/" + strconv.Itoa(value)
+	return kv.PutDir(dirName)
+}
+
+// DeleteTree removes the key and the keys under it
+func (kv *boltClient) DeleteTree(key string) error {
+	key = trimKey(key)
+	var events []*Event
+	err := kv.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		prefix := []byte(key + "/")
+
+		// keys can't be deleted while iterating
+		keys := [][]byte{}
+		if b.Get([]byte(key)) != nil {
+			keys = append(keys, []byte(key))
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		if len(keys) == 0 {
+			return keyNotFound(key)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if !bytes.HasSuffix(k, []byte("/")) {
+				events = append(events, &Event{Type: EventDelete, Key: string(k)})
+			}
+		}
+		return nil
+	})
+	return kv.notify(events, err)
+}
+
+// CompareAndSwap compares and sets the key in a single write transaction
+func (kv *boltClient) CompareAndSwap(key, prevValue, value string) error {
+	key = trimKey(key)
+	var events []*Event
+	err := kv.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		current := b.Get([]byte(key))
+		if (prevValue == "" && current != nil) || (prevValue != "" && string(current) != prevValue) {
+			return ErrCompareFailed
+		}
+		events = kv.changeEvents(b, key, value)
+		return b.Put([]byte(key), []byte(value))
+	})
+	return kv.notify(events, err)
+}
+
+// Watch reports the changes made by this process, the only one that can open the file
+func (kv *boltClient) Watch(prefix string, stop <-chan struct{}) (<-chan *Event, error) {
+	return kv.watchers.Watch(prefix, stop), nil
+}
@@ -0,0 +1,73 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+func newTestBoltClient(t *testing.T) (KVClient, func()) {
+	dir, err := ioutil.TempDir("", "kontinuous-kv-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewBoltClient(filepath.Join(dir, "kontinuous.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.(*boltClient).db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltDirectories(t *testing.T) {
+	client, cleanup := newTestBoltClient(t)
+	defer cleanup()
+
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "acaleph")
+	client.PutDir("/kontinuous/pipelines/acaleph:kontinuous/builds")
+	client.PutInt("/kontinuous/pipelines/acaleph:kontinuous/builds/1/number", 1)
+	client.PutIntDir("/kontinuous/pipelines/acaleph:kontinuous/builds", 2)
+
+	builds, err := client.GetDir("/kontinuous/pipelines/acaleph:kontinuous/builds")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(builds) != 2 || builds[1].Key != "/kontinuous/pipelines/acaleph:kontinuous/builds/2" {
+		t.Errorf("Expected builds 1 and 2, got %d builds", len(builds))
+	}
+
+	if owner, _ := client.Get("/kontinuous/pipelines/acaleph:kontinuous/owner"); owner != "acaleph" {
+		t.Errorf("Expected owner acaleph, got %s", owner)
+	}
+	if _, err := client.Get("/kontinuous/pipelines/acaleph:kontinuous/builds/2"); err != nil {
+		t.Errorf("Expected empty directory to exist, got %s", err)
+	}
+	if _, err := client.GetDir("/kontinuous/users"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found, got %v", err)
+	}
+}
+
+func TestBoltDeleteTree(t *testing.T) {
+	client, cleanup := newTestBoltClient(t)
+	defer cleanup()
+
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "acaleph")
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous-ui/owner", "acaleph")
+
+	if err := client.DeleteTree("/kontinuous/pipelines/acaleph:kontinuous"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	pipelines, _ := client.GetDir("/kontinuous/pipelines")
+	if len(pipelines) != 1 || pipelines[0].Key != "/kontinuous/pipelines/acaleph:kontinuous-ui" {
+		t.Errorf("Expected only the other pipeline to remain, got %d pipelines", len(pipelines))
+	}
+	if err := client.DeleteTree("/kontinuous/pipelines/acaleph:kontinuous"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package kv
+
+import (
+	etcd "github.com/coreos/etcd/client"
+)
+
+// Entry is a key of a dump, empty directories are kept so the layout is restored as it was
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Dir   bool   `json:"dir,omitempty"`
+}
+
+// Dump returns the keys holding values and the empty directories under prefix,
+// sorted by key. Nothing is returned when prefix does not exist.
+func Dump(kvClient KVClient, prefix string) ([]*Entry, error) {
+	entries := []*Entry{}
+	if err := dumpDir(kvClient, prefix, &entries); err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+func dumpDir(kvClient KVClient, dir string, entries *[]*Entry) error {
+	pairs, err := kvClient.GetDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		if !pair.Dir {
+			*entries = append(*entries, &Entry{Key: pair.Key, Value: string(pair.Value)})
+			continue
+		}
+
+		before := len(*entries)
+		if err := dumpDir(kvClient, pair.Key, entries); err != nil {
+			return err
+		}
+		// only empty directories need an entry, the others are created with their keys
+		if len(*entries) == before {
+			*entries = append(*entries, &Entry{Key: pair.Key, Dir: true})
+		}
+	}
+	return nil
+}
+
+// Restore writes the entries of a dump, existing keys are overwritten
+func Restore(kvClient KVClient, entries []*Entry) error {
+	for _, entry := range entries {
+		var err error
+		if entry.Dir {
+			err = kvClient.PutDir(entry.Key)
+		} else {
+			err = kvClient.Put(entry.Key, entry.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package kv_test
+
+import (
+	"testing"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+	"github.com/AcalephStorage/kontinuous/store/kv/fake"
+)
+
+func TestDumpAndRestore(t *testing.T) {
+	client := fake.NewClient()
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/document", `{"owner":"acaleph"}`)
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/builds/1", `{"number":1}`)
+	client.PutDir("/kontinuous/pipelines/acaleph:kontinuous/heads")
+	client.Put("/kontinuous/users/acaleph/token", "")
+
+	entries, err := kv.Dump(client, "/kontinuous")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(entries) != 4 || !entries[2].Dir || entries[2].Key != "/kontinuous/pipelines/acaleph:kontinuous/heads" {
+		t.Fatalf("Expected 3 keys and the empty directory, got %d entries", len(entries))
+	}
+
+	restored := fake.NewClient()
+	if err := kv.Restore(restored, entries); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if build, _ := restored.Get("/kontinuous/pipelines/acaleph:kontinuous/builds/1"); build != `{"number":1}` {
+		t.Errorf("Expected build 1 to be restored, got %s", build)
+	}
+	if heads, err := restored.GetDir("/kontinuous/pipelines/acaleph:kontinuous/heads"); err != nil || len(heads) != 0 {
+		t.Errorf("Expected the empty directory to be restored, got %v", err)
+	}
+	if _, err := restored.Get("/kontinuous/users/acaleph/token"); err != nil {
+		t.Errorf("Expected the empty value to be restored, got %v", err)
+	}
+
+	if entries, err := kv.Dump(fake.NewClient(), "/kontinuous"); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty dump, got %d entries: %v", len(entries), err)
+	}
+}
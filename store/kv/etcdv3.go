@@ -0,0 +1,413 @@
+package kv
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto/tls"
+
+	"golang.org/x/net/context"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// maxTxnOps is etcd's default limit of operations in a transaction
+const maxTxnOps = 128
+
+// etcdV3Client stores the keys in the etcd v3 API. v3 has a flat keyspace,
+// directories are the prefix of the keys under them and empty directories
+// are kept as a key with a trailing slash.
+type etcdV3Client struct {
+	client *clientv3.Client
+}
+
+// NewEtcdV3Client instantiates and establish connection to etcd using the v3 API
+func NewEtcdV3Client(cacert, cert, key string, addresses ...string) (KVClient, error) {
+	log := kvLog.InFunc("NewEtcdV3Client")
+
+	config, err := createV3Config(cacert, cert, key, addresses)
+	if err != nil {
+		log.WithError(err).Error("unable to create etcd v3 client config")
+		return nil, err
+	}
+
+	client, err := clientv3.New(*config)
+	if err != nil {
+		log.WithError(err).Error("unable to create v3 kvclient.")
+		return nil, err
+	}
+
+	return &etcdV3Client{client}, nil
+}
+
+// keyNotFound is the same error as the v2 API so callers can keep checking it with etcd.IsKeyNotFound
+func keyNotFound(key string) error {
+	return etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+}
+
+func trimKey(key string) string {
+	return strings.TrimSuffix(key, "/")
+}
+
+func (kv *etcdV3Client) Put(key, value string) error {
+	_, err := kv.client.Put(context.Background(), trimKey(key), value)
+	return err
+}
+
+// Get returns the value of a key, directories have no value
+func (kv *etcdV3Client) Get(key string) (string, error) {
+	key = trimKey(key)
+	res, err := kv.client.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Kvs) != 0 {
+		return string(res.Kvs[0].Value), nil
+	}
+
+	dir, err := kv.client.Get(context.Background(), key+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return "", err
+	}
+	if dir.Count == 0 {
+		return "", keyNotFound(key)
+	}
+	return "", nil
+}
+
+func (kv *etcdV3Client) PutInt(key string, value int) error {
+	return kv.Put(key, strconv.Itoa(value))
+}
+
+func (kv *etcdV3Client) GetInt(key string) (int, error) {
+	val, err := kv.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(val)
+}
+
+// GetDir returns the direct children of a directory like the v2 API. The keys under the
+// directory are read without their values, only the values of the direct children are read.
+func (kv *etcdV3Client) GetDir(key string) ([]*KVPair, error) {
+	key = trimKey(key)
+	res, err := kv.client.Get(context.Background(), key+"/",
+		clientv3.WithPrefix(),
+		clientv3.WithKeysOnly(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Kvs) == 0 {
+		// a key with a value is an empty directory in v2
+		if _, err := kv.Get(key); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes := children(key, pairs(res.Kvs))
+	if err := kv.readValues(nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// readValues reads the values of the keys that are not directories, in transactions
+// of at most maxTxnOps reads. Keys deleted since they were listed have no value.
+func (kv *etcdV3Client) readValues(nodes []*KVPair) error {
+	keys := []*KVPair{}
+	for _, n := range nodes {
+		if !n.Dir {
+			keys = append(keys, n)
+		}
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+
+		ops := make([]clientv3.Op, n)
+		for i, pair := range keys[:n] {
+			ops[i] = clientv3.OpGet(pair.Key)
+		}
+		res, err := kv.client.Txn(context.Background()).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+
+		for i, r := range res.Responses {
+			if kvs := r.GetResponseRange().Kvs; len(kvs) != 0 {
+				keys[i].Value = kvs[0].Value
+				keys[i].LastIndex = uint64(kvs[0].ModRevision)
+			}
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func pairs(kvs []*mvccpb.KeyValue) []*KVPair {
+	kvpair := make([]*KVPair, len(kvs))
+	for i, n := range kvs {
+		kvpair[i] = &KVPair{
+			Key:       string(n.Key),
+			Value:     n.Value,
+			LastIndex: uint64(n.ModRevision),
+		}
+	}
+	return kvpair
+}
+
+// children groups the keys under a directory by its direct children, used by the
+// stores with a flat keyspace. Subdirectories have no value and the latest index
+// of the keys under them.
+func children(dir string, all []*KVPair) []*KVPair {
+	prefix := dir + "/"
+	nodes := map[string]*KVPair{}
+	for _, n := range all {
+		name := strings.TrimPrefix(n.Key, prefix)
+		if name == "" {
+			// the directory's own marker
+			continue
+		}
+
+		if i := strings.Index(name, "/"); i >= 0 {
+			child := prefix + name[:i]
+			pair, exists := nodes[child]
+			if !exists {
+				pair = &KVPair{Key: child, Value: []byte{}, Dir: true}
+				nodes[child] = pair
+			}
+			if n.LastIndex > pair.LastIndex {
+				pair.LastIndex = n.LastIndex
+			}
+			continue
+		}
+
+		nodes[n.Key] = n
+	}
+
+	keys := make([]string, 0, len(nodes))
+	for k := range nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvpair := []*KVPair{}
+	for _, k := range keys {
+		kvpair = append(kvpair, nodes[k])
+	}
+	return kvpair
+}
+
+// PutDir creates an empty directory, the marker is kept when keys are added to it
+func (kv *etcdV3Client) PutDir(key string) error {
+	_, err := kv.client.Put(context.Background(), trimKey(key)+"/", "")
+	return err
+}
+
+func (kv *etcdV3Client) PutIntDir(key string, value int) error {
+	dirName := key + "/" + strconv.Itoa(value)
+	return kv.PutDir(dirName)
+}
+
+// DeleteTree removes the key and the keys under it in a single transaction
+func (kv *etcdV3Client) DeleteTree(key string) error {
+	key = trimKey(key)
+	res, err := kv.client.Txn(context.Background()).Then(
+		clientv3.OpDelete(key),
+		clientv3.OpDelete(key+"/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	var deleted int64
+	for _, r := range res.Responses {
+		deleted += r.GetResponseDeleteRange().Deleted
+	}
+	if deleted == 0 {
+		return keyNotFound(key)
+	}
+	return nil
+}
+
+// CompareAndSwap sets the key in a transaction comparing its value, or that it was never created
+func (kv *etcdV3Client) CompareAndSwap(key, prevValue, value string) error {
+	key = trimKey(key)
+	cmp := clientv3.Compare(clientv3.Value(key), "=", prevValue)
+	if prevValue == "" {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}
+
+	res, err := kv.client.Txn(context.Background()).
+		If(cmp).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !res.Succeeded {
+		return ErrCompareFailed
+	}
+	return nil
+}
+
+// Watch reports the changes of the key and the keys under it, directory markers are skipped
+func (kv *etcdV3Client) Watch(prefix string, stop <-chan struct{}) (<-chan *Event, error) {
+	key := trimKey(prefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := kv.client.Watch(ctx, key, clientv3.WithPrefix())
+	events := make(chan *Event, watchBuffer)
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go func() {
+		defer close(events)
+		for res := range changes {
+			if res.Err() != nil {
+				return
+			}
+			for _, ev := range res.Events {
+				name := string(ev.Kv.Key)
+				// the prefix also matches the keys next to it sharing its name
+				if (name != key && !strings.HasPrefix(name, key+"/")) || strings.HasSuffix(name, "/") {
+					continue
+				}
+
+				event := &Event{Key: name, Index: uint64(ev.Kv.ModRevision)}
+				switch {
+				case ev.Type == mvccpb.DELETE:
+					event.Type = EventDelete
+				case ev.IsCreate():
+					event.Type = EventCreate
+					event.Value = ev.Kv.Value
+				default:
+					event.Type = EventUpdate
+					event.Value = ev.Kv.Value
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// MigrateToV3 copies the keys under prefix from an etcd v2 client to a v3 client and
+// returns the number of keys copied. Existing v3 keys are overwritten so it can be run
+// again, keys with a TTL are attached to a lease with the remaining TTL.
+func MigrateToV3(from, to KVClient, prefix string) (int, error) {
+	v2, ok := from.(*etcdClient)
+	if !ok {
+		return 0, fmt.Errorf("migration source is not an etcd v2 client")
+	}
+	v3, ok := to.(*etcdV3Client)
+	if !ok {
+		return 0, fmt.Errorf("migration target is not an etcd v3 client")
+	}
+
+	res, err := v2.client.Get(context.Background(), prefix, &etcd.GetOptions{
+		Quorum:    true,
+		Recursive: true,
+		Sort:      true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ops := []clientv3.Op{}
+	if err := v3.migrationOps(res.Node, &ops); err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if _, err := v3.client.Txn(context.Background()).Then(ops[start:end]...).Commit(); err != nil {
+			return start, err
+		}
+	}
+	return len(ops), nil
+}
+
+// migrationOps adds the puts of a v2 node and its children
+func (kv *etcdV3Client) migrationOps(node *etcd.Node, ops *[]clientv3.Op) error {
+	opts := []clientv3.OpOption{}
+	if node.TTL > 0 {
+		lease, err := kv.client.Grant(context.Background(), node.TTL)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
+	if !node.Dir {
+		*ops = append(*ops, clientv3.OpPut(node.Key, node.Value, opts...))
+		return nil
+	}
+
+	// only empty directories need a marker, the others exist through their keys
+	if len(node.Nodes) == 0 {
+		*ops = append(*ops, clientv3.OpPut(trimKey(node.Key)+"/", "", opts...))
+	}
+	for _, child := range node.Nodes {
+		if err := kv.migrationOps(child, ops); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createV3Config(cacert, cert, key string, addresses []string) (*clientv3.Config, error) {
+	config := &clientv3.Config{
+		DialTimeout: 5 * time.Second,
+	}
+
+	scheme := "http"
+	if cacert != "" || cert != "" || key != "" {
+		certCfg := &certConfig{
+			caCert: cacert,
+			cert:   cert,
+			key:    key,
+		}
+
+		ca, err := certCfg.loadCa()
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := certCfg.loadCert()
+		if err != nil {
+			return nil, err
+		}
+
+		scheme = "https"
+		config.TLS = &tls.Config{
+			RootCAs:      ca,
+			Certificates: []tls.Certificate{c},
+		}
+	}
+
+	for _, addr := range addresses {
+		config.Endpoints = append(config.Endpoints, scheme+"://"+addr)
+	}
+	return config, nil
+}
@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+func TestChildrenGroupsSubdirectories(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/kontinuous/pipelines/acaleph:kontinuous/"), ModRevision: 1},
+		{Key: []byte("/kontinuous/pipelines/acaleph:kontinuous/builds/1/number"), Value: []byte("1"), ModRevision: 4},
+		{Key: []byte("/kontinuous/pipelines/acaleph:kontinuous/builds/2/"), ModRevision: 6},
+		{Key: []byte("/kontinuous/pipelines/acaleph:kontinuous/owner"), Value: []byte("acaleph"), ModRevision: 2},
+	}
+
+	nodes := children("/kontinuous/pipelines/acaleph:kontinuous", pairs(kvs))
+	if len(nodes) != 2 {
+		t.Fatalf("Expected builds and owner, got %d children", len(nodes))
+	}
+
+	builds, owner := nodes[0], nodes[1]
+	if builds.Key != "/kontinuous/pipelines/acaleph:kontinuous/builds" || len(builds.Value) != 0 || !builds.Dir || builds.LastIndex != 6 {
+		t.Errorf("Expected builds directory at revision 6, got %s at %d", builds.Key, builds.LastIndex)
+	}
+	if owner.Key != "/kontinuous/pipelines/acaleph:kontinuous/owner" || string(owner.Value) != "acaleph" {
+		t.Errorf("Expected owner acaleph, got %s=%s", owner.Key, owner.Value)
+	}
+
+	builds2 := children("/kontinuous/pipelines/acaleph:kontinuous/builds", pairs(kvs[1:3]))
+	if len(builds2) != 2 || builds2[1].Key != "/kontinuous/pipelines/acaleph:kontinuous/builds/2" {
+		t.Errorf("Expected empty build directory 2 to be listed, got %d children", len(builds2))
+	}
+}
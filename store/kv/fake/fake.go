@@ -0,0 +1,231 @@
+// Package fake is an in-memory kv.KVClient for tests and dry runs. It keeps the etcd v2 directory
+// semantics the stores rely on: parent directories are created on Put, GetDir returns
+// the direct children sorted by key and missing keys return etcd's key not found error.
+// Like v2, removing a directory is watched as a single delete event of the directory.
+package fake
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+type node struct {
+	dir   bool
+	value string
+	index uint64
+}
+
+// Client is an in-memory etcd keyspace
+type Client struct {
+	mu       sync.Mutex
+	nodes    map[string]*node
+	index    uint64
+	watchers kv.Watchers
+}
+
+// NewClient returns an empty keyspace
+func NewClient() *Client {
+	return &Client{
+		nodes: map[string]*node{"/": {dir: true}},
+	}
+}
+
+func clean(key string) string {
+	return path.Clean("/" + key)
+}
+
+func etcdError(code int, message, key string) error {
+	return etcd.Error{Code: code, Message: message, Cause: key}
+}
+
+// Keys returns all the keys holding values, sorted
+func (c *Client) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []string{}
+	for key, n := range c.nodes {
+		if !n.dir {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mkdirs creates the parent directories of a key
+func (c *Client) mkdirs(key string) error {
+	dir := path.Dir(key)
+	if n, exists := c.nodes[dir]; exists {
+		if !n.dir {
+			return etcdError(etcd.ErrorCodeNotDir, "Not a directory", dir)
+		}
+		return nil
+	}
+
+	if err := c.mkdirs(dir); err != nil {
+		return err
+	}
+	c.index++
+	c.nodes[dir] = &node{dir: true, index: c.index}
+	return nil
+}
+
+// Put sets the value of a key
+func (c *Client) Put(key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.put(clean(key), value)
+}
+
+func (c *Client) put(key, value string) error {
+	if n, exists := c.nodes[key]; exists && n.dir {
+		return etcdError(etcd.ErrorCodeNotFile, "Not a file", key)
+	}
+	if err := c.mkdirs(key); err != nil {
+		return err
+	}
+
+	eventType := kv.EventCreate
+	if _, exists := c.nodes[key]; exists {
+		eventType = kv.EventUpdate
+	}
+
+	c.index++
+	c.nodes[key] = &node{value: value, index: c.index}
+	c.watchers.Notify(&kv.Event{Type: eventType, Key: key, Value: []byte(value), Index: c.index})
+	return nil
+}
+
+// Get returns the value of the specified key, directories have no value
+func (c *Client) Get(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = clean(key)
+	n, exists := c.nodes[key]
+	if !exists {
+		return "", etcdError(etcd.ErrorCodeKeyNotFound, "Key not found", key)
+	}
+	return n.value, nil
+}
+
+// PutInt accepts an Int value and store it under the specified key.
+func (c *Client) PutInt(key string, value int) error {
+	return c.Put(key, strconv.Itoa(value))
+}
+
+// GetInt returns the value of the specified key. In Int type
+func (c *Client) GetInt(key string) (int, error) {
+	val, err := c.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(val)
+}
+
+// GetDir returns the child nodes of a given directory
+func (c *Client) GetDir(key string) ([]*kv.KVPair, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = clean(key)
+	if _, exists := c.nodes[key]; !exists {
+		return nil, etcdError(etcd.ErrorCodeKeyNotFound, "Key not found", key)
+	}
+
+	children := []string{}
+	for k := range c.nodes {
+		if k != "/" && path.Dir(k) == key {
+			children = append(children, k)
+		}
+	}
+	sort.Strings(children)
+
+	pairs := []*kv.KVPair{}
+	for _, k := range children {
+		n := c.nodes[k]
+		pairs = append(pairs, &kv.KVPair{
+			Key:       k,
+			Value:     []byte(n.value),
+			LastIndex: n.index,
+			Dir:       n.dir,
+		})
+	}
+	return pairs, nil
+}
+
+// PutDir creates a directory and its parents, existing directories are kept
+func (c *Client) PutDir(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = clean(key)
+	if n, exists := c.nodes[key]; exists {
+		if !n.dir {
+			return etcdError(etcd.ErrorCodeNotDir, "Not a directory", key)
+		}
+		return nil
+	}
+	if err := c.mkdirs(key); err != nil {
+		return err
+	}
+
+	c.index++
+	c.nodes[key] = &node{dir: true, index: c.index}
+	return nil
+}
+
+// PutIntDir creates an integer directory under the given key
+func (c *Client) PutIntDir(key string, value int) error {
+	return c.PutDir(key + "/" + strconv.Itoa(value))
+}
+
+// DeleteTree removes a key and everything under it
+func (c *Client) DeleteTree(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = clean(key)
+	if _, exists := c.nodes[key]; !exists {
+		return etcdError(etcd.ErrorCodeKeyNotFound, "Key not found", key)
+	}
+
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	for k := range c.nodes {
+		if k == key || strings.HasPrefix(k, prefix) {
+			delete(c.nodes, k)
+		}
+	}
+	// the root directory always exists
+	c.nodes["/"] = &node{dir: true}
+
+	c.index++
+	c.watchers.Notify(&kv.Event{Type: kv.EventDelete, Key: key, Index: c.index})
+	return nil
+}
+
+// CompareAndSwap sets the key if its value is prevValue, or if it does not exist when prevValue is empty
+func (c *Client) CompareAndSwap(key, prevValue, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = clean(key)
+	n, exists := c.nodes[key]
+	if (prevValue == "" && exists) || (prevValue != "" && (!exists || n.dir || n.value != prevValue)) {
+		return kv.ErrCompareFailed
+	}
+	return c.put(key, value)
+}
+
+// Watch reports the changes of the key and the keys under it until stop is closed
+func (c *Client) Watch(prefix string, stop <-chan struct{}) (<-chan *kv.Event, error) {
+	return c.watchers.Watch(clean(prefix), stop), nil
+}
@@ -0,0 +1,67 @@
+package fake
+
+import (
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/AcalephStorage/kontinuous/store/kv"
+)
+
+func TestGetDirReturnsChildren(t *testing.T) {
+	client := NewClient()
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "acaleph")
+	client.PutInt("/kontinuous/pipelines/acaleph:kontinuous/builds/2/number", 2)
+	client.PutInt("/kontinuous/pipelines/acaleph:kontinuous/builds/1/number", 1)
+
+	pairs, err := client.GetDir("/kontinuous/pipelines/acaleph:kontinuous/builds")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(pairs) != 2 || pairs[0].Key != "/kontinuous/pipelines/acaleph:kontinuous/builds/1" {
+		t.Errorf("Expected builds 1 and 2 sorted, got %d pairs", len(pairs))
+	}
+
+	if _, err := client.GetDir("/kontinuous/users"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found, got %v", err)
+	}
+	if err := client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner/name", "acaleph"); err == nil {
+		t.Error("Expected keys under a value to fail")
+	}
+}
+
+func TestDeleteTree(t *testing.T) {
+	client := NewClient()
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "acaleph")
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous-ui/owner", "acaleph")
+
+	if err := client.DeleteTree("/kontinuous/pipelines/acaleph:kontinuous"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keys := client.Keys(); len(keys) != 1 || keys[0] != "/kontinuous/pipelines/acaleph:kontinuous-ui/owner" {
+		t.Errorf("Expected only the other pipeline to remain, got %v", keys)
+	}
+	if err := client.DeleteTree("/kontinuous/pipelines/acaleph:kontinuous"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client := NewClient()
+	stop := make(chan struct{})
+	events, _ := client.Watch("/kontinuous/pipelines/acaleph:kontinuous", stop)
+
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous-ui/owner", "acaleph")
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "acaleph")
+	client.Put("/kontinuous/pipelines/acaleph:kontinuous/owner", "AcalephStorage")
+	client.DeleteTree("/kontinuous/pipelines/acaleph:kontinuous")
+	close(stop)
+
+	types := []kv.EventType{}
+	for event := range events {
+		types = append(types, event.Type)
+	}
+	if len(types) != 3 || types[0] != kv.EventCreate || types[1] != kv.EventUpdate || types[2] != kv.EventDelete {
+		t.Errorf("Expected create, update and delete of the watched pipeline, got %v", types)
+	}
+}
@@ -49,13 +49,27 @@ type KVClient interface {
 
 	// DeleteTree removes a reange of keys under the given directory.
 	DeleteTree(key string) error
+
+	// CompareAndSwap sets the value of a key only if its current value is prevValue,
+	// an empty prevValue only sets a key that does not exist. Returns ErrCompareFailed
+	// when the key was changed.
+	CompareAndSwap(key, prevValue, value string) error
+
+	// Watch reports the changes of the key and the keys under it until stop is closed.
+	// The channel is closed when the watch ends, also when the watcher fell behind or
+	// lost the connection, the current values have to be read again before watching again.
+	Watch(prefix string, stop <-chan struct{}) (<-chan *Event, error)
 }
 
-// KVPair defines the retrieved key and value
+// ErrCompareFailed is returned when a compare and swap finds a different value
+var ErrCompareFailed = errors.New("compare failed, the key was changed")
+
+// KVPair defines the retrieved key and value, directories have no value
 type KVPair struct {
 	Key       string
 	Value     []byte
 	LastIndex uint64
+	Dir       bool
 }
 
 // NewKVClient instantiates and establish connection to etcd
@@ -120,6 +134,7 @@ func (kv *etcdClient) GetDir(key string) ([]*KVPair, error) {
 			Key:       n.Key,
 			Value:     []byte(n.Value),
 			LastIndex: n.ModifiedIndex,
+			Dir:       n.Dir,
 		})
 	}
 	return kvpair, nil
@@ -140,6 +155,73 @@ func (kv *etcdClient) DeleteTree(key string) error {
 	return err
 }
 
+func (kv *etcdClient) CompareAndSwap(key, prevValue, value string) error {
+	opts := &etcd.SetOptions{PrevValue: prevValue, PrevExist: etcd.PrevExist}
+	if prevValue == "" {
+		opts = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	}
+
+	_, err := kv.client.Set(context.Background(), key, value, opts)
+	if cErr, ok := err.(etcd.Error); ok {
+		switch cErr.Code {
+		case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist, etcd.ErrorCodeKeyNotFound:
+			return ErrCompareFailed
+		}
+	}
+	return err
+}
+
+func (kv *etcdClient) Watch(prefix string, stop <-chan struct{}) (<-chan *Event, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := kv.client.Watcher(prefix, &etcd.WatcherOptions{Recursive: true})
+	events := make(chan *Event, watchBuffer)
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go func() {
+		defer close(events)
+		for {
+			res, err := watcher.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			event := &Event{
+				Key:   res.Node.Key,
+				Value: []byte(res.Node.Value),
+				Index: res.Node.ModifiedIndex,
+			}
+			switch res.Action {
+			case "delete", "compareAndDelete", "expire":
+				event.Type = EventDelete
+				event.Value = nil
+			case "create":
+				event.Type = EventCreate
+			default:
+				event.Type = EventUpdate
+				if res.PrevNode == nil {
+					event.Type = EventCreate
+				}
+			}
+
+			// only removed directories are reported, their keys are removed with them
+			if res.Node.Dir && event.Type != EventDelete {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
 // utils
 
 type certConfig struct {
@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"strings"
+	"sync"
+)
+
+// EventType is the kind of change of a watched key
+type EventType string
+
+const (
+	// EventCreate is a key set for the first time
+	EventCreate EventType = "create"
+	// EventUpdate is a key set again
+	EventUpdate EventType = "update"
+	// EventDelete is a key removed, removing a tree is reported as the removal of each
+	// of its keys or, with the etcd v2 API, as the removal of the directory only
+	EventDelete EventType = "delete"
+)
+
+// watchBuffer is how many events a watcher can fall behind before its watch is closed
+const watchBuffer = 100
+
+// Event is a change of a key under a watched prefix, directories are not reported
+type Event struct {
+	Type  EventType `json:"type"`
+	Key   string    `json:"key"`
+	Value []byte    `json:"value,omitempty"`
+	Index uint64    `json:"index"`
+}
+
+// Watchers reports the changes of a store to its watchers, for the stores that
+// can't be watched themselves like the embedded store and the fake
+type Watchers struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+type watcher struct {
+	prefix string
+	events chan *Event
+}
+
+// matches checks if the key is the watched prefix or a key under it
+func (w *watcher) matches(key string) bool {
+	return key == w.prefix || strings.HasPrefix(key, w.prefix+"/")
+}
+
+// Watch returns the changes under prefix until stop is closed
+func (ws *Watchers) Watch(prefix string, stop <-chan struct{}) <-chan *Event {
+	w := &watcher{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		events: make(chan *Event, watchBuffer),
+	}
+
+	ws.mu.Lock()
+	if ws.watchers == nil {
+		ws.watchers = map[*watcher]bool{}
+	}
+	ws.watchers[w] = true
+	ws.mu.Unlock()
+
+	go func() {
+		<-stop
+		ws.remove(w)
+	}()
+	return w.events
+}
+
+// Notify sends an event to the watchers of its key. Watchers that fell behind are
+// closed instead of blocking the store.
+func (ws *Watchers) Notify(event *Event) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for w := range ws.watchers {
+		if !w.matches(event.Key) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			delete(ws.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+func (ws *Watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.watchers[w] {
+		delete(ws.watchers, w)
+		close(w.events)
+	}
+}
@@ -0,0 +1,131 @@
+package mc
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStore keeps the objects as files under a directory, one per bucket.
+// Used in place of minio by installs with a single kontinuous instance.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates the directory of the store if needed
+func NewLocalStore(root string) (*LocalStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root}, nil
+}
+
+// path returns the file of an object, object names can't point outside of the bucket
+func (ls *LocalStore) path(bucket, object string) string {
+	name := path.Clean("/" + object)
+	return filepath.Join(ls.root, filepath.Base(bucket), filepath.FromSlash(name))
+}
+
+// ListObjects returns the names of the objects starting with prefix, sorted
+func (ls *LocalStore) ListObjects(bucket, prefix string) ([]string, error) {
+	bucketDir := ls.path(bucket, "")
+
+	// only walk the deepest directory the prefix is in
+	dir := ls.path(bucket, prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	result := []string{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketDir, file)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			result = append(result, name)
+		}
+		return nil
+	})
+	sort.Strings(result)
+	return result, err
+}
+
+// CopyLocally copies an object to a file
+func (ls *LocalStore) CopyLocally(bucket, object, file string) error {
+	src, err := os.Open(ls.path(bucket, object))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// PutObject writes the object to a temporary file first so readers never see a partial object
+func (ls *LocalStore) PutObject(bucket, object string, content io.Reader) error {
+	file := ls.path(bucket, object)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// DeleteTree removes the objects starting with prefix
+func (ls *LocalStore) DeleteTree(bucket, prefix string) error {
+	objects, err := ls.ListObjects(bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := ls.DeleteObject(bucket, object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteObject removes an object, empty directories are left for the next objects
+func (ls *LocalStore) DeleteObject(bucket, object string) error {
+	err := os.Remove(ls.path(bucket, object))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package mc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "kontinuous-objects-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store, _ := NewLocalStore(root)
+	store.PutObject("kontinuous", "pipelines/1/builds/1/stages/1/logs/agent.log", strings.NewReader("building"))
+	store.PutObject("kontinuous", "pipelines/1/builds/1/artifacts/app", strings.NewReader("binary"))
+	store.PutObject("kontinuous", "pipelines/1/builds/10/artifacts/app", strings.NewReader("binary"))
+
+	logs, err := store.ListObjects("kontinuous", "pipelines/1/builds/1/stages/1/logs")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(logs, []string{"pipelines/1/builds/1/stages/1/logs/agent.log"}) {
+		t.Errorf("Expected the stage's log, got %v", logs)
+	}
+
+	file := filepath.Join(root, "copy")
+	if err := store.CopyLocally("kontinuous", logs[0], file); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "building" {
+		t.Errorf("Expected log content, got %s", content)
+	}
+
+	if err := store.DeleteTree("kontinuous", "pipelines/1/builds/1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	remaining, _ := store.ListObjects("kontinuous", "pipelines/")
+	if !reflect.DeepEqual(remaining, []string{"pipelines/1/builds/10/artifacts/app"}) {
+		t.Errorf("Expected only build 10 to remain, got %v", remaining)
+	}
+}
+
+func TestLocalStoreStaysInBucket(t *testing.T) {
+	store := &LocalStore{"/var/lib/kontinuous/objects"}
+	if file := store.path("kontinuous", "../../etc/passwd"); file != "/var/lib/kontinuous/objects/kontinuous/etc/passwd" {
+		t.Errorf("Expected object to stay in the bucket, got %s", file)
+	}
+}
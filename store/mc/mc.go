@@ -1,11 +1,30 @@
 package mc
 
 import (
+	"io"
 	"strings"
 
 	"github.com/minio/minio-go"
 )
 
+// ObjectStore stores the logs and artifacts of the builds
+type ObjectStore interface {
+	// ListObjects returns the names of the objects starting with prefix
+	ListObjects(bucket, prefix string) ([]string, error)
+
+	// CopyLocally copies an object to a file
+	CopyLocally(bucket, object, file string) error
+
+	// PutObject stores the content of an object
+	PutObject(bucket, object string, content io.Reader) error
+
+	// DeleteTree removes the objects starting with prefix
+	DeleteTree(bucket, prefix string) error
+
+	// DeleteObject removes an object
+	DeleteObject(bucket, object string) error
+}
+
 type MinioClient struct {
 	client *minio.Client
 }
@@ -27,8 +46,8 @@ func NewMinioClient(host, accessKey, secretKey string) (*MinioClient, error) {
 	return &MinioClient{client}, nil
 }
 
-func (mc *MinioClient) ListObjects(bucket, prefix string) ([]minio.ObjectInfo, error) {
-	var result []minio.ObjectInfo
+func (mc *MinioClient) ListObjects(bucket, prefix string) ([]string, error) {
+	var result []string
 
 	doneCh := make(chan struct{})
 
@@ -41,8 +60,7 @@ func (mc *MinioClient) ListObjects(bucket, prefix string) ([]minio.ObjectInfo, e
 		if object.Err != nil {
 			return result, object.Err
 		}
-		//result = append(result, object.Key)
-		result = append(result, object)
+		result = append(result, object.Key)
 	}
 	return result, nil
 }
@@ -54,6 +72,11 @@ func (mc *MinioClient) CopyLocally(bucket, object, file string) error {
 	return nil
 }
 
+func (mc *MinioClient) PutObject(bucket, object string, content io.Reader) error {
+	_, err := mc.client.PutObject(bucket, object, content, "application/octet-stream")
+	return err
+}
+
 func (mc *MinioClient) DeleteTree(bucket, prefix string) error {
 	doneCh := make(chan struct{})
 	defer close(doneCh)